@@ -5,6 +5,8 @@ author: Antonio Gonzalez
 """
 from pathlib import Path
 
+__version__ = '0.1.0'
+
 # Directories and file names where the various components of the model
 # are stored.
 files = {
@@ -50,3 +52,25 @@ del files, get_paths
 from . import cell
 from . import instrumentation
 from . import modulation
+from . import simulation
+from . import export
+from . import stimulus
+from . import protocols
+from . import batch
+from . import network
+from . import plasticity
+from . import fit
+from . import sensitivity
+from . import analysis
+from . import rng
+from . import meta
+from . import plot
+from . import pharma
+from . import units
+from . import morph
+from . import nmodl
+from . import expr
+from . import rl
+from . import scan
+from . import golden
+from . import events
@@ -0,0 +1,151 @@
+"""
+Run a simulation described in a configuration file.
+
+Usage:
+
+    python -m msn config.json [--output DIR] [--plot FORMAT]
+
+The configuration file (JSON, or YAML if PyYAML is installed) describes
+the cell, the stimulus, and other simulation settings. For example:
+
+    {
+        "cell": {"type": "dmsn", "index": 12},
+        "stimulus": {"delay": 10, "duration": 150, "amplitude": 0.2,
+                     "add_rheob": true},
+        "tstop": 200,
+        "noise": {"glut_freq": 12, "gaba_freq": 4},
+        "modulation": "DA",
+        "temperature": 35,
+        "seed": 1234,
+        "channels": {"kv7": {"mod": "kv7.mod", "gbar": 1e-4,
+                             "compartments": ["soma", "axon"]}},
+        "output": "results"
+    }
+
+Only "cell" is required. Times, currents, etc can be given with units,
+e.g. "tstop": "0.2 s" or "amplitude": "200 pA"; numbers without units
+are in ms, nA, Hz, mV and degC. Additional ion channels, defined in mod
+files (paths relative to the working directory) or by the formulas of
+their rate functions, can be added in "channels"; see
+cell.register_channel and nmodl.hh_channel (only channels defined by
+formulas can be stochastic, with "stochastic": true). The file is
+validated (see params.load_file and params.config_schema) before the
+simulation starts.
+A configuration can start from a named set of settings with "preset",
+e.g. "preset": "lindroos2020-imsn-da" (see params.presets); settings
+given in the file take precedence.
+The results are saved in the output directory: the voltage trace
+('trace.csv'), the times of action potentials ('spikes.csv'), and a copy
+of the configuration ('config.json'). The CSV files have JSON sidecars
+('trace.csv.json', 'spikes.csv.json') with the provenance of the results
+(see meta.capture). If no "seed" is given, one is chosen at random and
+saved in the copy of the configuration, so that the simulation can be
+repeated. With --plot, a figure of the voltage trace is also saved
+('trace.svg' or 'trace.png').
+
+author: Antonio Gonzalez
+"""
+import argparse
+import json
+from pathlib import Path
+
+import pandas as pd
+
+from .cell import MSN, register_channel
+from .instrumentation import Stim, ActionPotentials
+from .modulation import Dopamine, Acetylcholine
+from .meta import capture, write_sidecar
+from .nmodl import hh_channel
+from .params import load_file
+from .plot import trace
+from .rng import seed_channels, set_seed
+from .simulation import set_temperature
+
+
+def run(config):
+    """
+    Run the simulation described in a configuration.
+
+    Parameters
+    ----------
+    config : dict
+        Simulation settings; see the module documentation.
+
+    Returns
+    -------
+    stim : instrumentation.Stim
+        The stimulus object, which holds the recorded traces.
+    """
+    config['seed'] = set_seed(config.get('seed'))
+    stochastic = []
+    for name, channel in config.get('channels', {}).items():
+        channel = dict(channel)
+        if 'gates' in channel:
+            if channel.get('stochastic'):
+                stochastic.append(name)
+            hh_channel(name, channel.pop('gates'),
+                       ion=channel.pop('ion', None),
+                       gbar=channel.get('gbar', 0),
+                       parameters=channel.pop('parameters', None),
+                       stochastic=channel.pop('stochastic', False),
+                       gamma=channel.pop('gamma', 10))
+        register_channel(name, **channel)
+    cell = MSN(config['cell']['type'], config['cell']['index'],
+               v_init=config['cell'].get('v_init', -80))
+    for name in stochastic:
+        seed_channels(cell.all, name)
+    if 'temperature' in config:
+        set_temperature(config['temperature'])
+    if 'noise' in config:
+        cell.add_bg_noise(**config['noise'])
+    if config.get('modulation') == 'DA':
+        Dopamine(cell)
+    elif config.get('modulation') == 'ACh':
+        Acetylcholine(cell)
+    elif config.get('modulation') is not None:
+        raise ValueError("`modulation` must be 'DA' or 'ACh'")
+
+    stim = Stim(cell)
+    stim_params = dict(amplitude=0, add_rheob=False)
+    stim_params.update(config.get('stimulus', {}))
+    stim.set_stim(tmax=config.get('tstop', 150), **stim_params)
+    stim.run()
+    return stim
+
+
+def main(args=None):
+    parser = argparse.ArgumentParser(
+        prog='python -m msn',
+        description='Run a MSN simulation described in a configuration '
+                    'file.')
+    parser.add_argument('config', help='configuration file (JSON or YAML)')
+    parser.add_argument('-o', '--output',
+                        help='output directory; overrides "output" in '
+                             'the configuration file')
+    parser.add_argument('--plot', choices=['svg', 'png'],
+                        help='save a figure of the voltage trace in this '
+                             'format')
+    args = parser.parse_args(args)
+
+    config = load_file(args.config)
+    output = Path(args.output or config.get('output', '.'))
+    output.mkdir(parents=True, exist_ok=True)
+
+    stim = run(config)
+    metadata = capture(params=config, cell=stim.cell)
+    pd.DataFrame({'t': stim.t.as_numpy(), 'v': stim.v.as_numpy()}).to_csv(
+        output / 'trace.csv', index=False)
+    write_sidecar(output / 'trace.csv', metadata)
+    ap = ActionPotentials(stim.t, stim.v)
+    pd.DataFrame({'t': ap.timestamps}).to_csv(output / 'spikes.csv',
+                                              index=False)
+    write_sidecar(output / 'spikes.csv', metadata)
+    if args.plot is not None:
+        trace(stim.t, stim.v, path=output / f'trace.{args.plot}')
+    with open(output / 'config.json', 'w') as file:
+        json.dump(config, file, indent=2)
+    print(f'{ap.n} action potentials; results saved in {output}')
+
+
+if __name__ == '__main__':
+    main()
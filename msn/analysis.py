@@ -0,0 +1,1345 @@
+"""
+Analysis of simulation results.
+
+author: Antonio Gonzalez
+"""
+import numpy as np
+import pandas as pd
+from neuron import h
+
+from .instrumentation import as_array
+
+
+def phase_plane(t, v):
+    """
+    Phase-plane trajectory (V vs dV/dt) of a voltage trace.
+
+    Parameters
+    ----------
+    t : array_like
+        Time in ms (a NEURON vector or array).
+    v : array_like
+        Membrane potential in mV.
+
+    Returns
+    -------
+    v : array
+        Membrane potential in mV.
+    dvdt : array
+        Rate of change of membrane potential in mV/ms (= V/s).
+
+    Example
+    -------
+    >>> stim.run()
+    >>> v, dvdt = phase_plane(stim.t, stim.v)
+    >>> plt.plot(v, dvdt)
+    """
+    t = as_array(t)
+    v = as_array(v)
+    return v, np.gradient(v, t)
+
+
+def nullclines(f, g, v, u):
+    """
+    Evaluate a two-variable model on a grid to find its nullclines.
+
+    For a model dv/dt = f(v, u), du/dt = g(v, u), the v-nullcline is
+    the curve f(v, u) = 0 and the u-nullcline is g(v, u) = 0.
+
+    Parameters
+    ----------
+    f, g : callable
+        Functions f(v, u) and g(v, u). They must accept numpy arrays.
+    v, u : array_like
+        Values of v and u defining the grid.
+
+    Returns
+    -------
+    V, U : arrays
+        The grid, as returned by numpy.meshgrid.
+    F, G : arrays
+        dv/dt and du/dt at each point in the grid.
+
+    Example
+    -------
+    Plot the nullclines as the zero contour lines:
+    >>> V, U, F, G = nullclines(f, g, np.linspace(-90, 0, 200),
+    ...                         np.linspace(-100, 300, 200))
+    >>> plt.contour(V, U, F, levels=[0], colors='C0')
+    >>> plt.contour(V, U, G, levels=[0], colors='C1')
+    """
+    V, U = np.meshgrid(v, u)
+    return V, U, f(V, U), g(V, U)
+
+
+def _jacobian(f, g, v, u, eps=1e-6):
+    return np.array([
+        [(f(v + eps, u) - f(v - eps, u)) / (2 * eps),
+         (f(v, u + eps) - f(v, u - eps)) / (2 * eps)],
+        [(g(v + eps, u) - g(v - eps, u)) / (2 * eps),
+         (g(v, u + eps) - g(v, u - eps)) / (2 * eps)]])
+
+
+def _classify(jacobian):
+    eigenvalues = np.linalg.eigvals(jacobian)
+    real = eigenvalues.real
+    if np.all(real < 0):
+        stability = 'stable'
+    elif np.all(real > 0):
+        stability = 'unstable'
+    else:
+        return 'saddle'
+    if np.any(np.abs(eigenvalues.imag) > 0):
+        return f'{stability} focus'
+    return f'{stability} node'
+
+
+def fixed_points(f, g, v, u, tol=1e-9, max_iter=50):
+    """
+    Find and classify the fixed points of a two-variable model.
+
+    Parameters
+    ----------
+    f, g : callable
+        Functions f(v, u) = dv/dt and g(v, u) = du/dt.
+    v, u : array_like
+        Values of v and u defining the grid where fixed points are
+        searched for.
+    tol : float, default=1e-9
+        Tolerance for Newton's method.
+    max_iter : int, default=50
+        Maximum number of iterations of Newton's method.
+
+    Returns
+    -------
+    points : pandas dataframe
+        One row per fixed point with columns [v, u, type], where type
+        is 'stable node', 'unstable node', 'stable focus', 'unstable
+        focus' or 'saddle', from the eigenvalues of the Jacobian.
+
+    Notes
+    -----
+    Candidate points are the grid cells where both f and g change
+    sign; these are refined with Newton's method. Fixed points between
+    grid values where f or g do not change sign (e.g. where nullclines
+    touch without crossing) may be missed; use a finer grid if needed.
+    """
+    V, U, F, G = nullclines(f, g, v, u)
+    points = []
+    for i in range(V.shape[0] - 1):
+        for j in range(V.shape[1] - 1):
+            cell_f = F[i:i+2, j:j+2]
+            cell_g = G[i:i+2, j:j+2]
+            if not (cell_f.min() <= 0 <= cell_f.max() and
+                    cell_g.min() <= 0 <= cell_g.max()):
+                continue
+            x = np.array([V[i:i+2, j:j+2].mean(), U[i:i+2, j:j+2].mean()])
+            for _ in range(max_iter):
+                jacobian = _jacobian(f, g, *x)
+                try:
+                    step = np.linalg.solve(jacobian,
+                                           [f(*x), g(*x)])
+                except np.linalg.LinAlgError:
+                    break
+                x = x - step
+                if np.abs(step).max() < tol:
+                    break
+            if abs(f(*x)) > 1e-6 or abs(g(*x)) > 1e-6:
+                continue
+            is_new = all(np.abs(x - point).max() > 1e-6
+                         for point in points)
+            if is_new:
+                points.append(x)
+    return pd.DataFrame(
+        [{'v': x[0], 'u': x[1],
+          'type': _classify(_jacobian(f, g, *x))} for x in points],
+        columns=['v', 'u', 'type'])
+
+
+def _moving_average(x, width):
+    # Moving average along the last axis. The signal is padded with its
+    # first and last values, so that the ends are not pulled towards 0
+    # (as with zero padding, np.convolve(mode='same')).
+    x = np.asarray(x, dtype=float)
+    if width <= 1:
+        return x
+    pad = [(0, 0)] * (x.ndim - 1) + [(width // 2, (width - 1) // 2)]
+    padded = np.pad(x, pad, mode='edge')
+    return np.apply_along_axis(np.convolve, -1, padded,
+                               np.ones(width) / width, mode='valid')
+
+
+class StateDetector:
+    """
+    Detect up and down states in a membrane potential trace.
+
+    The trace is (optionally) smoothed, and segmented with two
+    thresholds and hysteresis: the cell enters an up state when the
+    membrane potential rises above `up_threshold` and goes back to a
+    down state only when it falls below `down_threshold`. States
+    shorter than `min_duration` are merged into the preceding state.
+
+    Attributes
+    ----------
+    states : pandas dataframe
+        One row per state with columns [state, start, end, duration],
+        where state is 'up' or 'down' and times are in ms. The first
+        and last states are truncated by the start and end of the
+        trace.
+
+    Methods
+    -------
+    dwell_times(state)
+        Durations of the up or down states
+    dwell_histogram(state, bins=10, range=None)
+        Histogram of dwell times
+    transition_rates()
+        Rate of up-down transitions
+    annotate(recorder, source='states')
+        Add state transitions as events to a Recorder
+
+    Example
+    -------
+    >>> detector = StateDetector(stim.t, stim.v, up_threshold=-60,
+    ...                          down_threshold=-70)
+    >>> detector.states
+    >>> detector.transition_rates()
+    """
+
+    def __init__(self, t, v, up_threshold=-60, down_threshold=-70,
+                 min_duration=50, smooth=10):
+        """
+        Parameters
+        ----------
+        t : array_like
+            Time in ms (a NEURON vector or array). The sampling
+            interval must be constant.
+        v : array_like
+            Membrane potential in mV.
+        up_threshold : numeric, default=-60
+            Potential (mV) above which the cell enters an up state.
+        down_threshold : numeric, default=-70
+            Potential (mV) below which the cell returns to a down
+            state. Must be lower than or equal to `up_threshold`.
+        min_duration : numeric, default=50
+            Minimum duration (ms) of a state.
+        smooth : numeric, default=10
+            Width (ms) of the moving average applied to the trace
+            before detection, which removes action potentials and fast
+            fluctuations. 0 for no smoothing.
+        """
+        if down_threshold > up_threshold:
+            raise ValueError('`down_threshold` must not be higher than '
+                             '`up_threshold`')
+        self.t = as_array(t)
+        self.v = as_array(v)
+        self.up_threshold = up_threshold
+        self.down_threshold = down_threshold
+        self.min_duration = min_duration
+        self.smooth = smooth
+        self.states = self._detect()
+
+    def _detect(self):
+        t = self.t
+        v = self.v
+        dt = t[1] - t[0]
+        width = int(round(self.smooth / dt))
+        v = _moving_average(v, width)
+
+        # Hysteresis: 1 above the up threshold, 0 below the down
+        # threshold, and in between carry the last state over.
+        mark = np.where(v > self.up_threshold, 1,
+                        np.where(v < self.down_threshold, 0, -1))
+        if mark[0] == -1:
+            midpoint = (self.up_threshold + self.down_threshold) / 2
+            mark[0] = int(v[0] > midpoint)
+        last = np.maximum.accumulate(
+            np.where(mark >= 0, np.arange(mark.size), 0))
+        state = mark[last]
+
+        # Segments of constant state, merging those that are too short
+        # into the preceding one.
+        edges = np.concatenate([[0], np.flatnonzero(np.diff(state)) + 1,
+                                [state.size]])
+        segments = []
+        for start, end in zip(edges[:-1], edges[1:]):
+            value = state[start]
+            is_short = (t[end - 1] - t[start] + dt) < self.min_duration
+            if segments and (is_short or segments[-1][0] == value):
+                segments[-1][2] = end
+            else:
+                segments.append([value, start, end])
+        # Merging may leave consecutive segments in the same state.
+        merged = []
+        for segment in segments:
+            if merged and merged[-1][0] == segment[0]:
+                merged[-1][2] = segment[2]
+            else:
+                merged.append(segment)
+
+        rows = [{'state': 'up' if value else 'down',
+                 'start': t[start],
+                 'end': t[end - 1] + dt,
+                 'duration': t[end - 1] + dt - t[start]}
+                for value, start, end in merged]
+        return pd.DataFrame(rows,
+                            columns=['state', 'start', 'end', 'duration'])
+
+    def dwell_times(self, state, complete=True):
+        """
+        Durations of the up or down states.
+
+        Parameters
+        ----------
+        state : {'up', 'down'}
+        complete : bool, default=True
+            If True, exclude the first and last states, which are
+            truncated by the start and end of the trace.
+
+        Returns
+        -------
+        durations : array
+            Durations in ms.
+        """
+        states = self.states
+        if complete:
+            states = states.iloc[1:-1]
+        return states.duration[states.state == state].values
+
+    def dwell_histogram(self, state, bins=10, range=None):
+        """
+        Histogram of the dwell times in up or down states.
+
+        Parameters
+        ----------
+        state : {'up', 'down'}
+        bins, range :
+            See numpy.histogram.
+
+        Returns
+        -------
+        counts : array
+        edges : array
+            Bin edges in ms.
+        """
+        return np.histogram(self.dwell_times(state), bins=bins,
+                            range=range)
+
+    def transition_rates(self):
+        """
+        Rate of transitions between states.
+
+        Returns
+        -------
+        rates : dict
+            'up' (down-to-up transitions per second), 'down'
+            (up-to-down transitions per second), and the mean dwell
+            time (ms) in each state, 'mean_up' and 'mean_down' (NaN if
+            there are no complete states).
+        """
+        total = (self.t[-1] - self.t[0]) * 1e-3
+        transitions = list(zip(self.states.state[:-1],
+                               self.states.state[1:]))
+        rates = {'up': transitions.count(('down', 'up')) / total,
+                 'down': transitions.count(('up', 'down')) / total}
+        for state in ['up', 'down']:
+            durations = self.dwell_times(state)
+            rates[f'mean_{state}'] = (durations.mean() if durations.size
+                                      else np.nan)
+        return rates
+
+    def annotate(self, recorder, source='states'):
+        """
+        Add the state transitions as events to a Recorder.
+
+        Parameters
+        ----------
+        recorder : instrumentation.Recorder
+        source : str, default='states'
+            Name of the event source.
+
+        Notes
+        -----
+        Events are of kind 'up_state_onset' or 'down_state_onset'. The
+        start of the trace is not a transition and is not annotated.
+        """
+        for row in self.states.iloc[1:].itertuples():
+            recorder.annotate(f'{row.state}_state_onset', source=source,
+                              time=row.start)
+
+
+class APFeatures:
+    """
+    Waveform features of action potentials.
+
+    The features are calculated for each action potential following the
+    definitions in eFEL (the Electrophys Feature Extraction Library,
+    https://efel.readthedocs.io), and have the same names, so that they
+    can be compared with those extracted from experimental recordings.
+
+    Attributes
+    ----------
+    features : pandas dataframe
+        One row per action potential, with columns:
+        - peak_time: time of the peak (ms)
+        - AP_begin_voltage: membrane potential at the start of the
+          action potential, where dV/dt first exceeds
+          `derivative_threshold` (the threshold; mV)
+        - peak_voltage: membrane potential at the peak (mV)
+        - AP_amplitude: peak_voltage - AP_begin_voltage (mV)
+        - AP_duration_half_width: width at half amplitude (ms)
+        - AHP_depth_abs: minimum membrane potential between this and
+          the next action potential, or the end of the trace (mV)
+        - AHP_depth: AHP_depth_abs relative to the baseline potential
+          (mV; only if `stim_start` is given, NaN otherwise)
+        - AP_peak_upstroke: maximum dV/dt during the rise (mV/ms)
+        - AP_peak_downstroke: minimum dV/dt during the fall (mV/ms)
+        - dvdt_ratio: AP_peak_upstroke / |AP_peak_downstroke|
+
+    Methods
+    -------
+    mean()
+        Mean of each feature over action potentials
+
+    Example
+    -------
+    >>> stim.run()
+    >>> ap = APFeatures(stim.t, stim.v, stim_start=stim.stim.delay)
+    >>> ap.features
+    """
+
+    def __init__(self, t, v, threshold=-20, derivative_threshold=10,
+                 stim_start=None):
+        """
+        Parameters
+        ----------
+        t : array_like
+            Time in ms (a NEURON vector or array).
+        v : array_like
+            Membrane potential in mV.
+        threshold : numeric, default=-20
+            Voltage threshold for detecting action potentials (eFEL's
+            `Threshold`).
+        derivative_threshold : numeric, default=10
+            dV/dt (mV/ms) that marks the start of an action potential
+            (eFEL's `DerivativeThreshold`).
+        stim_start : None or numeric, default=None
+            Start of the stimulus in ms. The baseline potential is the
+            mean between 0.9 * stim_start and stim_start (eFEL's
+            `voltage_base`).
+        """
+        self.t = as_array(t)
+        self.v = as_array(v)
+        self.threshold = threshold
+        self.derivative_threshold = derivative_threshold
+        self.stim_start = stim_start
+        self.features = self._calculate()
+
+    def _crossing(self, index1, index2, value):
+        # Time at which v crosses `value` between two consecutive
+        # samples, by linear interpolation.
+        t1, t2 = self.t[index1], self.t[index2]
+        v1, v2 = self.v[index1], self.v[index2]
+        return t1 + (value - v1) * (t2 - t1) / (v2 - v1)
+
+    def _calculate(self):
+        t, v = self.t, self.v
+        dvdt = np.gradient(v, t)
+        above = v > self.threshold
+        upstrokes = np.flatnonzero(~above[:-1] & above[1:]) + 1
+        downstrokes = np.flatnonzero(above[:-1] & ~above[1:]) + 1
+        # Ignore an action potential that is still above threshold at
+        # the end of the trace.
+        upstrokes = upstrokes[upstrokes < (downstrokes.max()
+                                           if downstrokes.size else 0)]
+
+        voltage_base = np.nan
+        if self.stim_start is not None:
+            base = (t >= 0.9 * self.stim_start) & (t < self.stim_start)
+            voltage_base = v[base].mean()
+
+        rows = []
+        previous_end = 0
+        for index, up in enumerate(upstrokes):
+            down = downstrokes[downstrokes > up][0]
+            peak = up + np.argmax(v[up:down])
+            if index + 1 < len(upstrokes):
+                next_up = upstrokes[index + 1]
+            else:
+                next_up = v.size
+
+            # Start: first point of the last run of dV/dt above the
+            # threshold before the peak.
+            below = np.flatnonzero(
+                dvdt[previous_end:peak] < self.derivative_threshold)
+            begin = previous_end + (below[-1] + 1 if below.size else 0)
+
+            # Half width.
+            half = (v[begin] + v[peak]) / 2
+            rise = begin + np.flatnonzero(v[begin:peak + 1] >= half)[0]
+            fall = peak + np.flatnonzero(v[peak:next_up] <= half)
+            if rise > begin and fall.size:
+                half_width = (self._crossing(fall[0] - 1, fall[0], half) -
+                              self._crossing(rise - 1, rise, half))
+            else:
+                half_width = np.nan
+
+            # AHP: minimum until the next action potential starts (or
+            # the end of the trace).
+            ahp = down + np.argmin(v[down:next_up])
+            upstroke = dvdt[begin:peak + 1].max()
+            downstroke = dvdt[peak:ahp + 1].min()
+            rows.append({
+                'peak_time': t[peak],
+                'AP_begin_voltage': v[begin],
+                'peak_voltage': v[peak],
+                'AP_amplitude': v[peak] - v[begin],
+                'AP_duration_half_width': half_width,
+                'AHP_depth_abs': v[ahp],
+                'AHP_depth': v[ahp] - voltage_base,
+                'AP_peak_upstroke': upstroke,
+                'AP_peak_downstroke': downstroke,
+                'dvdt_ratio': upstroke / abs(downstroke)})
+            previous_end = ahp
+        columns = ['peak_time', 'AP_begin_voltage', 'peak_voltage',
+                   'AP_amplitude', 'AP_duration_half_width',
+                   'AHP_depth_abs', 'AHP_depth', 'AP_peak_upstroke',
+                   'AP_peak_downstroke', 'dvdt_ratio']
+        return pd.DataFrame(rows, columns=columns)
+
+    def mean(self):
+        """
+        Mean of each feature over all action potentials.
+
+        Returns
+        -------
+        means : pandas series
+        """
+        return self.features.drop(columns='peak_time').mean()
+
+
+class Impedance:
+    """
+    Impedance profile from the response to a current (e.g. a ZAP).
+
+    The impedance is the ratio of the Fourier transforms of the
+    membrane potential and of the injected current, Z(f) = V(f) / I(f).
+
+    Attributes
+    ----------
+    profile : pandas dataframe
+        Columns [frequency, magnitude, phase]: frequency in Hz,
+        magnitude (|Z|) in MOhm and phase in radians, for frequencies
+        between `f_min` and `f_max`.
+    resonance_frequency : float
+        Frequency (Hz) of maximum impedance.
+    q : float
+        Resonance strength: maximum impedance divided by the impedance
+        at the lowest frequency.
+
+    Example
+    -------
+    >>> zap = Chirp(0.02, 0.5, 20, start=500, duration=20000)
+    >>> zap.play(cell.soma)
+    >>> ...  # record t and v, and run the simulation
+    >>> z = Impedance(t, v, zap(t), f_min=0.5, f_max=20)
+    >>> z.resonance_frequency
+    """
+
+    def __init__(self, t, v, i, f_min=0.5, f_max=20, start=None,
+                 stop=None):
+        """
+        Parameters
+        ----------
+        t : array_like
+            Time in ms. The sampling interval must be constant.
+        v : array_like
+            Membrane potential in mV.
+        i : array_like
+            Injected current in nA, at the same times.
+        f_min, f_max : numeric, default=0.5, 20
+            Frequency range (Hz) of the profile, usually that of the
+            stimulus.
+        start, stop : None or numeric, default=None
+            Time window (ms) to analyse, e.g. the duration of the
+            stimulus. If None, the start or end of the trace.
+        """
+        t = as_array(t)
+        v = as_array(v)
+        i = np.asarray(i, dtype=float)
+        window = np.ones(t.size, dtype=bool)
+        if start is not None:
+            window &= t >= start
+        if stop is not None:
+            window &= t < stop
+        t, v, i = t[window], v[window], i[window]
+
+        dt = (t[1] - t[0]) * 1e-3
+        frequency = np.fft.rfftfreq(t.size, dt)
+        impedance = (np.fft.rfft(v - v.mean()) /
+                     np.fft.rfft(i - i.mean()))
+        keep = (frequency >= f_min) & (frequency <= f_max)
+        # mV/nA = MOhm
+        self.profile = pd.DataFrame({'frequency': frequency[keep],
+                                     'magnitude': np.abs(impedance[keep]),
+                                     'phase': np.angle(impedance[keep])})
+        peak = self.profile.magnitude.idxmax()
+        self.resonance_frequency = self.profile.frequency[peak]
+        self.q = (self.profile.magnitude[peak] /
+                  self.profile.magnitude.iloc[0])
+
+    def plot(self, ax=None, **kwargs):
+        """
+        Plot the impedance magnitude vs frequency.
+
+        Parameters
+        ----------
+        ax : None or matplotlib axes object
+            Matplotlib axes to use for plotting. If None (default), one
+            will be created.
+        **kwargs :
+            Additional keyword arguments passed on to the plot function.
+
+        Returns
+        -------
+        ax : matplotlib axes object
+        """
+        import matplotlib.pyplot as plt
+
+        if ax is None:
+            ax = plt.figure().add_subplot(111)
+        ax.plot(self.profile.frequency, self.profile.magnitude, **kwargs)
+        if ax.get_xlabel() == '':
+            ax.set_xlabel('Frequency (Hz)')
+        if ax.get_ylabel() == '':
+            ax.set_ylabel('Impedance (MOhm)')
+        return ax
+
+
+class PSP:
+    """
+    Detection and kinetics of postsynaptic potentials.
+
+    Subthreshold synaptic events (spontaneous, miniature or evoked) are
+    detected in a voltage trace from the rate of rise of the membrane
+    potential: an event starts where the (smoothed) dV/dt crosses
+    `rate_threshold`, and is kept if its amplitude exceeds
+    `amplitude_threshold`. For each event, the amplitude, the 10-90%
+    rise time, and the time constants of the rise and decay are
+    measured; the time constants are obtained by fitting exponentials
+    (by linear regression of the logarithm) between 10% and 90% of the
+    rise, and between 90% and 20% of the decay.
+
+    Attributes
+    ----------
+    events : pandas dataframe
+        One row per event, with columns:
+        - onset: start of the event (ms)
+        - peak_time: time of the peak (ms)
+        - baseline: membrane potential at the onset (mV)
+        - amplitude: peak - baseline (mV; positive for EPSPs and
+          IPSPs alike)
+        - rise_time: 10-90% rise time (ms)
+        - tau_rise: time constant of the rise (ms)
+        - tau_decay: time constant of the decay (ms; NaN if the next
+          event starts before the decay can be fitted)
+    frequency : float
+        Number of events per second.
+
+    Methods
+    -------
+    summary()
+        Statistics of the event measures
+
+    Notes
+    -----
+    Events that summate are detected separately if the second starts
+    rising after `refractory` ms; the amplitude of the second is then
+    measured from its own onset. Periods with action potentials (above
+    `spike_threshold`) are ignored.
+
+    Example
+    -------
+    Spontaneous EPSPs from background synaptic input:
+    >>> cell.add_bg_noise(glut_freq=2, gaba_freq=0)
+    >>> stim.run()
+    >>> psp = PSP(stim.t, stim.v)
+    >>> psp.events
+    >>> psp.summary()
+    """
+
+    def __init__(self, t, v, sign=1, rate_threshold=0.5,
+                 amplitude_threshold=0.2, window=50, smooth=0.5,
+                 refractory=2, spike_threshold=-20, dt=None):
+        """
+        Parameters
+        ----------
+        t, v : array_like
+            Time (ms) and membrane potential (mV). Traces recorded
+            with a variable time step are resampled uniformly (see
+            `dt`).
+        sign : {1, -1}, default=1
+            1 to detect depolarising events (EPSPs), -1 for
+            hyperpolarising events (IPSPs).
+        rate_threshold : numeric, default=0.5
+            Rate of rise (mV/ms) that marks the start of an event.
+        amplitude_threshold : numeric, default=0.2
+            Minimum amplitude (mV) of an event.
+        window : numeric, default=50
+            Maximum duration (ms) of an event, in which its peak and
+            decay are measured.
+        smooth : numeric, default=0.5
+            Width (ms) of the moving average applied before calculating
+            dV/dt for detection; measures are taken from the unsmoothed
+            trace.
+        refractory : numeric, default=2
+            Minimum time (ms) between the detection of two events.
+        spike_threshold : numeric, default=-20
+            Events during which the membrane potential exceeds this
+            value (mV) are action potentials, and are ignored.
+        dt : None or numeric, default=None
+            Time step (ms) at which the trace is resampled. If None,
+            the shortest time step of the trace, so that fast rises
+            recorded with a variable time step are not undersampled.
+        """
+        if sign not in (1, -1):
+            raise ValueError('sign must be 1 or -1')
+        t = as_array(t).astype(float)
+        v = as_array(v).astype(float)
+        if dt is None:
+            steps = np.diff(t)
+            dt = steps[steps > 0].min()
+        self._t = np.arange(t[0], t[-1], dt)
+        self._v = np.interp(self._t, t, v)
+        self._dt = dt
+        self.sign = sign
+        self.window = window
+        self._spike_threshold = spike_threshold
+        self.events = self._detect(rate_threshold, amplitude_threshold,
+                                   smooth, refractory)
+        duration = self._t[-1] - self._t[0]
+        self.frequency = len(self.events) / duration * 1e3
+
+    @staticmethod
+    def _fit_tau(t, y):
+        # Time constant of y = exp(-t / tau), from a linear regression
+        # of log(y); NaN if there are too few points.
+        if t.size < 3:
+            return np.nan
+        slope = np.polyfit(t, np.log(y), 1)[0]
+        return -1 / slope if slope < 0 else np.nan
+
+    def _measure(self, onset, end):
+        t = self._t[onset:end] - self._t[onset]
+        y = self.sign * self._v[onset:end]
+        peak = int(np.argmax(y))
+        amplitude = y[peak] - y[0]
+        if amplitude <= 0:
+            return None
+        fraction = (y - y[0]) / amplitude
+        rise = fraction[:peak + 1]
+        row = {'onset': self._t[onset], 'peak_time': self._t[onset + peak],
+               'baseline': self._v[onset], 'amplitude': amplitude}
+        t10 = t[np.argmax(rise >= 0.1)]
+        t90 = t[np.argmax(rise >= 0.9)]
+        row['rise_time'] = t90 - t10
+        fit = (rise > 0.1) & (rise < 0.9)
+        row['tau_rise'] = self._fit_tau(t[:peak + 1][fit], 1 - rise[fit])
+        # Decay: from the peak until the response first falls below 20%.
+        decay = fraction[peak:]
+        below = np.flatnonzero(decay < 0.2)
+        stop = below[0] if below.size else decay.size
+        fit = decay[:stop] < 0.9
+        row['tau_decay'] = (self._fit_tau(t[peak:peak + stop][fit],
+                                          decay[:stop][fit])
+                            if below.size else np.nan)
+        return row
+
+    def _detect(self, rate_threshold, amplitude_threshold, smooth,
+                refractory):
+        dt = self._dt
+        y = self.sign * self._v
+        smoothed = _moving_average(y, int(round(smooth / dt)))
+        dydt = np.gradient(smoothed, dt)
+        crossings = np.flatnonzero((dydt[1:] >= rate_threshold) &
+                                   (dydt[:-1] < rate_threshold)) + 1
+        starts = []
+        for index in crossings:
+            if starts and (index - starts[-1]) * dt < refractory:
+                continue
+            starts.append(index)
+        rows = []
+        window = int(round(self.window / dt))
+        for number, index in enumerate(starts):
+            # The onset is the last point, up to 5 ms before the
+            # crossing, where the potential was not rising.
+            first = max(index - int(round(5 / dt)), 0)
+            flat = np.flatnonzero(dydt[first:index] <= 0)
+            onset = first + flat[-1] if flat.size else first
+            end = min(onset + window, y.size)
+            if number + 1 < len(starts):
+                end = min(end, starts[number + 1])
+            if end - onset < 3:
+                continue
+            if np.any(self._v[onset:end] > self._spike_threshold):
+                continue
+            row = self._measure(onset, end)
+            if row is not None and row['amplitude'] >= amplitude_threshold:
+                rows.append(row)
+        return pd.DataFrame(rows, columns=[
+            'onset', 'peak_time', 'baseline', 'amplitude', 'rise_time',
+            'tau_rise', 'tau_decay'])
+
+    def summary(self):
+        """
+        Statistics of the event measures.
+
+        Returns
+        -------
+        summary : pandas dataframe
+            Count, mean, standard deviation and median (columns) of
+            the amplitude, rise time, time constants and intervals
+            between events (rows).
+        """
+        columns = ['amplitude', 'rise_time', 'tau_rise', 'tau_decay']
+        summary = self.events[columns].agg(
+            ['count', 'mean', 'std', 'median']).T
+        intervals = np.diff(self.events.onset.values)
+        summary.loc['interval'] = [
+            intervals.size,
+            intervals.mean() if intervals.size else np.nan,
+            intervals.std() if intervals.size else np.nan,
+            np.median(intervals) if intervals.size else np.nan]
+        return summary
+
+
+def spike_reliability(trains, start, stop, sigma=3, dt=0.1):
+    """
+    Reliability of spike timing across trials (Schreiber et al 2003).
+
+    Each spike train is convolved with a Gaussian kernel, and the
+    reliability is the mean correlation (cosine similarity) between all
+    pairs of convolved trains.
+
+    Parameters
+    ----------
+    trains : list of array_like
+        Spike times (ms) in each trial.
+    start, stop : numeric
+        Time window (ms) to analyse.
+    sigma : numeric, default=3
+        Standard deviation of the Gaussian kernel in ms; the time scale
+        of the measure.
+    dt : numeric, default=0.1
+        Time step (ms) of the convolved trains.
+
+    Returns
+    -------
+    reliability : float
+        Between 0 (no spike-time correlation) and 1 (identical trains).
+        NaN if fewer than two trials have spikes.
+
+    References
+    ----------
+    Schreiber S, Fellous JM, Whitmer D, Tiesinga P & Sejnowski TJ
+    (2003). A new correlation-based measure of spike timing
+    reliability. Neurocomputing 52-54, 925-931.
+    """
+    t = np.arange(start, stop, dt)
+    signals = []
+    for train in trains:
+        train = np.asarray(train, dtype=float)
+        train = train[(train >= start) & (train < stop)]
+        if train.size == 0:
+            continue
+        signal = np.exp(-(t[:, np.newaxis] - train)**2 /
+                        (2 * sigma**2)).sum(axis=1)
+        signals.append(signal / np.linalg.norm(signal))
+    if len(signals) < 2:
+        return np.nan
+    signals = np.array(signals)
+    similarity = signals @ signals.T
+    n = len(signals)
+    return (similarity.sum() - n) / (n * (n - 1))
+
+
+def spike_precision(trains, window=5):
+    """
+    Precision of spike timing across trials.
+
+    Each spike is matched to the nearest spike in every other trial.
+
+    Parameters
+    ----------
+    trains : list of array_like
+        Spike times (ms) in each trial.
+    window : numeric, default=5
+        Maximum time difference (ms) for two spikes to be matched.
+
+    Returns
+    -------
+    precision : dict
+        'jitter': mean absolute time difference (ms) between matched
+        spikes; 'fraction_matched': fraction of spikes that are matched
+        in the other trials.
+    """
+    differences = []
+    n_matched = 0
+    n_total = 0
+    trains = [np.sort(np.asarray(train, dtype=float)) for train in trains]
+    for index, train in enumerate(trains):
+        for other_index, other in enumerate(trains):
+            if other_index == index:
+                continue
+            n_total += train.size
+            if other.size == 0:
+                continue
+            position = np.clip(np.searchsorted(other, train), 1,
+                               max(other.size - 1, 1))
+            nearest = np.minimum(np.abs(other[position - 1] - train),
+                                 np.abs(other[position % other.size] -
+                                        train))
+            matched = nearest <= window
+            differences.extend(nearest[matched])
+            n_matched += matched.sum()
+    return {'jitter': np.mean(differences) if differences else np.nan,
+            'fraction_matched': n_matched / n_total if n_total else np.nan}
+
+
+class Population:
+    """
+    Activity of a population of neurones.
+
+    Analysis of spike times from many cells, e.g. those recorded in a
+    network (see network.Network.spikes): raster, population firing
+    rate, pairwise correlations and synchrony.
+
+    Attributes
+    ----------
+    spikes : pandas dataframe
+        One row per spike with columns [population, cell, time, row],
+        where `row` is the position of the cell in the raster (cells of
+        each population are numbered consecutively).
+    n_cells : int
+        Number of cells, including those that did not fire.
+    start, stop : numeric
+        Time window (ms) analysed.
+
+    Methods
+    -------
+    from_network(network, population=None, start=0, stop=None)
+        Population activity of a network
+    raster()
+        Spike times and raster rows
+    binned(bin_size=1)
+        Spike counts of each cell in time bins
+    rate(bin_size=1, sigma=5)
+        Smoothed population firing rate
+    correlations(bin_size=5)
+        Pairwise correlation coefficients of spike counts
+    synchrony(sigma=5)
+        Golomb-Rinzel synchrony index
+
+    Example
+    -------
+    >>> net.run(2000)
+    >>> activity = Population.from_network(net, start=500, stop=2000)
+    >>> t, rate = activity.rate(sigma=10)
+    >>> activity.synchrony()
+
+    References
+    ----------
+    Golomb D & Rinzel J (1993). Dynamics of globally coupled inhibitory
+    neurons with heterogeneity. Phys Rev E 48, 4810-4814.
+    """
+
+    def __init__(self, spikes, n_cells=None, start=0, stop=None):
+        """
+        Parameters
+        ----------
+        spikes : pandas dataframe
+            Spike times, with columns [cell, time] and, optionally,
+            population (as returned by network.Network.spikes).
+        n_cells : None, int or dict, default=None
+            Number of cells (for a single population) or number of cells
+            in each population, as {population: n}, so that silent cells
+            are counted. If None, the largest cell index + 1.
+        start : numeric, default=0
+            Start of the time window (ms).
+        stop : None or numeric, default=None
+            End of the time window (ms), excluded. If None, the last
+            spike, included.
+        """
+        spikes = spikes.copy()
+        if 'population' not in spikes:
+            spikes['population'] = ''
+        names = list(dict.fromkeys(spikes.population))
+        if isinstance(n_cells, dict):
+            names = list(n_cells) + [name for name in names
+                                     if name not in n_cells]
+        sizes = {}
+        for name in names:
+            cells = spikes.cell[spikes.population == name]
+            if isinstance(n_cells, dict) and name in n_cells:
+                sizes[name] = n_cells[name]
+            elif n_cells is not None and not isinstance(n_cells, dict):
+                sizes[name] = n_cells
+            else:
+                sizes[name] = int(cells.max()) + 1 if len(cells) else 0
+        offsets = dict(zip(names, np.cumsum([0] + list(sizes.values()))))
+        spikes['row'] = spikes.cell + spikes.population.map(offsets)
+        if stop is None:
+            stop = spikes.time.max() if len(spikes) else start
+            inside = spikes.time <= stop
+        else:
+            inside = spikes.time < stop
+        self.start = start
+        self.stop = stop
+        self.n_cells = int(sum(sizes.values()))
+        self.spikes = spikes[(spikes.time >= start)
+                             & inside].reset_index(drop=True)
+
+    @classmethod
+    def from_network(cls, network, population=None, start=0, stop=None):
+        """
+        Population activity of a network.
+
+        Parameters
+        ----------
+        network : network.Network
+            A network, after running the simulation.
+        population : None or str, default=None
+            Population to analyse. If None, all cells in the network.
+        start, stop : numeric
+            Time window (ms); see Population. If `stop` is None, the
+            end of the simulation.
+        """
+        names = list(network.populations) if population is None else [
+            population]
+        n_cells = {name: len(network.populations[name]) for name in names}
+        if stop is None:
+            stop = h.t
+        return cls(network.spikes(population), n_cells, start, stop)
+
+    def raster(self):
+        """
+        Spike times and raster rows.
+
+        Returns
+        -------
+        times : array
+            Spike times (ms).
+        rows : array
+            Row of each spike in the raster (cell number).
+        """
+        return self.spikes.time.values, self.spikes.row.values
+
+    def binned(self, bin_size=1):
+        """
+        Spike counts of each cell in time bins.
+
+        Parameters
+        ----------
+        bin_size : numeric, default=1
+            Bin width (ms).
+
+        Returns
+        -------
+        t : array
+            Start of each bin (ms).
+        counts : array, shape (n_cells, n_bins)
+        """
+        edges = np.arange(self.start, self.stop + bin_size, bin_size)
+        counts = np.zeros((self.n_cells, len(edges) - 1))
+        bins = np.clip(np.searchsorted(edges, self.spikes.time,
+                                       side='right') - 1,
+                       0, len(edges) - 2)
+        np.add.at(counts, (self.spikes.row.values, bins), 1)
+        return edges[:-1], counts
+
+    @staticmethod
+    def _smooth(signal, sigma, dt):
+        # Gaussian smoothing along the last axis. As in _moving_average,
+        # the signal is padded with its first and last values so that
+        # the rate does not drop towards 0 at the ends.
+        if sigma <= 0:
+            return signal
+        half_width = int(np.ceil(4 * sigma / dt))
+        x = np.arange(-half_width, half_width + 1) * dt
+        kernel = np.exp(-x**2 / (2 * sigma**2))
+        kernel /= kernel.sum()
+        signal = np.asarray(signal, dtype=float)
+        pad = [(0, 0)] * (signal.ndim - 1) + [(half_width, half_width)]
+        padded = np.pad(signal, pad, mode='edge')
+        return np.apply_along_axis(np.convolve, -1, padded, kernel,
+                                   mode='valid')
+
+    def rate(self, bin_size=1, sigma=5):
+        """
+        Population firing rate, smoothed with a Gaussian kernel.
+
+        Parameters
+        ----------
+        bin_size : numeric, default=1
+            Bin width (ms).
+        sigma : numeric, default=5
+            Standard deviation of the kernel (ms); 0 for no smoothing.
+
+        Returns
+        -------
+        t : array
+            Time (ms), the start of each bin.
+        rate : array
+            Mean firing rate per cell (Hz).
+        """
+        t, counts = self.binned(bin_size)
+        rate = counts.sum(axis=0) / max(self.n_cells, 1) / bin_size * 1e3
+        return t, self._smooth(rate, sigma, bin_size)
+
+    def correlations(self, bin_size=5):
+        """
+        Pairwise correlation coefficients of spike counts.
+
+        Parameters
+        ----------
+        bin_size : numeric, default=5
+            Bin width (ms); the time scale of the correlations.
+
+        Returns
+        -------
+        correlations : array, shape (n_cells, n_cells)
+            Pearson correlation coefficient between the spike counts
+            of each pair of cells; NaN for cells without spikes.
+        mean : float
+            Mean over all pairs of different cells with spikes.
+        """
+        __, counts = self.binned(bin_size)
+        with np.errstate(divide='ignore', invalid='ignore'):
+            correlations = np.corrcoef(counts)
+        correlations = np.atleast_2d(correlations)
+        pairs = ~np.eye(len(correlations), dtype=bool) & np.isfinite(
+            correlations)
+        mean = correlations[pairs].mean() if pairs.any() else np.nan
+        return correlations, mean
+
+    def synchrony(self, sigma=5, dt=0.5):
+        """
+        Synchrony index of Golomb and Rinzel (1993).
+
+        The spike train of each cell is smoothed with a Gaussian kernel.
+        The index is the ratio of the variance over time of the
+        population average to the mean variance of the individual
+        cells, chi = sqrt(var(mean) / mean(var)).
+
+        Parameters
+        ----------
+        sigma : numeric, default=5
+            Standard deviation of the kernel (ms).
+        dt : numeric, default=0.5
+            Time step (ms) of the smoothed trains.
+
+        Returns
+        -------
+        chi : float
+            Between 0 (asynchronous; chi decreases as 1/sqrt(n_cells))
+            and 1 (fully synchronous). NaN if no cell fired.
+        """
+        __, counts = self.binned(dt)
+        signals = self._smooth(counts, sigma, dt)
+        individual = signals.var(axis=1).mean()
+        if individual == 0:
+            return np.nan
+        return np.sqrt(signals.mean(axis=0).var() / individual)
+
+
+class LFP:
+    """
+    Local field potential (LFP) proxy of a population of cells.
+
+    Two estimates are available:
+
+    'synaptic': the weighted-sum proxy of Mazzoni et al (2015), built
+    from the synaptic currents of all cells,
+        LFP(t) = sum |I_AMPA(t - delay)| - alpha * sum |I_GABA(t)|,
+    which approximates the LFP of a population of cells with a
+    realistic morphology from point-neuron (or reduced) simulations.
+    In the striatum, where MSNs have no consistent orientation, this
+    is a proxy of the signal, not its absolute value.
+
+    'membrane': the potential (uV) at the electrode generated by the
+    transmembrane currents of every segment, each taken as a point
+    source in an infinite homogeneous medium,
+        phi = 1 / (4 pi sigma) sum I_n / r_n.
+
+    With positions, the synaptic currents of each cell are also weighted
+    by the inverse of the distance from the cell to the electrode.
+
+    Currents are recorded from the moment the object is created, so it
+    must be created before the simulation is run, and after all
+    synapses are in place.
+
+    Attributes
+    ----------
+    cells : list
+        The cells.
+    method : str
+        'synaptic' or 'membrane'.
+
+    Methods
+    -------
+    signal()
+        The LFP after the simulation
+
+    Example
+    -------
+    >>> cells = net.populations['dmsn'] + net.populations['imsn']
+    >>> lfp = LFP(cells)
+    >>> net.run(2000)
+    >>> t, signal = lfp.signal()
+
+    References
+    ----------
+    Mazzoni A, Lindén H, Cuntz H, Lansner A, Panzeri S & Einevoll GT
+    (2015). Computing the local field potential (LFP) from
+    integrate-and-fire network models. PLoS Comput Biol 11, e1004584.
+    """
+
+    def __init__(self, cells, method='synaptic', positions=None,
+                 electrode=(0, 0, 0), sigma=0.3, alpha=1.65, delay=6,
+                 min_distance=10, dt=None):
+        """
+        Parameters
+        ----------
+        cells : list
+            Model cells, e.g. the cells of one or more populations of a
+            network.
+        method : {'synaptic', 'membrane'}, default='synaptic'
+            The estimate to calculate; see above.
+        positions : None or array_like, default=None
+            Position (um) of each cell, shape (n_cells, 2) or (n_cells,
+            3), e.g. network.Network.positions. Required for
+            'membrane', where the position of each segment is that of
+            its 3D points plus the position of its cell (the sections
+            themselves are not moved). With 'synaptic', the current of
+            each cell is weighted by the distance from its position to
+            the electrode; if None, all cells have weight 1.
+        electrode : sequence, default=(0, 0, 0)
+            Position of the electrode (um).
+        sigma : numeric, default=0.3
+            Extracellular conductivity (S/m).
+        alpha, delay : numeric, default=1.65, 6
+            Relative weight of GABA currents and delay (ms) of AMPA
+            currents in the synaptic proxy.
+        min_distance : numeric, default=10
+            Smallest distance (um) from a source to the electrode, to
+            avoid the singularity of point sources.
+        dt : None or numeric, default=None
+            Sampling interval (ms). If None, every time step.
+        """
+        if method not in ('synaptic', 'membrane'):
+            raise ValueError("`method` must be 'synaptic' or 'membrane'")
+        if method == 'membrane' and positions is None:
+            raise ValueError("`positions` are required for 'membrane'")
+        self.cells = list(cells)
+        self.method = method
+        self.sigma = sigma
+        self.alpha = alpha
+        self.delay = delay
+        electrode = np.pad(np.asarray(electrode, dtype=float),
+                           (0, 3 - len(electrode)))
+        if positions is not None:
+            positions = np.asarray(positions, dtype=float)
+            positions = np.pad(positions, ((0, 0),
+                                           (0, 3 - positions.shape[1])))
+
+        self._t = h.Vector()
+        self._record(self._t, h._ref_t, dt)
+        self._sources = []
+        if method == 'membrane':
+            h.CVode().use_fast_imem(1)
+            h.define_shape()
+        for index, cell in enumerate(self.cells):
+            offset = None if positions is None else positions[index]
+            if method == 'synaptic':
+                weight = 1
+                if offset is not None:
+                    weight = 1 / (4 * np.pi * sigma * max(
+                        np.linalg.norm(offset - electrode), min_distance))
+                for section in cell.all:
+                    for segment in section:
+                        for point in segment.point_processes():
+                            kind = point.hname().split('[')[0]
+                            inhibitory = kind not in ('glutamate', 'tmglut')
+                            if not inhibitory:
+                                ref = point._ref_i_ampa
+                            elif kind in ('gaba', 'tmgaba', 'gabab'):
+                                ref = point._ref_i
+                            else:
+                                continue
+                            vector = h.Vector()
+                            self._record(vector, ref, dt)
+                            self._sources.append((inhibitory, weight,
+                                                  vector))
+            else:
+                for section in cell.all:
+                    for segment in section:
+                        position = np.array([
+                            _interp3d(section, segment.x, axis)
+                            for axis in 'xyz']) + offset
+                        distance = max(np.linalg.norm(position - electrode),
+                                       min_distance)
+                        vector = h.Vector()
+                        self._record(vector, segment._ref_i_membrane_, dt)
+                        self._sources.append(
+                            (None, 1 / (4 * np.pi * sigma * distance),
+                             vector))
+
+    @staticmethod
+    def _record(vector, ref, dt):
+        if dt is None:
+            vector.record(ref)
+        else:
+            vector.record(ref, dt)
+
+    def signal(self):
+        """
+        The LFP after the simulation.
+
+        Returns
+        -------
+        t : array
+            Time (ms).
+        lfp : array
+            For 'membrane', the potential in uV. For 'synaptic', the
+            proxy in nA (or, with positions, in uV).
+        """
+        t = self._t.as_numpy().copy()
+        if self.method == 'membrane':
+            lfp = np.zeros(t.size)
+            for __, weight, vector in self._sources:
+                lfp += weight * vector.as_numpy()
+            # nA / (S/m um) = mV
+            return t, lfp * 1e3
+        ampa = np.zeros(t.size)
+        gaba = np.zeros(t.size)
+        for is_gaba, weight, vector in self._sources:
+            current = weight * np.abs(vector.as_numpy())
+            if is_gaba:
+                gaba += current
+            else:
+                ampa += current
+        # Delay AMPA currents.
+        ampa = np.interp(t - self.delay, t, ampa, left=0)
+        lfp = ampa - self.alpha * gaba
+        if any(weight != 1 for __, weight, __ in self._sources):
+            lfp *= 1e3
+        return t, lfp
+
+
+def _interp3d(section, x, axis):
+    # Coordinate of a point along a section, from its 3D points.
+    n = section.n3d()
+    arc = np.array([section.arc3d(i) for i in range(n)])
+    coordinate = np.array([getattr(section, f'{axis}3d')(i)
+                           for i in range(n)])
+    return np.interp(x * section.L, arc, coordinate)
@@ -0,0 +1,407 @@
+"""
+HTTP service to run simulations remotely.
+
+Simulations described by configurations (as in the command line
+interface, see msn.__main__) are submitted over HTTP, queued, and run
+in worker processes, at most a given number at a time; their status and
+results are then retrieved over HTTP. This allows sharing a compute
+server between users without giving them access to it.
+
+Endpoints (all data are JSON):
+
+    POST   /jobs               Submit a configuration; returns the job
+                               id (202), or the validation error (400).
+    GET    /jobs               Status of all jobs.
+    GET    /jobs/<id>          Status of a job.
+    GET    /jobs/<id>/result   Time, voltage, action potential times,
+                               seed and provenance of a finished job
+                               (409 if not finished yet).
+    DELETE /jobs/<id>          Cancel a queued job.
+
+Usage:
+
+    python -m msn.api [--host HOST] [--port PORT] [--workers N]
+                      [--max-queue N] [--output DIR]
+
+Example
+-------
+    curl -X POST localhost:8000/jobs \\
+        -d '{"cell": {"type": "dmsn", "index": 12}, "tstop": 500}'
+    curl localhost:8000/jobs/1
+    curl localhost:8000/jobs/1/result
+
+Notes
+-----
+The service has no authentication and runs any valid configuration,
+including mod files named in "channels"; it should only be reachable
+from a trusted network (by default it listens on localhost only).
+
+author: Antonio Gonzalez
+"""
+import argparse
+import datetime
+import json
+import queue
+import threading
+import traceback
+from concurrent.futures import ProcessPoolExecutor
+from concurrent.futures.process import BrokenProcessPool
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from pathlib import Path
+
+from .params import ParameterError, apply_preset, validate
+
+
+def _run_job(config):
+    # Run one simulation in a worker process and return its results in
+    # a form that can be sent as JSON.
+    from .__main__ import run
+    from .instrumentation import ActionPotentials
+    from .meta import capture
+
+    stim = run(config)
+    ap = ActionPotentials(stim.t, stim.v)
+    return {'t': stim.t.as_numpy().tolist(),
+            'v': stim.v.as_numpy().tolist(),
+            'spikes': list(ap.timestamps),
+            'seed': config['seed'],
+            'provenance': capture(params=config, cell=stim.cell)}
+
+
+def _now():
+    return datetime.datetime.now().isoformat(timespec='seconds')
+
+
+class JobQueue:
+    """
+    A queue of simulations run with bounded concurrency.
+
+    Each simulation runs in a fresh worker process (so that runs do not
+    share NEURON's state), and at most `workers` run at a time; the
+    others wait in the queue in the order they were submitted. A job
+    whose worker process dies (e.g. from a segmentation fault in a mod
+    file) fails with an error, and does not block the queue.
+
+    Attributes
+    ----------
+    workers : int
+        Maximum number of simulations run at a time.
+    max_queue : int
+        Maximum number of queued (not yet running) jobs.
+    output : None or Path
+        Directory where the result of each job is saved, as
+        '<id>.json'.
+
+    Methods
+    -------
+    submit(config)
+        Validate a configuration and queue it
+    status(job_id=None)
+        Status of a job, or of all jobs
+    result(job_id)
+        Results of a finished job
+    cancel(job_id)
+        Cancel a queued job
+    close()
+        Stop the workers
+    """
+
+    def __init__(self, workers=2, max_queue=100, output=None):
+        """
+        Parameters
+        ----------
+        workers : int, default=2
+            Maximum number of simulations run at a time.
+        max_queue : int, default=100
+            Maximum number of queued jobs; further submissions are
+            refused until the queue has room.
+        output : None or str or Path, default=None
+            If given, the result of each job is also saved in this
+            directory.
+        """
+        self.workers = workers
+        self.max_queue = max_queue
+        self.output = None if output is None else Path(output)
+        if self.output is not None:
+            self.output.mkdir(parents=True, exist_ok=True)
+        self._jobs = {}
+        self._results = {}
+        self._queue = queue.Queue()
+        self._lock = threading.Lock()
+        self._next_id = 1
+        self._threads = [threading.Thread(target=self._work, daemon=True)
+                         for __ in range(workers)]
+        for thread in self._threads:
+            thread.start()
+
+    def _work(self):
+        while True:
+            job_id = self._queue.get()
+            if job_id is None:
+                return
+            with self._lock:
+                job = self._jobs[job_id]
+                if job['status'] == 'cancelled':
+                    continue
+                job['status'] = 'running'
+                job['started'] = _now()
+            try:
+                # A new process for each job; if it dies, the error is
+                # raised here instead of waiting forever for a result.
+                with ProcessPoolExecutor(1) as executor:
+                    result = executor.submit(_run_job,
+                                             job['config']).result()
+            except BrokenProcessPool:
+                with self._lock:
+                    job['status'] = 'failed'
+                    job['error'] = ('The worker process running the '
+                                    'simulation terminated abruptly.')
+                    job['finished'] = _now()
+                continue
+            except Exception:
+                with self._lock:
+                    job['status'] = 'failed'
+                    job['error'] = traceback.format_exc()
+                    job['finished'] = _now()
+                continue
+            if self.output is not None:
+                with open(self.output / f'{job_id}.json', 'w') as file:
+                    json.dump(result, file)
+            with self._lock:
+                self._results[job_id] = result
+                job['status'] = 'done'
+                job['finished'] = _now()
+
+    def submit(self, config):
+        """
+        Validate a configuration and queue it.
+
+        Parameters
+        ----------
+        config : dict
+            Simulation settings; see msn.__main__.
+
+        Returns
+        -------
+        job_id : int
+
+        Raises
+        ------
+        ParameterError
+            If the configuration is not valid.
+        RuntimeError
+            If the queue is full.
+        """
+        if not isinstance(config, dict):
+            raise ParameterError('expected a mapping of settings')
+        config = apply_preset(config)
+        validate(config)
+        with self._lock:
+            queued = sum(job['status'] == 'queued'
+                         for job in self._jobs.values())
+            if queued >= self.max_queue:
+                raise RuntimeError(f'the queue is full ({queued} jobs)')
+            job_id = self._next_id
+            self._next_id += 1
+            self._jobs[job_id] = {'id': job_id, 'status': 'queued',
+                                  'submitted': _now(), 'config': config}
+        self._queue.put(job_id)
+        return job_id
+
+    def status(self, job_id=None):
+        """
+        Status of a job, or of all jobs if `job_id` is None.
+
+        Each status is a dict with the job's 'id', 'status' ('queued',
+        'running', 'done', 'failed' or 'cancelled'), 'config', the
+        times it was 'submitted', 'started' and 'finished', and the
+        'error' (traceback) of a failed job.
+
+        Raises
+        ------
+        KeyError
+            If there is no such job.
+        """
+        with self._lock:
+            if job_id is None:
+                return [dict(job) for job in self._jobs.values()]
+            return dict(self._jobs[job_id])
+
+    def result(self, job_id):
+        """
+        Results of a finished job, or None if not finished.
+
+        Raises
+        ------
+        KeyError
+            If there is no such job.
+        """
+        with self._lock:
+            if job_id not in self._jobs:
+                raise KeyError(job_id)
+            return self._results.get(job_id)
+
+    def cancel(self, job_id):
+        """
+        Cancel a queued job. Running jobs cannot be cancelled.
+
+        Returns
+        -------
+        cancelled : bool
+            True if the job was cancelled.
+
+        Raises
+        ------
+        KeyError
+            If there is no such job.
+        """
+        with self._lock:
+            job = self._jobs[job_id]
+            if job['status'] != 'queued':
+                return False
+            job['status'] = 'cancelled'
+            job['finished'] = _now()
+            return True
+
+    def close(self):
+        """
+        Stop the workers once the running jobs have finished.
+        """
+        for __ in self._threads:
+            self._queue.put(None)
+        for thread in self._threads:
+            thread.join()
+
+
+class _Handler(BaseHTTPRequestHandler):
+    # Requests are handled with the JobQueue in `server.jobs`.
+
+    def _send(self, code, data):
+        body = json.dumps(data).encode()
+        self.send_response(code)
+        self.send_header('Content-Type', 'application/json')
+        self.send_header('Content-Length', str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def _send_stream(self, code, data, chunk_size=65536):
+        # Send large data (e.g. results) without building the whole
+        # body in memory: the JSON is encoded and written in pieces, and
+        # the end of the body is marked by closing the connection.
+        self.send_response(code)
+        self.send_header('Content-Type', 'application/json')
+        self.end_headers()
+        self.close_connection = True
+        chunks, size = [], 0
+        for chunk in json.JSONEncoder().iterencode(data):
+            chunks.append(chunk)
+            size += len(chunk)
+            if size >= chunk_size:
+                self.wfile.write(''.join(chunks).encode())
+                chunks, size = [], 0
+        self.wfile.write(''.join(chunks).encode())
+
+    def _route(self):
+        # ('jobs', job_id, action), with None for missing parts; None
+        # if the path is not a known endpoint.
+        parts = self.path.split('?')[0].strip('/').split('/')
+        if parts[0] != 'jobs' or len(parts) > 3:
+            return None
+        try:
+            job_id = int(parts[1]) if len(parts) > 1 else None
+        except ValueError:
+            return None
+        action = parts[2] if len(parts) > 2 else None
+        return parts[0], job_id, action
+
+    def do_POST(self):
+        if self._route() != ('jobs', None, None):
+            return self._send(404, {'error': 'not found'})
+        length = int(self.headers.get('Content-Length', 0))
+        try:
+            config = json.loads(self.rfile.read(length))
+            job_id = self.server.jobs.submit(config)
+        except (ValueError, ParameterError) as error:
+            return self._send(400, {'error': str(error)})
+        except RuntimeError as error:
+            return self._send(503, {'error': str(error)})
+        self._send(202, {'id': job_id, 'status': 'queued'})
+
+    def do_GET(self):
+        route = self._route()
+        if route is None or route[2] not in (None, 'result'):
+            return self._send(404, {'error': 'not found'})
+        __, job_id, action = route
+        try:
+            if job_id is None:
+                return self._send(200, self.server.jobs.status())
+            if action is None:
+                return self._send(200, self.server.jobs.status(job_id))
+            result = self.server.jobs.result(job_id)
+        except KeyError:
+            return self._send(404, {'error': f'no job {job_id}'})
+        if result is None:
+            return self._send(409, {'error': f'job {job_id} is not '
+                                             'finished'})
+        self._send_stream(200, result)
+
+    def do_DELETE(self):
+        route = self._route()
+        if route is None or route[1] is None or route[2] is not None:
+            return self._send(404, {'error': 'not found'})
+        job_id = route[1]
+        try:
+            cancelled = self.server.jobs.cancel(job_id)
+        except KeyError:
+            return self._send(404, {'error': f'no job {job_id}'})
+        if not cancelled:
+            return self._send(409, {'error': f'job {job_id} is not '
+                                             'queued'})
+        self._send(200, {'id': job_id, 'status': 'cancelled'})
+
+
+def serve(host='127.0.0.1', port=8000, workers=2, max_queue=100,
+          output=None):
+    """
+    Run the HTTP service until interrupted.
+
+    Parameters
+    ----------
+    host : str, default='127.0.0.1'
+        Address to listen on; '0.0.0.0' for all interfaces.
+    port : int, default=8000
+    workers, max_queue, output :
+        See JobQueue.
+    """
+    server = ThreadingHTTPServer((host, port), _Handler)
+    server.jobs = JobQueue(workers, max_queue, output)
+    print(f'Listening on http://{host}:{port} ({workers} workers)')
+    try:
+        server.serve_forever()
+    except KeyboardInterrupt:
+        pass
+    finally:
+        server.server_close()
+        server.jobs.close()
+
+
+def main(args=None):
+    parser = argparse.ArgumentParser(
+        prog='python -m msn.api',
+        description='Run MSN simulations submitted over HTTP.')
+    parser.add_argument('--host', default='127.0.0.1',
+                        help='address to listen on (default: localhost)')
+    parser.add_argument('--port', type=int, default=8000)
+    parser.add_argument('--workers', type=int, default=2,
+                        help='maximum number of simulations run at a '
+                             'time')
+    parser.add_argument('--max-queue', type=int, default=100,
+                        help='maximum number of queued jobs')
+    parser.add_argument('-o', '--output',
+                        help='directory where results are also saved')
+    args = parser.parse_args(args)
+    serve(args.host, args.port, args.workers, args.max_queue, args.output)
+
+
+if __name__ == '__main__':
+    main()
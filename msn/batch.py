@@ -0,0 +1,115 @@
+"""
+Run many simulations in parallel, e.g. for parameter sweeps.
+
+author: Antonio Gonzalez
+"""
+import itertools
+import multiprocessing
+import sys
+import traceback
+
+import pandas as pd
+
+
+def grid(**values):
+    """
+    Generate all combinations of parameter values.
+
+    Parameters
+    ----------
+    **values :
+        Parameter names and, for each, a sequence of values.
+
+    Yields
+    ------
+    params : dict
+        One combination of parameter values.
+
+    Example
+    -------
+    >>> list(grid(cell_index=[1, 2], kaf=[1, 1.2]))
+    [{'cell_index': 1, 'kaf': 1}, {'cell_index': 1, 'kaf': 1.2},
+     {'cell_index': 2, 'kaf': 1}, {'cell_index': 2, 'kaf': 1.2}]
+    """
+    names = list(values)
+    for combination in itertools.product(*values.values()):
+        yield dict(zip(names, combination))
+
+
+def _run_one(args):
+    # Run one simulation. Errors are caught and returned so that one
+    # failed run does not stop the whole batch.
+    index, function, params = args
+    try:
+        return index, function(**params), None
+    except Exception:
+        return index, None, traceback.format_exc()
+
+
+def run_batch(function, params, processes=None, progress=True,
+              maxtasksperchild=None):
+    """
+    Run a simulation for each set of parameters in parallel processes.
+
+    Parameters
+    ----------
+    function : callable
+        The function that runs one simulation. It is called as
+        `function(**p)` for each `p` in `params` and should build the
+        model cell, run the simulation, and return the result (e.g. a
+        number, or a dict of numbers). It must be defined at the top
+        level of a module so that it can be sent to other processes.
+    params : iterable of dict
+        Parameters for each run, e.g. as generated by grid().
+    processes : None or int, default=None
+        Number of worker processes. If None, the number of CPUs.
+    progress : bool, default=True
+        If True, print the number of completed runs as they finish.
+    maxtasksperchild : None or int, default=None
+        Number of runs after which a worker process is replaced by a
+        fresh one. Setting this to 1 ensures that every simulation runs
+        in a clean NEURON instance, at the cost of some speed.
+
+    Returns
+    -------
+    results : pandas dataframe
+        One row per run, in the same order as `params`, with one column
+        per parameter plus the columns 'result' (the value returned by
+        `function`, or None if the run failed) and 'error' (None, or
+        the traceback if the run failed).
+
+    Example
+    -------
+    In a script:
+    >>> def count_spikes(cell_index, amplitude):
+    ...     cell = MSN('dmsn', cell_index)
+    ...     stim = Stim(cell)
+    ...     stim.set_stim(amplitude=amplitude)
+    ...     stim.run()
+    ...     return ActionPotentials(stim.t, stim.v).n
+    >>> if __name__ == '__main__':
+    ...     results = run_batch(count_spikes,
+    ...                         grid(cell_index=range(10),
+    ...                              amplitude=[0.1, 0.2]))
+    """
+    params = list(params)
+    tasks = [(index, function, p) for index, p in enumerate(params)]
+    results = [None] * len(params)
+    errors = [None] * len(params)
+    with multiprocessing.Pool(processes,
+                              maxtasksperchild=maxtasksperchild) as pool:
+        for n, (index, result, error) in enumerate(
+                pool.imap_unordered(_run_one, tasks), start=1):
+            results[index] = result
+            errors[index] = error
+            if progress:
+                failed = sum(error is not None for error in errors)
+                print(f'\r{n}/{len(tasks)} runs completed '
+                      f'({failed} failed)', end='', file=sys.stderr)
+    if progress:
+        print(file=sys.stderr)
+
+    results_df = pd.DataFrame(params)
+    results_df['result'] = results
+    results_df['error'] = errors
+    return results_df
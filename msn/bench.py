@@ -0,0 +1,218 @@
+"""
+Benchmarks of simulation speed.
+
+Times a few representative simulations, and reports the number of
+integration steps per second of wall-clock time and the time per
+compartment and step, so that changes in performance (e.g. from a new
+mechanism, or a new version of NEURON) can be compared across versions
+and machines. Each benchmark has a budget, the maximum time per
+compartment and step, and is reported as failed if it exceeds it.
+
+Example
+-------
+>>> results = run_benchmarks(['single_cell_fixed', 'recorder'])
+
+or, from the command line:
+    python -m msn.bench
+    python -m msn.bench network --cells 1000 --tstop 500
+
+which exits with status 1 if any benchmark is over budget.
+
+author: Antonio Gonzalez
+"""
+import argparse
+import sys
+import tempfile
+import time
+from pathlib import Path
+
+import pandas as pd
+from neuron import h
+
+from . import rng
+from .cell import MSN, ReducedMSN
+from .instrumentation import Recorder
+from .network import Network
+from .simulation import set_integrator
+
+
+def _n_compartments():
+    return sum(section.nseg for section in h.allsec())
+
+
+def _time_run(tstop, v_init=-80):
+    # Run a simulation, counting the integration steps.
+    h.finitialize(v_init)
+    n_steps = 0
+    start = time.perf_counter()
+    while h.t < tstop:
+        h.fadvance()
+        n_steps += 1
+    return n_steps, time.perf_counter() - start
+
+
+def _single_cell(method, tstop, record=None):
+    # `record` is None (no recording), 'memory' (every step, in
+    # memory), 'ring' (ring buffers) or 'stream' (streamed to files).
+    set_integrator(method)
+    cell = MSN('dmsn', 12)
+    stim = h.IClamp(0.5, sec=cell.soma)
+    stim.delay = 100
+    stim.dur = tstop
+    stim.amp = cell.rheobase * 1e-3 + 0.05
+    if record is None:
+        n_steps, wall = _time_run(tstop)
+        return n_steps, wall, _n_compartments()
+    recorder = Recorder()
+    segments = [segment for section in cell.all for segment in section]
+    with tempfile.TemporaryDirectory() as directory:
+        for index, segment in enumerate(segments):
+            name = f'v_{index}'
+            if record == 'memory':
+                recorder.add(name, segment)
+            elif record == 'ring':
+                recorder.add(name, segment, dt=0.1, buffer=1000)
+            else:
+                recorder.add(name, segment, dt=0.1,
+                             path=Path(directory) / f'{name}.dat')
+        n_steps, wall = _time_run(tstop)
+        if record == 'stream':
+            start = time.perf_counter()
+            recorder.flush()
+            wall += time.perf_counter() - start
+        for index in range(len(segments)):
+            recorder.remove(f'v_{index}')
+    return n_steps, wall, _n_compartments()
+
+
+def _network(n_cells, tstop):
+    set_integrator('fixed')
+    rng.set_seed(0)
+    net = Network()
+    for name in ('dmsn', 'imsn'):
+        net.add_population(
+            name, name, range(n_cells // 2),
+            cell_class=lambda cell_type, index: ReducedMSN(cell_type))
+    for source in ('dmsn', 'imsn'):
+        for target in ('dmsn', 'imsn'):
+            net.connect(source, target, probability=0.05, weight=5e-4,
+                        compartment='soma', seed=0)
+    drive = []
+    for cells in net.populations.values():
+        for cell in cells:
+            stim = h.IClamp(0.5, sec=cell.soma)
+            stim.delay, stim.dur = 0, tstop
+            stim.amp = cell.rheobase * 1e-3 * 1.1
+            drive.append(stim)
+    n_steps, wall = _time_run(tstop)
+    return n_steps, wall, _n_compartments()
+
+
+# Benchmarks, as {name: (function, description)}. Each function takes
+# the duration of the simulation (ms) and the number of cells (for
+# networks) and returns (steps, wall-clock time, compartments).
+benchmarks = {
+    'single_cell_fixed': (
+        lambda tstop, n_cells: _single_cell('fixed', tstop),
+        'dMSN, current step, fixed step (dt=0.025 ms)'),
+    'single_cell_cvode': (
+        lambda tstop, n_cells: _single_cell('cvode', tstop),
+        'dMSN, current step, variable step (CVODE)'),
+    'recorder': (
+        lambda tstop, n_cells: _single_cell('fixed', tstop, 'memory'),
+        'dMSN, fixed step, recording v in every segment'),
+    'recorder_ring': (
+        lambda tstop, n_cells: _single_cell('fixed', tstop, 'ring'),
+        'dMSN, fixed step, v in every segment to ring buffers'),
+    'recorder_stream': (
+        lambda tstop, n_cells: _single_cell('fixed', tstop, 'stream'),
+        'dMSN, fixed step, v in every segment streamed to files'),
+    'network': (
+        lambda tstop, n_cells: _network(n_cells, tstop),
+        'network of reduced MSNs, fixed step'),
+}
+
+# Budgets, as the maximum time (ns) per compartment and integration
+# step of each benchmark. They are generous limits for a current
+# desktop machine, meant to catch large regressions rather than small
+# differences between machines.
+budgets = {
+    'single_cell_fixed': 1000,
+    'single_cell_cvode': 5000,
+    'recorder': 1500,
+    'recorder_ring': 2000,
+    'recorder_stream': 2500,
+    'network': 2000,
+}
+
+
+def run_benchmarks(names=None, tstop=1000, n_cells=1000, budgets=None):
+    """
+    Run benchmarks.
+
+    Parameters
+    ----------
+    names : None or list of str, default=None
+        Benchmarks to run (keys of `benchmarks`). If None, all.
+    tstop : numeric, default=1000
+        Duration (ms) of each simulation.
+    n_cells : int, default=1000
+        Number of cells in the network benchmark.
+    budgets : None or dict, default=None
+        Maximum ns per compartment and step of each benchmark, as
+        {name: budget}; benchmarks not in it have no budget. If None,
+        the module's `budgets`.
+
+    Returns
+    -------
+    results : pandas dataframe
+        One row per benchmark, with columns [benchmark, description,
+        steps, compartments, wall (s), steps_per_s,
+        ns_per_compartment_step, budget, passed]. `budget` is NaN and
+        `passed` True for benchmarks without a budget.
+    """
+    if budgets is None:
+        budgets = globals()['budgets']
+    rows = []
+    for name in names or benchmarks:
+        if name not in benchmarks:
+            raise ValueError(f"Unknown benchmark '{name}'; it must be "
+                             f"one of {list(benchmarks)}")
+        function, description = benchmarks[name]
+        n_steps, wall, n_compartments = function(tstop, n_cells)
+        ns = wall * 1e9 / (n_steps * n_compartments)
+        budget = budgets.get(name, float('nan'))
+        rows.append({
+            'benchmark': name, 'description': description,
+            'steps': n_steps, 'compartments': n_compartments,
+            'wall': wall, 'steps_per_s': n_steps / wall,
+            'ns_per_compartment_step': ns, 'budget': budget,
+            'passed': not ns > budget})
+    set_integrator('fixed')
+    return pd.DataFrame(rows)
+
+
+def main(argv=None):
+    parser = argparse.ArgumentParser(
+        prog='python -m msn.bench',
+        description='Measure simulation speed.')
+    parser.add_argument('names', nargs='*', metavar='benchmark',
+                        help=f'benchmarks to run: {", ".join(benchmarks)} '
+                        '(default: all)')
+    parser.add_argument('--tstop', type=float, default=1000,
+                        help='duration of each simulation (ms)')
+    parser.add_argument('--cells', type=int, default=1000,
+                        help='number of cells in the network benchmark')
+    args = parser.parse_args(argv)
+    results = run_benchmarks(args.names or None, args.tstop, args.cells)
+    print(results.drop(columns='description').to_string(
+        index=False, float_format='{:.4g}'.format))
+    failed = results.loc[~results['passed'], 'benchmark']
+    if len(failed):
+        print(f'Over budget: {", ".join(failed)}')
+        return 1
+    return 0
+
+
+if __name__ == '__main__':
+    sys.exit(main())
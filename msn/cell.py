@@ -9,7 +9,7 @@ import neuron as nrn
 from neuron import h
 import matplotlib.pyplot as plt
 
-from . import paths
+from . import nmodl, paths, rng
 from .params import ModelParameters
 
 h.load_file('stdrun.hoc')
@@ -17,8 +17,52 @@ h.load_file('import3d.hoc')
 nrn.load_mechanisms(paths['mechanisms'])
 
 
+# NMDA receptor kinetics by GluN2 subunit, as parameters of
+# mechanisms/glutamate.mod. Time constants are given as in that file
+# (they are divided by its temperature factor q = 2). GluN2B receptors
+# decay several times more slowly than GluN2A receptors (Vicini et al
+# 1998), and are slightly less sensitive to Mg block (Kuner & Schoepfer
+# 1996); alpha and beta are the parameters of the Mg block of Jahr &
+# Stevens (1990). These are approximate values for qualitative
+# simulations.
+#
+# Vicini S et al (1998). Functional and pharmacological differences
+# between recombinant N-methyl-D-aspartate receptors. J Neurophysiol
+# 79, 555-566.
+# Kuner T & Schoepfer R (1996). Multiple structural elements determine
+# subunit specificity of Mg2+ block in NMDA receptor channels. J
+# Neurosci 16, 3549-3558.
+nmda_subunits = {
+    'GluN2A': {'tau1_nmda': 5.52, 'tau2_nmda': 100, 'alpha': 0.062,
+               'beta': 3.57},
+    'GluN2B': {'tau1_nmda': 10, 'tau2_nmda': 600, 'alpha': 0.058,
+               'beta': 4.5}}
+
+
+def set_nmda_subunit(synapse, subunit):
+    """
+    Set the NMDA kinetics of a glutamate synapse to those of a subunit.
+
+    Parameters
+    ----------
+    synapse : object
+        A glutamate synapse (mechanisms/glutamate.mod).
+    subunit : str or dict
+        A key of `nmda_subunits` ('GluN2A' or 'GluN2B'), or a dict of
+        parameters of glutamate.mod, e.g. {'tau2_nmda': 300}.
+    """
+    if isinstance(subunit, str):
+        if subunit not in nmda_subunits:
+            raise ValueError(f"Unknown NMDA subunit '{subunit}'; it must "
+                             f"be one of {list(nmda_subunits)}")
+        subunit = nmda_subunits[subunit]
+    for key, value in subunit.items():
+        setattr(synapse, key, value)
+
+
 def synaptic_input(section, stype, x=0.5, interval=10, number=10,
-                   start=50, noise=0, threshold=10, delay=1, weight=0):
+                   start=50, noise=0, threshold=10, delay=1, weight=0,
+                   erev=None, nmda_subunit=None, stp=None):
     """
     Connect a synapse to a cell section and deliver synaptic stimuli.
 
@@ -26,8 +70,13 @@ def synaptic_input(section, stype, x=0.5, interval=10, number=10,
     ----------
     section : object
         The cell section that will receive synaptic input.
-    stype : {'gaba', 'glut'}
-        The type of synapse.
+    stype : {'gaba', 'gabab', 'glut', 'ampa', 'nmda'}
+        The type of synapse. 'glut' is a glutamatergic synapse with
+        both AMPA and NMDA components; 'ampa' and 'nmda' are the same
+        synapse with only one of these components active. 'gabab' is
+        a slow GABA-B synapse (see mechanisms/gabab.mod); its maximal
+        conductance `gmax` is set to `weight`, and the NetCon weight
+        (the relative amount of transmitter released) to 1.
     x : float, range [0, 1], default=0.5
         Location on `section` where the synapse will be created.
     interval : numeric, default=10
@@ -49,6 +98,23 @@ def synaptic_input(section, stype, x=0.5, interval=10, number=10,
     weight : numeric, default=0
         Connection weight in uS. Passed on to the NET_RECEIVE procedure
         in the target point.
+    erev : None or numeric, default=None
+        Reversal potential of the synapse in mV. If None (default), the
+        value defined in the synaptic mechanism is used (0 mV for
+        glutamate, -60 mV for GABA, -90 mV for GABA-B).
+    nmda_subunit : None, str or dict, default=None
+        NMDA kinetics of glutamate synapses, e.g. 'GluN2B' (see
+        set_nmda_subunit). If None, the default kinetics of
+        glutamate.mod.
+    stp : None or dict, default=None
+        Tsodyks-Markram short-term plasticity parameters, e.g.
+        {'U': 0.5, 'tau_rec': 800, 'tau_facil': 0}. If given, the
+        synapse is the plastic version of the glutamate or GABA synapse
+        (mechanisms/tmglut.mod or tmgaba.mod), and any parameter not
+        given takes the default value in that file. The response to the
+        first spike is that of the synapse without plasticity; later
+        responses depress or facilitate. Not available for 'gabab'
+        synapses, whose release is set by their own kinetics.
 
     Returns
     -------
@@ -76,12 +142,34 @@ def synaptic_input(section, stype, x=0.5, interval=10, number=10,
     documentation.
     """
     # Create the synapse.
-    if stype == 'glut':
-        synapse = h.glutamate(x, sec=section)
+    if stp is not None and stype == 'gabab':
+        raise ValueError('Short-term plasticity is not available for '
+                         'GABA-B synapses')
+    if stype in ('glut', 'ampa', 'nmda'):
+        if stp is not None:
+            synapse = h.tmglut(x, sec=section)
+        else:
+            synapse = h.glutamate(x, sec=section)
+        if stype == 'ampa':
+            synapse.nmda_scale_factor = 0
+        elif stype == 'nmda':
+            synapse.ampa_scale_factor = 0
+        if nmda_subunit is not None:
+            set_nmda_subunit(synapse, nmda_subunit)
     elif stype == 'gaba':
-        synapse = h.gaba(x, sec=section)
+        if stp is not None:
+            synapse = h.tmgaba(x, sec=section)
+        else:
+            synapse = h.gaba(x, sec=section)
+    elif stype == 'gabab':
+        synapse = h.gabab(x, sec=section)
     else:
-        raise ValueError("Synapse type `stype` must be 'glut' or 'gaba'")
+        raise ValueError("Synapse type `stype` must be 'glut', 'ampa', "
+                         "'nmda', 'gaba' or 'gabab'")
+    if erev is not None:
+        synapse.erev = erev
+    for key, value in (stp or {}).items():
+        setattr(synapse, key, value)
 
     # Create the stimulus (NetStim - spike generator)
     stim = h.NetStim()
@@ -89,12 +177,18 @@ def synaptic_input(section, stype, x=0.5, interval=10, number=10,
     stim.number = number
     stim.start = start
     stim.noise = noise
+    if noise > 0:
+        rng.seed_netstim(stim, owner=section.cell())
 
     # Connect the stimulus to the synapse (NetCon - connection object)
     conn = h.NetCon(stim, synapse)
     conn.threshold = threshold
     conn.delay = delay
-    conn.weight[0] = weight
+    if stype == 'gabab':
+        synapse.gmax = weight
+        conn.weight[0] = 1
+    else:
+        conn.weight[0] = weight
 
     return synapse, stim, conn
 
@@ -191,6 +285,376 @@ def get_channel_density(distance, params):
     return density
 
 
+class DensityGradient:
+    """
+    Ion channel density as a function of path distance from the soma.
+
+    A gradient is a function of distance (um) that returns either a
+    factor that scales the density set from the Lindroos et al
+    parameters (relative gradient, the default) or the density itself
+    (gbar or pbar, absolute gradient). Use the constructors linear(),
+    exponential() and table(), or pass any function of distance.
+
+    Attributes
+    ----------
+    function : callable
+        Density, or factor, as a function of distance.
+    relative : bool
+        Whether the gradient scales the existing density.
+
+    See also
+    --------
+    set_density_gradient
+
+    Example
+    -------
+    Kir density increasing linearly by 50% per 100 um:
+    >>> gradient = DensityGradient.linear(1, 0.005)
+    >>> cell = MSN('dmsn', 12, gradients={'kir': gradient})
+    """
+    def __init__(self, function, relative=True):
+        self.function = function
+        self.relative = relative
+
+    @classmethod
+    def linear(cls, start, slope, relative=True):
+        """
+        start + slope * distance
+        """
+        return cls(lambda distance: start + slope * distance, relative)
+
+    @classmethod
+    def exponential(cls, start, amplitude, length, relative=True):
+        """
+        start + amplitude * exp(distance / length)
+
+        A negative `length` (um) gives a decreasing gradient.
+        """
+        return cls(lambda distance: start + amplitude * np.exp(
+            distance / length), relative)
+
+    @classmethod
+    def table(cls, distances, values, relative=True):
+        """
+        Linear interpolation of `values` at `distances` (um); values
+        beyond the ends are those at the ends.
+        """
+        distances = np.asarray(distances, dtype=float)
+        values = np.asarray(values, dtype=float)
+        return cls(lambda distance: np.interp(distance, distances, values),
+                   relative)
+
+    def __call__(self, distance):
+        return self.function(distance)
+
+
+def set_density_gradient(cell, mechanism, gradient, compartment='dend',
+                         variable=None):
+    """
+    Set the density of an ion channel as a function of somatic distance.
+
+    Parameters
+    ----------
+    cell : object
+        A NEURON model cell, e.g. cell.MSN.
+    mechanism : str
+        Ion channel, e.g. 'kir' or 'cal12'. Its gbar is set, or pbar
+        for calcium channels.
+    gradient : DensityGradient or callable
+        The density (or, for relative gradients, the factor scaling the
+        current density) as a function of path distance from the soma
+        (um). A function is taken as a relative gradient.
+    compartment : str, default='dend'
+        Only sections whose name contains this are changed, e.g. 'dend'
+        or 'soma'; 'all' for all sections.
+    variable : None or str, default=None
+        Density parameter of the mechanism. If None, 'pbar' for calcium
+        channels and 'gbar' otherwise.
+
+    Notes
+    -----
+    Relative gradients scale the density at the time they are set;
+    setting the same relative gradient twice applies it twice.
+    """
+    if not isinstance(gradient, DensityGradient):
+        gradient = DensityGradient(gradient)
+    if variable is None:
+        variable = 'pbar' if mechanism.startswith('ca') else 'gbar'
+    h.distance(sec=cell.soma)
+    for section in cell.all:
+        if compartment != 'all' and compartment not in section.name():
+            continue
+        for segment in section:
+            if not hasattr(segment, mechanism):
+                continue
+            mech = getattr(segment, mechanism)
+            value = gradient(h.distance(segment.x, sec=section))
+            if gradient.relative:
+                value *= getattr(mech, variable)
+            setattr(mech, variable, max(value, 0))
+
+
+# Ion channels added by the user; see register_channel().
+user_channels = {}
+
+
+def register_channel(name, compartments=('soma', 'dend'), gbar=0,
+                     variable=None, mod=None):
+    """
+    Register an ion channel to be inserted in every new cell.
+
+    Registered channels are inserted, alongside the built-in ones, in
+    all the MSN cells created afterwards (including SimplifiedMSN and
+    morph.MorphologyMSN), so that new channels can be added to the
+    model without changing this library.
+
+    Parameters
+    ----------
+    name : str
+        Mechanism name (its SUFFIX in the mod file).
+    compartments : sequence of str, default=('soma', 'dend')
+        Sections where the channel is inserted: those whose name
+        contains any of these (e.g. 'soma', 'dend', 'axon').
+    gbar : numeric, callable or DensityGradient, default=0
+        Channel density, or density as a function of the distance from
+        the soma (um); see DensityGradient. Relative gradients scale
+        the default density in the mod file.
+    variable : None or str, default=None
+        Name of the density parameter in the mod file. If None, 'pbar'
+        for mechanisms whose name starts with 'ca' (as the calcium
+        channels in this model) and 'gbar' otherwise.
+    mod : None or str or Path, default=None
+        Mod file that defines the mechanism. It is compiled and loaded
+        (see nmodl.load) if the mechanism is not yet available.
+
+    Raises
+    ------
+    ValueError
+        If the mechanism is not available in NEURON, or its mod file
+        defines a different mechanism.
+
+    Example
+    -------
+    >>> register_channel('kv7', compartments=['soma', 'axon'],
+    ...                  gbar=1e-4, mod='kv7.mod')
+    >>> cell = MSN('dmsn', 12)  # Now with kv7 in the soma and axon.
+    """
+    if not nmodl.is_loaded(name):
+        if mod is None:
+            raise ValueError(f"Unknown mechanism '{name}'; give its mod "
+                             "file with `mod`")
+        if nmodl.parse(mod)['name'] != name:
+            raise ValueError(f"{mod} does not define mechanism '{name}'")
+        nmodl.load(mod)
+    if variable is None:
+        variable = 'pbar' if name.startswith('ca') else 'gbar'
+    user_channels[name] = {'compartments': list(compartments),
+                           'gbar': gbar, 'variable': variable}
+
+
+def unregister_channel(name=None):
+    """
+    Stop inserting a registered channel (or all, if `name` is None) in
+    new cells.
+    """
+    if name is None:
+        user_channels.clear()
+    else:
+        user_channels.pop(name, None)
+
+
+# Ion concentrations (mM), as {ion: (inside, outside)}; typical values
+# for mammalian neurones in artificial cerebrospinal fluid. The model
+# itself uses fixed reversal potentials (ek = -85 mV, ena = 50 mV).
+ion_concentrations = {'k': (140, 5), 'na': (10, 145), 'ca': (5e-5, 2)}
+
+# Ion valences.
+_valences = {'k': 1, 'na': 1, 'ca': 2, 'cal': 2}
+
+
+def nernst(inside, outside, valence, celsius=None):
+    """
+    Nernst equilibrium potential (mV).
+
+    Parameters
+    ----------
+    inside, outside : numeric
+        Concentrations of the ion inside and outside the cell (any
+        units, the same for both).
+    valence : int
+        Charge of the ion, e.g. 1 for K+, 2 for Ca2+.
+    celsius : None or numeric, default=None
+        Temperature (degC). If None, NEURON's temperature (h.celsius).
+    """
+    if celsius is None:
+        celsius = h.celsius
+    # R T / F in mV.
+    rt_f = 8.314462618 * (celsius + 273.15) / 96485.33212 * 1e3
+    return rt_f / valence * np.log(outside / inside)
+
+
+def set_reversal_potentials(cell, concentrations=None, dynamic=('ca',),
+                            ions=None):
+    """
+    Derive reversal potentials from ion concentrations.
+
+    Instead of fixed reversal potentials, NEURON computes them from the
+    ion concentrations with the Nernst equation at the temperature of
+    the simulation (h.celsius), when the simulation is initialised;
+    for the ions in `dynamic`, they are also updated at every time step
+    as concentrations change (e.g. eca follows cai as calcium
+    accumulates; see cadyn.mod).
+
+    Parameters
+    ----------
+    cell : object
+        A NEURON model cell, e.g. cell.MSN.
+    concentrations : None or dict, default=None
+        Concentrations (mM) as {ion: (inside, outside)}, for any of
+        'k', 'na', 'ca' and 'cal'. Ions not given take the values in
+        `ion_concentrations`.
+    dynamic : sequence of str, default=('ca',)
+        Ions whose reversal potential is updated during the simulation.
+    ions : None or sequence of str, default=None
+        Ions whose reversal potential is derived from concentrations;
+        the others keep their fixed reversal potentials. If None, the
+        ions in `concentrations` and `dynamic`.
+
+    Returns
+    -------
+    potentials : dict
+        Initial reversal potentials (mV) at the current temperature, as
+        {ion: mV}.
+
+    Notes
+    -----
+    The calcium channels of the model (can, car, cal12, etc) compute
+    their current from the concentrations (GHK equation) and are not
+    affected by eca; eca matters for mechanisms that use it, e.g. user
+    channels (see register_channel).
+
+    Example
+    -------
+    High extracellular potassium (ek from the concentrations, and eca
+    dynamic; other reversal potentials unchanged):
+    >>> set_reversal_potentials(cell, {'k': (140, 10)})
+    """
+    concentrations = concentrations or {}
+    if ions is None:
+        ions = list(dict.fromkeys([*concentrations, *dynamic]))
+    potentials = {}
+    for ion in ions:
+        if ion not in _valences:
+            raise ValueError(f"Unknown ion '{ion}'; it must be one of "
+                             f"{list(_valences)}")
+        if ion not in concentrations and ion not in ion_concentrations:
+            raise ValueError(f"No concentrations given for '{ion}'")
+        inside, outside = concentrations.get(ion, ion_concentrations[ion])
+        setattr(h, f'{ion}i0_{ion}_ion', inside)
+        setattr(h, f'{ion}o0_{ion}_ion', outside)
+        for section in cell.all:
+            if not h.ismembrane(f'{ion}_ion', sec=section):
+                continue
+            # Keep the concentration style set by the mechanisms;
+            # reversal potential computed (e_style 2) at initialisation
+            # (einit), and at every step (eadvance) if dynamic.
+            c_style = max(int(h.ion_style(f'{ion}_ion', sec=section)) & 3,
+                          1)
+            h.ion_style(f'{ion}_ion', c_style, 2, 1, int(ion in dynamic),
+                        1, sec=section)
+        potentials[ion] = nernst(inside, outside, _valences[ion])
+    return potentials
+
+
+def add_potassium_accumulation(cell, kbath=None, depth=0.1, tau=1000,
+                               ki=None, sections=None):
+    """
+    Add accumulation of extracellular potassium.
+
+    Potassium currents raise the concentration of potassium in a thin
+    extracellular shell around the membrane, from which it is cleared
+    (by glial uptake and diffusion) towards the bath concentration with
+    a time constant `tau` (see mechanisms/kext.mod). The potassium
+    reversal potential then follows the concentrations (Nernst), so
+    that high frequency firing depolarises ek.
+
+    Parameters
+    ----------
+    cell : object
+        A NEURON model cell, e.g. cell.MSN.
+    kbath : None or numeric, default=None
+        Bath (and initial) extracellular concentration (mM). If None,
+        that in `ion_concentrations`.
+    depth : numeric, default=0.1
+        Thickness (um) of the extracellular shell; smaller values give
+        faster accumulation.
+    tau : numeric, default=1000
+        Time constant (ms) of clearance.
+    ki : None or numeric, default=None
+        Intracellular concentration (mM). If None, that in
+        `ion_concentrations`.
+    sections : None or list, default=None
+        Sections with accumulation. If None, all.
+
+    Returns
+    -------
+    ek : float
+        Initial potassium reversal potential (mV).
+
+    Example
+    -------
+    >>> add_potassium_accumulation(cell, tau=500)
+    >>> ko = h.Vector().record(cell.soma(0.5)._ref_ko)
+    """
+    default_ki, default_ko = ion_concentrations['k']
+    kbath = default_ko if kbath is None else kbath
+    ki = default_ki if ki is None else ki
+    for section in cell.all if sections is None else sections:
+        section.insert('kext')
+        for segment in section:
+            segment.kext.kbath = kbath
+            segment.kext.depth = depth
+            segment.kext.tau = tau
+    h.ki0_k_ion = ki
+    h.ko0_k_ion = kbath
+    return nernst(ki, kbath, 1)
+
+
+def set_kir_block(cell, block=True, **params):
+    """
+    Switch the polyamine block of the inward rectifier (Kir) channel.
+
+    By default the Kir channel (kir.mod) has only a voltage-dependent
+    activation. With polyamine block the channel is in addition
+    blocked on depolarisation and unblocked on hyperpolarisation with
+    a slow time course, which shapes the latency of up-state onset.
+
+    Parameters
+    ----------
+    cell : object
+        A NEURON model cell, e.g. cell.MSN.
+    block : bool, default=True
+        If True, use the Kir channel with polyamine block; if False,
+        use the original channel.
+    **params :
+        Parameters of the block kinetics (see kir.mod): 'bhalf' and
+        'bslope' (mV), half-block voltage and slope of the steady-state
+        unblocked fraction; 'btau0' and 'btaumin' (ms), peak and
+        minimum of the time constant.
+
+    Example
+    -------
+    >>> cell = MSN('dmsn', 12)
+    >>> set_kir_block(cell, btau0=40)
+    """
+    for section in cell.all:
+        for segment in section:
+            if hasattr(segment, 'kir'):
+                segment.kir.pablock = int(block)
+                for name, value in params.items():
+                    setattr(segment.kir, name, value)
+
+
 class MSN:
     """
     Build a model of a MSN.
@@ -208,6 +672,9 @@ class MSN:
     v_init : numeric
         Initialisation membrane voltage
 
+    gradients : dict
+        Ion channel density gradients, see set_density_gradient
+
     Methods
     -------
     add_bg_noise(gaba_freq=4, glut_freq=12, syn_fact=[],
@@ -222,7 +689,8 @@ class MSN:
     model by Lindroos and Hellgren Kotaleski (2020), available from
     ModelDB (accession number 266775).
     """
-    def __init__(self, cell_type, cell_index, v_init=-80):
+    def __init__(self, cell_type, cell_index, v_init=-80, gradients=None,
+                 gbar_nap=0):
         """
         Parameters
         ----------
@@ -234,6 +702,16 @@ class MSN:
             iMSNs.
         v_init : numeric, default=-80
             Initialisation membrane voltage.
+        gradients : None or dict, default=None
+            Dendritic ion channel density gradients, as {mechanism:
+            gradient}, applied after the densities are set from the
+            Lindroos et al parameters; see DensityGradient and
+            set_density_gradient.
+        gbar_nap : numeric, default=0
+            Persistent sodium (mechanisms/nap.mod) conductance in S/cm2,
+            uniform in the soma and dendrites. The channel is not part
+            of the Lindroos et al model, and is only inserted if this
+            is not zero.
         """
         # self._gid = gid
         self.type = cell_type
@@ -249,9 +727,16 @@ class MSN:
 
         # Create cell
         self._setup_morphology()
+        self._setup_discretisation()
         self._setup_mechanisms()
         self._setup_biophysics()
         self._setup_density()
+        self._setup_user_channels()
+        if gbar_nap:
+            self._setup_nap(gbar_nap)
+        self.gradients = gradients or {}
+        for mechanism, gradient in self.gradients.items():
+            set_density_gradient(self, mechanism, gradient)
         h.celsius = 35
         self.v_init = v_init
 
@@ -271,6 +756,7 @@ class MSN:
         assert(len(self.soma) == 1)
         self.soma = self.soma[0]
 
+    def _setup_discretisation(self):
         # Spatial discretisation.
         for sec in self.all:
             if 'axon' in sec.name():
@@ -300,6 +786,13 @@ class MSN:
             for mechanism in mechanisms:
                 sec.insert(mechanism)
 
+    def _setup_nap(self, gbar):
+        for sec in self.all:
+            if 'soma' in sec.name() or 'dend' in sec.name():
+                sec.insert('nap')
+                for segment in sec:
+                    segment.gbar_nap = gbar
+
     def _setup_biophysics(self):
         for sec in self.all:
             sec.Ra = 150
@@ -330,6 +823,26 @@ class MSN:
                         cmd = f'segment.{prefix}{mechanism} = {density}'
                         exec(cmd)
 
+    def _setup_user_channels(self):
+        # Insert the channels registered with register_channel().
+        for name, channel in user_channels.items():
+            gbar = channel['gbar']
+            if callable(gbar) and not isinstance(gbar, DensityGradient):
+                gbar = DensityGradient(gbar, relative=False)
+            for section in self.all:
+                if not any(compartment in section.name()
+                           for compartment in channel['compartments']):
+                    continue
+                section.insert(name)
+                if not callable(gbar):
+                    for segment in section:
+                        setattr(getattr(segment, name), channel['variable'],
+                                gbar)
+            if callable(gbar):
+                for compartment in channel['compartments']:
+                    set_density_gradient(self, name, gbar, compartment,
+                                         variable=channel['variable'])
+
     def add_bg_noise(self, gaba_freq=4, glut_freq=12, dend_only=False,
                      ampa_scale_factor=None, nmda_scale_factor=None,
                      gaba_scale_factor=None, delays=[]):
@@ -449,3 +962,432 @@ class MSN:
                 netcon = line[2]
                 netcon.weight[0] = 0
             self._bg_noise = []
+
+
+class SimplifiedMSN(MSN):
+    """
+    Build a model of a MSN with a simplified morphology.
+
+    Instead of the reconstructed morphology (SWC file) used by MSN, the
+    cell here is made of a soma and a number of identical, unbranched
+    dendrites attached to it. Everything else (ion channels, their
+    distribution as a function of somatic distance, passive properties,
+    etc) is set up exactly as in MSN, so the simplified cell can be
+    used with the rest of this library (stimulation, modulation,
+    background noise) in the same way.
+
+    This is useful to study dendritic processing in isolation, e.g. the
+    effects of dendritic length on synaptic integration, or to speed up
+    simulations.
+
+    Attributes
+    ----------
+    n_dend : int
+        Number of dendrites
+    dend_length : numeric
+        Length of each dendrite in um
+    dend_diam : numeric
+        Diameter of each dendrite in um
+    soma_diam : numeric
+        Diameter (and length) of the soma in um
+
+    See also
+    --------
+    MSN
+
+    Notes
+    -----
+    The ion channel density parameters (and the cell's rheobase) in the
+    Lindroos et al data set were fitted to the reconstructed
+    morphologies. A simplified cell built with the same parameters will
+    thus not necessarily have the same excitability as the full model.
+
+    There is no axon in the simplified cell. The coupling (axial)
+    currents between compartments are calculated by NEURON from the
+    sections' geometry and axial resistance (`Ra`).
+
+    Example
+    -------
+    A dMSN with a soma and 6 dendrites, each 300 um long:
+    >>> cell = SimplifiedMSN('dmsn', 12, n_dend=6, dend_length=300)
+    """
+    def __init__(self, cell_type, cell_index, n_dend=4, dend_length=250,
+                 dend_diam=1, soma_diam=20, v_init=-80, gradients=None,
+                 gbar_nap=0):
+        """
+        Parameters
+        ----------
+        cell_type : str
+            Cell type to model, one of 'dmsn' or 'imsn'.
+        cell_index : int
+            Cell to model, from the set of iMSN and dMSN provided by
+            Lindroos et al.
+        n_dend : int, default=4
+            Number of dendrites attached to the soma.
+        dend_length : numeric, default=250
+            Length of each dendrite in um.
+        dend_diam : numeric, default=1
+            Diameter of each dendrite in um.
+        soma_diam : numeric, default=20
+            Diameter of the soma in um. The soma is modelled as a
+            cylinder with equal length and diameter.
+        v_init : numeric, default=-80
+            Initialisation membrane voltage.
+        gradients : None or dict, default=None
+            Dendritic ion channel density gradients; see MSN.
+        gbar_nap : numeric, default=0
+            Persistent sodium conductance in S/cm2; see MSN.
+        """
+        self.n_dend = n_dend
+        self.dend_length = dend_length
+        self.dend_diam = dend_diam
+        self.soma_diam = soma_diam
+        super().__init__(cell_type, cell_index, v_init=v_init,
+                         gradients=gradients, gbar_nap=gbar_nap)
+
+    def _setup_morphology(self):
+        self.soma = h.Section(name='soma', cell=self)
+        self.soma.L = self.soma_diam
+        self.soma.diam = self.soma_diam
+
+        # Dendrites are attached alternately to either end of the soma.
+        self.dend = []
+        for index in range(self.n_dend):
+            dend = h.Section(name=f'dend[{index}]', cell=self)
+            dend.L = self.dend_length
+            dend.diam = self.dend_diam
+            dend.connect(self.soma(index % 2))
+            self.dend.append(dend)
+
+        self.axon = []
+        self.all = [self.soma] + self.dend
+
+    def __repr__(self):
+        return f'SimplifiedMSN[{self.type}, {self.index}]'
+
+
+# Parameters of the reduced MSN model. From Izhikevich (2007) Dynamical
+# systems in neuroscience, MIT Press, chapter 8.
+reduced_params = {'C': 50, 'k': 1, 'vr': -80, 'vt': -25, 'vpeak': 40,
+                  'a': 0.01, 'b': -20, 'c': -55, 'd': 150}
+
+
+class ReducedMSN:
+    """
+    Build a reduced, two-variable model of a MSN.
+
+    The cell is an Izhikevich (2007) simple model neuron: the membrane
+    potential v and a recovery variable u, with a quadratic
+    current-voltage relation and a reset after each action potential
+    (see mechanisms/izhi.mod). This is much cheaper to simulate than
+    the full conductance-based model (MSN) and is thus useful for large
+    networks.
+
+    The cell has a single compartment (the soma) and the same
+    attributes as MSN that the rest of this library relies on (`soma`,
+    `all`, `dend`, `type`, `rheobase`, `v_init`), so it can be
+    stimulated (instrumentation.Stim), receive synaptic input
+    (synaptic_input), and be used in a network (network.Network).
+
+    Attributes
+    ----------
+    type : str
+        Cell type, 'imsn' or 'dmsn'
+    index : None
+        There is no cell index for reduced cells
+    params : dict
+        Parameters of the model (see `reduced_params`)
+    izh : NEURON point process
+        The point process implementing the model
+    rheobase : numeric
+        Rheobase in pA, calculated from the model parameters
+    v_init : numeric
+        Initialisation membrane voltage
+
+    See also
+    --------
+    fit.fit_reduced : Fit the parameters of the reduced model to the
+        activity of a full model.
+
+    Notes
+    -----
+    There are no ion channels in the reduced cell; dopamine and
+    acetylcholine modulation (modulation.Dopamine and Acetylcholine)
+    and background noise (add_bg_noise) are thus not available. Nor
+    are there dendrites; synaptic inputs should be placed on the soma.
+
+    Example
+    -------
+    >>> cell = ReducedMSN('dmsn')
+    >>> stim = Stim(cell)
+    >>> stim.set_stim(amplitude=0.05)
+    >>> stim.run()
+    """
+    default_params = reduced_params
+
+    def __init__(self, cell_type, params=None, v_init=-80):
+        """
+        Parameters
+        ----------
+        cell_type : str
+            Cell type, one of 'dmsn' or 'imsn'.
+        params : None or dict, default=None
+            Parameters of the model. Those not given are taken from
+            `reduced_params`; e.g. the output of fit.fit_reduced.
+        v_init : numeric, default=-80
+            Initialisation membrane voltage.
+        """
+        self.type = cell_type
+        self.index = None
+        self.params = dict(self.default_params)
+        if params is not None:
+            self.params.update(params)
+        self.v_init = v_init
+
+        # With cm = 1 uF/cm2 (0.01 pF/um2) the membrane area of the soma
+        # must be 100 * C um2 for its capacitance to be C pF.
+        self.soma = h.Section(name='soma', cell=self)
+        self.soma.L = self.soma.diam = np.sqrt(100 * self.params['C'] /
+                                               np.pi)
+        self.soma.cm = 1
+        self.izh = h.izhi(self.soma(0.5))
+        for name, value in self.params.items():
+            setattr(self.izh, name, value)
+        self.dend = []
+        self.axon = []
+        self.all = [self.soma]
+
+    @property
+    def rheobase(self):
+        # At steady state u = b (v - vr), and the minimum current for
+        # which there is no resting state (saddle-node bifurcation) is
+        # (k (vt - vr) + b)^2 / 4k. If a C < b the resting state loses
+        # stability before (Hopf bifurcation), where the trace of the
+        # Jacobian vanishes, at v = (vr + vt) / 2 + a C / 2k. The
+        # intrinsic bias current Ib (TAN) is subtracted; cells that
+        # fire spontaneously have a rheobase of 0.
+        p = self.params
+        if p['a'] * p['C'] < p['b']:
+            x = (p['vt'] - p['vr']) / 2 + p['a'] * p['C'] / (2 * p['k'])
+            current = (x * (p['b'] + p['k'] * (p['vt'] - p['vr']))
+                       - p['k'] * x**2)
+        else:
+            current = ((p['k'] * (p['vt'] - p['vr']) + p['b'])**2
+                       / (4 * p['k']))
+        return max(current - p.get('Ib', 0), 0)
+
+    def __repr__(self):
+        return f'{type(self).__name__}[{self.type}]'
+
+
+# Parameters of the fast-spiking interneurone model. From Izhikevich
+# (2007) Dynamical systems in neuroscience, MIT Press, chapter 8.
+fsi_params = {'C': 20, 'k': 1, 'vr': -55, 'vt': -40, 'vpeak': 25,
+              'a': 0.2, 'b': 0.025, 'c': -45, 'd': 0, 'vb': -55,
+              'cubic': 1}
+
+
+class FSI(ReducedMSN):
+    """
+    Build a reduced model of a striatal fast-spiking interneurone (FSI).
+
+    The cell is the Izhikevich (2007) model of fast-spiking
+    interneurones: as ReducedMSN, with a recovery variable that is only
+    activated above -55 mV (`vb`) and grows with the cube of the
+    membrane potential, so that the cell fires at high rates without
+    adaptation and starts firing at ~20 Hz (Hopf bifurcation) instead
+    of at arbitrarily low rates. The fast repolarisation of FSIs (the
+    Kv3 current) is represented by the reset, so action potentials have
+    no width; see ConductanceFSI for a model with a Kv3.1 current.
+
+    Being a ReducedMSN, a FSI has the same interface as the other
+    cells and can be mixed with MSNs in a network (network.Network,
+    with `cell_class=FSI`).
+
+    Example
+    -------
+    >>> net = Network()
+    >>> net.add_population('dmsn', 'dmsn', range(100))
+    >>> net.add_population('fsi', 'fsi', range(10), cell_class=FSI)
+    >>> net.connect('fsi', 'dmsn', probability=0.5, weight=2e-3)
+    """
+    default_params = fsi_params
+
+    def __init__(self, cell_type='fsi', params=None, v_init=-55):
+        """
+        Parameters
+        ----------
+        cell_type : str, default='fsi'
+            Cell type (label).
+        params : None or dict, default=None
+            Parameters of the model. Those not given are taken from
+            `fsi_params`.
+        v_init : numeric, default=-55
+            Initialisation membrane voltage.
+        """
+        super().__init__(cell_type, params=params, v_init=v_init)
+
+    @property
+    def rheobase(self):
+        # The resting state loses stability when the trace of the
+        # Jacobian of the model vanishes (Hopf bifurcation), at
+        # v = (vr + vt) / 2 + a C / 2k; the rheobase is the current for
+        # which this is the steady state.
+        p = self.params
+        v = (p['vr'] + p['vt']) / 2 + p['a'] * p['C'] / (2 * p['k'])
+        u = p['b'] * max(v - p['vb'], 0)**3
+        current = u - p['k'] * (v - p['vr']) * (v - p['vt'])
+        return max(current - p.get('Ib', 0), 0)
+
+
+# Parameters of the tonically active (cholinergic) interneurone model:
+# an Izhikevich (2007) simple model with a bias current `Ib` (pA) for
+# pacemaking at ~5 Hz and a slow, strong recovery variable for the long
+# afterhyperpolarisation. Chosen to reproduce these features, not
+# fitted to recordings.
+tan_params = {'C': 100, 'k': 0.7, 'vr': -60, 'vt': -45, 'vpeak': 30,
+              'a': 0.01, 'b': 2, 'c': -55, 'd': 100, 'Ib': 80}
+
+
+class TAN(ReducedMSN):
+    """
+    Build a reduced model of a striatal tonically active neurone (TAN),
+    i.e. a cholinergic interneurone.
+
+    The cell is an Izhikevich (2007) simple model neuron (as
+    ReducedMSN) that fires spontaneously at ~5 Hz, driven by an
+    intrinsic bias current (`Ib` in mechanisms/izhi.mod), and whose
+    slow recovery variable produces the long afterhyperpolarisation and
+    spike-frequency adaptation of TANs; excitation is thus followed by
+    a pause in firing. The parameters (`tan_params`) are chosen to
+    reproduce these features, not fitted to recordings.
+
+    Being a ReducedMSN, a TAN has the same interface as the other cells
+    and can be used in a network (network.Network, with
+    `cell_class=TAN`). Its firing can drive the cholinergic modulation
+    of MSNs (modulation.Muscarinic or Acetylcholine), e.g. with
+    simulation.Schedule.
+
+    Example
+    -------
+    >>> tan = TAN()
+    >>> spikes = h.Vector()
+    >>> detector = h.NetCon(tan.soma(0.5)._ref_v, None, sec=tan.soma)
+    >>> detector.record(spikes)
+    >>> h.finitialize(tan.v_init)
+    >>> h.continuerun(2000)
+    """
+    default_params = tan_params
+
+    def __init__(self, cell_type='tan', params=None, v_init=-60):
+        """
+        Parameters
+        ----------
+        cell_type : str, default='tan'
+            Cell type (label).
+        params : None or dict, default=None
+            Parameters of the model. Those not given are taken from
+            `tan_params`.
+        v_init : numeric, default=-60
+            Initialisation membrane voltage.
+        """
+        super().__init__(cell_type, params=params, v_init=v_init)
+
+
+# Maximal conductances (S/cm2) of the conductance-based fast-spiking
+# interneurone model: the fast sodium current of the MSN model
+# (mechanisms/naf.mod), the Kv3.1 current (mechanisms/kv31.mod) and the
+# leak ('pas'). Chosen so that the cell fires narrow action potentials
+# at up to ~200 Hz without adaptation, not fitted to recordings.
+fsi_conductances = {'naf': 1, 'kv31': 0.5, 'pas': 2.5e-4}
+
+
+class ConductanceFSI:
+    """
+    Build a conductance-based model of a striatal fast-spiking
+    interneurone (FSI).
+
+    The cell has a single compartment, whose area (5000 um2) stands
+    for the soma and dendrites, with the fast sodium current of the MSN
+    model (naf) and a Kv3.1 potassium current (mechanisms/kv31.mod;
+    Erisir et al 1999). The high activation threshold and fast
+    deactivation of Kv3.1 make action potentials narrow (half-width
+    ~0.8 ms) with a fast afterhyperpolarisation, so that the cell fires
+    at high rates (~50 Hz at rheobase to ~170 Hz at 1 nA) without
+    adaptation. Unlike FSI (a reduced model), action potentials have a
+    shape and the cell has ion channels, so it can be used wherever
+    spike waveforms or channel currents matter.
+
+    The cell has the same attributes as MSN that the rest of this
+    library relies on (`soma`, `all`, `dend`, `type`, `rheobase`,
+    `v_init`), so it can be stimulated (instrumentation.Stim), receive
+    synaptic input (synaptic_input), and be mixed with MSNs in a
+    network (network.Network, with `cell_class=ConductanceFSI`).
+
+    Attributes
+    ----------
+    type : str
+        Cell type (label)
+    index : None
+        There is no cell index for FSIs
+    conductances : dict
+        Maximal conductances (see `fsi_conductances`)
+    rheobase : numeric
+        Rheobase in pA, for the default conductances
+    v_init : numeric
+        Initialisation membrane voltage
+
+    Example
+    -------
+    >>> net = Network()
+    >>> net.add_population('dmsn', 'dmsn', range(10))
+    >>> net.add_population('fsi', 'fsi', [None] * 2,
+    ...                    cell_class=ConductanceFSI)
+    >>> net.connect('fsi', 'dmsn', probability=0.5, weight=2e-3)
+    """
+    # Measured with 500 ms current steps, to the nearest 10 pA.
+    rheobase = 130
+
+    def __init__(self, cell_type='fsi', cell_index=None, v_init=-70,
+                 conductances=None):
+        """
+        Parameters
+        ----------
+        cell_type : str, default='fsi'
+            Cell type (label).
+        cell_index : None, default=None
+            Ignored; for compatibility with MSN (see
+            network.Network.add_population).
+        v_init : numeric, default=-70
+            Initialisation membrane voltage.
+        conductances : None or dict, default=None
+            Maximal conductances in S/cm2. Those not given are taken
+            from `fsi_conductances`.
+        """
+        self.type = cell_type
+        self.index = None
+        self.conductances = dict(fsi_conductances)
+        if conductances is not None:
+            self.conductances.update(conductances)
+        self.v_init = v_init
+
+        self.soma = h.Section(name='soma', cell=self)
+        self.soma.L = self.soma.diam = 40
+        self.soma.cm = 1
+        self.soma.Ra = 150
+        for mechanism in ('pas', 'naf', 'kv31'):
+            self.soma.insert(mechanism)
+        segment = self.soma(0.5)
+        segment.pas.g = self.conductances['pas']
+        segment.pas.e = -70
+        segment.naf.gbar = self.conductances['naf']
+        segment.kv31.gbar = self.conductances['kv31']
+        self.soma.ena = 50
+        self.soma.ek = -85
+        h.celsius = 35
+        self.dend = []
+        self.axon = []
+        self.all = [self.soma]
+
+    def __repr__(self):
+        return f'{type(self).__name__}[{self.type}]'
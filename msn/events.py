@@ -0,0 +1,643 @@
+"""
+Event-driven simulation of large networks of point neurones.
+
+Networks of tens of thousands of cells or more are too slow to simulate
+with time steps, even with the reduced cell (cell.ReducedMSN). Here,
+synapses are instantaneous (voltage jumps), and the state of a cell is
+only updated when it receives an input: it is advanced from its last
+update with a solution of its equations without input. Action
+potentials can only occur at those times, or at times predicted from
+the same solution for cells that fire without further input.
+Simulations are deterministic (given the seeds) and their cost grows
+with the number of events rather than with the number of cells and
+time steps.
+
+Two models of the cells are available (`model` in
+EventNetwork.add_population):
+
+* 'izhikevich': the reduced model itself (cell.ReducedMSN). Its
+  equations have no closed-form solution, so their solution without
+  input is tabulated once per population, as a function of the initial
+  state (v, u) and of the elapsed time, together with the time of the
+  next action potential (see izhikevich_tables); updates are then
+  interpolated from the tables (Ros et al 2006). This keeps the
+  spike-frequency adaptation and the slow ramp to the first spike of
+  the reduced model, within the accuracy of the tables.
+* 'lif': a leaky integrate-and-fire neurone, whose membrane potential
+  between inputs has an exact solution. Its parameters are derived
+  from those of the reduced model (see lif_params): the membrane time
+  constant and input resistance at rest, and the threshold for which
+  the rheobase is the same. The approximation holds for subthreshold
+  integration and the onset of firing only, but it needs no tables.
+
+Ros E, Carrillo R, Ortigosa EM, Barbour B & Agis R (2006). Event-driven
+simulation scheme for spiking neural networks using lookup tables to
+characterize neuronal dynamics. Neural Comput 18, 2959-2993.
+
+Example
+-------
+10000 dMSNs and 10000 iMSNs with lateral inhibition and cortical input:
+>>> net = EventNetwork(seed=1)
+>>> net.add_population('dmsn', 10000, 'dmsn', model='izhikevich')
+>>> net.add_population('imsn', 10000, 'imsn', model='izhikevich')
+>>> for source in ('dmsn', 'imsn'):
+...     for target in ('dmsn', 'imsn'):
+...         net.connect(source, target, probability=0.01, weight=-0.5)
+>>> for target in ('dmsn', 'imsn'):
+...     net.add_poisson(target, rate=500, weight=1)
+>>> net.run(1000)
+>>> spikes = net.spikes()
+
+author: Antonio Gonzalez
+"""
+import heapq
+import itertools
+
+import numpy as np
+import pandas as pd
+
+from .cell import reduced_params
+from .rng import generator
+
+
+def lif_params(params=None, t_ref=2):
+    """
+    Leaky integrate-and-fire parameters equivalent to a reduced cell.
+
+    The Izhikevich model of cell.ReducedMSN is linearised at rest:
+    with the recovery variable at steady state, its conductance is
+    g = k (vt - vr) + b, its time constant C / g, and its rheobase
+    g**2 / 4k (see ReducedMSN.rheobase). The threshold of the
+    integrate-and-fire neurone is set so that its rheobase is the same.
+    In the model of fast-spiking interneurones (cell.FSI) the recovery
+    variable is not activated at rest, so that g = k (vt - vr).
+
+    Parameters
+    ----------
+    params : None or dict, default=None
+        Parameters of the reduced model; those not given are taken from
+        cell.reduced_params.
+    t_ref : numeric, default=2
+        Refractory period (ms), during which the membrane potential is
+        held at the reset potential and inputs are ignored.
+
+    Returns
+    -------
+    params : dict
+        With keys 'tau' (ms), 'R' (MOhm), 'v_rest', 'threshold',
+        'reset' (mV), 't_ref' (ms) and 'Ib' (pA), the intrinsic bias
+        current of the reduced model (cell.TAN), if any.
+    """
+    p = dict(reduced_params)
+    if params is not None:
+        p.update(params)
+    slope = 0 if p.get('cubic') and p['vr'] <= p['vb'] else p['b']
+    g = p['k'] * (p['vt'] - p['vr']) + slope  # nS
+    if g <= 0:
+        raise ValueError('the reduced model has no stable resting state')
+    return {'tau': p['C'] / g,
+            'R': 1e3 / g,
+            'v_rest': p['vr'],
+            'threshold': p['vr'] + g / (4 * p['k']),
+            'reset': p['vr'],
+            't_ref': t_ref,
+            'Ib': p.get('Ib', 0)}
+
+
+def _u_steady(p, v):
+    # Steady state of the recovery variable, U(v) in izhi.mod.
+    if p.get('cubic'):
+        return p['b'] * np.maximum(v - p['vb'], 0)**3
+    return p['b'] * (v - p['vr'])
+
+
+def izhikevich_tables(params=None, bias=0, n_v=150, n_u=150, n_t=60,
+                      horizon=500, dt=0.05):
+    """
+    Tabulate the solution of the reduced model without input.
+
+    The equations of cell.ReducedMSN (see mechanisms/izhi.mod) are
+    integrated (midpoint method) from every point of a grid of initial
+    states (v, u), and the state is stored at a set of elapsed times,
+    spaced geometrically up to `horizon` so that short intervals are
+    resolved finely. The time of the first action potential (v reaching
+    vpeak) is also stored; the state of trajectories that fire is held
+    at its value at that time (v = vpeak) afterwards.
+
+    Parameters
+    ----------
+    params : None or dict, default=None
+        Parameters of the reduced model; those not given are taken from
+        cell.reduced_params. For interneurones, e.g. cell.fsi_params
+        or cell.tan_params.
+    bias : numeric, default=0
+        Constant current (pA) injected in the cell.
+    n_v, n_u : int, default=150
+        Number of points of the grids of v and u.
+    n_t : int, default=60
+        Number of elapsed times.
+    horizon : numeric, default=500
+        Longest elapsed time (ms). Longer intervals are advanced in
+        several steps; action potentials later than this after the last
+        input are not predicted.
+    dt : numeric, default=0.05
+        Integration time step (ms).
+
+    Returns
+    -------
+    tables : dict
+        With keys 'v', 'u' (grids), 't' (elapsed times), 'v_t' and
+        'u_t' (state after each elapsed time, shape (n_v, n_u, n_t)),
+        't_spike' (time to the next action potential, inf if none
+        within `horizon`) and 'params'.
+    """
+    p = dict(reduced_params)
+    if params is not None:
+        p.update(params)
+    v_grid = np.linspace(min(p['vr'], p['c']) - 40, p['vpeak'], n_v)
+    u_rest = _u_steady(p, v_grid[[0, -1]])
+    u_grid = np.linspace(u_rest.min() - abs(p['d']),
+                         u_rest.max() + 4 * abs(p['d']), n_u)
+    # Injected and intrinsic (cell.TAN) bias currents.
+    current = bias + p.get('Ib', 0)
+    steps = np.unique(np.round(
+        np.geomspace(dt, horizon, n_t) / dt).astype(int))
+    t_grid = np.concatenate([[0], steps * dt])
+
+    def derivatives(v, u):
+        dv = p['k'] * (v - p['vr']) * (v - p['vt']) - u + current
+        du = p['a'] * (_u_steady(p, v) - u)
+        return dv / p['C'], du
+
+    v, u = (x.ravel() for x in np.meshgrid(v_grid, u_grid,
+                                           indexing='ij'))
+    v_t = np.empty((v.size, t_grid.size), dtype=np.float32)
+    u_t = np.empty_like(v_t)
+    v_t[:, 0], u_t[:, 0] = v, u
+    t_spike = np.full(v.size, np.inf)
+    u_spike = u.copy()
+    running = np.ones(v.size, dtype=bool)
+    column = 1
+    for step in range(1, steps[-1] + 1):
+        dv, du = derivatives(v, u)
+        dv, du = derivatives(v + dv * dt / 2, u + du * dt / 2)
+        v_new = v + dv * dt
+        u_new = u + du * dt
+        # First crossing of vpeak, interpolated within the step.
+        crossing = running & (v_new >= p['vpeak'])
+        fraction = (p['vpeak'] - v[crossing]) / (v_new[crossing]
+                                                 - v[crossing])
+        t_spike[crossing] = (step - 1 + fraction) * dt
+        u_spike[crossing] = u[crossing] + fraction * (u_new[crossing]
+                                                      - u[crossing])
+        running &= ~crossing
+        v = np.where(running, v_new, p['vpeak'])
+        u = np.where(running, u_new, u_spike)
+        if step == steps[column - 1]:
+            v_t[:, column], u_t[:, column] = v, u
+            column += 1
+    # Points already at vpeak fire at once.
+    at_peak = v_t[:, 0] >= p['vpeak']
+    t_spike[at_peak] = 0
+    shape = (n_v, n_u)
+    return {'v': v_grid, 'u': u_grid, 't': t_grid,
+            'v_t': v_t.reshape(shape + (-1,)),
+            'u_t': u_t.reshape(shape + (-1,)),
+            't_spike': t_spike.reshape(shape), 'params': p}
+
+
+def _grid_position(grid, x):
+    # Index of the grid interval containing each x (clipped to the grid)
+    # and the fractional position within it.
+    x = np.clip(x, grid[0], grid[-1])
+    index = np.clip(np.searchsorted(grid, x, side='right') - 1, 0,
+                    grid.size - 2)
+    return index, (x - grid[index]) / (grid[index + 1] - grid[index])
+
+
+class _Population:
+    # State of a population: membrane potential of each cell at the
+    # time of its last update, and the time until which it is
+    # refractory. Subclasses implement the model of the cells.
+
+    def __init__(self, name, n, cell_type, params, bias, v_rest,
+                 threshold):
+        self.name = name
+        self.n = n
+        self.cell_type = cell_type
+        self.params = params
+        self.threshold = threshold
+        self.bias = np.zeros(n) + bias
+        self.v = np.full(n, float(v_rest))
+        self.t_last = np.zeros(n)
+        self.refractory = np.full(n, -np.inf)
+        # Number of updates of each cell, to discard predicted spikes
+        # that are no longer valid.
+        self.version = np.zeros(n, dtype=int)
+        self.projections = []
+        self.spike_times = []
+        self.spike_cells = []
+
+
+class _LIFPopulation(_Population):
+    # Integrate-and-fire cells.
+
+    def __init__(self, name, n, cell_type, params, bias):
+        super().__init__(name, n, cell_type, params, bias,
+                         params['v_rest'], params['threshold'])
+        self.v_inf = params['v_rest'] + params['R'] * (
+            self.bias + params['Ib']) * 1e-3
+
+    def advance(self, cells, time):
+        # Exact solution of the membrane equation without input.
+        decay = np.exp(-(time - self.t_last[cells]) / self.params['tau'])
+        v_inf = self.v_inf[cells]
+        self.v[cells] = v_inf + (self.v[cells] - v_inf) * decay
+        self.t_last[cells] = time
+
+    def fire(self, cells, time):
+        # The membrane potential is held at reset during the refractory
+        # period, and evolves from there afterwards.
+        self.v[cells] = self.params['reset']
+        self.refractory[cells] = time + self.params['t_ref']
+        self.t_last[cells] = time + self.params['t_ref']
+
+    def spike_delay(self, cells):
+        # Time from the last update at which each cell reaches threshold
+        # without further input (inf for cells not driven above
+        # threshold by their bias).
+        delay = np.full(cells.size, np.inf)
+        v_inf = self.v_inf[cells]
+        above = v_inf > self.threshold
+        delay[above] = np.maximum(self.params['tau'] * np.log(
+            (v_inf[above] - self.v[cells[above]])
+            / (v_inf[above] - self.threshold)), 0)
+        return delay
+
+
+class _IzhikevichPopulation(_Population):
+    # State of a population of reduced (Izhikevich) cells, advanced with
+    # the tables of izhikevich_tables.
+
+    def __init__(self, name, n, cell_type, params, bias, t_ref,
+                 resolution):
+        if np.ndim(bias) > 0 and np.ptp(bias) > 0:
+            raise ValueError('the bias of an Izhikevich population must '
+                             'be the same for all cells')
+        self.tables = izhikevich_tables(params, float(np.max(bias)),
+                                        **(resolution or {}))
+        p = dict(self.tables['params'], t_ref=t_ref)
+        super().__init__(name, n, cell_type, p, bias, p['vr'],
+                         p['vpeak'])
+        # Initial state as in izhi.mod, with v = vr.
+        self.u = np.full(n, float(_u_steady(p, p['vr'])))
+
+    def _lookup(self, cells, elapsed):
+        tables = self.tables
+        i, fi = _grid_position(tables['v'], self.v[cells])
+        j, fj = _grid_position(tables['u'], self.u[cells])
+        k, fk = _grid_position(tables['t'], elapsed)
+        v = np.zeros(cells.size)
+        u = np.zeros(cells.size)
+        for di, wi in ((0, 1 - fi), (1, fi)):
+            for dj, wj in ((0, 1 - fj), (1, fj)):
+                for dk, wk in ((0, 1 - fk), (1, fk)):
+                    weight = wi * wj * wk
+                    v += weight * tables['v_t'][i + di, j + dj, k + dk]
+                    u += weight * tables['u_t'][i + di, j + dj, k + dk]
+        return v, u
+
+    def advance(self, cells, time):
+        # Intervals longer than the tables are advanced in steps.
+        horizon = self.tables['t'][-1]
+        self.t_last[cells], elapsed = time, time - self.t_last[cells]
+        while cells.size:
+            step = np.minimum(elapsed, horizon)
+            self.v[cells], self.u[cells] = self._lookup(cells, step)
+            elapsed = elapsed - step
+            cells, elapsed = cells[elapsed > 0], elapsed[elapsed > 0]
+
+    def fire(self, cells, time):
+        # At a predicted action potential, advance() has already set u
+        # to its value at vpeak (see izhikevich_tables).
+        self.v[cells] = self.params['c']
+        self.u[cells] += self.params['d']
+        self.refractory[cells] = time + self.params['t_ref']
+        self.t_last[cells] = time + self.params['t_ref']
+
+    def spike_delay(self, cells):
+        tables = self.tables
+        i, fi = _grid_position(tables['v'], self.v[cells])
+        j, fj = _grid_position(tables['u'], self.u[cells])
+        # Interpolate only between corners that fire; if any does not,
+        # the nearest corner decides.
+        corners = np.stack([tables['t_spike'][i + di, j + dj]
+                            for di in (0, 1) for dj in (0, 1)])
+        weights = np.stack([wi * wj for wi in (1 - fi, fi)
+                            for wj in (1 - fj, fj)])
+        delay = np.sum(np.where(np.isfinite(corners), corners, 0)
+                       * weights, axis=0)
+        nearest = corners[np.argmax(weights, axis=0),
+                          np.arange(cells.size)]
+        return np.where(np.isfinite(corners).all(axis=0), delay, nearest)
+
+
+class EventNetwork:
+    """
+    An event-driven network of reduced or integrate-and-fire neurones.
+
+    Attributes
+    ----------
+    populations : dict
+        Parameters of each population, as {name: dict}; see
+        lif_params() and izhikevich_tables().
+    t : float
+        Time (ms) up to which the network has been simulated.
+
+    Methods
+    -------
+    add_population(name, n, cell_type='dmsn', params=None, bias=0,
+                   t_ref=None, model='lif', resolution=None)
+        Add a population of cells
+    connect(source, target, probability, weight, delay=1,
+            topology=None, seed=None)
+        Connect two populations
+    add_poisson(target, rate, weight, seed=None)
+        Independent Poisson input to every cell of a population
+    run(tstop)
+        Run (or continue) the simulation
+    spikes(population=None)
+        Spike times
+    """
+
+    def __init__(self, seed=None):
+        """
+        Parameters
+        ----------
+        seed : None, int or numpy.random.Generator, default=None
+            Seed for the random numbers of connections and inputs
+            that are not given their own; see rng.generator.
+        """
+        self._rng = generator(seed)
+        self._populations = {}
+        self._inputs = []
+        self._events = []
+        self._sequence = itertools.count()
+        self._started = False
+        self.t = 0.
+
+    @property
+    def populations(self):
+        return {name: dict(population.params)
+                for name, population in self._populations.items()}
+
+    def add_population(self, name, n, cell_type='dmsn', params=None,
+                       bias=0, t_ref=None, model='lif', resolution=None):
+        """
+        Add a population of cells.
+
+        Parameters
+        ----------
+        name : str
+            Name of the population.
+        n : int
+            Number of cells.
+        cell_type : str, default='dmsn'
+            Cell type; only used to label the population, as the reduced
+            model has the same parameters for both types unless given.
+        params : None or dict, default=None
+            Parameters of the reduced model (see cell.reduced_params),
+            e.g. the output of fit.fit_reduced, or cell.fsi_params or
+            cell.tan_params for interneurones.
+        bias : numeric or array_like, default=0
+            Constant current (pA) injected in each cell. It must be the
+            same for all cells of an 'izhikevich' population.
+        t_ref : None or numeric, default=None
+            Refractory period (ms). If None, 2 ms for 'lif' and 0 for
+            'izhikevich' (whose reset already limits the firing rate).
+        model : {'lif', 'izhikevich'}, default='lif'
+            Model of the cells; see the module documentation.
+        resolution : None or dict, default=None
+            Resolution of the tables of an 'izhikevich' population,
+            e.g. {'n_v': 300, 'horizon': 1000}; see izhikevich_tables.
+        """
+        if name in self._populations:
+            raise ValueError(f'Population {name} already exists.')
+        if model == 'lif':
+            population = _LIFPopulation(
+                name, n, cell_type,
+                lif_params(params, 2 if t_ref is None else t_ref), bias)
+        elif model == 'izhikevich':
+            population = _IzhikevichPopulation(
+                name, n, cell_type, params, bias,
+                0 if t_ref is None else t_ref, resolution)
+        else:
+            raise ValueError("`model` must be 'lif' or 'izhikevich'")
+        self._populations[name] = population
+
+    def connect(self, source, target, probability, weight, delay=1,
+                topology=None, seed=None):
+        """
+        Connect two populations.
+
+        Parameters
+        ----------
+        source, target : str
+            Names of the source and target populations.
+        probability : None or float, range [0, 1]
+            Connection probability (cells do not connect to
+            themselves). Ignored if `topology` is given.
+        weight : numeric
+            Jump of the membrane potential of the target cell (mV) for
+            each action potential of the source cell; negative for
+            inhibition.
+        delay : numeric, default=1
+            Connection delay (ms); it must be positive.
+        topology : None or network.Topology, default=None
+            Connections to make.
+        seed : None, int or numpy.random.Generator, default=None
+            See rng.generator. If None, the network's generator.
+
+        Returns
+        -------
+        n : int
+            Number of connections made.
+        """
+        if delay <= 0:
+            raise ValueError('the delay must be positive')
+        sources = self._populations[source]
+        targets = self._populations[target]
+        rng = self._rng if seed is None else generator(seed)
+        if topology is None:
+            # Sample the targets of each source directly, without an
+            # adjacency matrix, which would not fit in memory for large
+            # populations.
+            pairs = []
+            for index in range(sources.n):
+                n = rng.binomial(targets.n, probability)
+                chosen = rng.choice(targets.n, n, replace=False)
+                if source == target:
+                    chosen = chosen[chosen != index]
+                pairs.append(np.column_stack(
+                    [np.full(len(chosen), index), chosen]))
+            pairs = np.concatenate(pairs) if pairs else np.empty((0, 2))
+        else:
+            if topology.shape != (sources.n, targets.n):
+                raise ValueError(f'The topology {topology.shape} does not '
+                                 'match the sizes of the populations')
+            pairs = topology.pairs.values
+        pairs = np.asarray(pairs, dtype=int)
+        # Targets of each source cell, in compressed sparse row format.
+        order = np.argsort(pairs[:, 0], kind='stable')
+        pointers = np.searchsorted(pairs[order, 0],
+                                   np.arange(sources.n + 1))
+        sources.projections.append({
+            'target': targets, 'weight': weight, 'delay': delay,
+            'pointers': pointers, 'targets': pairs[order, 1]})
+        return len(pairs)
+
+    def add_poisson(self, target, rate, weight, seed=None):
+        """
+        Independent Poisson input to every cell of a population.
+
+        Parameters
+        ----------
+        target : str
+            Name of the population.
+        rate : numeric
+            Rate of input events to each cell (Hz), e.g. the number of
+            inputs times their rate.
+        weight : numeric
+            Jump of the membrane potential (mV) for each input event.
+        seed : None, int or numpy.random.Generator, default=None
+            See rng.generator. If None, the network's generator.
+        """
+        if self._started:
+            raise RuntimeError('inputs must be added before running')
+        rng = self._rng if seed is None else generator(seed)
+        self._inputs.append({'target': self._populations[target],
+                             'rate': rate, 'weight': weight, 'rng': rng})
+
+    def _push(self, time, kind, *data):
+        heapq.heappush(self._events,
+                       (time, next(self._sequence), kind, data))
+
+    def _update(self, population, cells, time, weight):
+        # Advance `cells` to `time`, add the input and handle spikes.
+        active = time >= population.refractory[cells]
+        cells = cells[active]
+        if cells.size == 0:
+            return
+        population.advance(cells, time)
+        population.v[cells] += weight
+        population.version[cells] += 1
+        spiking = population.v[cells] >= population.threshold
+        if spiking.any():
+            self._spike(population, cells[spiking], time)
+        self._predict(population, cells)
+
+    def _spike(self, population, cells, time):
+        population.spike_times.append(np.full(cells.size, time))
+        population.spike_cells.append(cells)
+        population.fire(cells, time)
+        for number, projection in enumerate(population.projections):
+            for cell in cells:
+                self._push(time + projection['delay'], 'deliver',
+                           population, number, cell)
+
+    def _predict(self, population, cells):
+        # Time at which each cell fires without further input, for
+        # cells that do.
+        delays = population.spike_delay(cells)
+        for cell, delay in zip(cells, delays):
+            if np.isfinite(delay):
+                self._push(population.t_last[cell] + delay, 'threshold',
+                           population, cell, population.version[cell])
+
+    def _next_input(self, number, cell, time):
+        source = self._inputs[number]
+        interval = source['rng'].exponential(1e3 / source['rate'])
+        self._push(time + interval, 'input', number, cell)
+
+    def _start(self):
+        self._started = True
+        for population in self._populations.values():
+            self._predict(population, np.arange(population.n))
+        for number, source in enumerate(self._inputs):
+            if source['rate'] > 0:
+                for cell in range(source['target'].n):
+                    self._next_input(number, cell, 0)
+
+    def run(self, tstop):
+        """
+        Run the simulation until `tstop` (ms).
+
+        Calling run() again continues the simulation from where it
+        stopped.
+
+        Returns
+        -------
+        n_events : int
+            Number of events processed.
+        """
+        if not self._started:
+            self._start()
+        n_events = 0
+        while self._events and self._events[0][0] <= tstop:
+            time, __, kind, data = heapq.heappop(self._events)
+            n_events += 1
+            if kind == 'deliver':
+                population, number, cell = data
+                projection = population.projections[number]
+                targets = projection['targets'][
+                    projection['pointers'][cell]:
+                    projection['pointers'][cell + 1]]
+                self._update(projection['target'], targets, time,
+                             projection['weight'])
+            elif kind == 'input':
+                number, cell = data
+                source = self._inputs[number]
+                self._update(source['target'], np.array([cell]), time,
+                             source['weight'])
+                self._next_input(number, cell, time)
+            elif kind == 'threshold':
+                population, cell, version = data
+                if population.version[cell] == version:
+                    # No input since the prediction: the cell fires.
+                    cells = np.array([cell])
+                    population.advance(cells, time)
+                    population.version[cells] += 1
+                    self._spike(population, cells, time)
+                    self._predict(population, cells)
+        self.t = tstop
+        return n_events
+
+    def spikes(self, population=None):
+        """
+        Spike times.
+
+        Parameters
+        ----------
+        population : None or str, default=None
+            Population name. If None, spikes from all populations.
+
+        Returns
+        -------
+        spikes : pandas dataframe
+            One row per spike with columns [population, cell, time],
+            as network.Network.spikes(), sorted by time.
+        """
+        names = list(self._populations) if population is None else [
+            population]
+        frames = []
+        for name in names:
+            population = self._populations[name]
+            if population.spike_times:
+                times = np.concatenate(population.spike_times)
+                cells = np.concatenate(population.spike_cells)
+            else:
+                times, cells = np.empty(0), np.empty(0, dtype=int)
+            frames.append(pd.DataFrame({'population': name, 'cell': cells,
+                                        'time': times}))
+        return pd.concat(frames, ignore_index=True).sort_values(
+            'time', kind='stable', ignore_index=True)
@@ -0,0 +1,889 @@
+"""
+Export models and simulation results to other formats.
+
+author: Antonio Gonzalez
+"""
+import json
+import xml.etree.ElementTree as ET
+from pathlib import Path
+from xml.dom import minidom
+
+import numpy as np
+import pandas as pd
+from neuron import h
+
+from .cell import MSN, ReducedMSN, SimplifiedMSN
+from .meta import capture
+
+# np.trapz was renamed np.trapezoid in numpy 2.0.
+_trapezoid = getattr(np, 'trapezoid', None) or np.trapz
+
+# NeuroML2 namespace and schema.
+NEUROML_NS = 'http://www.neuroml.org/schema/neuroml2'
+NEUROML_SCHEMA = ('https://raw.githubusercontent.com/NeuralEnsemble/'
+                  'NeuroML2/master/Schemas/NeuroML2/NeuroML_v2.2.xsd')
+
+# Ion carried by each mechanism in the model, and the name of the
+# section attribute holding its reversal potential. Calcium
+# mechanisms have no reversal potential: their currents are calculated
+# with the GHK equation. L- and T-type channels carry 'cal', a calcium
+# pool separate from 'ca' (see caldyn.mod).
+ions = {
+    'naf': ('na', 'ena'),
+    'nap': ('na', 'ena'),
+    'kaf': ('k', 'ek'),
+    'kas': ('k', 'ek'),
+    'kdr': ('k', 'ek'),
+    'kir': ('k', 'ek'),
+    'kv31': ('k', 'ek'),
+    'sk': ('k', 'ek'),
+    'bk': ('k', 'ek'),
+    'Im': ('k', 'ek'),
+    'cal12': ('cal', None),
+    'cal13': ('cal', None),
+    'can': ('ca', None),
+    'car': ('ca', None),
+    'cav32': ('cal', None),
+    'cav33': ('cal', None)}
+
+
+def _section_id(section):
+    # Remove the cell prefix (if any) from the section name and make the
+    # name a valid NeuroML id, e.g. 'dend[12]' -> 'dend_12'.
+    name = section.name().split('.')[-1]
+    return name.replace('[', '_').replace(']', '')
+
+
+def _add_morphology(parent, cell):
+    morphology = ET.SubElement(parent, 'morphology', id='morphology')
+
+    # Make sure all sections have 3D points (cells created with
+    # SimplifiedMSN have no 3D information until this is done).
+    h.define_shape()
+
+    # One NeuroML segment per NEURON section, from its first to its last
+    # 3D point.
+    sections = list(cell.all)
+    index = {section: n for n, section in enumerate(sections)}
+    for n, section in enumerate(sections):
+        segment = ET.SubElement(morphology, 'segment', id=str(n),
+                                name=_section_id(section))
+        parent_seg = section.parentseg()
+        if parent_seg is not None:
+            ET.SubElement(segment, 'parent',
+                          segment=str(index[parent_seg.sec]),
+                          fractionAlong=str(parent_seg.x))
+        last = section.n3d() - 1
+        for tag, i in (('proximal', 0), ('distal', last)):
+            ET.SubElement(segment, tag,
+                          x=str(section.x3d(i)),
+                          y=str(section.y3d(i)),
+                          z=str(section.z3d(i)),
+                          diameter=str(section.diam3d(i)))
+
+    # Segment groups: one per section (used to set channel densities)
+    # plus the standard 'soma_group', 'dendrite_group' and
+    # 'axon_group'.
+    for n, section in enumerate(sections):
+        group = ET.SubElement(morphology, 'segmentGroup',
+                              id=_section_id(section))
+        ET.SubElement(group, 'member', segment=str(n))
+    for compartment in ('soma', 'dend', 'axon'):
+        members = [n for n, section in enumerate(sections)
+                   if compartment in section.name()]
+        if len(members) == 0:
+            continue
+        name = {'soma': 'soma_group', 'dend': 'dendrite_group',
+                'axon': 'axon_group'}[compartment]
+        group = ET.SubElement(morphology, 'segmentGroup', id=name)
+        for n in members:
+            ET.SubElement(group, 'member', segment=str(n))
+    return morphology
+
+
+def _add_biophysics(parent, cell):
+    biophysics = ET.SubElement(parent, 'biophysicalProperties',
+                               id='biophysics')
+    membrane = ET.SubElement(biophysics, 'membraneProperties')
+
+    # Channel densities in the model vary with somatic distance. Here
+    # the mean density in each section is used.
+    mechanisms = set()
+    for section in cell.all:
+        group = _section_id(section)
+        for mech in section.psection()['density_mechs']:
+            if mech == 'pas':
+                value = sum(seg.pas.g for seg in section) / section.nseg
+                ET.SubElement(membrane, 'channelDensity',
+                              id=f'pas_{group}', ionChannel='pas',
+                              condDensity=f'{value} S_per_cm2',
+                              erev=f'{section(0.5).pas.e}mV',
+                              ion='non_specific', segmentGroup=group)
+                mechanisms.add(mech)
+            elif mech in ions:
+                ion, erev = ions[mech]
+                if ion in ('ca', 'cal'):
+                    value = sum(getattr(seg, mech).pbar
+                                for seg in section) / section.nseg
+                    ET.SubElement(membrane, 'channelDensityGHK',
+                                  id=f'{mech}_{group}', ionChannel=mech,
+                                  permeability=f'{value} cm_per_s',
+                                  ion=ion, segmentGroup=group)
+                else:
+                    value = sum(getattr(seg, mech).gbar
+                                for seg in section) / section.nseg
+                    ET.SubElement(membrane, 'channelDensity',
+                                  id=f'{mech}_{group}', ionChannel=mech,
+                                  condDensity=f'{value} S_per_cm2',
+                                  erev=f'{getattr(section, erev)}mV',
+                                  ion=ion, segmentGroup=group)
+                mechanisms.add(mech)
+
+    ET.SubElement(membrane, 'spikeThresh', value='0mV')
+    ET.SubElement(membrane, 'specificCapacitance',
+                  value=f'{cell.soma.cm} uF_per_cm2')
+    ET.SubElement(membrane, 'initMembPotential', value=f'{cell.v_init}mV')
+    intracellular = ET.SubElement(biophysics, 'intracellularProperties')
+    ET.SubElement(intracellular, 'resistivity',
+                  value=f'{cell.soma.Ra} ohm_cm')
+    return mechanisms
+
+
+def _add_synapses(parent):
+    # Synaptic mechanisms defined in gaba.mod and glutamate.mod. The
+    # time constants in those files are divided by the temperature
+    # factor `q` in the mod files. Base conductances are those quoted in
+    # Section 2.6 in Lindroos and Hellgren Kotaleski (2020). A
+    # temporary section is created to read the synaptic parameters.
+    section = h.Section(name='export_tmp')
+    gaba = h.gaba(0.5, sec=section)
+    glut = h.glutamate(0.5, sec=section)
+    ET.SubElement(parent, 'expTwoSynapse', id='gaba', gbase='0.9nS',
+                  erev=f'{gaba.erev}mV',
+                  tauRise=f'{gaba.tau1 / gaba.q}ms',
+                  tauDecay=f'{gaba.tau2 / gaba.q}ms')
+    ET.SubElement(parent, 'expTwoSynapse', id='ampa', gbase='0.3nS',
+                  erev=f'{glut.erev}mV',
+                  tauRise=f'{glut.tau1_ampa / glut.q}ms',
+                  tauDecay=f'{glut.tau2_ampa / glut.q}ms')
+    nmda = ET.SubElement(parent, 'blockingPlasticSynapse', id='nmda',
+                         gbase='0.3nS', erev=f'{glut.erev}mV',
+                         tauRise=f'{glut.tau1_nmda / glut.q}ms',
+                         tauDecay=f'{glut.tau2_nmda / glut.q}ms')
+    ET.SubElement(nmda, 'blockMechanism',
+                  type='voltageConcDepBlockMechanism', species='mg',
+                  blockConcentration=f'{glut.mg}mM',
+                  scalingConc=f'{glut.beta}mM',
+                  scalingVolt=f'{1 / glut.alpha}mV')
+
+
+def to_neuroml(cell, path):
+    """
+    Export a model cell to a NeuroML2 file.
+
+    The file includes the cell's morphology, the density of each ion
+    channel in every section, passive properties, and the definitions of
+    the synapses (GABA, AMPA and NMDA) used in the model.
+
+    Parameters
+    ----------
+    cell : object
+        The model cell to export, e.g. an instance of cell.MSN.
+    path : str or Path
+        Output file name. By convention, NeuroML2 files have the
+        extension '.cell.nml' or '.nml'.
+
+    Notes
+    -----
+    The ion channel kinetics are defined in the NEURON mechanisms
+    (mechanisms/*.mod) and are not converted here. Instead, the exported
+    file includes references to one file per channel named
+    '<mechanism>.channel.nml' (e.g. 'naf.channel.nml'), which must be
+    provided separately to simulate the exported cell with e.g.
+    jNeuroML.
+
+    Channel densities in the MSN model change with somatic distance
+    within each section. In the exported file each section is one
+    segment with uniform channel density, equal to the mean density in
+    that section. Likewise, the modulation factors (dopamine and
+    acetylcholine) and calcium dynamics (cadyn, caldyn) are not
+    exported. The provenance of the file (see meta.capture) is saved as
+    JSON in the document's notes.
+
+    Example
+    -------
+    >>> cell = MSN('dmsn', 12)
+    >>> to_neuroml(cell, 'dmsn_12.cell.nml')
+    """
+    cell_id = f'{cell.type}_{cell.index}'
+    root = ET.Element('neuroml', {
+        'xmlns': NEUROML_NS,
+        'xmlns:xsi': 'http://www.w3.org/2001/XMLSchema-instance',
+        'xsi:schemaLocation': f'{NEUROML_NS} {NEUROML_SCHEMA}',
+        'id': cell_id})
+
+    _add_synapses(root)
+    nml_cell = ET.SubElement(root, 'cell', id=cell_id)
+    _add_morphology(nml_cell, cell)
+    mechanisms = _add_biophysics(nml_cell, cell)
+
+    # Include the channel files for the mechanisms used. The NeuroML
+    # schema requires these to go first.
+    for n, mech in enumerate(sorted(mechanisms)):
+        include = ET.Element('include', href=f'{mech}.channel.nml')
+        root.insert(n, include)
+    # Provenance (see meta.capture), which must go before everything
+    # else.
+    notes = ET.Element('notes')
+    notes.text = json.dumps(capture(cell=cell))
+    root.insert(0, notes)
+
+    xml = minidom.parseString(ET.tostring(root))
+    with open(path, 'wb') as file:
+        file.write(xml.toprettyxml(indent='  ', encoding='UTF-8'))
+
+
+def to_hdf5(path, traces, metadata=None, compression='gzip',
+            events=None):
+    """
+    Save recorded traces to an HDF5 file.
+
+    Each trace is stored as a separate chunked and compressed dataset,
+    which keeps files small and allows reading parts of long recordings
+    without loading them completely into memory.
+
+    Parameters
+    ----------
+    path : str or Path
+        Output file name.
+    traces : dict
+        Recorded traces, as {name: values}, where values are NEURON
+        vectors or arrays, e.g. {'t': stim.t, 'v': stim.v}.
+    metadata : None or dict, default=None
+        Run-level information (e.g. cell type, cell index, stimulus
+        parameters) saved as attributes of the file. Values must be
+        numbers, strings or arrays.
+    compression : None or str, default='gzip'
+        Compression filter; see h5py's documentation.
+    events : None or pandas dataframe, default=None
+        Events with columns [time, kind, source, label], as returned by
+        instrumentation.Recorder.events. They are saved in the group
+        'events', one dataset per column.
+
+    Notes
+    -----
+    The provenance of the run (see meta.capture; with `metadata` as
+    parameters) is saved as JSON in the attribute 'provenance'.
+
+    Requires the Python package [h5py](https://www.h5py.org/).
+
+    Example
+    -------
+    >>> stim.run()
+    >>> to_hdf5('run.h5', {'t': stim.t, 'v': stim.v},
+    ...         metadata={'cell_type': cell.type,
+    ...                   'cell_index': cell.index})
+    """
+    import h5py
+
+    with h5py.File(path, 'w') as file:
+        for name, values in traces.items():
+            if hasattr(values, 'as_numpy'):
+                values = values.as_numpy()
+            file.create_dataset(name, data=values, chunks=True,
+                                compression=compression)
+        if metadata is not None:
+            for key, value in metadata.items():
+                file.attrs[key] = value
+        file.attrs['provenance'] = json.dumps(capture(params=metadata))
+        if events is not None:
+            group = file.create_group('events')
+            group.create_dataset('time', data=events.time.values)
+            for column in ['kind', 'source', 'label']:
+                group.create_dataset(
+                    column, data=events[column].astype(str).values,
+                    dtype=h5py.string_dtype())
+
+
+def _feature_values(features):
+    # {name: array of values} from APFeatures, a dataframe (one column
+    # per feature) or a dict.
+    if hasattr(features, 'features'):
+        features = features.features
+    if isinstance(features, pd.DataFrame):
+        features = {name: features[name].values for name in features
+                    if name != 'peak_time'}
+    return {name: np.atleast_1d(np.asarray(values, dtype=float))
+            for name, values in features.items()}
+
+
+def to_efel_json(path, protocols, location='soma', min_std=0.05,
+                 min_abs_std=1e-3):
+    """
+    Save features in the eFEL/BluePyOpt JSON format.
+
+    The file has the layout of the feature files used by BluePyOpt
+    (e.g. in its L5PC example), {protocol: {location: {feature: [mean,
+    std]}}}, so that features extracted from the model can be used as
+    targets in existing optimisation and validation pipelines, or
+    compared with experimental features in the same format.
+
+    Parameters
+    ----------
+    path : str or Path
+        Output file name.
+    protocols : dict
+        Features for each protocol (e.g. each current step), as
+        {protocol: features}, where features is an analysis.APFeatures
+        object, a dataframe with one column per feature (one row per
+        action potential or per trial), or a dict {feature: value(s)}.
+        Feature names should be eFEL feature names (e.g.
+        'mean_frequency').
+    location : str, default='soma'
+        Recording location, e.g. 'soma' or 'soma.v'.
+    min_std : numeric, default=0.05
+        Minimum standard deviation, as a fraction of the absolute mean.
+        BluePyOpt scores features in units of standard deviation, which
+        therefore must not be 0 (e.g. for single values).
+    min_abs_std : numeric, default=1e-3
+        Minimum standard deviation, in the units of each feature, for
+        features whose mean is (close to) 0, e.g. a number of action
+        potentials of 0.
+
+    Returns
+    -------
+    features : dict
+        The contents of the file.
+
+    Example
+    -------
+    >>> features = {}
+    >>> for amplitude in [0.3, 0.4]:
+    ...     stim.set_stim(delay=50, duration=500, amplitude=amplitude,
+    ...                   tmax=550, add_rheob=False)
+    ...     stim.run()
+    ...     ap = APFeatures(stim.t, stim.v, stim_start=50)
+    ...     features[f'step_{amplitude}'] = ap
+    >>> to_efel_json('features.json', features)
+    """
+    contents = {}
+    for protocol, features in protocols.items():
+        values = _feature_values(features)
+        entries = {}
+        for name, value in values.items():
+            value = value[np.isfinite(value)]
+            if value.size == 0:
+                continue
+            mean = float(value.mean())
+            std = max(float(value.std()), abs(mean) * min_std,
+                      min_abs_std)
+            entries[name] = [mean, std]
+        contents[str(protocol)] = {location: entries}
+    with open(path, 'w') as file:
+        json.dump(contents, file, indent=4)
+    return contents
+
+
+def _nwb_timing(t):
+    # Sampling rate (Hz) and start time (s) of a uniformly sampled
+    # trace, or its timestamps (s) if the sampling interval varies
+    # (variable time step integration).
+    t = np.asarray(t, dtype=float) * 1e-3
+    intervals = np.diff(t)
+    if intervals.size and np.allclose(intervals, intervals[0],
+                                      rtol=1e-6, atol=0):
+        return {'rate': 1 / intervals[0], 'starting_time': t[0]}
+    return {'timestamps': t}
+
+
+def to_nwb(path, sweeps, clamp='current', description='', cell=None,
+           metadata=None, identifier=None):
+    """
+    Save recorded traces to a Neurodata Without Borders (NWB) file.
+
+    Sweeps are saved as intracellular electrophysiology series, as in
+    patch-clamp recordings: in current clamp, the membrane potential is
+    the response (acquisition) and the injected current the stimulus;
+    in voltage clamp, the other way around. Simulation output can thus
+    be read by the same analysis tools as experimental data.
+
+    Parameters
+    ----------
+    path : str or Path
+        Output file name, usually with extension '.nwb'.
+    sweeps : dict or list of dict
+        Recorded traces, one dict per sweep with keys 't' (ms), 'v'
+        (mV) and, optionally, 'i' (nA); values are NEURON vectors or
+        arrays, e.g. {'t': stim.t, 'v': stim.v}.
+    clamp : {'current', 'voltage'}, default='current'
+        Recording mode.
+    description : str, default=''
+        Session description.
+    cell : None or object, default=None
+        The model cell, e.g. cell.MSN; its type and index are saved as
+        the electrode's location.
+    metadata : None or dict, default=None
+        Run-level information saved with the provenance.
+    identifier : None or str, default=None
+        Unique identifier of the file. If None, a random one is
+        generated.
+
+    Notes
+    -----
+    Values are saved in NEURON's units, with the conversion factors to
+    the SI units required by NWB (V, A). The provenance of the run (see
+    meta.capture) is saved as JSON in the file's notes.
+
+    Requires the Python package [pynwb](https://pynwb.readthedocs.io/).
+
+    Example
+    -------
+    >>> sweeps = []
+    >>> for amplitude in [0.1, 0.2, 0.3]:
+    ...     stim.set_stim(delay=100, duration=500, amplitude=amplitude,
+    ...                   tmax=700, add_rheob=False)
+    ...     stim.run()
+    ...     sweeps.append({'t': np.array(stim.t), 'v': np.array(stim.v),
+    ...                    'i': np.array(stim.i)})
+    >>> to_nwb('steps.nwb', sweeps, cell=cell)
+    """
+    import datetime
+    import uuid
+
+    from pynwb import NWBFile, NWBHDF5IO
+    from pynwb.icephys import (
+        CurrentClampSeries, CurrentClampStimulusSeries,
+        VoltageClampSeries, VoltageClampStimulusSeries)
+
+    if clamp not in ('current', 'voltage'):
+        raise ValueError("clamp must be 'current' or 'voltage'")
+    if isinstance(sweeps, dict):
+        sweeps = [sweeps]
+    provenance = capture(params=metadata, cell=cell)
+    nwbfile = NWBFile(
+        session_description=description or 'msn simulation',
+        identifier=identifier or str(uuid.uuid4()),
+        session_start_time=datetime.datetime.now().astimezone(),
+        notes=json.dumps(provenance))
+    device = nwbfile.create_device(
+        name='NEURON', description=f"NEURON {provenance['host']['neuron']}")
+    location = 'soma' if cell is None else (
+        f'soma, {cell.type} cell {cell.index}')
+    electrode = nwbfile.create_icephys_electrode(
+        name='electrode', description='simulated electrode',
+        device=device, location=location)
+
+    # NEURON's units, as conversion factors to SI units.
+    voltage, current = 1e-3, 1e-9
+    if clamp == 'current':
+        response, stimulus = CurrentClampSeries, CurrentClampStimulusSeries
+        responses, stimuli = ('v', voltage), ('i', current)
+    else:
+        response, stimulus = VoltageClampSeries, VoltageClampStimulusSeries
+        responses, stimuli = ('i', current), ('v', voltage)
+    for number, sweep in enumerate(sweeps):
+        timing = _nwb_timing(sweep['t'])
+        for series, (key, conversion), add in [
+                (response, responses, nwbfile.add_acquisition),
+                (stimulus, stimuli, nwbfile.add_stimulus)]:
+            if key not in sweep:
+                continue
+            values = sweep[key]
+            if hasattr(values, 'as_numpy'):
+                values = values.as_numpy()
+            add(series(
+                name=f'{series.__name__}_{number:03d}',
+                data=np.asarray(values, dtype=float), electrode=electrode,
+                gain=1., conversion=conversion, sweep_number=number,
+                **timing))
+
+    with NWBHDF5IO(str(path), 'w') as io:
+        io.write(nwbfile)
+
+
+def trace_summary(t, v, threshold=-20):
+    """
+    Summary statistics of a voltage trace.
+
+    Parameters
+    ----------
+    t, v : array_like
+        Time (ms) and membrane potential (mV).
+    threshold : numeric, default=-20
+        Voltage (mV) for counting action potentials (upward crossings).
+
+    Returns
+    -------
+    summary : dict
+        With keys 'duration' (ms), 'v_min', 'v_max', 'v_mean', 'v_std'
+        (mV), 'v_final' (mV) and 'n_spikes'.
+    """
+    t = np.asarray(t, dtype=float)
+    v = np.asarray(v, dtype=float)
+    above = v >= threshold
+    # Mean and standard deviation are time-weighted, for traces
+    # recorded with a variable time step.
+    duration = t[-1] - t[0]
+    v_mean = _trapezoid(v, t) / duration
+    v_var = _trapezoid((v - v_mean)**2, t) / duration
+    return {
+        'duration': float(duration),
+        'v_min': float(v.min()),
+        'v_max': float(v.max()),
+        'v_mean': float(v_mean),
+        'v_std': float(np.sqrt(v_var)),
+        'v_final': float(v[-1]),
+        'n_spikes': int(np.sum(above[1:] & ~above[:-1]))}
+
+
+def _flatten_results(results):
+    # Expand the 'result' column of run_batch() into one column per
+    # key when results are dicts, e.g. {'rate': ...} -> 'result.rate'.
+    results = results.copy()
+    if 'result' in results and results.result.map(
+            lambda item: isinstance(item, dict) or item is None).all():
+        values = [item if item is not None else {}
+                  for item in results.result]
+        expanded = pd.json_normalize(values).add_prefix('result.')
+        expanded.index = results.index
+        results = pd.concat([results.drop(columns='result'), expanded],
+                            axis=1)
+    if 'error' in results:
+        results['error'] = results.error.astype('string')
+    return results
+
+
+def to_parquet(path, results, metadata=None, partition_cols=None,
+               compression='snappy'):
+    """
+    Save the results of a parameter sweep in Parquet format.
+
+    Parquet is a compressed columnar format with a schema, so the
+    results of very many runs can be queried directly (e.g. with
+    pandas.read_parquet or DuckDB) without custom parsers, and without
+    reading the columns that are not needed.
+
+    Parameters
+    ----------
+    path : str or Path
+        Output file name; or a directory, in which case the results are
+        added to it as a new file of a dataset, so that results of
+        several sweeps (or of chunks of a long sweep) can be appended
+        and read back together.
+    results : pandas dataframe
+        One row per run, e.g. as returned by batch.run_batch(). If the
+        column 'result' holds dicts (e.g. from trace_summary()), it is
+        expanded into one column per key, 'result.<key>'.
+    metadata : None or dict, default=None
+        Sweep-level information saved, with the provenance (see
+        meta.capture), as JSON in the schema metadata under the key
+        'msn'.
+    partition_cols : None or list of str, default=None
+        Columns by which to partition a dataset into subdirectories,
+        e.g. ['cell_index']; `path` is then a directory.
+    compression : str, default='snappy'
+        Compression codec; see pyarrow's documentation.
+
+    Returns
+    -------
+    schema : pyarrow.Schema
+        The schema of the saved table.
+
+    Notes
+    -----
+    Requires the Python package [pyarrow](https://arrow.apache.org/).
+
+    Example
+    -------
+    >>> def run(cell_index, amplitude):
+    ...     cell = MSN('dmsn', cell_index)
+    ...     stim = Stim(cell)
+    ...     stim.set_stim(amplitude=amplitude)
+    ...     stim.run()
+    ...     return trace_summary(stim.t, stim.v)
+    >>> results = run_batch(run, grid(cell_index=range(71),
+    ...                               amplitude=[0.1, 0.2, 0.3]))
+    >>> to_parquet('sweep.parquet', results)
+    >>> pd.read_parquet('sweep.parquet', columns=['cell_index',
+    ...                                           'result.n_spikes'])
+    """
+    import pyarrow as pa
+    import pyarrow.parquet as pq
+
+    table = pa.Table.from_pandas(_flatten_results(results),
+                                 preserve_index=False)
+    provenance = json.dumps(capture(params=metadata))
+    table = table.replace_schema_metadata(
+        {**(table.schema.metadata or {}), b'msn': provenance.encode()})
+    if partition_cols is not None or Path(path).is_dir():
+        pq.write_to_dataset(table, str(path), partition_cols=partition_cols,
+                            compression=compression)
+    else:
+        pq.write_table(table, str(path), compression=compression)
+    return table.schema
+
+
+def _mechanism_parameters(point_process):
+    # Values of the PARAMETER variables of a point process, e.g. the
+    # time constants of a synapse.
+    name = point_process.hname().split('[')[0]
+    standard = h.MechanismStandard(name, 1)
+    parameters = {}
+    for index in range(int(standard.count())):
+        parameter = h.ref('')
+        standard.name(parameter, index)
+        if hasattr(point_process, parameter[0]):
+            parameters[parameter[0]] = getattr(point_process, parameter[0])
+    return parameters
+
+
+def _swc_file(cell):
+    # SWC file of a cell's morphology, or None if its sections are not
+    # built from one (reduced cells, simplified or collapsed
+    # morphologies).
+    if not isinstance(cell, MSN) or isinstance(cell, SimplifiedMSN):
+        return None
+    if getattr(cell, 'reduced', None) is not None:
+        return None
+    return Path(getattr(cell, 'swc', None) or cell._morphology_file)
+
+
+def to_sonata(network, directory, gap_junctions=()):
+    """
+    Save a network in the SONATA format.
+
+    SONATA is the data format of the Allen Institute's Brain Modeling
+    Toolkit (BMTK) and of the Blue Brain Project. Saving a network in
+    this format allows loading the same cells and connections in other
+    simulators, e.g. to verify results across simulators.
+
+    The directory is organised as in BMTK:
+
+    - `network/nodes.h5` and `network/node_types.csv`: the cells, one
+      node population per population of the network and one node type
+      per cell class in each population, with the cell type,
+      parameter set (`cell_index`) and position (if given) of each
+      cell.
+    - `network/edges.h5` and `network/edge_types.csv`: the
+      connections, one edge population per pair of source and target
+      populations, with the weight (uS), delay (ms), section
+      (`sec_id`, index in `cell.all`) and location (`sec_x`) of each
+      synapse.
+    - Gap junctions (network.GapJunction), if given, as further edge
+      populations ('<population>_to_<population>_gap') whose edge types
+      have `is_gap_junction` set; `syn_weight` is the conductance of
+      the junction (uS), and the location in the source cell is in
+      `efferent_sec_id` and `efferent_sec_x`.
+    - `components/synaptic_models`: the parameters of the synapses of
+      each edge type, as JSON (`dynamics_params` of the edge types,
+      '<mechanism>_<edge_type_id>.json').
+    - `components/morphologies`: the SWC files of the cells.
+    - `circuit_config.json`: the paths of the above.
+
+    Parameters
+    ----------
+    network : network.Network
+        The network.
+    directory : str or Path
+        Output directory; it is created if it does not exist.
+    gap_junctions : iterable of network.GapJunction, default=()
+        Gap junctions between cells of the network.
+
+    Returns
+    -------
+    config : Path
+        The circuit configuration file.
+
+    Notes
+    -----
+    Cells are described by the model class (`model_template`, e.g.
+    'python:msn.cell.MSN') and `cell_index`, with `model_type`
+    'point_neuron' for reduced cells (cell.ReducedMSN); to simulate
+    them in BMTK, register a function that builds the cells with that
+    name (see bmtk.simulator.bionet.pyfunction_cache). Connection weights are
+    saved in NEURON's units (uS), and synapse parameters as given by
+    the mechanisms in `mechanisms`, which must also be compiled.
+
+    Requires the Python package [h5py](https://www.h5py.org/).
+
+    Example
+    -------
+    >>> net = Network()
+    >>> net.add_population('dmsn', 'dmsn', range(10))
+    >>> net.add_population('imsn', 'imsn', range(10))
+    >>> net.connect('dmsn', 'imsn', probability=0.2, weight=5e-4)
+    >>> to_sonata(net, 'sonata')
+    """
+    import shutil
+
+    import h5py
+
+    directory = Path(directory)
+    network_dir = directory / 'network'
+    synapses_dir = directory / 'components' / 'synaptic_models'
+    morphologies_dir = directory / 'components' / 'morphologies'
+    for path in (network_dir, synapses_dir, morphologies_dir):
+        path.mkdir(parents=True, exist_ok=True)
+
+    # Nodes: one node type per population and cell class (populations
+    # can mix full and reduced cells, see Network.add_population).
+    node_types = []
+    with h5py.File(network_dir / 'nodes.h5', 'w') as file:
+        file.attrs['magic'] = np.uint32(0x0A7A)
+        file.attrs['version'] = [0, 1]
+        for name, cells in network.populations.items():
+            type_ids = {}
+            for cell in cells:
+                if type(cell) in type_ids:
+                    continue
+                type_ids[type(cell)] = len(node_types) + 100
+                morphology = 'NONE'
+                swc = _swc_file(cell)
+                if swc is not None:
+                    morphology = swc.name
+                    shutil.copy(swc, morphologies_dir)
+                node_types.append({
+                    'node_type_id': type_ids[type(cell)],
+                    'pop_name': name,
+                    'model_type': ('point_neuron'
+                                   if isinstance(cell, ReducedMSN)
+                                   else 'biophysical'),
+                    'model_template':
+                        f'python:msn.cell.{type(cell).__name__}',
+                    'cell_type': cell.type,
+                    'morphology': morphology})
+            group = file.create_group(f'nodes/{name}')
+            n = len(cells)
+            group.create_dataset('node_id', data=np.arange(n))
+            group.create_dataset(
+                'node_type_id',
+                data=[type_ids[type(cell)] for cell in cells])
+            group.create_dataset('node_group_id', data=np.zeros(n, int))
+            group.create_dataset('node_group_index', data=np.arange(n))
+            attributes = group.create_group('0')
+            attributes.create_dataset(
+                'cell_index',
+                data=[-1 if cell.index is None else cell.index
+                      for cell in cells])
+            if name in network.positions:
+                positions = network.positions[name]
+                for axis, column in zip('xyz', positions.T):
+                    attributes.create_dataset(axis, data=column)
+    pd.DataFrame(node_types).to_csv(network_dir / 'node_types.csv',
+                                    sep=' ', index=False)
+
+    # Edges: one edge population per pair of populations, one edge type
+    # per pair of populations and synapse mechanism.
+    rows = []
+    edge_types = {}
+    for (source, source_index, target, target_index, synapse,
+         netcon) in network.connections:
+        mechanism = synapse.hname().split('[')[0]
+        key = (source, target, mechanism)
+        if key not in edge_types:
+            # One file per edge type, as synapses of the same mechanism
+            # may have different parameters in each projection.
+            edge_types[key] = len(edge_types) + 100
+            params_file = f'{mechanism}_{edge_types[key]}.json'
+            with open(synapses_dir / params_file, 'w') as file:
+                json.dump(_mechanism_parameters(synapse), file, indent=2)
+        segment = synapse.get_segment()
+        cell = network.populations[target][target_index]
+        rows.append({
+            'population': f'{source}_to_{target}',
+            'source': source, 'target': target,
+            'source_node_id': source_index,
+            'target_node_id': target_index,
+            'edge_type_id': edge_types[key],
+            'syn_weight': netcon.weight[0],
+            'delay': netcon.delay,
+            'sec_id': list(cell.all).index(segment.sec),
+            'sec_x': segment.x})
+
+    # Gap junctions: the node of each coupled cell is found from the
+    # cell that owns the section of each of the junction's two point
+    # processes.
+    nodes = {id(cell): (name, index)
+             for name, cells in network.populations.items()
+             for index, cell in enumerate(cells)}
+    for junction in gap_junctions:
+        segments = [junction._gap1.get_segment(),
+                    junction._gap2.get_segment()]
+        cells = [segment.sec.cell() for segment in segments]
+        if any(id(cell) not in nodes for cell in cells):
+            raise ValueError('Gap junction between cells that are not in '
+                             'the network')
+        (source, source_index), (target, target_index) = (
+            nodes[id(cell)] for cell in cells)
+        key = (source, target, 'gap')
+        if key not in edge_types:
+            edge_types[key] = len(edge_types) + 100
+        rows.append({
+            'population': f'{source}_to_{target}_gap',
+            'source': source, 'target': target,
+            'source_node_id': source_index,
+            'target_node_id': target_index,
+            'edge_type_id': edge_types[key],
+            'syn_weight': junction.g, 'delay': 0,
+            'sec_id': list(cells[1].all).index(segments[1].sec),
+            'sec_x': segments[1].x,
+            'efferent_sec_id': list(cells[0].all).index(segments[0].sec),
+            'efferent_sec_x': segments[0].x})
+    edges = pd.DataFrame(rows, columns=[
+        'population', 'source', 'target', 'source_node_id',
+        'target_node_id', 'edge_type_id', 'syn_weight', 'delay', 'sec_id',
+        'sec_x', 'efferent_sec_id', 'efferent_sec_x'])
+    with h5py.File(network_dir / 'edges.h5', 'w') as file:
+        file.attrs['magic'] = np.uint32(0x0A7A)
+        file.attrs['version'] = [0, 1]
+        for name, population in edges.groupby('population', sort=False):
+            group = file.create_group(f'edges/{name}')
+            n = len(population)
+            for column, key in [('source_node_id', 'source'),
+                                ('target_node_id', 'target')]:
+                dataset = group.create_dataset(
+                    column, data=population[column].values)
+                dataset.attrs['node_population'] = population[key].iloc[0]
+            group.create_dataset('edge_type_id',
+                                 data=population.edge_type_id.values)
+            group.create_dataset('edge_group_id', data=np.zeros(n, int))
+            group.create_dataset('edge_group_index', data=np.arange(n))
+            attributes = group.create_group('0')
+            columns = ['syn_weight', 'delay', 'sec_id', 'sec_x']
+            if name.endswith('_gap'):
+                columns += ['efferent_sec_id', 'efferent_sec_x']
+            for column in columns:
+                attributes.create_dataset(column,
+                                          data=population[column].values)
+    pd.DataFrame(
+        [{'edge_type_id': type_id, 'src_pop_name': source,
+          'trg_pop_name': target, 'model_template': mechanism,
+          'dynamics_params': ('NONE' if mechanism == 'gap'
+                              else f'{mechanism}_{type_id}.json'),
+          'is_gap_junction': mechanism == 'gap'}
+         for (source, target, mechanism), type_id in edge_types.items()],
+        columns=['edge_type_id', 'src_pop_name', 'trg_pop_name',
+                 'model_template', 'dynamics_params',
+                 'is_gap_junction']).to_csv(
+        network_dir / 'edge_types.csv', sep=' ', index=False)
+
+    config = {
+        'manifest': {
+            '$BASE_DIR': '.',
+            '$NETWORK_DIR': '$BASE_DIR/network',
+            '$COMPONENTS_DIR': '$BASE_DIR/components'},
+        'components': {
+            'synaptic_models_dir': '$COMPONENTS_DIR/synaptic_models',
+            'morphologies_dir': '$COMPONENTS_DIR/morphologies'},
+        'networks': {
+            'nodes': [{
+                'nodes_file': '$NETWORK_DIR/nodes.h5',
+                'node_types_file': '$NETWORK_DIR/node_types.csv'}],
+            'edges': [{
+                'edges_file': '$NETWORK_DIR/edges.h5',
+                'edge_types_file': '$NETWORK_DIR/edge_types.csv'}]},
+        'msn': capture()}
+    path = directory / 'circuit_config.json'
+    with open(path, 'w') as file:
+        json.dump(config, file, indent=2)
+    return path
@@ -0,0 +1,174 @@
+"""
+Mathematical expressions given as text.
+
+Formulas in configuration files, e.g. a stimulus waveform or the rate
+functions of an ion channel, are read into Expression objects. These
+check that the formula uses only arithmetic, a few mathematical
+functions and the expected variables, and can then be evaluated (as
+numpy functions) or translated to NMODL, to define new mechanisms
+without writing mod files by hand (see nmodl.hh_channel).
+
+Example
+-------
+>>> alpha = Expression('0.1 * (v + 40) / (1 - exp(-(v + 40) / 10))',
+...                    variables=['v'])
+>>> alpha(v=-30)
+1.5819767068693265
+>>> alpha.to_nmodl()
+'(0.1 * (v + 40)) / (1 - exp((-(v + 40)) / 10))'
+
+author: Antonio Gonzalez
+"""
+import ast
+
+import numpy as np
+
+# Functions allowed in expressions, with their numpy and NMODL names.
+functions = {
+    'exp': (np.exp, 'exp'),
+    'log': (np.log, 'log'),
+    'log10': (np.log10, 'log10'),
+    'sqrt': (np.sqrt, 'sqrt'),
+    'sin': (np.sin, 'sin'),
+    'cos': (np.cos, 'cos'),
+    'tanh': (np.tanh, 'tanh'),
+    'abs': (np.abs, 'fabs')}
+
+constants = {'pi': np.pi, 'e': np.e}
+
+_operators = {ast.Add: '+', ast.Sub: '-', ast.Mult: '*', ast.Div: '/',
+              ast.Pow: '^'}
+
+
+class Expression:
+    """
+    A formula of one or more variables.
+
+    Attributes
+    ----------
+    text : str
+        The formula, in Python syntax (`**` for powers).
+    variables : list of str
+        Names of the variables.
+
+    Methods
+    -------
+    __call__(**values)
+        Evaluate the formula
+    to_nmodl()
+        The formula in NMODL syntax
+    """
+
+    def __init__(self, text, variables=('t',)):
+        """
+        Parameters
+        ----------
+        text : str
+            The formula, e.g. '0.2 * sin(2 * pi * 5 * t / 1000)'. It
+            may contain numbers, the variables, the constants `pi` and
+            `e`, the operators + - * / ** and parentheses, and the
+            functions in `functions` (exp, log, sqrt, etc).
+        variables : sequence of str, default=('t',)
+            Names of the variables.
+
+        Raises
+        ------
+        ValueError
+            If the formula has a syntax error or contains anything else
+            than the above.
+        """
+        self.text = text
+        self.variables = list(variables)
+        try:
+            self._tree = ast.parse(text, mode='eval').body
+        except SyntaxError as error:
+            raise ValueError(f"invalid expression '{text}': "
+                             f"{error.msg}") from None
+        self._check(self._tree)
+        self._code = compile(ast.Expression(self._tree), '<expression>',
+                             'eval')
+
+    def _check(self, node):
+        if isinstance(node, ast.Constant) and isinstance(
+                node.value, (int, float)):
+            return
+        if isinstance(node, ast.Name):
+            if node.id in self.variables or node.id in constants:
+                return
+            raise ValueError(f"unknown name '{node.id}' in '{self.text}'; "
+                             f"variables are {self.variables}")
+        if isinstance(node, ast.BinOp) and type(node.op) in _operators:
+            self._check(node.left)
+            self._check(node.right)
+            return
+        if isinstance(node, ast.UnaryOp) and isinstance(
+                node.op, (ast.USub, ast.UAdd)):
+            self._check(node.operand)
+            return
+        if (isinstance(node, ast.Call) and isinstance(node.func, ast.Name)
+                and node.func.id in functions and len(node.args) == 1
+                and not node.keywords):
+            self._check(node.args[0])
+            return
+        segment = ast.get_source_segment(self.text, node)
+        raise ValueError(f"'{segment}' is not allowed in an expression "
+                         f"('{self.text}')")
+
+    def __call__(self, **values):
+        """
+        Evaluate the formula.
+
+        Parameters
+        ----------
+        **values :
+            Value (number or array) of each variable.
+
+        Returns
+        -------
+        result : float or numpy array
+        """
+        missing = set(self.variables) - set(values)
+        if missing:
+            raise ValueError(f'missing values for {sorted(missing)}')
+        namespace = {name: function for name, (function, __)
+                     in functions.items()}
+        namespace.update(constants)
+        namespace.update(values)
+        with np.errstate(divide='ignore', invalid='ignore'):
+            return eval(self._code, {'__builtins__': {}}, namespace)
+
+    def to_nmodl(self):
+        """
+        Return the formula in NMODL syntax.
+        """
+        return self._nmodl(self._tree)
+
+    def _nmodl(self, node):
+        if isinstance(node, ast.Constant):
+            return repr(node.value)
+        if isinstance(node, ast.Name):
+            if node.id == 'pi':
+                return 'PI'
+            if node.id == 'e':
+                return repr(np.e)
+            return node.id
+        if isinstance(node, ast.BinOp):
+            left, right = self._nmodl(node.left), self._nmodl(node.right)
+            if not isinstance(node.left, (ast.Constant, ast.Name,
+                                          ast.Call)):
+                left = f'({left})'
+            if not isinstance(node.right, (ast.Constant, ast.Name,
+                                           ast.Call)):
+                right = f'({right})'
+            return f'{left} {_operators[type(node.op)]} {right}'
+        if isinstance(node, ast.UnaryOp):
+            operand = self._nmodl(node.operand)
+            if not isinstance(node.operand, (ast.Constant, ast.Name,
+                                             ast.Call)):
+                operand = f'({operand})'
+            return ('-' if isinstance(node.op, ast.USub) else '') + operand
+        # Call
+        return f'{functions[node.func.id][1]}({self._nmodl(node.args[0])})'
+
+    def __repr__(self):
+        return f'Expression({self.text!r}, variables={self.variables})'
@@ -0,0 +1,459 @@
+"""
+Fit model parameters to experimental data.
+
+Model parameters (e.g. scaling factors for the ion channel
+conductances) are optimised with a genetic algorithm so that features
+of the simulated activity (e.g. rheobase, input resistance, firing
+rate) match target values.
+
+author: Antonio Gonzalez
+"""
+import numpy as np
+import pandas as pd
+
+from .batch import run_batch
+from .cell import reduced_params
+from .instrumentation import Stim, ActionPotentials
+from .rng import generator
+from .sensitivity import latin_hypercube
+
+
+def scale_conductances(cell, factors):
+    """
+    Scale the maximal conductance of ion channels in a cell.
+
+    Parameters
+    ----------
+    cell : object
+        A NEURON model cell, e.g. cell.MSN.
+    factors : dict
+        Scaling factors, as {mechanism: factor}, e.g. {'kaf': 1.2}.
+        The conductance (gbar or g) or, for calcium channels,
+        permeability (pbar) of the mechanism is multiplied by this
+        factor in all the cell segments.
+
+    Raises
+    ------
+    ValueError
+        If a mechanism has no conductance or permeability.
+    """
+    for section in cell.all:
+        for segment in section:
+            for mech, factor in factors.items():
+                if not hasattr(segment, mech):
+                    continue
+                mechanism = getattr(segment, mech)
+                for variable in ('gbar', 'pbar', 'g'):
+                    if hasattr(mechanism, variable):
+                        setattr(mechanism, variable,
+                                getattr(mechanism, variable) * factor)
+                        break
+                else:
+                    raise ValueError(f"mechanism '{mech}' has no "
+                                     "conductance (gbar or g) or "
+                                     "permeability (pbar)")
+
+
+def pareto_front(errors):
+    """
+    Find the non-dominated solutions of a multi-objective problem.
+
+    Parameters
+    ----------
+    errors : array, shape (n_solutions, n_objectives)
+        Error of each solution in each objective (lower is better).
+
+    Returns
+    -------
+    is_front : boolean array, shape (n_solutions,)
+        True for the solutions in the Pareto front, i.e. those for which
+        there is no other solution that is at least as good in all
+        objectives and better in at least one.
+    """
+    errors = np.asarray(errors, dtype=float)
+    is_front = np.ones(len(errors), dtype=bool)
+    for index, error in enumerate(errors):
+        dominated_by = (np.all(errors <= error, axis=1) &
+                        np.any(errors < error, axis=1))
+        is_front[index] = not dominated_by.any()
+    return is_front
+
+
+def _pareto_rank(errors):
+    # Rank solutions by successive Pareto fronts: 0 for the first front,
+    # 1 for the front found once the first is removed, etc.
+    rank = np.full(len(errors), -1)
+    remaining = np.arange(len(errors))
+    current = 0
+    while remaining.size:
+        front = pareto_front(errors[remaining])
+        rank[remaining[front]] = current
+        remaining = remaining[~front]
+        current += 1
+    return rank
+
+
+class GeneticFit:
+    """
+    Fit model parameters with a genetic algorithm.
+
+    A population of candidate parameter sets is evolved over a number
+    of generations. Each candidate is evaluated by running a
+    simulation (in parallel processes; see batch.run_batch) that
+    returns features of the model's activity. The error for each
+    feature is the difference from its target value in units of the
+    target's standard deviation. Candidates are selected by Pareto
+    rank (so that all the features are fitted at once, without
+    weighting them) and then by total error.
+
+    Attributes
+    ----------
+    bounds : dict
+        Lower and upper bounds for each parameter.
+    targets : dict
+        Target mean and standard deviation for each feature.
+    history : pandas dataframe
+        All the candidates evaluated, with their generation, parameter
+        values, feature values, errors and total error. Empty until
+        run() is called.
+
+    Methods
+    -------
+    run()
+        Run the optimisation
+    pareto()
+        Candidates in the Pareto front
+    best()
+        Candidate with the smallest total error
+
+    Example
+    -------
+    In a script, define a function that builds and simulates a cell
+    with the given parameters and returns the features:
+    >>> def evaluate(kaf, kir):
+    ...     cell = MSN('dmsn', 12)
+    ...     scale_conductances(cell, {'kaf': kaf, 'kir': kir})
+    ...     fi = FICurve(cell, amplitudes=[0.3, 0.5])
+    ...     rate = fi.run().rate.values
+    ...     return {'rate_low': rate[0], 'rate_high': rate[1]}
+    >>> if __name__ == '__main__':
+    ...     fit = GeneticFit(evaluate,
+    ...                      bounds={'kaf': (0.5, 2), 'kir': (0.5, 2)},
+    ...                      targets={'rate_low': (8, 2),
+    ...                               'rate_high': (20, 4)})
+    ...     fit.run()
+    ...     print(fit.best())
+    """
+
+    def __init__(self, evaluate, bounds, targets, population_size=20,
+                 n_generations=10, mutation=0.1, n_elite=2,
+                 max_error=250, processes=None, seed=None):
+        """
+        Parameters
+        ----------
+        evaluate : callable
+            Function called as `evaluate(**params)` for each candidate,
+            returning a dict of feature values, {feature: value}. A
+            feature that cannot be calculated (e.g. a firing rate when
+            there are no action potentials) can be NaN. It must be
+            defined at the top level of a module; see batch.run_batch.
+        bounds : dict
+            Lower and upper bounds for each parameter, as
+            {name: (low, high)}.
+        targets : dict
+            Target mean and standard deviation of each feature, as
+            {feature: (mean, std)}.
+        population_size : int, default=20
+            Number of candidates in each generation.
+        n_generations : int, default=10
+            Number of generations.
+        mutation : float, default=0.1
+            Standard deviation of the Gaussian mutation, as a fraction
+            of the range of each parameter.
+        n_elite : int, default=2
+            Number of best candidates copied unchanged to the next
+            generation.
+        max_error : numeric, default=250
+            Error assigned to features that are NaN or missing, and to
+            all features of candidates whose simulation failed.
+        processes : None or int, default=None
+            Number of parallel processes; see batch.run_batch.
+        seed : None or int, default=None
+            Seed for the random number generator.
+        """
+        self.evaluate = evaluate
+        self.bounds = bounds
+        self.targets = targets
+        self.population_size = population_size
+        self.n_generations = n_generations
+        self.mutation = mutation
+        self.n_elite = n_elite
+        self.max_error = max_error
+        self.processes = processes
+        self._rng = generator(seed)
+        self._names = list(bounds)
+        self._low = np.array([bounds[name][0] for name in self._names])
+        self._high = np.array([bounds[name][1] for name in self._names])
+        self.history = pd.DataFrame()
+
+    def _errors(self, features):
+        errors = np.full(len(self.targets), float(self.max_error))
+        if features is None:
+            return errors
+        for index, (name, (mean, std)) in enumerate(self.targets.items()):
+            value = features.get(name, np.nan)
+            if value is not None and np.isfinite(value):
+                errors[index] = min(abs(value - mean) / std,
+                                    self.max_error)
+        return errors
+
+    def _evaluate(self, population, generation):
+        params = [dict(zip(self._names, candidate))
+                  for candidate in population]
+        results = run_batch(self.evaluate, params,
+                            processes=self.processes, progress=False)
+        errors = np.array([self._errors(features)
+                           for features in results.result])
+        rows = pd.DataFrame(population, columns=self._names)
+        rows.insert(0, 'generation', generation)
+        for index, name in enumerate(self.targets):
+            rows[name] = [np.nan if features is None
+                          else features.get(name, np.nan)
+                          for features in results.result]
+            rows[f'{name}_error'] = errors[:, index]
+        rows['total_error'] = errors.sum(axis=1)
+        return rows, errors
+
+    def _select(self, rank, total_error):
+        # Binary tournament: lower Pareto rank wins, then lower total
+        # error.
+        a, b = self._rng.integers(len(rank), size=2)
+        if (rank[a], total_error[a]) <= (rank[b], total_error[b]):
+            return a
+        return b
+
+    def _offspring(self, population, rank, total_error):
+        order = np.lexsort((total_error, rank))
+        children = [population[index]
+                    for index in order[:self.n_elite]]
+        scale = self.mutation * (self._high - self._low)
+        while len(children) < self.population_size:
+            parent1 = population[self._select(rank, total_error)]
+            parent2 = population[self._select(rank, total_error)]
+            # Blend crossover, then Gaussian mutation.
+            alpha = self._rng.uniform(size=len(self._names))
+            child = alpha * parent1 + (1 - alpha) * parent2
+            child += self._rng.normal(scale=scale)
+            children.append(np.clip(child, self._low, self._high))
+        return np.array(children)
+
+    def run(self):
+        """
+        Run the optimisation.
+
+        Returns
+        -------
+        history : pandas dataframe
+            All the candidates evaluated.
+        """
+        population = self._rng.uniform(
+            self._low, self._high,
+            size=(self.population_size, len(self._names)))
+        history = []
+        for generation in range(self.n_generations):
+            rows, errors = self._evaluate(population, generation)
+            history.append(rows)
+            if generation < self.n_generations - 1:
+                rank = _pareto_rank(errors)
+                population = self._offspring(population, rank,
+                                             errors.sum(axis=1))
+        self.history = pd.concat(history, ignore_index=True)
+        return self.history
+
+    def pareto(self):
+        """
+        Candidates in the Pareto front (over all generations).
+
+        Returns
+        -------
+        pareto : pandas dataframe
+            Rows of `history` in the Pareto front.
+        """
+        columns = [f'{name}_error' for name in self.targets]
+        is_front = pareto_front(self.history[columns].values)
+        return self.history[is_front]
+
+    def best(self):
+        """
+        Candidate with the smallest total error.
+
+        Returns
+        -------
+        best : dict
+            Parameter values of the best candidate.
+        """
+        row = self.history.loc[self.history.total_error.idxmin()]
+        return {name: row[name] for name in self._names}
+
+
+def _simulate_reduced(params, amplitudes, delay, duration, dt=0.05):
+    # Euler integration of the reduced (Izhikevich) model for several
+    # parameter sets (arrays of shape (n, 1)) and current amplitudes
+    # (pA, shape (1, m)) at once. Returns the number of spikes during
+    # the step and the first and last inter-spike intervals.
+    p = {name: np.asarray(value, dtype=float)
+         for name, value in params.items()}
+    shape = np.broadcast(p['k'], amplitudes).shape
+    v = np.broadcast_to(p['vr'], shape).astype(float)
+    u = np.zeros(shape)
+    n_spikes = np.zeros(shape, dtype=int)
+    spike_times = np.full((4,) + shape, np.nan)
+    for step in range(int((delay + duration) / dt)):
+        t = step * dt
+        current = amplitudes if t >= delay else 0
+        v = v + dt * (p['k'] * (v - p['vr']) * (v - p['vt']) - u +
+                      current) / p['C']
+        u = u + dt * p['a'] * (p['b'] * (v - p['vr']) - u)
+        spiking = v >= p['vpeak']
+        v = np.where(spiking, p['c'], v)
+        u = np.where(spiking, u + p['d'], u)
+        if t >= delay:
+            n_spikes += spiking
+            # Times of the first two and the last two spikes.
+            first = spiking & (n_spikes <= 2)
+            spike_times[0] = np.where(first & (n_spikes == 1), t,
+                                      spike_times[0])
+            spike_times[1] = np.where(first & (n_spikes == 2), t,
+                                      spike_times[1])
+            spike_times[2] = np.where(spiking, spike_times[3],
+                                      spike_times[2])
+            spike_times[3] = np.where(spiking, t, spike_times[3])
+    first_isi = spike_times[1] - spike_times[0]
+    last_isi = spike_times[3] - spike_times[2]
+    return n_spikes, first_isi, last_isi
+
+
+def fit_reduced(cell, amplitudes, delay=50, duration=500, bounds=None,
+                n_samples=200, n_iter=20, seed=None):
+    """
+    Fit the parameters of the reduced MSN model to a full model.
+
+    The full conductance-based model is stimulated with current steps,
+    and its firing rate and spike-frequency adaptation at each step
+    amplitude are measured. The parameters of the reduced
+    (Izhikevich-style) model are then searched so that it reproduces
+    the same F-I relation and adaptation.
+
+    Parameters
+    ----------
+    cell : object
+        A NEURON model cell, e.g. cell.MSN.
+    amplitudes : array_like
+        Amplitudes of the current steps in nA. These should be above
+        the cell's rheobase.
+    delay : numeric, default=50
+        Delay of each step in ms.
+    duration : numeric, default=500
+        Duration of each step in ms.
+    bounds : None or dict, default=None
+        Lower and upper bound of the parameters to fit, as
+        {name: (low, high)}; other parameters keep their values in
+        cell.reduced_params. If None, 'k', 'vt', 'a', 'b' and 'd' are
+        fitted within a range around those values.
+    n_samples : int, default=200
+        Number of initial parameter sets, drawn from a Latin hypercube
+        sample.
+    n_iter : int, default=20
+        Number of refinement iterations. In each, `n_samples` random
+        perturbations of the best parameter set found so far are
+        evaluated, with a perturbation size that decreases over
+        iterations.
+    seed : None or int, default=None
+        Seed for the random number generator.
+
+    Returns
+    -------
+    params : dict
+        Parameters of the reduced model, to be used with
+        cell.ReducedMSN.
+    features : pandas dataframe
+        Firing rate (Hz) and adaptation of the full and the fitted
+        reduced models at each amplitude. Adaptation is the ratio of
+        the last to the first inter-spike interval (NaN if there are
+        fewer than three action potentials).
+
+    Example
+    -------
+    >>> cell = MSN('dmsn', 12)
+    >>> params, features = fit_reduced(cell, np.arange(0.3, 0.7, 0.1))
+    >>> reduced = ReducedMSN('dmsn', params=params)
+    """
+    amplitudes = np.asarray(amplitudes, dtype=float)
+    if bounds is None:
+        bounds = {'k': (0.2, 3), 'vt': (-55, -20), 'a': (0.001, 0.1),
+                  'b': (-30, 5), 'd': (20, 300)}
+    names = list(bounds)
+    low = np.array([bounds[name][0] for name in names])
+    high = np.array([bounds[name][1] for name in names])
+
+    # Features of the full model.
+    stim = Stim(cell)
+    rate = np.zeros(amplitudes.size)
+    adaptation = np.full(amplitudes.size, np.nan)
+    for index, amplitude in enumerate(amplitudes):
+        stim.set_stim(delay=delay, duration=duration, amplitude=amplitude,
+                      tmax=delay + duration, add_rheob=False)
+        stim.run()
+        ap = ActionPotentials(stim.t, stim.v)
+        rate[index] = ap.firing_rate(start=delay, stop=delay + duration)
+        if ap.n >= 3:
+            adaptation[index] = ap.isi[-1] / ap.isi[0]
+
+    def features(candidates):
+        params = dict(reduced_params)
+        params.update({name: candidates[:, [index]]
+                       for index, name in enumerate(names)})
+        n_spikes, first_isi, last_isi = _simulate_reduced(
+            params, amplitudes[np.newaxis] * 1e3, delay, duration)
+        # As for the full model, adaptation needs at least three action
+        # potentials (with two, the first and last intervals are the
+        # same).
+        adaptation = np.where(n_spikes >= 3, last_isi / first_isi, np.nan)
+        return n_spikes / (duration * 1e-3), adaptation
+
+    def errors(candidates):
+        candidate_rate, candidate_adaptation = features(candidates)
+        scale = max(rate.max(), 1)
+        error = np.sum(((candidate_rate - rate) / scale)**2, axis=1)
+        # Adaptation counts where it is defined in both models; a
+        # mismatch in whether it is defined is penalised.
+        defined = np.isnan(candidate_adaptation) == np.isnan(adaptation)
+        difference = np.where(np.isnan(candidate_adaptation - adaptation),
+                              0, candidate_adaptation - adaptation)
+        return error + np.sum(difference**2, axis=1) + np.sum(~defined,
+                                                              axis=1)
+
+    rng = generator(seed)
+    candidates = latin_hypercube(bounds, n_samples, seed=rng)[names].values
+    error = errors(candidates)
+    best = candidates[np.argmin(error)]
+    best_error = error.min()
+    for iteration in range(n_iter):
+        scale = 0.1 * (high - low) * (1 - iteration / n_iter)
+        candidates = np.clip(
+            best + rng.normal(scale=scale, size=(n_samples, len(names))),
+            low, high)
+        error = errors(candidates)
+        if error.min() < best_error:
+            best = candidates[np.argmin(error)]
+            best_error = error.min()
+
+    params = dict(reduced_params)
+    params.update({name: float(value) for name, value in zip(names, best)})
+    reduced_rate, reduced_adaptation = features(best[np.newaxis])
+    return params, pd.DataFrame({'amplitude': amplitudes,
+                                 'rate_full': rate,
+                                 'rate_reduced': reduced_rate[0],
+                                 'adaptation_full': adaptation,
+                                 'adaptation_reduced':
+                                     reduced_adaptation[0]})
@@ -0,0 +1,239 @@
+"""
+Regression checks against reference ("golden") traces.
+
+A set of canonical simulations (current and voltage clamp steps in
+model dMSNs and iMSNs) is run with fixed settings, and its traces are
+saved as reference data. After a change to the code (e.g. to a
+mechanism or to the integration settings), the same simulations are
+run again and compared with the reference, within a tolerance band, to
+verify that the behaviour of the model has not changed.
+
+Example
+-------
+Before the change:
+>>> record('golden')
+After the change:
+>>> report = compare('golden')
+>>> report[~report['passed']]
+
+or, from the command line:
+    python -m msn.golden record golden
+    python -m msn.golden compare golden
+
+Without a directory, the reference traces distributed with the model
+(in `reference_directory`) are used.
+
+author: Antonio Gonzalez
+"""
+import argparse
+import contextlib
+import sys
+from pathlib import Path
+
+import numpy as np
+import pandas as pd
+from neuron import h
+
+from . import rng
+from .cell import MSN
+from .instrumentation import ActionPotentials, Stim, VoltageClamp
+from .simulation import set_integrator
+
+
+def _current_step(cell_type, cell_index, amplitude):
+    cell = MSN(cell_type, cell_index)
+    stim = Stim(cell)
+    stim.set_stim(delay=100, duration=500, amplitude=amplitude,
+                  tmax=700)
+    stim.run()
+    return {'t': stim.t.as_numpy().copy(), 'v': stim.v.as_numpy().copy()}
+
+
+def _voltage_step(cell_type, cell_index, command):
+    cell = MSN(cell_type, cell_index)
+    vclamp = VoltageClamp(cell, record_currents=False)
+    vclamp.set_clamp(holding=-80, command=command, delay=20, duration=100,
+                     tmax=150)
+    vclamp.run()
+    return {'t': vclamp.t.as_numpy().copy(),
+            'i': vclamp.i.as_numpy().copy()}
+
+
+# Canonical simulations, as {name: (function, kwargs)}. Each function
+# returns a dict of arrays, with time in 't'.
+cases = {
+    'dmsn_subthreshold': (_current_step, {
+        'cell_type': 'dmsn', 'cell_index': 12, 'amplitude': -0.05}),
+    'dmsn_firing': (_current_step, {
+        'cell_type': 'dmsn', 'cell_index': 12, 'amplitude': 0.05}),
+    'imsn_subthreshold': (_current_step, {
+        'cell_type': 'imsn', 'cell_index': 1, 'amplitude': -0.05}),
+    'imsn_firing': (_current_step, {
+        'cell_type': 'imsn', 'cell_index': 1, 'amplitude': 0.05}),
+    'dmsn_vclamp': (_voltage_step, {
+        'cell_type': 'dmsn', 'cell_index': 12, 'command': -20}),
+}
+
+# Default tolerance of each kind of trace (mV for 'v', nA for 'i').
+tolerances = {'v': 0.5, 'i': 0.01}
+
+# Reference traces distributed with the model.
+reference_directory = Path(__file__).parent / 'reference'
+
+
+@contextlib.contextmanager
+def _fixed_settings():
+    # Fixed step integration with dt=0.025 ms and a master seed of 0;
+    # the integrator and the random number generators are restored
+    # afterwards.
+    cvode = h.CVode()
+    saved = (cvode.active(), h.dt, h.secondorder, cvode.atol(),
+             cvode.rtol())
+    try:
+        with rng.preserve():
+            set_integrator('fixed', dt=0.025)
+            rng.set_seed(0)
+            yield
+    finally:
+        active, h.dt, h.secondorder, atol, rtol = saved
+        cvode.active(active)
+        cvode.atol(atol)
+        cvode.rtol(rtol)
+
+
+def run_case(name):
+    """
+    Run one canonical simulation.
+
+    The integrator is set to the fixed step method with dt=0.025 ms,
+    and the master seed to 0, so that runs are reproducible; both are
+    restored afterwards.
+
+    Parameters
+    ----------
+    name : str
+        A key of `cases`.
+
+    Returns
+    -------
+    traces : dict
+        Arrays, as {'t': time, name: trace}.
+    """
+    if name not in cases:
+        raise ValueError(f"Unknown case '{name}'; it must be one of "
+                         f"{list(cases)}")
+    function, kwargs = cases[name]
+    with _fixed_settings():
+        return function(**kwargs)
+
+
+def record(directory=reference_directory, names=None):
+    """
+    Run canonical simulations and save their traces as reference.
+
+    Parameters
+    ----------
+    directory : str or Path, default=reference_directory
+        Where to save the traces, one .npz file per case.
+    names : None or list of str, default=None
+        Cases to run. If None, all of `cases`.
+
+    Returns
+    -------
+    paths : list of Path
+        The files written.
+    """
+    directory = Path(directory)
+    directory.mkdir(parents=True, exist_ok=True)
+    paths = []
+    for name in names or cases:
+        path = directory / f'{name}.npz'
+        np.savez_compressed(path, **run_case(name))
+        paths.append(path)
+    return paths
+
+
+def compare(directory=reference_directory, names=None, tolerance=None):
+    """
+    Run canonical simulations and compare them with the reference.
+
+    Each trace is interpolated on the time points of the reference,
+    and the largest absolute difference is compared with the tolerance.
+    For voltage traces, the number of action potentials must also be
+    the same.
+
+    Parameters
+    ----------
+    directory : str or Path, default=reference_directory
+        Directory with the reference traces (see record()).
+    names : None or list of str, default=None
+        Cases to compare. If None, all those with a reference file.
+    tolerance : None or dict, default=None
+        Tolerance of each kind of trace, e.g. {'v': 1}; defaults to
+        `tolerances`.
+
+    Returns
+    -------
+    report : pandas dataframe
+        One row per trace, with columns [case, trace, max_error,
+        tolerance, n_spikes, n_spikes_reference, passed].
+    """
+    directory = Path(directory)
+    tolerance = {**tolerances, **(tolerance or {})}
+    if names is None:
+        names = [path.stem for path in sorted(directory.glob('*.npz'))
+                 if path.stem in cases]
+    rows = []
+    for name in names:
+        with np.load(directory / f'{name}.npz') as data:
+            reference = dict(data)
+        traces = run_case(name)
+        for key, trace in traces.items():
+            if key == 't':
+                continue
+            expected = reference[key]
+            actual = np.interp(reference['t'], traces['t'], trace)
+            error = np.max(np.abs(actual - expected))
+            row = {'case': name, 'trace': key, 'max_error': error,
+                   'tolerance': tolerance[key], 'n_spikes': None,
+                   'n_spikes_reference': None}
+            passed = error <= tolerance[key]
+            if key == 'v':
+                row['n_spikes'] = ActionPotentials(traces['t'], trace).n
+                row['n_spikes_reference'] = ActionPotentials(
+                    reference['t'], expected).n
+                passed &= row['n_spikes'] == row['n_spikes_reference']
+            row['passed'] = bool(passed)
+            rows.append(row)
+    return pd.DataFrame(rows, columns=[
+        'case', 'trace', 'max_error', 'tolerance', 'n_spikes',
+        'n_spikes_reference', 'passed'])
+
+
+def main(argv=None):
+    parser = argparse.ArgumentParser(
+        prog='python -m msn.golden',
+        description='Record or check reference traces of the model.')
+    parser.add_argument('command', choices=['record', 'compare'])
+    parser.add_argument('directory', nargs='?',
+                        default=reference_directory,
+                        help='directory of the reference traces '
+                        '(default: those distributed with the model)')
+    parser.add_argument('--case', action='append', dest='names',
+                        help='case to run (default: all); may be repeated')
+    args = parser.parse_args(argv)
+    if args.command == 'record':
+        for path in record(args.directory, args.names):
+            print(path)
+        return 0
+    report = compare(args.directory, args.names)
+    if report.empty:
+        print(f'No reference traces in {args.directory}',
+              file=sys.stderr)
+        return 1
+    print(report.to_string(index=False))
+    return 0 if report['passed'].all() else 1
+
+
+if __name__ == '__main__':
+    sys.exit(main())
@@ -1,9 +1,121 @@
+import json
+from pathlib import Path
+
 import neuron as nrn
 from neuron import h
 import numpy as np
+import pandas as pd
 import matplotlib.pyplot as plt
 
 
+def as_array(x):
+    """
+    Return a NEURON vector (or any array_like) as a numpy array.
+    """
+    if hasattr(x, 'as_numpy'):
+        return x.as_numpy()
+    return np.asarray(x)
+
+
+def get_section(cell, name):
+    """
+    Get a cell section by name.
+
+    Parameters
+    ----------
+    cell : object
+        A NEURON model cell
+    name : str
+        Section name in NEURON's standard naming format for sections,
+        e.g. 'soma', 'dend[45]' or 'axon[0]'.
+
+    Returns
+    -------
+    section : object
+        The NEURON section.
+    """
+    if name == 'soma':
+        return cell.soma
+    for section in cell.all:
+        if name in section.name():
+            return section
+    raise ValueError(f'{name} is not a section in cell.')
+
+
+class Electrode:
+    """
+    A patch electrode between the amplifier and the cell.
+
+    Real recordings are made through an electrode with a series (access)
+    resistance and a capacitance to the bath, so that injected currents
+    are filtered, the potential at the amplifier differs from the
+    membrane potential by the voltage drop across the series resistance,
+    and the amplifier's bridge balance removes only part of this drop.
+    The electrode is modelled as a compartment (the tip) with the
+    pipette capacitance, connected to the cell through the series
+    resistance. Stimuli and recordings (see Stim and VoltageClamp) are
+    then made at the tip.
+
+    Attributes
+    ----------
+    tip : object
+        The NEURON section of the electrode tip.
+    rs : float
+        Series resistance (MOhm).
+    cp : float
+        Pipette capacitance (pF).
+    bridge : float
+        Resistance compensated by the bridge balance (MOhm).
+
+    Example
+    -------
+    An access resistance of 20 MOhm, with the bridge balanced at 15:
+    >>> electrode = Electrode(cell, rs=20, cp=4, bridge=15)
+    >>> stim = Stim(cell, electrode=electrode)
+    """
+
+    def __init__(self, cell, section='soma', x=0.5, rs=10, cp=3,
+                 bridge=None):
+        """
+        Parameters
+        ----------
+        cell : object
+            A NEURON model cell
+        section : str, default='soma'
+            Cell section where the electrode is attached; see Stim.
+        x : float, default=0.5
+            Location on the section.
+        rs : numeric, default=10
+            Series resistance in MOhm.
+        cp : numeric, default=3
+            Pipette capacitance in pF.
+        bridge : None or numeric, default=None
+            Resistance (MOhm) compensated by the bridge balance in
+            current clamp. If None, equal to `rs` (perfect balance);
+            0 for no compensation.
+        """
+        self.cell = cell
+        self.rs = rs
+        self.cp = cp
+        self.bridge = rs if bridge is None else bridge
+        self.tip = h.Section(name='electrode')
+        self.tip.L = self.tip.diam = 1
+        self.tip.nseg = 1
+        area = np.pi * self.tip.diam * self.tip.L * 1e-8  # cm2
+        # Capacitance in uF/cm2, and the axial resistivity for which
+        # the half-section resistance (from the tip node to the cell)
+        # equals rs.
+        self.tip.cm = cp * 1e-6 / area
+        cross_section = np.pi * (self.tip.diam / 2)**2 * 1e-8  # cm2
+        self.tip.Ra = (rs * 1e6 * cross_section
+                       / (self.tip.L / 2 * 1e-4))
+        self.tip.connect(get_section(cell, section)(x), 0)
+
+    def __repr__(self):
+        return (f'Electrode(rs={self.rs}, cp={self.cp}, '
+                f'bridge={self.bridge})')
+
+
 class ActionPotentials:
     """
     Action potentials in a voltage trace.
@@ -14,24 +126,52 @@ class ActionPotentials:
         The number of action potentials in the trace.
     threshold : numeric, default=0
         The voltage threshold used to detect aciton potetnials.
+    refractory : numeric, default=0
+        Minimum time between action potentials.
     timestamps : array
         Timestamps of detected action potentials.
+    isi : array
+        Inter-spike intervals.
+    cv : float
+        Coefficient of variation of the inter-spike intervals.
+
+    Methods
+    -------
+    firing_rate(start=None, stop=None)
+        Mean firing rate.
+    latency(onset)
+        Latency to the first action potential after a given time.
+    isi_histogram(bins=10, range=None)
+        Histogram of inter-spike intervals.
+
+    Example
+    -------
+    >>> stim.run()
+    >>> ap = ActionPotentials(stim.t, stim.v)
+    >>> ap.firing_rate(start=stim.stim.delay,
+    ...                stop=stim.stim.delay + stim.stim.dur)
     """
 
-    def __init__(self, x, y, threshold=0):
+    def __init__(self, x, y, threshold=0, refractory=0):
         """
         Parameters
         ----------
-        x : HocObject
-            A NEURON vector of time values.
-        y : HocObject
-            A NEURON vector of voltage values.
+        x : HocObject or array_like
+            A NEURON vector (or array) of time values in ms.
+        y : HocObject or array_like
+            A NEURON vector (or array) of voltage values.
         threshold : numeric, default=0
             Voltage threshold for detecting action potentials.
+        refractory : numeric, default=0
+            Refractory period in ms. Threshold crossings that occur less
+            than this time after an action potential are ignored. This
+            is useful e.g. with noisy traces that cross the threshold
+            several times during one action potential.
         """
         self._x = x
         self._y = y
         self._threshold = threshold
+        self._refractory = refractory
 
         self._n_spikes = 0
         self._timestamps = np.nan
@@ -39,10 +179,17 @@ class ActionPotentials:
 
     def _get_action_potentials(self):
         is_above_threshold = np.where(
-            self._y.as_numpy() > self.threshold, 1, 0)
+            as_array(self._y) > self.threshold, 1, 0)
         is_upstroke = np.diff(is_above_threshold) == 1
-        self._n_spikes = is_upstroke.sum()
-        self._timestamps = self._x.as_numpy()[:-1][is_upstroke]
+        timestamps = as_array(self._x)[:-1][is_upstroke]
+        if self._refractory > 0 and len(timestamps) > 0:
+            keep = [timestamps[0]]
+            for timestamp in timestamps[1:]:
+                if timestamp - keep[-1] >= self._refractory:
+                    keep.append(timestamp)
+            timestamps = np.array(keep)
+        self._timestamps = timestamps
+        self._n_spikes = len(timestamps)
 
     @property
     def n(self):
@@ -77,6 +224,106 @@ class ActionPotentials:
         self._threshold = value
         self._get_action_potentials()
 
+    @property
+    def refractory(self):
+        """
+        Refractory period for detecting action potentials.
+
+        The action potentials in the voltage trace will be detected
+        whenever this value is set.
+        """
+        return self._refractory
+
+    @refractory.setter
+    def refractory(self, value):
+        self._refractory = value
+        self._get_action_potentials()
+
+    @property
+    def isi(self):
+        """
+        Inter-spike intervals in ms.
+        """
+        return np.diff(self._timestamps)
+
+    @property
+    def cv(self):
+        """
+        Coefficient of variation (standard deviation / mean) of the
+        inter-spike intervals, or NaN if there are fewer than 2
+        intervals.
+        """
+        isi = self.isi
+        if len(isi) < 2:
+            return np.nan
+        return isi.std() / isi.mean()
+
+    def firing_rate(self, start=None, stop=None):
+        """
+        Mean firing rate in Hz.
+
+        Parameters
+        ----------
+        start, stop : None or numeric, default=None
+            Time window in ms over which to calculate the firing rate,
+            e.g. the duration of a current step. If None, the start
+            (or end) of the trace.
+
+        Returns
+        -------
+        rate : float
+            Number of action potentials per second.
+        """
+        x = as_array(self._x)
+        if start is None:
+            start = x[0]
+        if stop is None:
+            stop = x[-1]
+        timestamps = self._timestamps
+        n = np.sum((timestamps >= start) & (timestamps < stop))
+        return n / ((stop - start) / 1000)
+
+    def latency(self, onset):
+        """
+        Latency to the first action potential.
+
+        Parameters
+        ----------
+        onset : numeric
+            Time in ms from which latency is measured, e.g. the start
+            of a stimulus.
+
+        Returns
+        -------
+        latency : float
+            Time in ms between `onset` and the first action potential
+            after it, or NaN if there are no action potentials.
+        """
+        after = self._timestamps[self._timestamps >= onset]
+        if len(after) == 0:
+            return np.nan
+        return after[0] - onset
+
+    def isi_histogram(self, bins=10, range=None):
+        """
+        Histogram of inter-spike intervals.
+
+        Parameters
+        ----------
+        bins : int or sequence, default=10
+            Number of bins or bin edges; see numpy.histogram.
+        range : None or (float, float), default=None
+            Lower and upper range of the bins in ms.
+
+        Returns
+        -------
+        counts : array
+            Number of intervals in each bin.
+        edges : array
+            Bin edges in ms.
+        """
+        return np.histogram(self.isi, bins=bins, range=range)
+
 
 class Stim:
     """
@@ -92,6 +339,8 @@ class Stim:
         Time vector
     v : array_like
         Voltage vector
+    i : array_like
+        Injected current vector
 
     Methods
     -------
@@ -117,7 +366,8 @@ class Stim:
     >>> stim.plot()
     """
 
-    def __init__(self, cell, section='soma'):
+    def __init__(self, cell, section='soma', record_dt=None,
+                 electrode=None):
         """
         Parameters
         ----------
@@ -127,25 +377,39 @@ class Stim:
             Cell section where stimulus will be applied. It should be in
             NEURON's standard naming format for sections, e.g.
             'dend[45]' or 'axon[0]'.
+        record_dt : None or numeric, default=None
+            Sampling interval for recording in ms. If None (default),
+            time and voltage are recorded at every time step. Setting
+            this is useful to record on a uniform time grid when using
+            variable time step integration; see
+            simulation.set_integrator().
+        electrode : None or Electrode, default=None
+            If given, the current is injected, and the voltage
+            recorded, through this electrode (`section` is ignored),
+            and `v` is the voltage reported by the amplifier after
+            bridge balance.
         """
         self.cell = cell
-        stim = None
-        if section == 'soma':
-            stim = h.IClamp(0.5, sec=cell.soma)
+        self.electrode = electrode
+        if electrode is None:
+            self.stim = h.IClamp(0.5, sec=get_section(cell, section))
+            ref = cell.soma(0.5)._ref_v
         else:
-            for sec in cell.all:
-                if section in sec.name():
-                    stim = h.IClamp(0.5, sec=sec)
-                    break
-        if stim is None:
-            raise ValueError(f'{section} is not a section in cell.')
-        self.stim = stim
+            self.stim = h.IClamp(0.5, sec=electrode.tip)
+            ref = electrode.tip(0.5)._ref_v
 
         # Recording vectors
         self.t = h.Vector()
-        self.t.record(h._ref_t)
         self.v = h.Vector()
-        self.v.record(cell.soma(0.5)._ref_v)
+        self.i = h.Vector()
+        if record_dt is None:
+            self.t.record(h._ref_t)
+            self.v.record(ref)
+            self.i.record(self.stim._ref_i)
+        else:
+            self.t.record(h._ref_t, record_dt)
+            self.v.record(ref, record_dt)
+            self.i.record(self.stim._ref_i, record_dt)
 
     def set_stim(self, delay=10, duration=100, amplitude=0.25,
                  tmax=150, add_rheob=True):
@@ -196,6 +460,10 @@ class Stim:
         while h.t < self.tmax:
             h.fadvance()
         # h.run()
+        if self.electrode is not None and self.electrode.bridge != 0:
+            # Bridge balance: subtract the drop across the compensated
+            # resistance (nA * MOhm = mV).
+            self.v.sub(self.i.c().mul(self.electrode.bridge))
 
     def plot(self, ax=None, label='', **kwargs):
         """
@@ -227,3 +495,914 @@ class Stim:
         if ax.get_ylabel() == '':
             ax.set_ylabel('Membrane potential (mV)')
         return ax
+
+
+# Name of the current (a RANGE variable) computed by each of the ion
+# channel mechanisms in the model.
+channel_currents = {
+    'naf': 'ina',
+    'nap': 'ina',
+    'kaf': 'ik',
+    'kas': 'ik',
+    'kdr': 'ik',
+    'kir': 'ik',
+    'kv31': 'ik',
+    'sk': 'ik',
+    'bk': 'ik',
+    'Im': 'ik',
+    'can': 'ica',
+    'car': 'ica',
+    'cal12': 'ical',
+    'cal13': 'ical',
+    'cav32': 'ical',
+    'cav33': 'ical',
+    'pas': 'i'}
+
+
+class VoltageClamp:
+    """
+    A voltage clamp.
+
+    The membrane potential is held at a holding potential, stepped to a
+    command potential, and then returned to the holding potential. The
+    clamp current and the current through each ion channel at the
+    clamped location are recorded.
+
+    Attributes
+    ----------
+    cell : object
+        The NEURON model cell
+    clamp : object
+        The NEURON SEClamp object
+    t : array_like
+        Time vector
+    v : array_like
+        Membrane voltage vector
+    i : array_like
+        Clamp current vector (nA)
+    currents : dict
+        Current density (mA/cm2) through each ion channel mechanism at
+        the clamped location, as {mechanism: vector}.
+    i_leak, i_subtracted : None or array
+        With P/N leak subtraction, the estimated leak and capacitive
+        current, and the clamp current after subtraction (nA).
+
+    Methods
+    -------
+    set_clamp(holding=-80, command=-40, delay=10, duration=100,
+              tmax=150)
+        Set a voltage step
+    set_waveform(t, v)
+        Set an arbitrary command waveform
+    set_leak_subtraction(n=4, polarity=-1, holding=None)
+        Use P/N leak subtraction
+    run()
+        Run the simulation
+    plot(ax=None, label='', **kwargs)
+        Display the clamp current
+
+    Examples
+    --------
+    Activation of potassium currents by a step to 0 mV:
+    >>> cell = MSN(cell_type='dmsn', cell_index=12)
+    >>> vclamp = VoltageClamp(cell)
+    >>> vclamp.set_clamp(holding=-80, command=0)
+    >>> vclamp.run()
+    >>> plt.plot(vclamp.t, vclamp.currents['kaf'])
+    """
+
+    def __init__(self, cell, section='soma', rs=0.001,
+                 record_currents=True, electrode=None):
+        """
+        Parameters
+        ----------
+        cell : object
+            A NEURON model cell
+        section : str, default='soma'
+            Cell section where the clamp is applied; see Stim.
+        rs : numeric, default=0.001
+            Series resistance in MOhm. The default, very small value
+            approximates an ideal clamp; use larger values (e.g. 5-20
+            MOhm) to simulate the limitations of a real clamp.
+        record_currents : bool, default=True
+            If True, record the current through each ion channel
+            mechanism at the clamped location.
+        electrode : None or Electrode, default=None
+            If given, the cell is clamped through this electrode: the
+            clamp holds the electrode tip, and the membrane sees the
+            series resistance and pipette capacitance of the electrode.
+            `v` is then the membrane potential at the electrode's
+            location, and `rs` should be small.
+        """
+        self.cell = cell
+        if electrode is None:
+            segment = get_section(cell, section)(0.5)
+            self.clamp = h.SEClamp(segment)
+        else:
+            # The segment where the electrode is attached.
+            segment = electrode.tip.parentseg()
+            self.clamp = h.SEClamp(0.5, sec=electrode.tip)
+        self.clamp.rs = rs
+        self._waveform = None
+        self._pn = None
+        self.i_leak = None
+        self.i_subtracted = None
+
+        # Recording vectors
+        self.t = h.Vector()
+        self.t.record(h._ref_t)
+        self.v = h.Vector()
+        self.v.record(segment._ref_v)
+        self.i = h.Vector()
+        self.i.record(self.clamp._ref_i)
+        self.currents = {}
+        if record_currents is True:
+            for mech in segment:
+                if mech.name() in channel_currents:
+                    current = channel_currents[mech.name()]
+                    vector = h.Vector()
+                    vector.record(getattr(mech, f'_ref_{current}'))
+                    self.currents[mech.name()] = vector
+
+    def set_clamp(self, holding=-80, command=-40, delay=10,
+                  duration=100, tmax=150):
+        """
+        Set a voltage step.
+
+        Parameters
+        ----------
+        holding : numeric, default=-80
+            Holding potential in mV.
+        command : numeric, default=-40
+            Command potential in mV.
+        delay : numeric, default=10
+            Time at the holding potential before the step, in ms.
+        duration : numeric, default=100
+            Step duration in ms.
+        tmax : numeric, default=150
+            Length of simulation in ms.
+        """
+        self._remove_waveform()
+        self.clamp.amp1 = holding
+        self.clamp.dur1 = delay
+        self.clamp.amp2 = command
+        self.clamp.dur2 = duration
+        self.clamp.amp3 = holding
+        self.clamp.dur3 = max(tmax - delay - duration, 0)
+        self.tmax = tmax
+
+    def set_waveform(self, t, v):
+        """
+        Set an arbitrary command waveform.
+
+        Parameters
+        ----------
+        t : array_like
+            Time values in ms.
+        v : array_like
+            Command potential in mV at each time in `t`. Values are
+            linearly interpolated between time points.
+        """
+        self._remove_waveform()
+        t = h.Vector(t)
+        v = h.Vector(v)
+        v.play(self.clamp._ref_amp1, t, True)
+        self._waveform = (t, v)
+        self.clamp.dur1 = t.x[t.size() - 1]
+        self.clamp.dur2 = 0
+        self.clamp.dur3 = 0
+        self.tmax = t.x[t.size() - 1]
+
+    def set_leak_subtraction(self, n=4, polarity=-1, holding=None):
+        """
+        Use P/N leak subtraction, as in experiments.
+
+        Besides the test step, `n` small steps of 1/n of its amplitude
+        are applied, in a range of potentials where voltage-gated
+        channels are (ideally) closed. With a command waveform
+        (set_waveform), the subpulses are the waveform scaled by 1/n
+        about its first value. Their currents, which are only
+        the linear leak and capacitive currents, are summed to estimate
+        the linear current of the test step, which is then subtracted
+        from the clamp current (`i_subtracted`).
+
+        Parameters
+        ----------
+        n : int, default=4
+            Number of subpulses (the N of P/N). 0 to switch off leak
+            subtraction.
+        polarity : {-1, 1}, default=-1
+            Direction of the subpulses relative to the test step; -1
+            (opposite direction) keeps them away from the activation
+            range of depolarisation-activated channels.
+        holding : None or numeric, default=None
+            Holding potential (mV) of the subpulses. If None, the
+            holding potential of the test step (the first value of a
+            waveform).
+
+        Notes
+        -----
+        The holding current of the subpulses is measured before the
+        command first departs from its initial value, which should thus
+        be held for a while (as the `delay` of set_clamp). Subtraction
+        is only as good
+        as the assumption that no channel opens during the subpulses:
+        in MSNs, hyperpolarising subpulses activate Kir channels, which
+        are then partly subtracted, as in experiments.
+        """
+        if polarity not in (-1, 1):
+            raise ValueError('`polarity` must be -1 or 1')
+        self._pn = None if n == 0 else (n, polarity, holding)
+
+    def _remove_waveform(self):
+        if self._waveform is not None:
+            self._waveform[1].play_remove()
+            self._waveform = None
+
+    def run(self, v_init=None):
+        """
+        Run the simulation.
+
+        Parameters
+        ----------
+        v_init : None or numeric, default=None
+            Membrane voltage for initialising the simulation. If None,
+            the simulated cell's `v_init` attribute will be used.
+        """
+        self.i_leak = None
+        self.i_subtracted = None
+        if self._pn is not None:
+            # The subpulses are identical, so one is simulated and its
+            # current is multiplied by n. It is run first, so that the
+            # recordings hold the test step.
+            n, polarity, holding = self._pn
+            if self._waveform is None:
+                test = (self.clamp.amp1, self.clamp.amp2, self.clamp.amp3)
+                if holding is None:
+                    holding = test[0]
+                step = polarity * (test[1] - test[0]) / n
+                self.clamp.amp1 = self.clamp.amp3 = holding
+                self.clamp.amp2 = holding + step
+                onset = self.clamp.dur1
+            else:
+                times = self._waveform[0].as_numpy().copy()
+                test = self._waveform[1].as_numpy().copy()
+                if holding is None:
+                    holding = test[0]
+                self._waveform[1].from_python(
+                    holding + polarity * (test - test[0]) / n)
+                changed = np.flatnonzero(test != test[0])
+                onset = times[changed[0]] if changed.size else times[-1]
+            self._run(v_init)
+            t_pn = self.t.as_numpy().copy()
+            i_pn = self.i.as_numpy().copy()
+            if self._waveform is None:
+                self.clamp.amp1, self.clamp.amp2, self.clamp.amp3 = test
+            else:
+                self._waveform[1].from_python(test)
+            self._run(v_init)
+            # Baseline (holding) current of the subpulses, before the
+            # command changes.
+            baseline = t_pn < onset
+            if not baseline.any():
+                baseline = t_pn <= onset
+            i_pn -= i_pn[baseline].mean()
+            self.i_leak = polarity * n * np.interp(self.t.as_numpy(),
+                                                   t_pn, i_pn)
+            self.i_subtracted = self.i.as_numpy() - self.i_leak
+        else:
+            self._run(v_init)
+
+    def _run(self, v_init):
+        if v_init is None:
+            h.finitialize(self.cell.v_init)
+        else:
+            h.finitialize(v_init)
+        while h.t < self.tmax:
+            h.fadvance()
+
+    def plot(self, ax=None, label='', **kwargs):
+        """
+        Plot the clamp current.
+
+        Parameters
+        ----------
+        ax : None or matplotlib axes object
+            Matplotlib axes to use for plotting. If None (default), one
+            will be created.
+        label : str
+            Legend label.
+        **kwargs :
+            Additional keyword arguments passed on to the plot function.
+
+        Returns
+        -------
+        ax : matplotlib axes object
+            The matplotlib axes used for plotting.
+        """
+        if ax is None:
+            ax = plt.figure().add_subplot(111)
+        ax.plot(self.t, self.i, label=label, **kwargs)
+        if label:
+            ax.legend()
+        if ax.get_xlabel() == '':
+            ax.set_xlabel('Time (ms)')
+        if ax.get_ylabel() == '':
+            ax.set_ylabel('Clamp current (nA)')
+        return ax
+
+
+class Recorder:
+    """
+    Record selected variables during a simulation.
+
+    Each variable (a "probe") is recorded with its own sampling
+    interval, so that e.g. the membrane potential can be recorded at
+    high resolution while slow variables such as calcium concentration
+    are sampled sparsely, saving memory in long simulations.
+
+    By default the samples are kept in memory for the whole simulation.
+    A probe can instead keep only its most recent samples (a ring
+    buffer), or stream its samples to a binary file (read with
+    read_memmap) as the simulation runs; in both cases the samples are
+    moved out of NEURON's vectors every `flush_interval` ms of
+    simulated time, so memory use does not grow with the duration of
+    the simulation.
+
+    Sampling a variable every `dt` ms picks single values, so that
+    fluctuations faster than the sampling interval are aliased. With
+    `average=True` the variable is recorded at every time step instead,
+    and each sample is the mean over its interval (a moving-average
+    filter before decimation), computed as the simulation runs.
+
+    Besides the traces, the recorder keeps a stream of timestamped
+    events (annotations) that give them context: action potentials,
+    stimulus onset and offset, or any event emitted by other components
+    (e.g. up-state onsets) with annotate().
+
+    Methods
+    -------
+    add(name, segment, variable='v', dt=None, buffer=None, path=None,
+        average=False)
+        Record a variable in a segment
+    add_ref(name, ref, dt=None, buffer=None, path=None, average=False)
+        Record any NEURON variable given its reference
+    get(name)
+        Recorded time and values of a probe
+    to_dataframe(names=None)
+        Recorded values in a pandas dataframe
+    remove(name)
+        Stop recording a probe
+    flush()
+        Move the samples of ring-buffer, streaming and averaging probes
+        out of NEURON's vectors
+    add_spikes(name, segment, threshold=0)
+        Record action potentials as events
+    add_stimulus(name, stim)
+        Record the onset and offset of a current clamp as events
+    annotate(kind, source='', label='', time=None)
+        Add an event
+    events()
+        All the events in a pandas dataframe
+
+    Example
+    -------
+    >>> rec = Recorder()
+    >>> rec.add('v_soma', cell.soma(0.5))
+    >>> rec.add('cai_soma', cell.soma(0.5), 'cai', dt=1)
+    >>> rec.add('ina_soma', cell.soma(0.5), 'naf.ina', dt=0.1)
+    >>> stim.run()
+    >>> t, v = rec.get('v_soma')
+
+    Keep only the last second of the voltage, and stream the calcium
+    concentration to a file:
+    >>> rec = Recorder()
+    >>> rec.add('v_soma', cell.soma(0.5), dt=0.1, buffer=10000)
+    >>> rec.add('cai_soma', cell.soma(0.5), 'cai', dt=1,
+    ...         path='cai_soma.dat')
+
+    The mean membrane potential in 1 ms intervals:
+    >>> rec.add('v_mean', cell.soma(0.5), dt=1, average=True)
+
+    Events:
+    >>> rec.add_spikes('soma', cell.soma(0.5))
+    >>> rec.add_stimulus('step', stim.stim)
+    >>> stim.run()
+    >>> rec.events()
+    """
+
+    def __init__(self, flush_interval=1000):
+        """
+        Parameters
+        ----------
+        flush_interval : numeric, default=1000
+            Simulated time (ms) between transfers of the samples of
+            ring-buffer, streaming and averaging probes out of NEURON's
+            vectors.
+        """
+        self._probes = {}
+        self._t = h.Vector()
+        self._t.record(h._ref_t)
+        self._spike_detectors = {}
+        self._stimuli = {}
+        self._annotations = []
+        self._buffers = {}
+        self.flush_interval = flush_interval
+        self._init_handler = h.FInitializeHandler(self._initialize)
+
+    def add(self, name, segment, variable='v', dt=None, buffer=None,
+            path=None, average=False):
+        """
+        Record a variable in a segment.
+
+        Parameters
+        ----------
+        name : str
+            Name of the probe.
+        segment : object
+            NEURON segment, e.g. `cell.soma(0.5)`.
+        variable : str, default='v'
+            Variable to record, e.g. 'v' or 'cai'. Variables of a
+            mechanism are given as 'mechanism.variable', e.g.
+            'naf.ina' or 'kir.gk'.
+        dt : None or numeric, default=None
+            Sampling interval in ms. If None, record at every time
+            step.
+        buffer, path, average :
+            Ring buffer size, file to stream to, and averaging; see
+            add_ref.
+        """
+        if '.' in variable:
+            mech, variable = variable.split('.')
+            ref = getattr(getattr(segment, mech), f'_ref_{variable}')
+        else:
+            ref = getattr(segment, f'_ref_{variable}')
+        self.add_ref(name, ref, dt=dt, buffer=buffer, path=path,
+                     average=average)
+
+    def add_ref(self, name, ref, dt=None, buffer=None, path=None,
+                average=False):
+        """
+        Record any NEURON variable given its reference.
+
+        Parameters
+        ----------
+        name : str
+            Name of the probe.
+        ref : object
+            Reference to a NEURON variable, e.g.
+            `cell.soma(0.5)._ref_v` or `synapse._ref_i`.
+        dt : None or numeric, default=None
+            Sampling interval in ms. If None, record at every time
+            step.
+        buffer : None or int, default=None
+            If given, keep only the last `buffer` samples (ring
+            buffer). Requires `dt`.
+        path : None, str or Path, default=None
+            If given, stream the samples (float64) to this file, which
+            is overwritten when the simulation is initialised and can
+            be read with read_memmap, also while the simulation is
+            running. Requires `dt`.
+        average : bool, default=False
+            If True, record at every time step and keep the mean of
+            each interval of `dt` ms (the sample at time t is the mean
+            over [t, t + dt)); intervals without any time step (with
+            the variable step method) take the previous mean. The
+            samples of the last, incomplete interval are not returned.
+            Requires `dt`; can be combined with `buffer` or `path`.
+        """
+        if name in self._probes:
+            raise ValueError(f'Probe {name} already exists.')
+        if buffer is not None and path is not None:
+            raise ValueError('Give either `buffer` or `path`, not both.')
+        if (buffer is not None or path is not None or average) and (
+                dt is None):
+            raise ValueError('Ring-buffer, streaming and averaging '
+                             'probes need a sampling interval `dt`.')
+        values = h.Vector()
+        if dt is None or average:
+            values.record(ref)
+        else:
+            values.record(ref, dt)
+        self._probes[name] = (values, dt)
+        if buffer is not None:
+            self._buffers[name] = {'size': int(buffer), 'n': 0,
+                                   'data': np.zeros(0)}
+        elif path is not None:
+            self._buffers[name] = {'path': Path(path), 'n': 0}
+        elif average:
+            # Averages are kept in memory as a buffer without a size.
+            self._buffers[name] = {'size': None, 'n': 0,
+                                   'data': np.zeros(0)}
+        if average:
+            state = self._buffers[name]
+            state['times'] = h.Vector().record(h._ref_t)
+            self._reset_average(state)
+
+    def remove(self, name):
+        """
+        Stop recording a probe and discard its data.
+        """
+        values, __ = self._probes.pop(name)
+        values.play_remove()
+        self._buffers.pop(name, None)
+
+    @staticmethod
+    def _reset_average(state):
+        # Samples (and their times) of the interval being averaged, the
+        # index of that interval, and the last mean.
+        state['pending'] = np.zeros(0)
+        state['pending_t'] = np.zeros(0)
+        state['bin'] = 0
+        state['last'] = np.nan
+
+    @staticmethod
+    def _average(state, times, samples, dt):
+        # Means of the samples in consecutive intervals of `dt` ms, up
+        # to the last, incomplete one, whose samples are kept in
+        # `state` for the next call.
+        times = np.concatenate([state['pending_t'], times])
+        samples = np.concatenate([state['pending'], samples])
+        if times.size == 0:
+            return np.zeros(0)
+        bins = np.floor(times / dt + 1e-9).astype(int) - state['bin']
+        last = bins[-1]
+        done = bins < last
+        state['pending_t'] = times[~done]
+        state['pending'] = samples[~done]
+        if last <= 0:
+            return np.zeros(0)
+        counts = np.bincount(bins[done], minlength=last)
+        sums = np.bincount(bins[done], weights=samples[done],
+                           minlength=last)
+        means = sums / np.maximum(counts, 1)
+        # Intervals without samples take the previous mean.
+        previous = np.maximum.accumulate(
+            np.where(counts > 0, np.arange(last), -1))
+        means = np.where(previous >= 0, means[previous], state['last'])
+        state['bin'] += last
+        state['last'] = means[-1]
+        return means
+
+    def _initialize(self):
+        # Events belong to a single run.
+        self._annotations = []
+        for name, state in self._buffers.items():
+            state['n'] = 0
+            if 'times' in state:
+                self._reset_average(state)
+            if 'path' in state:
+                state['path'].write_bytes(b'')
+                _write_memmap_index(state['path'], [name],
+                                    self._probes[name][1], np.float64, 0)
+            else:
+                state['data'] = np.zeros(0)
+        if self._buffers:
+            h.CVode().event(self.flush_interval, self._flush_event)
+
+    def _flush_event(self):
+        self.flush()
+        h.CVode().event(h.t + self.flush_interval, self._flush_event)
+
+    def flush(self):
+        """
+        Move the samples of ring-buffer, streaming and averaging probes
+        out of NEURON's vectors.
+
+        This is done periodically during the simulation, and when the
+        data are read with get(); it only needs to be called to update
+        the streamed files at the end of a simulation.
+        """
+        for name, state in self._buffers.items():
+            values, dt = self._probes[name]
+            samples = values.as_numpy().copy()
+            values.resize(0)
+            if 'times' in state:
+                times = state['times'].as_numpy().copy()
+                state['times'].resize(0)
+                samples = self._average(state, times, samples, dt)
+            state['n'] += samples.size
+            if 'path' in state:
+                with open(state['path'], 'ab') as file:
+                    file.write(samples.astype(np.float64).tobytes())
+                _write_memmap_index(state['path'], [name], dt,
+                                    np.float64, state['n'])
+            elif state['size'] is None:
+                state['data'] = np.concatenate([state['data'], samples])
+            else:
+                data = np.concatenate([state['data'], samples])
+                state['data'] = data[-state['size']:]
+
+    def add_spikes(self, name, segment, threshold=0):
+        """
+        Record action potentials in a segment as events.
+
+        Parameters
+        ----------
+        name : str
+            Name of the event source.
+        segment : object
+            NEURON segment, e.g. `cell.soma(0.5)`.
+        threshold : numeric, default=0
+            Voltage threshold for detecting action potentials.
+        """
+        detector = h.NetCon(segment._ref_v, None, sec=segment.sec)
+        detector.threshold = threshold
+        times = h.Vector()
+        detector.record(times)
+        self._spike_detectors[name] = (detector, times)
+
+    def add_stimulus(self, name, stim):
+        """
+        Record the onset and offset of a current clamp as events.
+
+        Parameters
+        ----------
+        name : str
+            Name of the event source.
+        stim : NEURON IClamp
+            The current clamp, e.g. `Stim.stim`. Its timing is read when
+            events() is called, so it may be changed after this.
+        """
+        self._stimuli[name] = stim
+
+    def annotate(self, kind, source='', label='', time=None):
+        """
+        Add an event.
+
+        Parameters
+        ----------
+        kind : str
+            Kind of event, e.g. 'up_state_onset'.
+        source : str, default=''
+            Component that emitted the event.
+        label : str, default=''
+            Free-text description.
+        time : None or numeric, default=None
+            Time of the event in ms. If None, the current simulation
+            time, so that this can be called during a simulation (e.g.
+            from a callback scheduled with CVode.event).
+
+        Notes
+        -----
+        Events are cleared when the simulation is initialised, so that
+        events() only returns those of the last run; events added
+        before a run are thus discarded.
+        """
+        if time is None:
+            time = h.t
+        self._annotations.append((float(time), kind, source, label))
+
+    def events(self):
+        """
+        All the events, sorted by time.
+
+        Returns
+        -------
+        events : pandas dataframe
+            One row per event with columns [time, kind, source, label].
+            Action potentials are of kind 'spike' and current clamps
+            produce 'stimulus_on' and 'stimulus_off' events.
+        """
+        rows = list(self._annotations)
+        for name, (__, times) in self._spike_detectors.items():
+            rows.extend((t, 'spike', name, '') for t in times)
+        for name, stim in self._stimuli.items():
+            label = f'{stim.amp} nA'
+            rows.append((stim.delay, 'stimulus_on', name, label))
+            rows.append((stim.delay + stim.dur, 'stimulus_off', name,
+                         label))
+        events = pd.DataFrame(rows,
+                              columns=['time', 'kind', 'source', 'label'])
+        return events.sort_values('time', kind='stable',
+                                  ignore_index=True)
+
+    @property
+    def names(self):
+        """
+        Names of the probes.
+        """
+        return list(self._probes)
+
+    def get(self, name):
+        """
+        Recorded time and values of a probe.
+
+        Returns
+        -------
+        t : array
+            Time in ms.
+        values : array
+            Recorded values. For a ring-buffer probe, the last samples;
+            for a streaming probe, the memory-mapped file.
+        """
+        values, dt = self._probes[name]
+        if name in self._buffers:
+            self.flush()
+            state = self._buffers[name]
+            if 'path' in state:
+                t, data = read_memmap(state['path'])
+                return t, data[name]
+            values = state['data']
+            t = (state['n'] - values.size + np.arange(values.size)) * dt
+            return t, values
+        values = values.as_numpy()
+        if dt is None:
+            t = self._t.as_numpy()[:values.size]
+        else:
+            t = np.arange(values.size) * dt
+        return t, values
+
+    def to_dataframe(self, names=None):
+        """
+        Recorded values in a pandas dataframe.
+
+        Parameters
+        ----------
+        names : None or list of str, default=None
+            Probes to include. If None, all probes. They must all have
+            the same sampling interval.
+
+        Returns
+        -------
+        data : pandas dataframe
+            A column 't' for time plus one column per probe.
+        """
+        if names is None:
+            names = self.names
+        intervals = set(self._probes[name][1] for name in names)
+        if len(intervals) > 1:
+            raise ValueError('Probes have different sampling intervals.')
+        data = {}
+        for name in names:
+            t, values = self.get(name)
+            data.setdefault('t', t)
+            data[name] = values
+        return pd.DataFrame(data)
+
+
+class MemmapRecorder:
+    """
+    Record variables directly to a binary file during a simulation.
+
+    For very long simulations, traces held in memory (NEURON vectors)
+    may not fit in RAM. Here the simulation is run in chunks, and at the
+    end of each chunk the recorded samples are appended to a binary
+    file and discarded from memory. An index file (the data file name
+    plus '.json') describes the data and is updated after each chunk,
+    so the data recorded so far can be read (with read_memmap) while
+    the simulation is still running.
+
+    The data file holds one row per sample and one column per probe,
+    in C order, without a header. All probes are sampled at the same
+    interval.
+
+    Methods
+    -------
+    add(name, segment, variable='v')
+        Record a variable in a segment
+    add_ref(name, ref)
+        Record any NEURON variable given its reference
+    run(tstop, v_init=-80, chunk=1000)
+        Run the simulation, writing the data to the file
+
+    Example
+    -------
+    >>> rec = MemmapRecorder('long_run.dat', dt=0.1)
+    >>> rec.add('v_soma', cell.soma(0.5))
+    >>> rec.add('cai_soma', cell.soma(0.5), 'cai')
+    >>> rec.run(3600 * 1000, v_init=cell.v_init)
+    >>> t, data = read_memmap('long_run.dat')
+    >>> data['v_soma']
+    """
+
+    def __init__(self, path, dt=0.1, dtype='float32'):
+        """
+        Parameters
+        ----------
+        path : str or Path
+            Data file name. It is overwritten when run() is called.
+        dt : numeric, default=0.1
+            Sampling interval in ms.
+        dtype : str or numpy dtype, default='float32'
+            Data type of the samples in the file.
+        """
+        self.path = Path(path)
+        self.dt = dt
+        self.dtype = np.dtype(dtype)
+        self._probes = {}
+
+    def add(self, name, segment, variable='v'):
+        """
+        Record a variable in a segment; see Recorder.add.
+        """
+        if '.' in variable:
+            mech, variable = variable.split('.')
+            ref = getattr(getattr(segment, mech), f'_ref_{variable}')
+        else:
+            ref = getattr(segment, f'_ref_{variable}')
+        self.add_ref(name, ref)
+
+    def add_ref(self, name, ref):
+        """
+        Record any NEURON variable given its reference; see
+        Recorder.add_ref.
+        """
+        if name in self._probes:
+            raise ValueError(f'Probe {name} already exists.')
+        values = h.Vector()
+        values.record(ref, self.dt)
+        self._probes[name] = values
+
+    def _write_index(self, n_samples):
+        _write_memmap_index(self.path, list(self._probes), self.dt,
+                            self.dtype, n_samples)
+
+    def _flush(self, file):
+        # Write the samples recorded in all probes and discard them.
+        vectors = list(self._probes.values())
+        n = min(int(vector.size()) for vector in vectors)
+        data = np.column_stack([vector.as_numpy()[:n]
+                                for vector in vectors])
+        file.write(data.astype(self.dtype).tobytes())
+        file.flush()
+        for vector in vectors:
+            # Keep any samples beyond those written (there should be
+            # none, as all probes have the same sampling interval).
+            rest = vector.as_numpy()[n:].copy()
+            vector.resize(0)
+            vector.append(h.Vector(rest))
+        return n
+
+    def run(self, tstop, v_init=-80, chunk=1000):
+        """
+        Run the simulation, writing the data to the file.
+
+        Parameters
+        ----------
+        tstop : numeric
+            Duration of the simulation in ms.
+        v_init : numeric, default=-80
+            Initialisation membrane voltage.
+        chunk : numeric, default=1000
+            Simulated time (ms) between writes to the file.
+
+        Returns
+        -------
+        n_samples : int
+            Number of samples written.
+        """
+        n_samples = 0
+        self._write_index(n_samples)
+        with open(self.path, 'wb') as file:
+            h.finitialize(v_init)
+            while h.t < tstop:
+                stop = min(h.t + chunk, tstop)
+                while h.t < stop:
+                    h.fadvance()
+                n_samples += self._flush(file)
+                self._write_index(n_samples)
+        return n_samples
+
+
+def _write_memmap_index(path, names, dt, dtype, n_samples):
+    # Index file of a binary data file (see MemmapRecorder).
+    index = {'names': names, 'dt': dt, 'dtype': np.dtype(dtype).str,
+             'n_samples': n_samples}
+    path = Path(path)
+    with open(path.with_name(path.name + '.json'), 'w') as file:
+        json.dump(index, file, indent=2)
+
+
+def read_memmap(path):
+    """
+    Read data written by MemmapRecorder (or by a streaming probe of
+    Recorder).
+
+    The data are memory-mapped, not loaded into memory: only the parts
+    that are accessed are read from disk. The data can be read while
+    the simulation is running; they include the samples written up to
+    the last update of the index.
+
+    Parameters
+    ----------
+    path : str or Path
+        Data file name.
+
+    Returns
+    -------
+    t : array
+        Time in ms.
+    data : numpy memmap (structured)
+        The samples, with one field per probe, e.g. data['v_soma'].
+    """
+    path = Path(path)
+    with open(path.with_name(path.name + '.json')) as file:
+        index = json.load(file)
+    dtype = np.dtype([(name, index['dtype']) for name in index['names']])
+    t = np.arange(index['n_samples']) * index['dt']
+    if index['n_samples'] == 0:
+        return t, np.zeros(0, dtype=dtype)
+    data = np.memmap(path, dtype=dtype, mode='r',
+                     shape=(index['n_samples'],))
+    return t, data
@@ -0,0 +1,355 @@
+"""
+A simulated recording rig with live controls.
+
+A model cell is simulated continuously, paced to run at (a multiple
+of) real time, while its parameters are changed from outside: the
+current injected at the soma, the dopamine level, and the conductance
+of any ion channel. Changes take effect immediately, and the membrane
+potential can be read as it is simulated, as in a patch-clamp rig. The
+controls and the trace are available from Python and over HTTP, so that
+the rig can be driven from a browser, a notebook or a script.
+
+Endpoints (all data are JSON):
+
+    GET  /state               Simulation time and current settings.
+    GET  /trace?since=T       Samples (t, v) after time T (ms).
+    POST /settings            Change settings, e.g. {"amplitude": 0.2,
+                              "dopamine": 1, "kir": 0.5}.
+
+Usage:
+
+    python -m msn.live [--type TYPE] [--index N] [--port PORT]
+                       [--speed X]
+
+Example
+-------
+>>> rig = Rig(MSN('dmsn', 12), dopamine=True)
+>>> rig.start()
+>>> rig.set(amplitude=0.25)
+>>> rig.set(naf=0.5)  # Half the sodium conductance.
+>>> t, v = rig.trace(since=1000)
+>>> rig.stop()
+
+author: Antonio Gonzalez
+"""
+import argparse
+import collections
+import json
+import threading
+import time
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from urllib.parse import parse_qs, urlparse
+
+from neuron import h
+
+from .cell import MSN
+from .modulation import Dopamine
+
+
+class Rig:
+    """
+    A model cell simulated continuously with live controls.
+
+    The simulation runs in a separate thread. Settings changed with
+    set() are applied by that thread between integration steps, so they
+    never change in the middle of a step.
+
+    Settings
+    --------
+    amplitude : numeric
+        Current injected at the soma (nA).
+    dopamine : numeric
+        Dopamine modulation level (see modulation.Dopamine.set_level);
+        only if the rig was created with `dopamine`.
+    <mechanism> : numeric
+        Conductance of an ion channel (e.g. 'naf', 'kir', 'cal13'), as
+        a factor of its value when the rig was created; 0 to block the
+        channel.
+
+    Attributes
+    ----------
+    cell : object
+        The model cell.
+    settings : dict
+        Current value of each setting.
+    speed : None or numeric
+        Simulated time per real time; None to run as fast as possible.
+
+    Methods
+    -------
+    start()
+        Start the simulation
+    stop()
+        Stop the simulation
+    set(**settings)
+        Change settings
+    trace(since=None)
+        Recorded samples
+    serve(host='127.0.0.1', port=8001)
+        Serve the controls and the trace over HTTP
+    """
+
+    def __init__(self, cell, dopamine=False, record_dt=0.1, speed=1,
+                 buffer=600000, v_init=None):
+        """
+        Parameters
+        ----------
+        cell : object
+            A NEURON model cell, e.g. cell.MSN.
+        dopamine : bool or modulation.Dopamine, default=False
+            Dopamine modulation of the cell. If True, a new Dopamine
+            modulation is created, initially at level 0.
+        record_dt : numeric, default=0.1
+            Sampling interval (ms) of the membrane potential.
+        speed : None or numeric, default=1
+            Simulated time per real time, e.g. 1 for real time, 0.1 to
+            run ten times slower. If None, the simulation runs as fast
+            as possible.
+        buffer : int, default=600000
+            Number of samples kept (one minute at the default sampling
+            interval); older samples are discarded.
+        v_init : None or numeric, default=None
+            Initial membrane potential (mV). If None, the cell's
+            `v_init`.
+        """
+        self.cell = cell
+        self.speed = speed
+        self.record_dt = record_dt
+        self.v_init = cell.v_init if v_init is None else v_init
+        self.stim = h.IClamp(0.5, sec=cell.soma)
+        self.stim.delay = 0
+        self.stim.dur = 1e9
+        self.stim.amp = 0
+        self.dopamine = None
+        if dopamine is True:
+            self.dopamine = Dopamine(cell)
+            self.dopamine.set_level(0)
+        elif dopamine:
+            self.dopamine = dopamine
+        self.settings = {'amplitude': 0.}
+        if self.dopamine is not None:
+            self.settings['dopamine'] = self.dopamine.level
+        self._baseline = {}
+        self._samples = collections.deque(maxlen=buffer)
+        self._pending = {}
+        self._lock = threading.Lock()
+        self._thread = None
+        self._running = False
+
+    def _channel(self, name):
+        # Baseline conductance of a channel in every segment, as a list
+        # of (mechanism, variable, value).
+        if name not in self._baseline:
+            baseline = []
+            for section in self.cell.all:
+                for segment in section:
+                    if not hasattr(segment, name):
+                        continue
+                    mechanism = getattr(segment, name)
+                    for variable in ('gbar', 'pbar'):
+                        if hasattr(mechanism, variable):
+                            baseline.append((
+                                mechanism, variable,
+                                getattr(mechanism, variable)))
+                            break
+            if not baseline:
+                raise ValueError(f"unknown setting '{name}': not an ion "
+                                 "channel in the cell")
+            self._baseline[name] = baseline
+        return self._baseline[name]
+
+    def set(self, **settings):
+        """
+        Change settings; see the class documentation.
+
+        Raises
+        ------
+        ValueError
+            If a setting is unknown or its value is not valid.
+        """
+        for name, value in settings.items():
+            value = float(value)
+            if name == 'dopamine' and self.dopamine is None:
+                raise ValueError('the rig has no dopamine modulation')
+            if name not in ('amplitude', 'dopamine'):
+                if value < 0:
+                    raise ValueError(f'{name}: the conductance factor '
+                                     'must not be negative')
+                self._channel(name)
+            settings[name] = value
+        with self._lock:
+            self._pending.update(settings)
+        if not self._running:
+            self._apply()
+
+    def _apply(self):
+        with self._lock:
+            pending, self._pending = self._pending, {}
+        for name, value in pending.items():
+            if name == 'amplitude':
+                self.stim.amp = value
+            elif name == 'dopamine':
+                self.dopamine.set_level(value)
+            else:
+                for mechanism, variable, baseline in self._baseline[name]:
+                    setattr(mechanism, variable, baseline * value)
+            self.settings[name] = value
+        if pending and h.CVode().active():
+            h.CVode().re_init()
+
+    def _loop(self):
+        h.finitialize(self.v_init)
+        next_sample = 0
+        start = time.perf_counter()
+        while self._running:
+            self._apply()
+            # Integrate 1 ms at a time, then wait for the real time
+            # to catch up.
+            end = h.t + 1
+            while h.t < end:
+                h.fadvance()
+                if h.t >= next_sample:
+                    self._samples.append((h.t, self.cell.soma(0.5).v))
+                    next_sample += self.record_dt
+            if self.speed is not None:
+                delay = h.t / 1000 / self.speed - (
+                    time.perf_counter() - start)
+                if delay > 0:
+                    time.sleep(delay)
+
+    def start(self):
+        """
+        Start the simulation, from time 0.
+        """
+        if self._running:
+            return
+        self._samples.clear()
+        self._running = True
+        self._thread = threading.Thread(target=self._loop, daemon=True)
+        self._thread.start()
+
+    def stop(self):
+        """
+        Stop the simulation.
+        """
+        self._running = False
+        if self._thread is not None:
+            self._thread.join()
+            self._thread = None
+
+    def trace(self, since=None):
+        """
+        Recorded samples.
+
+        Parameters
+        ----------
+        since : None or numeric, default=None
+            Return only samples after this time (ms), e.g. the time of
+            the last sample read, to get the samples as they come.
+
+        Returns
+        -------
+        t, v : list
+            Time (ms) and membrane potential (mV).
+        """
+        samples = list(self._samples)
+        if since is not None:
+            samples = [sample for sample in samples if sample[0] > since]
+        if not samples:
+            return [], []
+        t, v = zip(*samples)
+        return list(t), list(v)
+
+    def state(self):
+        """
+        Simulation time (ms), whether it is running, and the settings.
+        """
+        return {'t': h.t, 'running': self._running,
+                'settings': dict(self.settings)}
+
+    def serve(self, host='127.0.0.1', port=8001):
+        """
+        Serve the controls and the trace over HTTP until interrupted.
+
+        See the module documentation for the endpoints. The simulation
+        is started if it is not running.
+        """
+        server = ThreadingHTTPServer((host, port), _Handler)
+        server.rig = self
+        self.start()
+        print(f'Listening on http://{host}:{port}')
+        try:
+            server.serve_forever()
+        except KeyboardInterrupt:
+            pass
+        finally:
+            server.server_close()
+            self.stop()
+
+
+class _Handler(BaseHTTPRequestHandler):
+    # Requests are handled with the Rig in `server.rig`.
+
+    def _send(self, code, data):
+        body = json.dumps(data).encode()
+        self.send_response(code)
+        self.send_header('Content-Type', 'application/json')
+        self.send_header('Content-Length', str(len(body)))
+        # Allow controls in a web page served from elsewhere.
+        self.send_header('Access-Control-Allow-Origin', '*')
+        self.end_headers()
+        self.wfile.write(body)
+
+    def do_GET(self):
+        url = urlparse(self.path)
+        if url.path == '/state':
+            return self._send(200, self.server.rig.state())
+        if url.path == '/trace':
+            since = parse_qs(url.query).get('since', [None])[0]
+            try:
+                since = None if since is None else float(since)
+            except ValueError:
+                return self._send(400, {'error': 'since must be a '
+                                                 'number'})
+            t, v = self.server.rig.trace(since)
+            return self._send(200, {'t': t, 'v': v})
+        self._send(404, {'error': 'not found'})
+
+    def do_POST(self):
+        if urlparse(self.path).path != '/settings':
+            return self._send(404, {'error': 'not found'})
+        length = int(self.headers.get('Content-Length', 0))
+        try:
+            settings = json.loads(self.rfile.read(length))
+            if not isinstance(settings, dict):
+                raise ValueError('expected a mapping of settings')
+            self.server.rig.set(**settings)
+        except (TypeError, ValueError) as error:
+            return self._send(400, {'error': str(error)})
+        self._send(200, self.server.rig.state())
+
+
+def main(args=None):
+    parser = argparse.ArgumentParser(
+        prog='python -m msn.live',
+        description='Simulate a MSN continuously, with settings that '
+                    'can be changed over HTTP.')
+    parser.add_argument('--type', default='dmsn', choices=['dmsn', 'imsn'],
+                        help='cell type')
+    parser.add_argument('--index', type=int, default=0,
+                        help='parameter set of the cell')
+    parser.add_argument('--dopamine', action='store_true',
+                        help='add dopamine modulation (initially off)')
+    parser.add_argument('--host', default='127.0.0.1',
+                        help='address to listen on (default: localhost)')
+    parser.add_argument('--port', type=int, default=8001)
+    parser.add_argument('--speed', type=float, default=1,
+                        help='simulated time per real time')
+    args = parser.parse_args(args)
+    rig = Rig(MSN(args.type, args.index), dopamine=args.dopamine,
+              speed=args.speed)
+    rig.serve(args.host, args.port)
+
+
+if __name__ == '__main__':
+    main()
@@ -40,6 +40,8 @@ UNITS	{
 
 PARAMETER	{
 	gbar = 0.00001 (S/cm2) 
+    q = 1
+    qg = 1
     damod = 0
     maxMod = 1
     level = 0
@@ -64,7 +66,7 @@ STATE	{
 
 BREAKPOINT	{
 	SOLVE states METHOD cnexp
-	gIm = gbar*m*modulation()
+	gIm = qg*gbar*m*modulation()
 	ik = gIm*(v-ek)
 }
 
@@ -86,7 +88,7 @@ PROCEDURE rates(){
 		mAlpha = 3.3e-3*exp(2.5*0.04*(v - -35))
 		mBeta = 3.3e-3*exp(-2.5*0.04*(v - -35))
 		mInf = mAlpha/(mAlpha + mBeta)
-		mTau = (1/(mAlpha + mBeta))/qt
+		mTau = (1/(mAlpha + mBeta))/qt/q
 	UNITSON
 }
 
@@ -18,6 +18,8 @@ NEURON {
 
 PARAMETER {
     gbar = 0.0 (mho/cm2)
+    q = 1
+    qg = 1
     k1 = 0.180 (mM)
     k4 = 0.011 (mM)
 }
@@ -36,12 +38,12 @@ STATE { o }
 
 BREAKPOINT {
     SOLVE state METHOD cnexp
-    ik = gbar*o*(v-ek)
+    ik = qg*gbar*o*(v-ek)
 }
 
 DERIVATIVE state {
     rate(v, cai)
-    o' = (oinf-o)/otau
+    o' = (oinf-o)/otau*q
 }
 
 INITIAL {
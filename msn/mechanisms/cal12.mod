@@ -41,6 +41,9 @@ PARAMETER {
     a = 0.17
     :q = 1	          : room temperature 22-25 C
     q = 2	          : body temperature 35 C
+    table_vmin = -150 (mV)
+    table_vmax = 100 (mV)
+    qg = 1
     damod = 0
     maxMod = 1
     level = 0
@@ -65,22 +68,23 @@ STATE { m h }
 
 BREAKPOINT {
     SOLVE states METHOD cnexp
-    ical = pbar*m*(h*a+1-a)*ghk(v, cali, calo) *modulation()
+    ical = qg*pbar*m*(h*a+1-a)*ghk(v, cali, calo) *modulation()
 }
 
 INITIAL {
-    rates()
+    rates(v)
     m = minf
     h = hinf
 }
 
 DERIVATIVE states { 
-    rates()
+    rates(v)
     m' = (minf-m)/mtau*q
     h' = (hinf-h)/htau*q
 }
 
-PROCEDURE rates() {
+PROCEDURE rates(v (mV)) {
+    TABLE minf, mtau, hinf, htau DEPEND table_vmin, table_vmax FROM table_vmin TO table_vmax WITH 1000
     UNITSOFF
     minf = 1/(1+exp((v-(-8.9))/(-6.7)))
     :mtau = 0.06+1/(0.06*exp((v-(-46))/20)+0.41*exp((v-26)/-48))
@@ -39,6 +39,9 @@ PARAMETER {
     pbar = 0.0 (cm/s)
     :q = 1	: room temperature 22 C
     q = 3	: body temperature 35 C
+    table_vmin = -150 (mV)
+    table_vmax = 100 (mV)
+    qg = 1
     damod = 0
     maxMod = 1
     level = 0
@@ -63,22 +66,23 @@ STATE { m h }
 
 BREAKPOINT {
     SOLVE states METHOD cnexp
-    ica = pbar*m*m*m*h*ghk(v, cai, cao) *modulation()
+    ica = qg*pbar*m*m*m*h*ghk(v, cai, cao) *modulation()
 }
 
 INITIAL {
-    rates()
+    rates(v)
     m = minf
     h = hinf
 }
 
 DERIVATIVE states { 
-    rates()
+    rates(v)
     m' = (minf-m)/mtau*q
     h' = (hinf-h)/htau*q
 }
 
-PROCEDURE rates() {
+PROCEDURE rates(v (mV)) {
+    TABLE minf, mtau, hinf, htau DEPEND table_vmin, table_vmax FROM table_vmin TO table_vmax WITH 1000
     UNITSOFF
     minf = 1/(1+exp((v-(-29))/(-9.6)))
     mtau = 5.1*3
@@ -17,6 +17,8 @@ NEURON {
 }
 
 PARAMETER {
+    q = 1
+    qg = 1
     pbar = 6.7e-6   (cm/s)
     mvhalf = -61.5  (mV)
     mslope = -8.0   (mV)
@@ -46,7 +48,7 @@ STATE { m h }
 
 BREAKPOINT {
     SOLVE states METHOD cnexp
-    perm = pbar*m*m*m*h
+    perm = qg*pbar*m*m*m*h
     ical = ghk(v, cali, calo)*perm
     I    = ical
 }
@@ -59,8 +61,8 @@ INITIAL {
 
 DERIVATIVE states { 
     rates(v)
-    m' = (minf-m)/mtau
-    h' = (hinf-h)/htot
+    m' = (minf-m)/mtau*q
+    h' = (hinf-h)/htot*q
 }
 
 PROCEDURE rates(v (mV)) {
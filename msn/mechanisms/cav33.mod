@@ -17,6 +17,8 @@ NEURON {
 }
 
 PARAMETER {
+    q = 1
+    qg = 1
     pbar = 6.7e-6 (cm/s)
     mvhalf = -73.5 (mV)     : 73.5 +/- 1.3
     mslope =  -4.4 (mV)
@@ -48,7 +50,7 @@ STATE { m h }
 
 BREAKPOINT {
     SOLVE states METHOD cnexp
-    perm = pbar*(m^p)*h
+    perm = qg*pbar*(m^p)*h
     ical = ghk(v, cali, calo)*perm
     I    = ical
 }
@@ -61,8 +63,8 @@ INITIAL {
 
 DERIVATIVE states { 
     rates(v)
-    m' = (minf-m)/mtau
-    h' = (hinf-h)/htot
+    m' = (minf-m)/mtau*q
+    h' = (hinf-h)/htot*q
 }
 
 PROCEDURE rates(v (mV)) {
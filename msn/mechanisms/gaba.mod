@@ -38,7 +38,7 @@ ENDCOMMENT
 NEURON {
 	POINT_PROCESS gaba
 	RANGE tau1, tau2
-	RANGE erev, g, i, q
+	RANGE erev, g, i, q, scale_factor
     RANGE damod, maxMod, level, max2, lev2
 	
 	NONSPECIFIC_CURRENT i
@@ -57,6 +57,7 @@ PARAMETER {
 	tau1    =   0.5     (ms)    : wolf et al., 2007 -> Galaretta 1997
     tau2    =   7.5     (ms)    : wolf et al., 2007 -> Galaretta 1997
     q       =   2       : approx room temp 
+    scale_factor = 1
     
     damod       = 0
     maxMod      = 1
@@ -96,7 +97,7 @@ INITIAL {
 BREAKPOINT {
 	SOLVE state METHOD cnexp
 	
-	g = (B - A) * modulation(maxMod,max2,level,lev2)
+	g = (B - A) * modulation(maxMod,max2,level,lev2) * scale_factor
 	i = g * (v - erev)
 }
 
@@ -0,0 +1,149 @@
+TITLE GABA-B receptor synapse with G-protein activated K+ (GIRK) current
+
+COMMENT
+Detailed kinetic model of GABA-B receptors (Destexhe et al 1996), with
+four states: transmitter (T) binds free receptors (R0) that become
+activated (R) and desensitise (D); activated receptors catalyse the
+activation of G-proteins (G), and the K+ (GIRK) channel opens when
+G-proteins occupy its n = 4 binding sites,
+
+    R0 + T <-> R        (K1, K2)
+    R <-> D             (d1, d2)
+    R + G0 -> R + G     (K3)
+    G -> G0             (K4)
+
+    R' = K1 * T * (1 - R - D) - K2 * R + d2 * D - d1 * R
+    D' = d1 * R - d2 * D
+    G' = K3 * R - K4 * G
+    g  = gmax * G^n / (G^n + KD)
+
+Each presynaptic spike releases a pulse of transmitter, of
+concentration Cmax times the connection weight, for Cdur ms; pulses
+from different connections add up. Because several G-proteins are
+needed to open the channel, the response is slow (peak ~ 100 ms) and
+grows supralinearly with the number of spikes in a burst.
+
+The connection weight is thus the relative amount of transmitter
+released (1 for Cmax); the maximal conductance gmax (uS) is a
+parameter of the synapse.
+
+The modulation variables (damod, maxMod, level, max2, lev2) are as in
+gaba.mod, so that the synapse can be modulated as GABA-A synapses.
+
+Rate constants of the detailed model, fitted to GABA-B currents in
+thalamic and hippocampal neurons (Destexhe & Sejnowski 1995).
+
+Destexhe A & Sejnowski TJ (1995). G protein activation kinetics and
+spillover of gamma-aminobutyric acid may account for differences
+between inhibitory responses in the hippocampus and thalamus. Proc
+Natl Acad Sci USA 92, 9515-9519.
+
+Destexhe A, Mainen ZF & Sejnowski TJ (1996). Kinetic models of
+synaptic transmission. In Methods in Neuronal Modeling, 2nd ed, Koch C
+& Segev I (eds), MIT Press, pp 1-25.
+ENDCOMMENT
+
+
+NEURON {
+    POINT_PROCESS gabab
+    RANGE K1, K2, K3, K4, d1, d2, KD, n, Cmax, Cdur
+    RANGE erev, g, i, gmax, scale_factor
+    RANGE damod, maxMod, level, max2, lev2
+    NONSPECIFIC_CURRENT i
+}
+
+
+UNITS {
+    (nA) = (nanoamp)
+    (mV) = (millivolt)
+    (uS) = (microsiemens)
+    (mM) = (milli/liter)
+}
+
+
+PARAMETER {
+    erev    = -90       (mV)    : K+ reversal potential
+    gmax    = 0.001     (uS)
+    K1      = 0.66      (/ms mM)
+    K2      = 0.020     (/ms)
+    d1      = 0.017     (/ms)   : desensitisation
+    d2      = 0.0053    (/ms)   : resensitisation
+    K3      = 0.0083    (/ms)
+    K4      = 0.0079    (/ms)
+    KD      = 100
+    n       = 4
+    Cmax    = 0.5       (mM)    : transmitter pulse
+    Cdur    = 0.3       (ms)
+    scale_factor = 1
+
+    damod       = 0
+    maxMod      = 1
+    max2        = 1
+    level       = 0
+    lev2        = 0
+}
+
+
+ASSIGNED {
+    v       (mV)
+    i       (nA)
+    g       (uS)
+    T       (mM)
+}
+
+
+STATE {
+    R
+    D
+    G
+}
+
+
+INITIAL {
+    R       = 0
+    D       = 0
+    G       = 0
+    T       = 0
+}
+
+
+BREAKPOINT {
+    SOLVE bindkin METHOD derivimplicit
+
+    g = gmax * G^n / (G^n + KD) * scale_factor
+    g = g * modulation(maxMod,max2,level,lev2)
+    i = g * (v - erev)
+}
+
+
+DERIVATIVE bindkin {
+    R' = K1 * T * (1 - R - D) - K2 * R + d2 * D - d1 * R
+    D' = d1 * R - d2 * D
+    G' = K3 * R - K4 * G
+}
+
+
+NET_RECEIVE(weight) {
+    if (flag == 0) {
+        : Spike: start a transmitter pulse, ended by a self-event
+        : that carries the same weight.
+        T = T + Cmax * weight
+        net_send(Cdur, 1)
+    } else {
+        : End of a pulse.
+        T = T - Cmax * weight
+        if (T < 0) {
+            T = 0
+        }
+    }
+}
+
+
+FUNCTION modulation(m1,m2,l1,l2) {
+    : calculates modulation factor
+
+    modulation = 1 + damod * ( (m1-1)*l1 + (m2-1)*l2 )
+    if (modulation < 0) {
+        modulation = 0
+    }
+}
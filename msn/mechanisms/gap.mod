@@ -0,0 +1,42 @@
+COMMENT
+Gap junction (electrical synapse).
+
+One half of a gap junction between two cells. The current is
+proportional to the difference between the membrane potential at this
+location (v) and at the coupled location in the other cell (vgap,
+transferred by ParallelContext source_var/target_var). A gap junction
+is made of two of these point processes, one in each cell, each
+receiving the membrane potential of the other.
+ENDCOMMENT
+
+
+NEURON {
+	THREADSAFE
+	POINT_PROCESS gap
+	RANGE g, i, vgap
+	NONSPECIFIC_CURRENT i
+}
+
+
+UNITS {
+	(nA) = (nanoamp)
+	(mV) = (millivolt)
+	(uS) = (microsiemens)
+}
+
+
+PARAMETER {
+	g = 0.001 (uS)
+}
+
+
+ASSIGNED {
+	v (mV)
+	vgap (mV)
+	i (nA)
+}
+
+
+BREAKPOINT {
+	i = g * (v - vgap)
+}
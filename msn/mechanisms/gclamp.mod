@@ -0,0 +1,38 @@
+COMMENT
+Conductance injection (dynamic clamp).
+
+A conductance g with reversal potential e. The conductance is usually
+driven by playing a vector into it (Vector.play), e.g. to replay a
+recorded synaptic conductance waveform.
+ENDCOMMENT
+
+
+NEURON {
+	POINT_PROCESS gclamp
+	RANGE g, e, i
+	NONSPECIFIC_CURRENT i
+}
+
+
+UNITS {
+	(nA) = (nanoamp)
+	(mV) = (millivolt)
+	(uS) = (microsiemens)
+}
+
+
+PARAMETER {
+	g = 0 (uS)
+	e = 0 (mV)
+}
+
+
+ASSIGNED {
+	v (mV)
+	i (nA)
+}
+
+
+BREAKPOINT {
+	i = g * (v - e)
+}
@@ -0,0 +1,108 @@
+COMMENT
+Izhikevich (2007) simple model neuron.
+
+    C dv/dt = k (v - vr) (v - vt) - u + Ib + I
+    du/dt = a (U(v) - u)
+    if v >= vpeak: v = c, u = u + d
+
+where U(v) = b (v - vr), or, if cubic = 1, the nonlinear U(v) of the
+fast-spiking interneurone model: 0 for v < vb and b (v - vb)^3 above
+(b then in pA/mV3). Ib is an intrinsic bias current (0 by default)
+that makes the cell fire spontaneously, as in cell.TAN.
+
+The point process provides the membrane current of the model; the
+membrane capacitance is that of the section where it is inserted, which
+must have a membrane area such that its capacitance equals C (i.e. with
+cm = 1 uF/cm2, an area of 100 * C um2, where C is in pF). Currents
+injected in the section (e.g. with IClamp, or synapses) then add to I
+as in the original model.
+
+Spikes are detected with WATCH and cause a NetCon event (net_event), so
+the point process can be the source of a NetCon:
+    NetCon(izh, target)
+
+Default parameters are those of the MSN model in Izhikevich (2007)
+Dynamical systems in neuroscience, MIT Press, chapter 8 (see also
+cell.fsi_params and cell.tan_params).
+ENDCOMMENT
+
+
+NEURON {
+	POINT_PROCESS izhi
+	RANGE C, k, vr, vt, vpeak, a, b, c, d, vb, cubic, Ib, i
+	NONSPECIFIC_CURRENT i
+}
+
+
+UNITS {
+	(nA) = (nanoamp)
+	(mV) = (millivolt)
+}
+
+
+PARAMETER {
+	C = 50 : pF
+	k = 1 : nS/mV
+	vr = -80 (mV)
+	vt = -25 (mV)
+	vpeak = 40 (mV)
+	a = 0.01 (/ms)
+	b = -20 : nS
+	c = -55 (mV)
+	d = 150 : pA
+	vb = -55 (mV)
+	cubic = 0
+	Ib = 0 : pA
+}
+
+
+ASSIGNED {
+	v (mV)
+	i (nA)
+}
+
+
+STATE {
+	u : pA
+}
+
+
+INITIAL {
+	u = ustar(v)
+	net_send(0, 1)
+}
+
+
+BREAKPOINT {
+	SOLVE states METHOD cnexp
+	: pA to nA
+	i = -(k * (v - vr) * (v - vt) - u + Ib) / 1000
+}
+
+
+DERIVATIVE states {
+	u' = a * (ustar(v) - u)
+}
+
+
+FUNCTION ustar(v (mV)) {
+	: Steady state of u, U(v).
+	if (cubic == 0) {
+		ustar = b * (v - vr)
+	} else if (v < vb) {
+		ustar = 0
+	} else {
+		ustar = b * (v - vb)^3
+	}
+}
+
+
+NET_RECEIVE (w) {
+	if (flag == 1) {
+		WATCH (v > vpeak) 2
+	} else if (flag == 2) {
+		net_event(t)
+		v = c
+		u = u + d
+	}
+}
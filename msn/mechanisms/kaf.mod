@@ -43,6 +43,9 @@ UNITS {
 PARAMETER {
     gbar = 0.0 (S/cm2) 
     q = 2
+    table_vmin = -150 (mV)
+    table_vmax = 100 (mV)
+    qg = 1
     damod = 0
     maxMod = 1
     level = 0
@@ -66,34 +69,41 @@ STATE { m h }
 
 BREAKPOINT {
     SOLVE states METHOD cnexp
-    gk = gbar*m*m*h *modulation()
+    gk = qg*gbar*m*m*h *modulation()
     ik = gk*(v-ek)
 }
 
 DERIVATIVE states {
-    rates()
+    rates(v)
     m' = (minf-m)/mtau*q
     h' = (hinf-h)/htau*q
 }
 
 INITIAL {
-    rates()
+    rates(v)
     m = minf
     h = hinf
 }
 
-PROCEDURE rates() {
+PROCEDURE rates(v (mV)) {
+    : The rates depend on v only through v+modShift; gates() is
+    : tabulated as a function of the shifted potential.
+    gates(v+modShift)
+}
+
+PROCEDURE gates(vs (mV)) {
     LOCAL alpha, beta, sum
+    TABLE minf, mtau, hinf, htau DEPEND table_vmin, table_vmax FROM table_vmin TO table_vmax WITH 1000
     UNITSOFF
-    alpha = 1.5/(1+exp((v-4+modShift)/(-17)))
-    beta = 0.6/(1+exp((v-10+modShift)/9))
+    alpha = 1.5/(1+exp((vs-4)/(-17)))
+    beta = 0.6/(1+exp((vs-10)/9))
     sum = alpha+beta
     minf = alpha/sum
     mtau = 1/sum
     : mtau = 1/( 1.5/(1+exp((v-4)/(-17))) + 0.6/(1+exp((v-10)/9)) ) : don't shift tau
     
-    alpha = 0.105/(1+exp((v-(-121)+modShift)/22))
-    beta = 0.065/(1+exp((v-(-55)+modShift)/(-11)))
+    alpha = 0.105/(1+exp((vs-(-121))/22))
+    beta = 0.065/(1+exp((vs-(-55))/(-11)))
     sum = alpha+beta
     hinf = alpha/sum
     htau = 1/sum
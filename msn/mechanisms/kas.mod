@@ -35,7 +35,10 @@ UNITS {
 PARAMETER {
     gbar = 0.0 (S/cm2) 
     q = 3
+    qg = 1
     a = 0.2
+    table_vmin = -150 (mV)
+    table_vmax = 100 (mV)
     damod = 0
     maxMod = 1
     level = 0
@@ -58,24 +61,25 @@ STATE { m h }
 
 BREAKPOINT {
     SOLVE states METHOD cnexp
-    gk = gbar*m*m*h*modulation()
+    gk = qg*gbar*m*m*h*modulation()
     ik = gk*(v-ek)
 }
 
 DERIVATIVE states {
-    rates()
+    rates(v)
     m' = (minf-m)/mtau*q
     h' = (hinf-h)/htau*q
 }
 
 INITIAL {
-    rates()
+    rates(v)
     m = minf
     h = hinf
 }
 
-PROCEDURE rates() {
+PROCEDURE rates(v (mV)) {
     LOCAL alpha, beta, sum
+    TABLE minf, mtau, hinf, htau DEPEND a, table_vmin, table_vmax FROM table_vmin TO table_vmax WITH 1000
     UNITSOFF
     alpha = 0.25/(1+exp((v-50)/(-20)))
     beta = 0.05/(1+exp((v-(-90))/35))
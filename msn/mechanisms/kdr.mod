@@ -15,6 +15,9 @@ UNITS {
 PARAMETER {
     gbar = 0.0 (S/cm2) 
     q = 3
+    table_vmin = -150 (mV)
+    table_vmax = 100 (mV)
+    qg = 1
 }
 
 ASSIGNED {
@@ -30,22 +33,23 @@ STATE { m }
 
 BREAKPOINT {
     SOLVE states METHOD cnexp
-    gk = gbar*m
+    gk = qg*gbar*m
     ik = gk*(v-ek)
 }
 
 DERIVATIVE states {
-    rates()
+    rates(v)
     m' = (minf-m)/mtau*q
 }
 
 INITIAL {
-    rates()
+    rates(v)
     m = minf
 }
 
-PROCEDURE rates() {
+PROCEDURE rates(v (mV)) {
     LOCAL alpha, beta, sum
+    TABLE minf, mtau DEPEND table_vmin, table_vmax FROM table_vmin TO table_vmax WITH 1000
     UNITSOFF
     alpha = 1.0*exp((v-(-13))/(-9.09))
     beta =  1.0*exp((v-(-13))/(-12.5))
@@ -0,0 +1,68 @@
+TITLE Extracellular potassium accumulation
+
+COMMENT
+Potassium accumulation in a thin extracellular space around the
+membrane (Frankenhaeuser-Hodgkin space), with clearance (glial uptake
+and diffusion) towards the bath concentration:
+
+    ko' = ik / (F * depth) + (kbath - ko) / tau
+
+where depth is the thickness of the extracellular shell. During high
+frequency firing ko rises, depolarising ek, which in turn changes
+firing; because this mechanism writes ko, NEURON computes ek from the
+concentrations (Nernst) at every time step.
+
+Frankenhaeuser B & Hodgkin AL (1956). The after-effects of impulses in
+the giant nerve fibres of Loligo. J Physiol 131, 341-376.
+Based on kext.mod in the NEURON examples.
+ENDCOMMENT
+
+
+NEURON {
+    THREADSAFE
+    SUFFIX kext
+    USEION k READ ik WRITE ko
+    RANGE kbath, depth, tau
+}
+
+
+UNITS {
+    (mV)    = (millivolt)
+    (mA)    = (milliamp)
+    (mM)    = (milli/liter)
+    (um)    = (micron)
+    FARADAY = (faraday) (coulombs)
+}
+
+
+PARAMETER {
+    kbath   = 5     (mM)    : bath (and initial) concentration
+    depth   = 0.1   (um)    : thickness of the extracellular shell
+    tau     = 1000  (ms)    : clearance time constant
+}
+
+
+ASSIGNED {
+    ik      (mA/cm2)
+}
+
+
+STATE {
+    ko      (mM)
+}
+
+
+INITIAL {
+    ko = kbath
+}
+
+
+BREAKPOINT {
+    SOLVE state METHOD cnexp
+}
+
+
+DERIVATIVE state {
+    : (1e4) converts mA/cm2 / (coulombs/mole um) to mM/ms.
+    ko' = (1e4) * ik / (FARADAY * depth) + (kbath - ko) / tau
+}
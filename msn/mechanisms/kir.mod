@@ -15,6 +15,18 @@ where:
 
 [] == default values
 {} == ranges
+
+Polyamine block (Kir2 channels) can be added by setting pablock = 1.
+Intracellular polyamines (spermine) block the channel on depolarisation
+and are removed on hyperpolarisation with a slower time course, which
+delays the decrease in conductance at the onset of up-states. The
+fraction of unblocked channels, b, relaxes to
+
+    binf = 1/(1+exp((v-bhalf)/bslope))
+
+with a bell-shaped time constant that peaks (btaumin + btau0) at
+bhalf. With
+pablock = 0 (default) the channel is as in the original model.
     
 ENDCOMMENT
 
@@ -24,6 +36,7 @@ NEURON {
     USEION k READ ek WRITE ik
     RANGE gbar, gk, ik
     RANGE damod, maxMod, level, max2, lev2
+    RANGE pablock, bhalf, bslope, btau0, btaumin
 }
 
 UNITS {
@@ -35,11 +48,19 @@ UNITS {
 PARAMETER {
     gbar = 0.0 (S/cm2) 
     q = 3
+    table_vmin = -150 (mV)
+    table_vmax = 100 (mV)
+    qg = 1
     damod = 0
     maxMod = 1
     level = 0
     max2 = 1
     lev2 = 0
+    pablock = 0
+    bhalf = -50 (mV)
+    bslope = 10 (mV)
+    btau0 = 20 (ms)
+    btaumin = 0.5 (ms)
 } 
 
 ASSIGNED {
@@ -49,28 +70,45 @@ ASSIGNED {
     gk (S/cm2)
     minf
     mtau (ms)
+    binf
+    btau (ms)
 }
 
-STATE { m }
+STATE { m b }
 
 BREAKPOINT {
     SOLVE states METHOD cnexp
-    gk = gbar*m*modulation()
+    if (pablock) {
+        gk = qg*gbar*m*b*modulation()
+    } else {
+        gk = qg*gbar*m*modulation()
+    }
     ik = gk*(v-ek)
 }
 
 DERIVATIVE states {
-    rates()
+    rates(v)
     m' = (minf-m)/mtau*q
+    b' = (binf-b)/btau*q
 }
 
 INITIAL {
-    rates()
+    rates(v)
     m = minf
+    b = binf
+}
+
+PROCEDURE rates(v (mV)) {
+    mrates(v)
+    UNITSOFF
+    binf = 1/(1+exp((v-bhalf)/bslope))
+    btau = btaumin + 2*btau0/(exp((v-bhalf)/(2*bslope))+exp(-(v-bhalf)/(2*bslope)))
+    UNITSON
 }
 
-PROCEDURE rates() {
+PROCEDURE mrates(v (mV)) {
     LOCAL alpha, beta, sum
+    TABLE minf, mtau DEPEND table_vmin, table_vmax FROM table_vmin TO table_vmax WITH 1000
     UNITSOFF
     minf = 1/(1+exp((v-(-102))/13))
     alpha = 0.1*exp((v-(-60))/(-14))
@@ -0,0 +1,82 @@
+TITLE Kv3.1 potassium current
+
+NEURON {
+    THREADSAFE
+    SUFFIX kv31
+    USEION k READ ek WRITE ik
+    RANGE gbar, gk, ik
+}
+
+UNITS {
+    (S) = (siemens)
+    (mV) = (millivolt)
+    (mA) = (milliamp)
+}
+
+PARAMETER {
+    gbar = 0.0 (S/cm2)
+    q = 1
+    table_vmin = -150 (mV)
+    table_vmax = 100 (mV)
+    qg = 1
+}
+
+ASSIGNED {
+    v (mV)
+    ek (mV)
+    ik (mA/cm2)
+    gk (S/cm2)
+    ninf
+    ntau (ms)
+}
+
+STATE { n }
+
+BREAKPOINT {
+    SOLVE states METHOD cnexp
+    gk = qg*gbar*n*n
+    ik = gk*(v-ek)
+}
+
+DERIVATIVE states {
+    rates(v)
+    n' = (ninf-n)/ntau*q
+}
+
+INITIAL {
+    rates(v)
+    n = ninf
+}
+
+PROCEDURE rates(v (mV)) {
+    LOCAL alpha, beta
+    TABLE ninf, ntau DEPEND table_vmin, table_vmax FROM table_vmin TO table_vmax WITH 1000
+    UNITSOFF
+    alpha = vtrap(95-v, 11.8)
+    beta = 0.025*exp(-v/22.222)
+    ninf = alpha/(alpha+beta)
+    ntau = 1/(alpha+beta)
+    UNITSON
+}
+
+FUNCTION vtrap(x, y) {
+    : x/(exp(x/y)-1), with its limit at x = 0
+    if (fabs(x/y) < 1e-6) {
+        vtrap = y*(1-x/y/2)
+    } else {
+        vtrap = x/(exp(x/y)-1)
+    }
+}
+
+COMMENT
+
+Kv3.1/Kv3.2 current of fast-spiking interneurones, with a high
+activation threshold and fast deactivation, which make action
+potentials narrow and allow firing at high rates.
+
+Kinetics from the model of Erisir et al (1999) J Neurophysiol 82:2476,
+based on recordings from neocortical fast-spiking interneurones.
+
+Used by cell.ConductanceFSI.
+
+ENDCOMMENT
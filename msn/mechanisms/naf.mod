@@ -35,6 +35,9 @@ UNITS {
 PARAMETER {
     gbar = 0.0 (S/cm2) 
     q = 1.8
+    table_vmin = -150 (mV)
+    table_vmax = 100 (mV)
+    qg = 1
     mVhalf     = -25.0 (mV)
     hVhalf     = -62.0 (mV)
     mSlope     =  -9.2 (mV)
@@ -64,40 +67,53 @@ STATE { m h }
 
 BREAKPOINT {
     SOLVE states METHOD cnexp
-    gna = gbar*m*m*m*h*modulation()
+    gna = qg*gbar*m*m*m*h*modulation()
     ina = gna*(v-ena)
 }
 
 DERIVATIVE states {
-    rates()
+    rates(v)
     m' = (minf-m)/mtau*q
     h' = (hinf-h)/htau*q
 }
 
 INITIAL {
-    rates()
+    rates(v)
     m = minf
     h = hinf
 }
 
-PROCEDURE rates() {
+PROCEDURE rates(v (mV)) {
     UNITSOFF
     minf = 1 / (1 + exp( (v-mVhalf) / mSlope ) )
     hinf = 1 / (1 + exp( (v-hVhalf) / hSlope ) )
     
-    mtau = 0.38 + 1/( 0.6*exp((v-(-58.0))/8.0) + 1.8*exp((v-(-58.0))/(-35.0))  )
-    
-    if (v < - 60) {
-        htau = 3.4 + 0.015*v
-    }else{
-        htau = 0.56 + 1.1/(1+exp((v-(-48))/15.0)) + 1.2/(1+exp((v-(-48))/4.0))
-    }
+    mtau = mtauf(v)
+    htau = htauf(v)
         
     :mtau = 0.13 +1/(0.6*exp((v-(-58))/taum)+1.8*exp((v-(-58))/(taun)))
     :htau = 0.14 +1.2/(1+exp((v-(-32))/tauh))
     UNITSON
 }
 
+FUNCTION mtauf(v (mV)) (ms) {
+    TABLE DEPEND table_vmin, table_vmax FROM table_vmin TO table_vmax WITH 1000
+    UNITSOFF
+    mtauf = 0.38 + 1/( 0.6*exp((v-(-58.0))/8.0) + 1.8*exp((v-(-58.0))/(-35.0))  )
+    UNITSON
+}
+
+FUNCTION htauf(v (mV)) (ms) {
+    TABLE DEPEND table_vmin, table_vmax FROM table_vmin TO table_vmax WITH 1000
+    UNITSOFF
+    if (v < - 60) {
+        htauf = 3.4 + 0.015*v
+    }else{
+        htauf = 0.56 + 1.1/(1+exp((v-(-48))/15.0)) + 1.2/(1+exp((v-(-48))/4.0))
+    }
+    UNITSON
+}
+
 FUNCTION modulation() {
     : returns modulation factor
     
@@ -0,0 +1,128 @@
+TITLE Persistent sodium current
+
+COMMENT
+neuromodulation is added as functions:
+    
+    modulation = 1 + damod*(maxMod-1)*level
+
+where:
+    
+    damod  [0]: is a switch for turning modulation on or off {1/0}
+    maxMod [1]: is the maximum modulation for this specific channel (read from the param file)
+                e.g. 10% increase would correspond to a factor of 1.1 (100% +10%) {0-inf}
+    level  [0]: is an additional parameter for scaling modulation. 
+                Can be used simulate non static modulation by gradually changing the value from 0 to 1 {0-1}
+
+[] == default values
+{} == ranges
+    
+ENDCOMMENT
+
+NEURON {
+    THREADSAFE
+    SUFFIX nap
+    USEION na READ ena WRITE ina
+    RANGE gbar, gna, ina
+    RANGE damod, maxMod, level, max2, lev2
+}
+
+UNITS {
+    (S) = (siemens)
+    (mV) = (millivolt)
+    (mA) = (milliamp)
+}
+
+PARAMETER {
+    gbar = 0.0 (S/cm2) 
+    q = 3
+    table_vmin = -150 (mV)
+    table_vmax = 100 (mV)
+    qg = 1
+    damod = 0
+    maxMod = 1
+    level = 0
+    max2 = 1
+    lev2 = 0
+} 
+
+ASSIGNED {
+    v (mV)
+    ena (mV)
+    ina (mA/cm2)
+    gna (S/cm2)
+    minf
+    mtau (ms)
+    hinf
+    htau (ms)
+}
+
+STATE { m h }
+
+BREAKPOINT {
+    SOLVE states METHOD cnexp
+    gna = qg*gbar*m*m*m*h*modulation()
+    ina = gna*(v-ena)
+}
+
+DERIVATIVE states {
+    rates(v)
+    m' = (minf-m)/mtau*q
+    h' = (hinf-h)/htau*q
+}
+
+INITIAL {
+    rates(v)
+    m = minf
+    h = hinf
+}
+
+PROCEDURE rates(v (mV)) {
+    LOCAL alpha, beta
+    TABLE minf, mtau, hinf, htau DEPEND table_vmin, table_vmax FROM table_vmin TO table_vmax WITH 1000
+    UNITSOFF
+    minf = 1/(1+exp((v-(-52.6))/(-4.6)))
+    alpha = 0.182*trap(v+38, 6)
+    beta = 0.124*trap(-(v+38), 6)
+    mtau = 6/(alpha+beta)
+
+    hinf = 1/(1+exp((v-(-48.8))/10))
+    alpha = -2.88e-6*trap(v+17, -4.63)
+    beta = 6.94e-6*trap(v+64.4, 2.63)
+    htau = 1/(alpha+beta)
+    UNITSON
+}
+
+FUNCTION trap(x, y) {
+    : x/(1-exp(-x/y)), and its limit when x -> 0
+    if (fabs(x/y) < 1e-6) {
+        trap = y*(1+x/y/2)
+    } else {
+        trap = x/(1-exp(-x/y))
+    }
+}
+
+FUNCTION modulation() {
+    : returns modulation factor
+    
+    modulation = 1 + damod * ( (maxMod-1)*level + (max2-1)*lev2 ) 
+    if (modulation < 0) {
+        modulation = 0
+    }    
+}
+
+COMMENT
+
+Original data by Magistretti & Alonso (1999), rat entorhinal cortex
+neurons, 22 C. Kinetics as implemented by Hay et al (2011; ModelDB
+139653). Activation is fast and has a low threshold; inactivation is
+very slow (seconds).
+
+Q factor of 3 used, as for the other channels in the model, to adjust
+the kinetics to 35 C.
+
+There is no NaP in the original model by Lindroos & Hellgren Kotaleski
+(2020) and so no fitted density for it. The channel is only inserted,
+in the soma and dendrites, if a conductance is given (gbar_nap in
+cell.MSN).
+
+ENDCOMMENT
@@ -17,6 +17,7 @@ NEURON {
 PARAMETER {
     gbar = 0.0 (mho/cm2)
     q = 1
+    qg = 1
 }
 
 ASSIGNED {
@@ -33,7 +34,7 @@ STATE { o }
 
 BREAKPOINT {
     SOLVE state METHOD cnexp
-    I  = gbar*o*(v-ek)
+    I  = qg*gbar*o*(v-ek)
     ik = I 
 }
 
@@ -0,0 +1,147 @@
+COMMENT
+GABA synapse with short-term plasticity.
+
+Same as gaba.mod (double exponential conductance with neuromodulation),
+with the addition of the Tsodyks-Markram model of short-term synaptic
+plasticity (depression and facilitation), in the formulation of
+Fuhrmann et al (2002). For each presynaptic spike the fraction of
+resources released is u*R, where R is the fraction of available
+resources, which recovers with time constant tau_rec, and u is the
+utilisation of resources, which is incremented by U(1 - u) at each
+spike and decays back to 0 with time constant tau_facil. If tau_facil
+is 0 there is no facilitation and u = U.
+
+The conductance is scaled by u*R/U, so that the response to the first
+spike (or to a spike after a long pause, with R = 1 and u = U) has the
+same conductance (the NetCon weight) as with gaba.mod; later responses
+are smaller (depression) or larger (facilitation).
+
+    U         : utilisation of resources at the first spike {0-1}
+    tau_rec   : recovery from depression (ms)
+    tau_facil : decay of facilitation (ms)
+
+The state of the plasticity model is kept separately for each NetCon
+connected to the synapse.
+
+References:
+
+Tsodyks M, Pawelzik K & Markram H (1998). Neural networks with dynamic
+synapses. Neural Comput 10, 821-835.
+
+Fuhrmann G, Segev I, Markram H & Tsodyks M (2002). Coding of temporal
+information by activity-dependent synapses. J Neurophysiol 87, 140-148.
+ENDCOMMENT
+
+
+NEURON {
+	POINT_PROCESS tmgaba
+	RANGE tau1, tau2
+	RANGE erev, g, i, q, scale_factor
+	RANGE U, tau_rec, tau_facil
+	RANGE damod, maxMod, level, max2, lev2
+
+	NONSPECIFIC_CURRENT i
+}
+
+
+UNITS {
+	(nA) = (nanoamp)
+	(mV) = (millivolt)
+	(uS) = (microsiemens)
+}
+
+
+PARAMETER {
+	erev        = -60.0     (mV)
+	tau1        =   0.5     (ms)
+	tau2        =   7.5     (ms)
+	q           =   2
+	scale_factor =  1
+
+	U           =   0.5     (1)     <1e-9, 1>
+	tau_rec     = 800       (ms)    <1e-9, 1e9>
+	tau_facil   =   0       (ms)    <0, 1e9>
+
+	damod       = 0
+	maxMod      = 1
+	max2        = 1
+	level       = 0
+	lev2        = 0
+}
+
+
+ASSIGNED {
+	v (mV)
+	i (nA)
+	g (uS)
+	factor
+}
+
+
+STATE {
+	A (uS)
+	B (uS)
+}
+
+
+INITIAL {
+	LOCAL tp
+	if (tau1/tau2 > .9999) {
+		tau1 = .9999*tau2
+	}
+	A       = 0
+	B       = 0
+	tp      = (tau1*tau2)/(tau2 - tau1) * log(tau2/tau1)
+	factor  = -exp(-tp/tau1) + exp(-tp/tau2)
+	factor  = 1/factor
+}
+
+
+BREAKPOINT {
+	SOLVE state METHOD cnexp
+
+	g = (B - A) * modulation(maxMod,max2,level,lev2) * scale_factor
+	i = g * (v - erev)
+}
+
+
+DERIVATIVE state {
+	A' = -A/tau1*q
+	B' = -B/tau2*q
+}
+
+
+NET_RECEIVE(weight (uS), R, u, tsyn (ms)) {
+	INITIAL {
+		R    = 1
+		u    = 0
+		tsyn = t
+	}
+
+	: Facilitation: u decays since the last spike, then is incremented.
+	if (tau_facil > 0) {
+		u = u*exp(-(t - tsyn)/tau_facil)
+		u = u + U*(1 - u)
+	} else {
+		u = U
+	}
+
+	: Depression: resources recover since the last spike, then a
+	: fraction u of them is released, relative to the fraction U
+	: released by the first spike.
+	R    = 1 - (1 - R)*exp(-(t - tsyn)/tau_rec)
+	A    = A + weight*factor*u*R/U
+	B    = B + weight*factor*u*R/U
+	R    = R - u*R
+	tsyn = t
+}
+
+
+FUNCTION modulation(m1,m2,l1,l2) {
+	: calculates modulation factor
+
+	modulation = 1 + damod * ( (m1-1)*l1 + (m2-1)*l2 )
+	if (modulation < 0) {
+		modulation = 0
+	}
+}
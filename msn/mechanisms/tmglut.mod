@@ -0,0 +1,214 @@
+COMMENT
+Glutamate synapse with short-term plasticity.
+
+Same as glutamate.mod (AMPA and Mg-blocked NMDA double exponential
+conductances with neuromodulation), with the addition of the
+Tsodyks-Markram model of short-term synaptic plasticity (depression and
+facilitation), as in tmgaba.mod. For each presynaptic spike both
+components are scaled by the fraction of resources released relative
+to that of the first spike, u*R/U, so that the response to the first
+spike is the same as with glutamate.mod.
+
+    U         : utilisation of resources at the first spike {0-1}
+    tau_rec   : recovery from depression (ms)
+    tau_facil : decay of facilitation (ms)
+
+The state of the plasticity model is kept separately for each NetCon
+connected to the synapse.
+
+References:
+
+Tsodyks M, Pawelzik K & Markram H (1998). Neural networks with dynamic
+synapses. Neural Comput 10, 821-835.
+
+Fuhrmann G, Segev I, Markram H & Tsodyks M (2002). Coding of temporal
+information by activity-dependent synapses. J Neurophysiol 87, 140-148.
+ENDCOMMENT
+
+
+NEURON {
+	POINT_PROCESS tmglut
+	RANGE tau1_ampa, tau2_ampa, tau1_nmda, tau2_nmda
+	RANGE erev, g, i
+	RANGE i_ampa, i_nmda, g_ampa, g_nmda, ratio, I, G, mg, q, block, alpha, beta
+	RANGE ampa_scale_factor, nmda_scale_factor
+	RANGE U, tau_rec, tau_facil
+    RANGE damod, maxModNMDA,max2NMDA,maxModAMPA,max2AMPA,l1NMDA,l2NMDA,l1AMPA,l2AMPA
+	
+	NONSPECIFIC_CURRENT i
+	USEION cal WRITE ical VALENCE 2
+}
+
+
+UNITS {
+	(nA) = (nanoamp)
+	(mV) = (millivolt)
+	(uS) = (microsiemens)
+}
+
+
+PARAMETER {
+	erev        = 0.0       (mV)
+	
+	tau1_ampa   = 1.9       (ms)
+    tau2_ampa   = 4.8       (ms)  : tau2 > tau1
+    tau1_nmda   = 5.52      (ms)  : Chapman et al 2003; table 1, adult rat (rise time, rt = 12.13. rt ~= 2.197*tau (wiki;rise time) -> tau = 12.13 / 2.197 ~= 5.52
+    tau2_nmda   = 231       (ms)  : Chapman et al 2003 (table 1; adult)
+    
+    ratio       = 1         (1)   : both components give same maximal amplitude of current
+    mg          = 1         (mM)
+    alpha       = 0.062
+    beta        = 3.57
+    q           = 2               : approx room temp -> 
+    
+    nmda_scale_factor = 1
+    ampa_scale_factor = 1
+    
+    ca_ratio_ampa = 0.005
+    ca_ratio_nmda = 0.1
+    
+    maxModNMDA  = 1
+    max2NMDA    = 1
+    maxModAMPA  = 1
+    max2AMPA    = 1
+    damod       = 0
+    l1NMDA      = 0
+    l2NMDA      = 0
+    l1AMPA      = 0
+    l2AMPA      = 0
+
+    U           = 0.5       (1)     <1e-9, 1>
+    tau_rec     = 800       (ms)    <1e-9, 1e9>
+    tau_facil   = 0         (ms)    <0, 1e9>
+}
+
+
+ASSIGNED {
+	v (mV)
+	i (nA)
+	g (uS)
+	factor_nmda
+	factor_ampa
+	i_ampa
+	i_nmda
+	g_ampa
+	g_nmda
+	block
+	I
+	G
+	ical (nA)
+}
+
+
+STATE {
+	A (uS)
+	B (uS)
+	C (uS)
+	D (uS)
+}
+
+
+
+INITIAL {
+	LOCAL tp
+	if (tau1_nmda/tau2_nmda > .9999) {
+		tau1_nmda = .9999*tau2_nmda
+	}
+	if (tau1_ampa/tau2_ampa > .9999) {
+		tau1_ampa = .9999*tau2_ampa
+	}
+	
+	: NMDA
+	A           = 0
+	B           = 0
+	tp          = (tau1_nmda*tau2_nmda)/(tau2_nmda - tau1_nmda) * log(tau2_nmda/tau1_nmda)
+	factor_nmda = -exp(-tp/tau1_nmda) + exp(-tp/tau2_nmda)
+	factor_nmda = 1/factor_nmda
+	
+	: AMPA
+	C           = 0
+	D           = 0
+	tp          = (tau1_ampa*tau2_ampa)/(tau2_ampa - tau1_ampa) * log(tau2_ampa/tau1_ampa)
+	factor_ampa = -exp(-tp/tau1_ampa) + exp(-tp/tau2_ampa)
+	factor_ampa = 1/factor_ampa
+}
+
+
+
+
+BREAKPOINT {
+	SOLVE state METHOD cnexp
+	
+	: NMDA
+	g_nmda = (B - A) * modulation(maxModNMDA,max2NMDA,l1NMDA,l2NMDA)
+	block  = MgBlock()
+	i_nmda = g_nmda * (v - erev) * block * nmda_scale_factor
+	
+	: AMPA
+	g_ampa = (D - C) * modulation(maxModAMPA,max2AMPA,l1AMPA,l2AMPA)
+	i_ampa = g_ampa * (v - erev) * ampa_scale_factor
+	
+	: total current
+	G = g_ampa + g_nmda
+	I = i_ampa + i_nmda
+	
+	: splitting in ca and non ca currents
+	ical = i_ampa*ca_ratio_ampa  + i_nmda*ca_ratio_nmda
+    i = i_ampa*(1-ca_ratio_ampa) + i_nmda*(1-ca_ratio_nmda)
+}
+
+
+
+DERIVATIVE state {
+	A' = -A/tau1_nmda*q
+	B' = -B/tau2_nmda*q
+	C' = -C/tau1_ampa*q
+	D' = -D/tau2_ampa*q
+}
+
+
+
+NET_RECEIVE(weight (uS), R, u, tsyn (ms)) {
+	LOCAL release
+	INITIAL {
+		R    = 1
+		u    = 0
+		tsyn = t
+	}
+
+	: Facilitation: u decays since the last spike, then is incremented.
+	if (tau_facil > 0) {
+		u = u*exp(-(t - tsyn)/tau_facil)
+		u = u + U*(1 - u)
+	} else {
+		u = U
+	}
+
+	: Depression: resources recover since the last spike, then a
+	: fraction u of them is released.
+	R       = 1 - (1 - R)*exp(-(t - tsyn)/tau_rec)
+	release = u*R/U
+	A = A + weight*factor_nmda*release
+	B = B + weight*factor_nmda*release
+	C = C + weight*factor_ampa*ratio*release
+	D = D + weight*factor_ampa*ratio*release
+	R    = R - u*R
+	tsyn = t
+}
+
+
+
+FUNCTION MgBlock() {
+    
+    MgBlock = 1 / (1 + mg * exp(-alpha * v) / beta )
+    
+}
+
+FUNCTION modulation(m1,m2,l1,l2) {
+    : returns modulation factor
+    
+    modulation = 1 + damod * ( (m1-1)*l1 + (m2-1)*l2 )
+    if (modulation < 0) {
+        modulation = 0
+    } 
+}
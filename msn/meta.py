@@ -0,0 +1,144 @@
+"""
+Run metadata and provenance.
+
+The functions here collect the information needed to know how a result
+was produced (the parameters, the version of this library, the random
+seed, the solver settings and the machine where it ran) so that it can
+be saved together with the result.
+
+author: Antonio Gonzalez
+"""
+import datetime
+import json
+import platform
+import subprocess
+import sys
+from pathlib import Path
+
+import numpy as np
+import neuron
+from neuron import h
+
+from . import __version__, rng
+
+
+def _git(*args):
+    # Output of a git command run from this package, or None if it
+    # failed.
+    try:
+        result = subprocess.run(['git', *args], cwd=Path(__file__).parent,
+                                capture_output=True, text=True, timeout=5)
+    except (OSError, subprocess.SubprocessError):
+        return None
+    if result.returncode != 0:
+        return None
+    return result.stdout
+
+
+def _git_commit():
+    # Commit of the source tree and whether it has uncommitted changes,
+    # if this library is run from its own git repository; (None, None)
+    # otherwise (e.g. if installed from a package, which may be inside
+    # an unrelated repository).
+    top = _git('rev-parse', '--show-toplevel')
+    root = Path(__file__).resolve().parents[1]
+    if top is None or Path(top.strip()).resolve() != root:
+        return None, None
+    commit = _git('rev-parse', 'HEAD')
+    status = _git('status', '--porcelain')
+    if commit is None:
+        return None, None
+    return commit.strip(), None if status is None else bool(status.strip())
+
+
+def _to_builtin(value):
+    # Convert numpy types, paths, etc into types that can be saved as
+    # JSON.
+    if isinstance(value, dict):
+        return {str(key): _to_builtin(item) for key, item in value.items()}
+    if isinstance(value, (list, tuple)):
+        return [_to_builtin(item) for item in value]
+    if isinstance(value, np.ndarray):
+        return value.tolist()
+    if isinstance(value, np.generic):
+        return value.item()
+    if value is None or isinstance(value, (bool, int, float, str)):
+        return value
+    return str(value)
+
+
+def capture(params=None, cell=None):
+    """
+    Collect the provenance of a simulation run.
+
+    Parameters
+    ----------
+    params : None or dict, default=None
+        Parameters of the run (e.g. a configuration, or stimulus
+        settings).
+    cell : None or object, default=None
+        The model cell, e.g. cell.MSN; its type and index are saved.
+
+    Returns
+    -------
+    metadata : dict
+        With keys 'created' (date and time, ISO format), 'version'
+        (of this library), 'git_commit' and 'git_dirty' (whether the
+        tree has uncommitted changes; both None if not available),
+        'seed' (master seed, see rng; None if not set), 'solver'
+        (integration method, time step, tolerances, temperature),
+        'host' (machine and software versions), and, if given,
+        'params' and 'cell'. All values can be saved as JSON.
+    """
+    cvode = h.CVode()
+    commit, dirty = _git_commit()
+    metadata = {
+        'created': datetime.datetime.now().isoformat(timespec='seconds'),
+        'version': __version__,
+        'git_commit': commit,
+        'git_dirty': dirty,
+        'seed': rng.get_seed(),
+        'solver': {
+            'method': 'cvode' if cvode.active() else (
+                'cn' if h.secondorder == 2 else 'fixed'),
+            'dt': h.dt,
+            'atol': cvode.atol(),
+            'rtol': cvode.rtol(),
+            'celsius': h.celsius,
+            'tstop': h.tstop},
+        'host': {
+            'hostname': platform.node(),
+            'platform': platform.platform(),
+            'python': sys.version.split()[0],
+            'neuron': neuron.__version__,
+            'numpy': np.__version__}}
+    if cell is not None:
+        metadata['cell'] = {'class': type(cell).__name__,
+                            'type': cell.type, 'index': cell.index}
+    if params is not None:
+        metadata['params'] = params
+    return _to_builtin(metadata)
+
+
+def write_sidecar(path, metadata):
+    """
+    Save metadata to a JSON file next to a data file.
+
+    Parameters
+    ----------
+    path : str or Path
+        The data file, e.g. 'trace.csv'. The metadata are saved in the
+        same directory with '.json' appended, e.g. 'trace.csv.json'.
+    metadata : dict
+        The metadata, e.g. as returned by capture().
+
+    Returns
+    -------
+    sidecar : Path
+        The sidecar file name.
+    """
+    path = Path(path)
+    sidecar = path.with_name(path.name + '.json')
+    with open(sidecar, 'w') as file:
+        json.dump(_to_builtin(metadata), file, indent=2)
+    return sidecar
@@ -31,11 +31,21 @@ neuromodulation by acetylcholine and dopamine. Eur J Neurosci; DOI:
 
 author: Antonio Gonzalez
 """
-import numpy as np
+import math
+
 from neuron import h
 
-# Setup a uniform random number generator
-rand_uniform = np.random.default_rng().uniform
+from . import rng
+
+
+def rand_uniform(low, high):
+    # Uniform random numbers from the modulation stream; see rng.
+    return rng.stream('modulation').uniform(low, high)
+
+# Dopamine receptors and the MSN type whose modulation parameters
+# describe the effects of activating each receptor (dMSNs express D1
+# receptors, iMSNs express D2 receptors).
+receptor_profiles = {'D1': 'dmsn', 'D2': 'imsn'}
 
 
 def get_modulation_params(cell_type, neurotransmitter):
@@ -162,9 +172,16 @@ class Dopamine:
         Not sure
     dt : numeric
         Time interval for playing `play`
+    receptor : None or str
+        Dopamine receptor ('D1' or 'D2') used to select the modulation
+        profile, or None if this was set by the cell type.
+    level : numeric
+        Current modulation level, as set by set_level().
 
     Methods
     -------
+    set_level(level)
+        Scale the modulation, e.g. during a simulation
     reset()
         Reset modulation
 
@@ -199,7 +216,7 @@ class Dopamine:
 
     def __init__(self, cell, modulate='no_axon',
                  intrinsic_modulation=True, gaba_modulation=True,
-                 glut_modulation=True, play=[], dt=h.dt):
+                 glut_modulation=True, play=[], dt=h.dt, receptor=None):
         """
         Parameters
         ----------
@@ -223,10 +240,24 @@ class Dopamine:
             Time interval for playing `play`. Defaults to NEURON's dt
             value, accessed via `neuron.h`.
             (TODO: I don't really know what use is this)
+        receptor : None or {'D1', 'D2'}, default=None
+            Dopamine receptor type that determines the modulation
+            profile. If None (default), the receptor is the one
+            expressed by the cell: D1 in dMSNs and D2 in iMSNs. Setting
+            this explicitly allows to apply e.g. the D2 profile to a
+            dMSN.
         """
         self.cell = cell
+        if receptor is None:
+            cell_type = cell.type
+        elif receptor in receptor_profiles:
+            cell_type = receptor_profiles[receptor]
+        else:
+            raise ValueError("Dopamine `receptor` must be 'D1' or 'D2'")
+        self.receptor = receptor
+        self.level = 1
         self.params = get_modulation_params(
-            cell.type, neurotransmitter='DA')
+            cell_type, neurotransmitter='DA')
         self.play = play
         self.dt = dt
 
@@ -284,7 +315,32 @@ class Dopamine:
                     syn.l1AMPA = 1
                     syn.l1NMDA = 1
 
+    def set_level(self, level):
+        """
+        Scale the modulation.
+
+        Parameters
+        ----------
+        level : numeric, range 0 to 1
+            0 for no modulation, 1 for full modulation. This can be
+            changed during a simulation (e.g. with simulation.Schedule)
+            to simulate the wash-in or wash-out of dopamine.
+        """
+        self.level = level
+        for section in self._sections:
+            for segment in section:
+                for mech in segment:
+                    if mech.name() in self.params['intrinsic']:
+                        mech.level = level
+                for syn in segment.point_processes():
+                    if 'gaba' in syn.hname():
+                        syn.level = level
+                    elif 'glut' in syn.hname():
+                        syn.l1AMPA = level
+                        syn.l1NMDA = level
+
     def reset(self):
+        self.level = 0
         if len(self.play):
             for trans in self.play.values():
                 trans.play_remove()
@@ -295,6 +351,477 @@ class Dopamine:
                 self._modulate_gaba(segment, reset=True)
 
 
+class DopamineField:
+    """
+    Extracellular dopamine concentration with release and reuptake.
+
+    Instead of a fixed level of modulation, the dopamine concentration
+    C (nM) evolves in time with release by dopaminergic axons and
+    reuptake by the dopamine transporter (DAT), which follows
+    Michaelis-Menten kinetics:
+
+        dC/dt = release(t) - Vmax * C / (Km + C).
+
+    Tonic firing of dopamine neurons releases dopamine continuously, at
+    the rate that keeps C at the `tonic` concentration. Each spike of a
+    phasic burst adds the dopamine released by one spike of tonic
+    firing; pauses stop the tonic release. The occupancy of each
+    receptor, C / (C + EC50), then sets the level of the dopamine
+    modulation of the cells (Dopamine.set_level) throughout the
+    simulation: D2 receptors (high affinity) sense tonic dopamine,
+    while D1 receptors (low affinity) respond mainly to bursts (Dreyer
+    et al 2010).
+
+    Attributes
+    ----------
+    modulations : list of Dopamine
+        The dopamine modulations driven by the concentration.
+    concentration : float
+        Current dopamine concentration (nM).
+    trace : list
+        Concentration during the last simulation, as (t, nM) pairs at
+        each update.
+
+    Bursts and pauses are scheduled again every time the simulation is
+    initialised; those added during a simulation (e.g. in a closed loop,
+    see rl.ActorCritic) also take effect in the current run.
+
+    Methods
+    -------
+    burst(time, n_spikes=6, rate=20)
+        Phasic burst of dopamine neurons
+    pause(time, duration)
+        Pause in the firing of dopamine neurons
+    occupancy(receptor, concentration=None)
+        Occupancy of dopamine receptors
+
+    References
+    ----------
+    Dreyer JK, Herrik KF, Berg RW & Hounsgaard JD (2010). Influence of
+    phasic and tonic dopamine release on receptor activation. J
+    Neurosci 30, 14273-14283.
+
+    Example
+    -------
+    A reward-like burst at 1 s and a pause at 3 s:
+    >>> field = DopamineField([Dopamine(dmsn), Dopamine(imsn)])
+    >>> field.burst(1000)
+    >>> field.pause(3000, 500)
+    """
+
+    def __init__(self, modulations, tonic=20, firing_rate=4, vmax=4,
+                 km=200, ec50=None, dt=1):
+        """
+        Parameters
+        ----------
+        modulations : Dopamine or list of Dopamine
+            Dopamine modulation of one or more cells. The receptor of
+            each is that of the Dopamine object, or else that expressed
+            by the cell (D1 in dMSNs, D2 in iMSNs).
+        tonic : numeric, default=20
+            Tonic dopamine concentration (nM).
+        firing_rate : numeric, default=4
+            Tonic firing rate (Hz) of dopamine neurons, which sets the
+            release per spike.
+        vmax : numeric, default=4
+            Maximal rate of reuptake (nM/ms, i.e. uM/s).
+        km : numeric, default=200
+            Michaelis constant of reuptake (nM).
+        ec50 : None or dict, default=None
+            Receptor affinities, as {receptor: nM}. If None, 1000 nM for
+            D1 and 10 nM for D2 (see Dreyer et al 2010).
+        dt : numeric, default=1
+            Time (ms) between updates of the modulation. Smaller values
+            follow fast changes more closely but slow down simulations.
+        """
+        if isinstance(modulations, Dopamine):
+            modulations = [modulations]
+        if tonic < 0:
+            raise ValueError('`tonic` must not be negative')
+        self.modulations = list(modulations)
+        self.tonic = tonic
+        self.vmax = vmax
+        self.km = km
+        self.ec50 = {'D1': 1000, 'D2': 10} if ec50 is None else ec50
+        self.dt = dt
+        # Release rate (nM/ms) at steady state, and release per spike.
+        self._tonic_release = vmax * tonic / (km + tonic)
+        self.release_per_spike = self._tonic_release / firing_rate * 1000
+        self.concentration = tonic
+        self.trace = []
+        self._events = []
+        self._running = False
+        self._init_handler = h.FInitializeHandler(self._initialize)
+
+    @staticmethod
+    def _receptor(modulation):
+        if modulation.receptor is not None:
+            return modulation.receptor
+        return {'dmsn': 'D1', 'imsn': 'D2'}[modulation.cell.type]
+
+    def occupancy(self, receptor, concentration=None):
+        """
+        Fraction of receptors bound by dopamine.
+
+        Parameters
+        ----------
+        receptor : {'D1', 'D2'}
+        concentration : None or numeric, default=None
+            Dopamine concentration (nM). If None, the current one.
+        """
+        if concentration is None:
+            concentration = self.concentration
+        return concentration / (concentration + self.ec50[receptor])
+
+    def burst(self, time, n_spikes=6, rate=20):
+        """
+        Phasic burst of dopamine neurons.
+
+        Parameters
+        ----------
+        time : numeric
+            Time (ms) of the first spike.
+        n_spikes : int, default=6
+            Number of spikes in the burst.
+        rate : numeric, default=20
+            Firing rate (Hz) within the burst.
+        """
+        for spike in range(n_spikes):
+            self._add_event(time + spike * 1000 / rate, self._release)
+
+    def pause(self, time, duration):
+        """
+        Pause in the firing of dopamine neurons (no tonic release).
+
+        Parameters
+        ----------
+        time : numeric
+            Start of the pause (ms).
+        duration : numeric
+            Duration of the pause (ms).
+        """
+        self._add_event(time, lambda: self._set_tonic(False))
+        self._add_event(time + duration, lambda: self._set_tonic(True))
+
+    def _add_event(self, time, function):
+        self._events.append((time, function))
+        if self._running and time >= h.t:
+            h.CVode().event(time, function)
+
+    def _set_tonic(self, on):
+        self._integrate()
+        self._release_rate = self._tonic_release if on else 0
+
+    def _release(self):
+        self._integrate()
+        self.concentration += self.release_per_spike
+        self._set_levels()
+
+    def _integrate(self):
+        # Euler integration from the last update to now, in steps of at
+        # most 0.1 ms.
+        elapsed = h.t - self._t_last
+        n_steps = max(int(elapsed / 0.1 + 0.5), 1)
+        step = elapsed / n_steps
+        for _ in range(n_steps):
+            uptake = self.vmax * self.concentration / (
+                self.km + self.concentration)
+            self.concentration = max(
+                self.concentration + step * (self._release_rate - uptake),
+                0)
+        self._t_last = h.t
+
+    def _set_levels(self):
+        for modulation in self.modulations:
+            modulation.set_level(self.occupancy(self._receptor(modulation)))
+        cvode = h.CVode()
+        if cvode.active():
+            cvode.re_init()
+
+    def _update(self):
+        self._integrate()
+        self._set_levels()
+        self.trace.append((h.t, self.concentration))
+        h.CVode().event(h.t + self.dt, self._update)
+
+    def _initialize(self):
+        self.concentration = self.tonic
+        self._release_rate = self._tonic_release
+        self._t_last = 0
+        self.trace = [(0, self.tonic)]
+        self._running = True
+        self._set_levels()
+        for time, function in self._events:
+            h.CVode().event(time, function)
+        h.CVode().event(self.dt, self._update)
+
+
+class Adenosine:
+    """
+    Adenosine A2A receptor modulation of iMSNs.
+
+    iMSNs express A2A receptors, which act on the same cAMP/PKA
+    targets as D2 receptors but in the opposite direction (A2A
+    receptors stimulate adenylyl cyclase through Golf, D2 receptors
+    inhibit it), and which reduce the affinity of D2 receptors for
+    dopamine in A2A-D2 heteromers (Ferré et al 2008).
+
+    This is modelled through the D2 modulation profile of the cell
+    (see Dopamine): A2A activation gives the D2 effects with the
+    opposite sign, and the D2 level is reduced by the A2A-D2
+    interaction, so that the level of the D2 modulation is
+
+        dopamine_level * (1 - interaction * level) - efficacy * level,
+
+    where `level` is the activation of A2A receptors (0 to 1). A
+    negative level reverses the D2 effects on each target (see the
+    `modulation` function in the mod files).
+
+    Attributes
+    ----------
+    dopamine : Dopamine
+        The D2 modulation of the cell.
+    level : float
+        Activation of A2A receptors (0 to 1).
+    dopamine_level : float
+        Level of D2 modulation without adenosine.
+    receptor : str
+        'A2A'.
+
+    Methods
+    -------
+    set_level(level)
+        Set the activation of A2A receptors
+    set_dopamine(level)
+        Set the level of D2 modulation by dopamine
+
+    References
+    ----------
+    Ferré S, Quiroz C, Woods AS, Cunha R, Popoli P, Ciruela F, Lluis C,
+    Franco R, Azdad K & Schiffmann SN (2008). An update on adenosine
+    A2A-dopamine D2 receptor interactions: implications for the
+    function of G protein-coupled receptors. Curr Pharm Des 14,
+    1468-1474.
+
+    Example
+    -------
+    A2A agonism (e.g. CGS-21680) in an iMSN with tonic dopamine:
+    >>> adenosine = Adenosine(Dopamine(imsn))
+    >>> adenosine.set_level(1)
+    """
+    receptor = 'A2A'
+
+    def __init__(self, dopamine, level=0, efficacy=1, interaction=0.5):
+        """
+        Parameters
+        ----------
+        dopamine : Dopamine
+            Dopamine modulation of an iMSN, or of a cell with the D2
+            profile (receptor='D2').
+        level : numeric, default=0
+            Initial activation of A2A receptors.
+        efficacy : numeric, default=1
+            Strength of the A2A effects relative to the D2 effects.
+        interaction : numeric, range [0, 1], default=0.5
+            Reduction of D2 modulation by full A2A activation.
+        """
+        if dopamine.receptor != 'D2' and (dopamine.receptor is not None
+                                          or dopamine.cell.type != 'imsn'):
+            raise ValueError('Adenosine modulation requires the D2 '
+                             'modulation profile')
+        self.dopamine = dopamine
+        self.cell = dopamine.cell
+        self.efficacy = efficacy
+        self.interaction = interaction
+        self.dopamine_level = dopamine.level
+        self.set_level(level)
+
+    def _update(self):
+        self.dopamine.set_level(
+            self.dopamine_level * (1 - self.interaction * self.level)
+            - self.efficacy * self.level)
+
+    def set_level(self, level):
+        """
+        Set the activation of A2A receptors.
+
+        Parameters
+        ----------
+        level : numeric, range 0 to 1
+            0 for no activation, 1 for full activation. This can be
+            changed during a simulation (see simulation.Schedule).
+        """
+        self.level = level
+        self._update()
+
+    def set_dopamine(self, level):
+        """
+        Set the level of D2 modulation by dopamine, as
+        Dopamine.set_level, taking into account A2A activation.
+        """
+        self.dopamine_level = level
+        self._update()
+
+
+class SignallingCascade:
+    """
+    Reduced cAMP/PKA/DARPP-32 signalling cascade.
+
+    Dopamine receptors do not change ion channels directly but through
+    intracellular signalling: D1 receptors stimulate, and D2 receptors
+    inhibit, the production of cAMP, which activates protein kinase A
+    (PKA); PKA phosphorylates its targets (channels and receptors) and
+    DARPP-32 at Thr34, which amplifies and prolongs the effect (Nair et
+    al 2015). This class implements a reduced model of the cascade, a
+    chain of three first-order processes with relative variables:
+
+        cAMP:  c' = (1 + g1 * D1 - g2 * D2 - c) / tau_camp
+        PKA:   a' = (c^n / (c^n + K^n) - a) / tau_pka
+        pD34:  d' = (a / (a + Kd) - d) / tau_darpp
+
+    where D1 and D2 are the occupancies of the receptors. The
+    modulation level (see Dopamine.set_level) follows phosphorylation:
+    it is 0 at the basal state (no dopamine), and 1 when the cell's
+    receptor is fully occupied (D1: maximal phosphorylation; D2:
+    minimal). With the default time constants, modulation develops and
+    reverses over minutes, as observed with bath application of
+    dopamine agonists.
+
+    Attributes
+    ----------
+    modulation : Dopamine or Adenosine
+        The modulation driven by the cascade.
+    receptor : str
+        'D1' or 'D2'.
+    camp, pka, darpp : float
+        Current relative cAMP concentration (1 at basal state), PKA
+        activity and fraction of phosphorylated DARPP-32.
+    level : float
+        Current modulation level.
+    trace : list
+        (t, camp, pka, darpp, level) at each update of the last
+        simulation.
+
+    References
+    ----------
+    Nair AG, Gutierrez-Arenas O, Eriksson O, Vincent P & Hellgren
+    Kotaleski J (2015). Sensing positive versus negative reward signals
+    through adenylyl cyclase-coupled GPCRs in direct and indirect
+    pathway striatal medium spiny neurons. J Neurosci 35, 14017-14030.
+
+    Example
+    -------
+    A D1 agonist (full occupancy) from 1 to 5 min:
+    >>> cascade = SignallingCascade(
+    ...     Dopamine(dmsn), lambda t: 1 if 60e3 <= t < 300e3 else 0)
+    """
+
+    def __init__(self, modulation, occupancy, gain_d1=4, gain_d2=0.8,
+                 K=2, n=2, Kd=0.2, tau_camp=2e3, tau_pka=10e3,
+                 tau_darpp=60e3, dt=100):
+        """
+        Parameters
+        ----------
+        modulation : Dopamine or Adenosine
+            Modulation of a cell; its receptor determines the sign of
+            the effect of dopamine on cAMP. With Adenosine, the cascade
+            sets its dopamine level (Adenosine.set_dopamine).
+        occupancy : numeric, callable or DopamineField
+            Occupancy of the receptor (0 to 1): a constant, a function
+            of time (ms), or the occupancy in a DopamineField (which
+            should not also drive `modulation`).
+        gain_d1, gain_d2 : numeric, default=4, 0.8
+            Increase and decrease of cAMP at full D1 or D2 occupancy,
+            relative to the basal concentration.
+        K, n : numeric, default=2, 2
+            Half-activation (relative cAMP) and Hill coefficient of
+            PKA activation.
+        Kd : numeric, default=0.2
+            PKA activity at half phosphorylation of DARPP-32.
+        tau_camp, tau_pka, tau_darpp : numeric, default=2e3, 10e3, 60e3
+            Time constants (ms) of each step.
+        dt : numeric, default=100
+            Time (ms) between updates.
+        """
+        self.modulation = modulation
+        dopamine = getattr(modulation, 'dopamine', modulation)
+        if dopamine.receptor is not None:
+            self.receptor = dopamine.receptor
+        else:
+            self.receptor = {'dmsn': 'D1', 'imsn': 'D2'}[dopamine.cell.type]
+        self.occupancy = occupancy
+        self.gain_d1 = gain_d1
+        self.gain_d2 = gain_d2
+        self.K = K
+        self.n = n
+        self.Kd = Kd
+        self.tau_camp = tau_camp
+        self.tau_pka = tau_pka
+        self.tau_darpp = tau_darpp
+        self.dt = dt
+        self.trace = []
+        self._basal = self._steady_state(0)
+        self._full = self._steady_state(1)
+        self._init_handler = h.FInitializeHandler(self._initialize)
+
+    def _camp(self, occupancy):
+        if self.receptor == 'D1':
+            return 1 + self.gain_d1 * occupancy
+        return max(1 - self.gain_d2 * occupancy, 0)
+
+    def _pka(self, camp):
+        return camp**self.n / (camp**self.n + self.K**self.n)
+
+    def _darpp(self, pka):
+        return pka / (pka + self.Kd)
+
+    def _steady_state(self, occupancy):
+        camp = self._camp(occupancy)
+        pka = self._pka(camp)
+        return camp, pka, self._darpp(pka)
+
+    def _get_occupancy(self):
+        if hasattr(self.occupancy, 'occupancy'):
+            return self.occupancy.occupancy(self.receptor)
+        if callable(self.occupancy):
+            return self.occupancy(h.t)
+        return self.occupancy
+
+    def _set_level(self):
+        basal, full = self._basal[2], self._full[2]
+        self.level = (self.darpp - basal) / (full - basal)
+        if hasattr(self.modulation, 'set_dopamine'):
+            self.modulation.set_dopamine(self.level)
+        else:
+            self.modulation.set_level(self.level)
+        cvode = h.CVode()
+        if cvode.active():
+            cvode.re_init()
+
+    def _update(self):
+        # Exact solution of each step for a constant input over dt.
+        def relax(value, target, tau):
+            return target + (value - target) * math.exp(-self.dt / tau)
+
+        self.camp = relax(self.camp, self._camp(self._get_occupancy()),
+                          self.tau_camp)
+        self.pka = relax(self.pka, self._pka(self.camp), self.tau_pka)
+        self.darpp = relax(self.darpp, self._darpp(self.pka),
+                           self.tau_darpp)
+        self._set_level()
+        self.trace.append((h.t, self.camp, self.pka, self.darpp,
+                           self.level))
+        h.CVode().event(h.t + self.dt, self._update)
+
+    def _initialize(self):
+        # Start at the steady state for the initial occupancy.
+        self.camp, self.pka, self.darpp = self._steady_state(
+            self._get_occupancy())
+        self._set_level()
+        self.trace = [(h.t, self.camp, self.pka, self.darpp, self.level)]
+        h.CVode().event(self.dt, self._update)
+
+
 class Acetylcholine:
     """
     Acetylcholine (ACh) modulation of a model neuron.
@@ -327,6 +854,8 @@ class Acetylcholine:
 
     Methods
     -------
+    set_level(level)
+        Scale the modulation, e.g. during a simulation
     reset()
         Reset modulation
 
@@ -478,6 +1007,29 @@ class Acetylcholine:
                     syn.l2AMPA = 1
                     syn.l2NMDA = 1
 
+    def set_level(self, level):
+        """
+        Scale the modulation.
+
+        Parameters
+        ----------
+        level : numeric, range 0 to 1
+            0 for no modulation, 1 for full modulation. This can be
+            changed during a simulation (e.g. with simulation.Schedule).
+            The kaf shift is not scaled.
+        """
+        for sec in self._sections:
+            for seg in sec:
+                for mech in seg:
+                    if mech.name() in self.params['intrinsic']:
+                        mech.lev2 = level
+                for syn in seg.point_processes():
+                    if 'gaba' in syn.hname():
+                        syn.lev2 = level
+                    elif 'glut' in syn.hname():
+                        syn.l2AMPA = level
+                        syn.l2NMDA = level
+
     def reset(self, what='all'):
         """
         Switch off synaptic modulation
@@ -503,3 +1055,86 @@ class Acetylcholine:
                 if what == 'all' or what == 'gaba':
                     self._modulate_gaba(seg, reset=True)
 
+
+class Muscarinic(Acetylcholine):
+    """
+    Muscarinic modulation of the Kir and CaV2 currents of a MSN.
+
+    A restricted acetylcholine profile: only the effects of muscarinic
+    receptors (M1 in iMSNs, M4 in dMSNs) on the Kir current and on the
+    CaV2 calcium currents are applied, with the values of Acetylcholine
+    (Table 3 in Lindroos & Hellgren Kotaleski, 2020); Naf, CaL, Im,
+    Kaf and synaptic currents are not modulated. Of the CaV2 channels,
+    only the N type (CaN, CaV2.2) is modulated in that table; the R type
+    (car, CaV2.3) is not.
+
+    Together with Dopamine on the same cell, and with the firing of a
+    cholinergic interneurone (cell.TAN) setting the level, this allows
+    dopamine-acetylcholine interactions to be studied.
+
+    Methods
+    -------
+    set_level(level)
+        Scale the modulation, e.g. during a simulation
+    reset()
+        Reset modulation
+
+    Example
+    -------
+    A pause in the firing of TANs, and thus in the modulation, at
+    1 s:
+    >>> muscarinic = Muscarinic(cell)
+    >>> schedule = Schedule()
+    >>> schedule.at(1000, muscarinic.set_level, 0)
+    """
+
+    channels = ('kir', 'can')
+
+    def __init__(self, cell, modulate='all', play=[], dt=h.dt):
+        """
+        Parameters
+        ----------
+        cell : object
+            Model cell to modulate.
+        modulate : ['no_axon', 'all'], default='all'
+            Whether to modulate all cell sections or exclude the axon.
+        play, dt :
+            See Acetylcholine.
+        """
+        super().__init__(cell, modulate=modulate,
+                         intrinsic_modulation=False, gaba_modulation=False,
+                         glut_modulation=False, shift_kaf=0, play=play,
+                         dt=dt)
+        self.params['intrinsic'] = {
+            name: value for name, value in self.params['intrinsic'].items()
+            if name in self.channels}
+        for section in self._sections:
+            for segment in section:
+                self._modulate_intrinsic(segment)
+
+    def set_level(self, level):
+        """
+        Scale the modulation.
+
+        Parameters
+        ----------
+        level : numeric, range 0 to 1
+            0 for no modulation, 1 for full modulation. This can be
+            changed during a simulation (e.g. with simulation.Schedule).
+        """
+        for section in self._sections:
+            for segment in section:
+                for mech in segment:
+                    if mech.name() in self.params['intrinsic']:
+                        mech.lev2 = level
+
+    def reset(self):
+        """
+        Switch off the modulation.
+        """
+        if len(self.play):
+            for trans in self.play.values():
+                trans.play_remove()
+        for section in self._sections:
+            for segment in section:
+                self._modulate_intrinsic(segment, reset=True)
@@ -0,0 +1,582 @@
+"""
+Cell morphology.
+
+Read neuronal reconstructions in the standard SWC format, describe them
+as a tree of unbranched sections (with their surface area and axial
+resistance), and build model MSNs on any reconstruction, either as is
+or collapsed to a reduced cell with a few compartments. Dendritic
+spines, with their own calcium pools, can be attached to any cell.
+
+SWC files have one line per sample point, with columns
+    id type x y z radius parent
+where type is 1 for soma, 2 for axon, 3 for (basal) dendrite and 4 for
+apical dendrite, coordinates and radius are in um, and parent is the id
+of the parent sample (-1 for the root).
+
+Example
+-------
+>>> sections = load_swc('cell.swc')
+>>> sections.groupby('type').area.sum()
+>>> cell = MorphologyMSN('dmsn', 12, swc='cell.swc', reduction='bush')
+
+References
+----------
+[Bush1993]: Bush PC & Sejnowski TJ (1993). Reduced compartmental models
+of neocortical pyramidal cells. J Neurosci Methods 46, 159-166.
+
+[Du2017]: Du K, Wu YW, Lindroos R, Liu Y, Rózsa B, Katona G, Ding JB &
+Hellgren Kotaleski J (2017). Cell-type-specific inhibition of the
+dendritic plateau potential in striatal spiny projection neurons. Proc
+Natl Acad Sci USA 114, E7612-E7621.
+
+[Rall1964]: Rall W (1964). Theoretical significance of dendritic trees
+for neuronal input-output relations. In: Neural theory and modeling,
+Reiss RF (ed), Stanford University Press, 73-97.
+
+author: Antonio Gonzalez
+"""
+import numpy as np
+import pandas as pd
+from neuron import h
+
+from . import rng
+from .cell import MSN, synaptic_input
+
+# SWC sample types
+swc_types = {1: 'soma', 2: 'axon', 3: 'dend', 4: 'dend'}
+
+
+def read_swc(path):
+    """
+    Read the sample points of a SWC file.
+
+    Parameters
+    ----------
+    path : str or Path
+
+    Returns
+    -------
+    samples : pandas dataframe
+        With columns [id, type, x, y, z, radius, parent], indexed by id.
+    """
+    samples = pd.read_csv(
+        path, sep=r'\s+', comment='#', header=None,
+        names=['id', 'type', 'x', 'y', 'z', 'radius', 'parent'])
+    samples = samples.astype({'id': int, 'type': int, 'parent': int})
+    return samples.set_index('id', drop=False)
+
+
+def _frustum(r1, r2, length):
+    # Lateral surface area (um2) of a truncated cone.
+    return np.pi * (r1 + r2) * np.sqrt(length**2 + (r1 - r2)**2)
+
+
+def load_swc(path, Ra=150):
+    """
+    Describe a SWC reconstruction as a tree of unbranched sections.
+
+    Parameters
+    ----------
+    path : str or Path
+        SWC file.
+    Ra : numeric, default=150
+        Axial resistivity (ohm cm), used to calculate the axial
+        resistance of each section.
+
+    Returns
+    -------
+    sections : pandas dataframe
+        One row per section, indexed by section number (the soma is 0),
+        with columns:
+
+        type : str
+            'soma', 'axon' or 'dend'.
+        parent : int
+            Parent section (-1 for the soma).
+        stem : int
+            The section, attached to the soma, where the branch starts
+            (-1 for the soma).
+        order : int
+            Branch order (0 for the soma, 1 for stems).
+        length : float
+            Length (um).
+        diam : float
+            Mean diameter (um), weighted by length.
+        area : float
+            Surface area (um2).
+        ra : float
+            Axial resistance (MOhm) from end to end.
+        distance : float
+            Path distance (um) from the soma to the end of the section.
+
+    Notes
+    -----
+    A soma described by a single sample is a sphere; otherwise its area
+    is that of the truncated cones between its samples. New sections
+    start at branch points and where the sample type changes.
+    """
+    samples = read_swc(path)
+    children = samples.groupby('parent').id.apply(list).to_dict()
+
+    rows = [dict(type='soma', parent=-1, stem=-1, order=0, length=0.,
+                 area=0., ra=0., distance=0., _diam_length=0.)]
+    soma = samples[samples.type == 1]
+    if len(soma) == 1:
+        radius = soma.radius.iloc[0]
+        rows[0]['area'] = 4 * np.pi * radius**2
+        rows[0]['length'] = 2 * radius
+        rows[0]['_diam_length'] = 4 * radius**2
+
+    # Walk the tree from the root; `section` is the section each sample
+    # belongs to.
+    root = samples.index[samples.parent == -1][0]
+    section = {root: 0}
+    stack = list(children.get(root, []))
+    while stack:
+        sample = stack.pop()
+        point = samples.loc[sample]
+        parent = samples.loc[point.parent]
+        parent_section = section[point.parent]
+        n_siblings = len(children.get(point.parent, []))
+        if point.type == 1:
+            index = 0
+        elif (parent_section == 0 or n_siblings > 1
+              or parent.type != point.type):
+            # Start a new section.
+            index = len(rows)
+            parent_row = rows[parent_section]
+            stem = index if parent_section == 0 else parent_row['stem']
+            rows.append(dict(
+                type=swc_types.get(point.type, 'dend'),
+                parent=parent_section, stem=stem,
+                order=parent_row['order'] + 1, length=0., area=0.,
+                ra=0., distance=parent_row['distance'], _diam_length=0.))
+        else:
+            index = parent_section
+        section[sample] = index
+
+        # The segment from the parent sample; the first point of a
+        # neurite is taken to be on the surface of a spherical soma.
+        length = np.sqrt((point.x - parent.x)**2 + (point.y - parent.y)**2
+                         + (point.z - parent.z)**2)
+        r1, r2 = parent.radius, point.radius
+        if parent.type == 1 and point.type != 1:
+            if len(soma) == 1:
+                length = max(length - parent.radius, 0)
+            r1 = r2
+        row = rows[index]
+        row['length'] += length
+        row['area'] += _frustum(r1, r2, length)
+        # Ra in ohm cm, lengths in um: 1e4 / 1e6 to MOhm.
+        row['ra'] += Ra * length / (np.pi * r1 * r2) * 1e-2
+        row['_diam_length'] += (r1 + r2) * length
+        if index != 0:
+            row['distance'] += length
+        stack.extend(children.get(sample, []))
+
+    sections = pd.DataFrame(rows)
+    sections['diam'] = sections._diam_length / sections.length.where(
+        sections.length > 0, np.nan)
+    sections = sections.drop(columns='_diam_length')
+    sections.index.name = 'section'
+    return sections[['type', 'parent', 'stem', 'order', 'length', 'diam',
+                     'area', 'ra', 'distance']]
+
+
+def reduce(sections, method='bush', Ra=150, Rm=10000):
+    """
+    Collapse the dendrites of a morphology into a few cylinders.
+
+    Each dendritic tree (all the sections from the same stem) is
+    replaced by an unbranched cable.
+
+    Parameters
+    ----------
+    sections : pandas dataframe
+        Sections, as returned by load_swc().
+    method : {'bush', 'rall'}, default='bush'
+        'rall': each tree becomes a single cylinder with the diameter of
+        the stem and the same electrotonic length as the tree (the mean
+        over its terminal branches), as in the equivalent cylinder of
+        [Rall1964]. This is exact for trees that follow the 3/2 power
+        rule; the membrane area is not preserved.
+
+        'bush': each branch order of a tree becomes one cylinder with
+        the mean length of the branches and a diameter that preserves
+        their total axial conductance (radius = sqrt(sum r**2)), as in
+        [Bush1993]. The membrane area is restored by the factor
+        `area_scale` (see below).
+    Ra : numeric, default=150
+        Axial resistivity (ohm cm).
+    Rm : numeric, default=10000
+        Specific membrane resistance (ohm cm2), used to calculate the
+        length constant for the 'rall' method.
+
+    Returns
+    -------
+    reduced : pandas dataframe
+        One row per cylinder, with columns [stem, order, parent, length,
+        diam, area_scale]. `parent` is the row of the parent cylinder
+        (-1 for the soma). `area_scale` is the ratio of the membrane
+        area of the original tree to that of the reduced one; membrane
+        capacitance and conductances should be multiplied by it.
+    """
+    def length_constant(diam):
+        # In um, with diameter in um.
+        return np.sqrt(Rm * diam * 1e-4 / (4 * Ra)) * 1e4
+
+    dend = sections[sections.type == 'dend']
+    rows = []
+    for stem, tree in dend.groupby('stem'):
+        if method == 'rall':
+            # Electrotonic length of each section, accumulated from the
+            # stem to every terminal section.
+            electrotonic = tree.length / length_constant(tree.diam)
+            total = {}
+            for index, row in tree.sort_values('order').iterrows():
+                total[index] = electrotonic[index] + total.get(
+                    row.parent, 0)
+            terminals = set(tree.index) - set(tree.parent)
+            diam = tree.loc[stem, 'diam']
+            length = np.mean([total[i] for i in terminals]) * \
+                length_constant(diam)
+            rows.append(dict(stem=stem, order=1, parent=-1, length=length,
+                             diam=diam, area_scale=1.))
+        elif method == 'bush':
+            first = len(rows)
+            area = 0
+            for order, branches in tree.groupby('order'):
+                radius = np.sqrt(np.sum((branches.diam / 2)**2))
+                length = branches.length.mean()
+                parent = -1 if len(rows) == first else len(rows) - 1
+                rows.append(dict(stem=stem, order=order, parent=parent,
+                                 length=length, diam=2 * radius))
+                area += np.pi * 2 * radius * length
+            for row in rows[first:]:
+                row['area_scale'] = tree.area.sum() / area
+        else:
+            raise ValueError("`method` must be 'bush' or 'rall'")
+    return pd.DataFrame(rows, columns=['stem', 'order', 'parent', 'length',
+                                       'diam', 'area_scale'])
+
+
+class MorphologyMSN(MSN):
+    """
+    Build a model of a MSN on a given reconstructed morphology.
+
+    The cell is set up as MSN (ion channels and their distribution,
+    passive properties, etc) but with the morphology read from any SWC
+    file, optionally reduced to a few compartments (see reduce()).
+
+    Attributes
+    ----------
+    swc : str
+        The SWC file.
+    reduction : None or str
+        Reduction method, if any.
+    sections : pandas dataframe
+        The sections of the reconstruction, see load_swc().
+    reduced : None or pandas dataframe
+        The cylinders of the reduced cell, see reduce().
+
+    See also
+    --------
+    MSN, SimplifiedMSN
+
+    Notes
+    -----
+    The reduced cell has no axon. Channel densities that depend on the
+    distance to the soma are calculated with the distances in the
+    reduced cell, which in general differ from those in the original
+    morphology. As with SimplifiedMSN, the parameters in the Lindroos
+    et al data set were fitted to their reconstructed morphologies, and
+    the excitability of a cell with a different morphology may differ.
+
+    Example
+    -------
+    >>> cell = MorphologyMSN('dmsn', 12, swc='cell.swc', reduction='bush')
+    """
+    def __init__(self, cell_type, cell_index, swc=None, reduction=None,
+                 v_init=-80, gradients=None, gbar_nap=0):
+        """
+        Parameters
+        ----------
+        cell_type : str
+            Cell type to model, one of 'dmsn' or 'imsn'.
+        cell_index : int
+            Cell to model, from the set of iMSN and dMSN provided by
+            Lindroos et al.
+        swc : None or str or Path, default=None
+            SWC file. If None, the morphology of the Lindroos et al
+            model for `cell_type` is used.
+        reduction : None or {'bush', 'rall'}, default=None
+            If given, collapse the dendrites with this method; see
+            reduce().
+        v_init : numeric, default=-80
+            Initialisation membrane voltage.
+        gradients : None or dict, default=None
+            Dendritic ion channel density gradients; see cell.MSN.
+        gbar_nap : numeric, default=0
+            Persistent sodium conductance in S/cm2; see cell.MSN.
+        """
+        self.swc = swc
+        self.reduction = reduction
+        self.reduced = None
+        super().__init__(cell_type, cell_index, v_init=v_init,
+                         gradients=gradients, gbar_nap=gbar_nap)
+        if self.reduced is not None:
+            self._scale_membrane()
+
+    def _setup_morphology(self):
+        if self.swc is None:
+            self.swc = self._morphology_file
+        self.swc = str(self.swc)
+        self.sections = load_swc(self.swc)
+        if self.reduction is None:
+            self._morphology_file = self.swc
+            super()._setup_morphology()
+            return
+
+        self.reduced = reduce(self.sections, self.reduction)
+        soma_area = self.sections.loc[0, 'area']
+        self.soma = h.Section(name='soma', cell=self)
+        # A cylinder with equal length and diameter and the same area
+        # as the original soma.
+        self.soma.L = self.soma.diam = np.sqrt(soma_area / np.pi)
+        self.dend = []
+        for index, row in self.reduced.iterrows():
+            dend = h.Section(name=f'dend[{index}]', cell=self)
+            dend.L = row.length
+            dend.diam = row.diam
+            if row.parent < 0:
+                dend.connect(self.soma(1 if len(self.dend) % 2 else 0))
+            else:
+                dend.connect(self.dend[int(row.parent)](1))
+            self.dend.append(dend)
+        self.axon = []
+        self.all = [self.soma] + self.dend
+
+    def _scale_membrane(self):
+        # Restore the membrane area of the original dendrites by scaling
+        # capacitance and all conductances. The calcium pools (cadyn and
+        # caldyn) are shells under the membrane whose volume is that of
+        # the reduced section; the calcium influx into them is scaled
+        # back so that concentrations are those of the original
+        # dendrites.
+        for dend, scale in zip(self.dend, self.reduced.area_scale):
+            if scale == 1:
+                continue
+            dend.cm *= scale
+            for segment in dend:
+                for mech in segment:
+                    for name in ('gbar', 'pbar', 'g'):
+                        if hasattr(mech, name):
+                            setattr(mech, name,
+                                    getattr(mech, name) * scale)
+                    if mech.name() in ('cadyn', 'caldyn'):
+                        mech.drive /= scale
+
+    def __repr__(self):
+        return f'MorphologyMSN[{self.type}, {self.index}, {self.swc}]'
+
+
+class Spine:
+    """
+    A dendritic spine: a neck and a head with its own calcium pools.
+
+    The neck is a thin cylinder whose axial resistance isolates the
+    head electrically and, since there is no calcium diffusion between
+    compartments in this model, the calcium concentration in the head
+    (cai and cali, see cadyn.mod and caldyn.mod) is independent of that
+    of the dendrite. Synapses placed on the head (see add_synapse) thus
+    produce local calcium signals, e.g. through NMDA receptors.
+
+    Attributes
+    ----------
+    parent : NEURON segment
+        The dendritic segment the spine is attached to.
+    neck, head : NEURON sections
+    synapses : list
+        Synapses on the head, as [synapse, netstim, netcon].
+
+    Methods
+    -------
+    add_synapse(stype='glut', **kwargs)
+        Add a synapse to the spine head
+    record_calcium()
+        Record calcium concentration in the spine head
+
+    Notes
+    -----
+    Spines are not part of `cell.all`, so they are not affected by
+    functions that act on all the sections of a cell (e.g. modulation
+    and background noise) unless passed explicitly. Default dimensions
+    are those of the spines in the MSN model of [Du2017].
+
+    Example
+    -------
+    >>> spine = Spine(cell.dend[10], x=0.5)
+    >>> spine.add_synapse('glut', start=100, number=1, weight=1e-3)
+    >>> calcium = spine.record_calcium()
+    """
+    def __init__(self, section, x=0.5, neck_length=0.5, neck_diam=0.125,
+                 head_length=0.5, head_diam=0.5, neck_resistance=None,
+                 channels=('cal12', 'cal13', 'car', 'cav32', 'cav33'),
+                 name=None):
+        """
+        Parameters
+        ----------
+        section : NEURON section
+            Dendrite where the spine is attached.
+        x : float, range [0, 1], default=0.5
+            Location on `section`.
+        neck_length, neck_diam : numeric, default=0.5, 0.125
+            Neck dimensions (um).
+        head_length, head_diam : numeric, default=0.5, 0.5
+            Head dimensions (um). The head is a cylinder.
+        neck_resistance : None or numeric, default=None
+            If given, the axial resistivity of the neck is set so that
+            its resistance is this value (MOhm); otherwise it is that of
+            the dendrite.
+        channels : sequence of str
+            Ion channels inserted in the head, with the densities of
+            the parent segment (mechanisms absent from the parent are
+            ignored). Calcium dynamics (cadyn, caldyn) are always
+            inserted in the head.
+        name : None or str, default=None
+            Name of the spine sections, e.g. 'spine[3]'. If None, the
+            name is derived from the parent segment.
+        """
+        self.parent = section(x)
+        if name is None:
+            name = f'spine_{section.name()}({x:g})'
+        cell = section.cell()
+        self.neck = h.Section(name=f'{name}.neck', cell=cell)
+        self.head = h.Section(name=f'{name}.head', cell=cell)
+        self.neck.L, self.neck.diam = neck_length, neck_diam
+        self.head.L, self.head.diam = head_length, head_diam
+        self.neck.connect(self.parent)
+        self.head.connect(self.neck(1))
+
+        for spine_section in (self.neck, self.head):
+            spine_section.Ra = section.Ra
+            spine_section.cm = section.cm
+            spine_section.insert('pas')
+            spine_section(0.5).pas.g = self.parent.pas.g
+            spine_section(0.5).pas.e = self.parent.pas.e
+        if neck_resistance is not None:
+            # R = Ra L / (pi r**2); Ra in ohm cm, lengths in um.
+            self.neck.Ra = (neck_resistance * np.pi * (neck_diam / 2)**2
+                            / neck_length * 1e2)
+
+        for mechanism in channels:
+            if not hasattr(self.parent, mechanism):
+                continue
+            self.head.insert(mechanism)
+            parent_mech = getattr(self.parent, mechanism)
+            head_mech = getattr(self.head(0.5), mechanism)
+            for variable in ('gbar', 'pbar'):
+                if hasattr(parent_mech, variable):
+                    setattr(head_mech, variable,
+                            getattr(parent_mech, variable))
+        self.head.insert('cadyn')
+        self.head.insert('caldyn')
+        # Only where the head has the ion, i.e. a channel using it.
+        for ion in ('ena', 'ek'):
+            if hasattr(self.head(0.5), ion):
+                setattr(self.head, ion, getattr(self.parent, ion))
+        self.synapses = []
+
+    @property
+    def neck_resistance(self):
+        """
+        Axial resistance of the neck (MOhm).
+        """
+        return (self.neck.Ra * self.neck.L
+                / (np.pi * (self.neck.diam / 2)**2) * 1e-2)
+
+    def add_synapse(self, stype='glut', **kwargs):
+        """
+        Add a synapse to the spine head.
+
+        Parameters
+        ----------
+        stype : {'glut', 'ampa', 'nmda', 'gaba', 'gabab'}, default='glut'
+            Synapse type.
+        **kwargs :
+            Passed on to cell.synaptic_input, e.g. `start`, `number`
+            and `weight`.
+
+        Returns
+        -------
+        synapse, netstim, netcon :
+            As returned by cell.synaptic_input.
+        """
+        synapse = synaptic_input(self.head, stype, x=0.5, **kwargs)
+        self.synapses.append(list(synapse))
+        return synapse
+
+    def record_calcium(self):
+        """
+        Record calcium concentration in the spine head.
+
+        Returns
+        -------
+        calcium : dict
+            NEURON vectors, as {'cai': vector, 'cali': vector}; cai is
+            the calcium through N-, R- and T-type channels, cali that
+            through L-type channels and NMDA receptors (mM).
+        """
+        calcium = {}
+        for variable in ('cai', 'cali'):
+            vector = h.Vector()
+            vector.record(getattr(self.head(0.5), f'_ref_{variable}'))
+            calcium[variable] = vector
+        return calcium
+
+
+def add_spines(cell, sections=None, density=1, seed=None, **kwargs):
+    """
+    Attach spines to the dendrites of a cell.
+
+    Parameters
+    ----------
+    cell : object
+        Model cell, e.g. cell.MSN.
+    sections : None or list, default=None
+        Dendrites where spines are attached. If None, all dendrites.
+    density : numeric, default=1
+        Number of spines per um of dendrite. Spines are placed at random
+        locations, the number on each dendrite being drawn from a
+        Poisson distribution.
+    seed : None or int, default=None
+        Random seed; see rng.generator.
+    **kwargs :
+        Passed on to Spine.
+
+    Returns
+    -------
+    spines : list of Spine
+        The spines, which are also appended to `cell.spines`.
+
+    Notes
+    -----
+    Each spine adds two compartments to the model, so a realistic
+    density over the whole cell (about 1 per um in MSNs) makes
+    simulations much slower. Spines are typically added only where
+    synaptic input is studied.
+    """
+    generator = rng.generator(seed)
+    if sections is None:
+        sections = [sec for sec in cell.all if 'dend' in sec.name()]
+    if not hasattr(cell, 'spines'):
+        cell.spines = []
+    spines = []
+    for section in sections:
+        number = generator.poisson(density * section.L)
+        for x in np.sort(generator.uniform(0, 1, number)):
+            spine = Spine(section, x=x,
+                          name=f'spine[{len(cell.spines)}]', **kwargs)
+            cell.spines.append(spine)
+            spines.append(spine)
+    return spines
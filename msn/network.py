@@ -0,0 +1,637 @@
+"""
+Networks of model neurones.
+
+author: Antonio Gonzalez
+"""
+from pathlib import Path
+
+import numpy as np
+import pandas as pd
+from neuron import h
+
+from .cell import MSN, ReducedMSN
+from .rng import generator
+from .simulation import run
+
+
+class Network:
+    """
+    A network of model neurones connected by synapses.
+
+    Cells are grouped in populations (e.g. dMSNs and iMSNs). Cells in
+    one population connect to cells in another (or the same)
+    population through synapses placed on the target cells. Action
+    potentials in the source cell are detected at the soma and
+    delivered to the synapse after a delay.
+
+    Attributes
+    ----------
+    populations : dict
+        Cells in each population, as {name: list of cells}.
+    positions : dict
+        Positions of the cells in each population (um), as {name: array
+        of shape (n_cells, n_dims)}, if given to add_population().
+    connections : list
+        One tuple (source population, source index, target population,
+        target index, synapse, netcon) for each connection.
+
+    Methods
+    -------
+    add_population(name, cell_type, cell_indices, cell_class=MSN,
+                   full=None)
+        Add a population of cells
+    connect(source, target, probability, weight, delay=1, stype='gaba',
+            compartment='dend', seed=None, stp=None, topology=None)
+        Connect two populations at random, or as given by a Topology
+    run(tstop)
+        Run the simulation
+    spikes(population=None)
+        Recorded spike times
+
+    Example
+    -------
+    A network of 10 dMSNs and 10 iMSNs with lateral inhibition:
+    >>> net = Network()
+    >>> net.add_population('dmsn', 'dmsn', range(10))
+    >>> net.add_population('imsn', 'imsn', range(10))
+    >>> for source in ('dmsn', 'imsn'):
+    ...     for target in ('dmsn', 'imsn'):
+    ...         net.connect(source, target, probability=0.2,
+    ...                     weight=5e-4, seed=1)
+    >>> net.run(1000)
+    >>> spikes = net.spikes()
+    """
+
+    def __init__(self, threshold=0):
+        """
+        Parameters
+        ----------
+        threshold : numeric, default=0
+            Voltage threshold (mV) at the soma for detecting action
+            potentials.
+        """
+        self.populations = {}
+        self.positions = {}
+        self.connections = []
+        self._threshold = threshold
+        self._detectors = {}
+        self._spike_times = {}
+        self._spike_ids = {}
+
+    def add_population(self, name, cell_type, cell_indices,
+                       cell_class=MSN, positions=None, full=None,
+                       reduced_params=None, **kwargs):
+        """
+        Add a population of cells.
+
+        A population can be hybrid: a few cells (`full`) are built with
+        `cell_class`, e.g. to record from them in detail, and the rest
+        with the reduced model (cell.ReducedMSN), which is much cheaper
+        to simulate. Both kinds of cells detect action potentials and
+        receive synapses in the same way, so they can be connected as
+        any other cells (synapses on reduced cells are placed on the
+        soma).
+
+        Parameters
+        ----------
+        name : str
+            Name of the population.
+        cell_type : str
+            Cell type, e.g. 'dmsn' or 'imsn'.
+        cell_indices : iterable of int
+            Index (parameter set) of each cell in the population; see
+            cell.MSN. Indices may be repeated.
+        cell_class : class, default=MSN
+            Class used to build the cells, e.g. MSN, SimplifiedMSN,
+            ReducedMSN, cell.FSI or cell.ConductanceFSI.
+        positions : None or array_like, default=None
+            Position of each cell (um), with shape (n_cells, 2) or
+            (n_cells, 3), e.g. from random_positions(). Required for
+            distance-dependent connectivity (see Topology.distance).
+        full : None or iterable of int, default=None
+            Positions in the population (0 to n_cells - 1) of the cells
+            built with `cell_class`; the others are reduced cells. If
+            None, all cells are built with `cell_class`.
+        reduced_params : None or dict, default=None
+            Parameters of the reduced cells (see cell.ReducedMSN), e.g.
+            the output of fit.fit_reduced for this cell type, or of the
+            cells of a reduced `cell_class` (e.g. FSI).
+        **kwargs :
+            Additional keyword arguments passed on to `cell_class`.
+
+        Returns
+        -------
+        cells : list
+            The cells created.
+
+        Example
+        -------
+        100 dMSNs, of which the first two are full models:
+        >>> net.add_population('dmsn', 'dmsn', range(100), full=[0, 1])
+        """
+        if name in self.populations:
+            raise ValueError(f'Population {name} already exists.')
+        cell_indices = list(cell_indices)
+        full = range(len(cell_indices)) if full is None else set(full)
+        cells = []
+        # Reduced cells (ReducedMSN and its subclasses, e.g. FSI and
+        # TAN) take parameters instead of an index.
+        reduced = (isinstance(cell_class, type)
+                   and issubclass(cell_class, ReducedMSN))
+        for position, index in enumerate(cell_indices):
+            if reduced:
+                cells.append(cell_class(cell_type, params=reduced_params,
+                                        **kwargs))
+            elif position in full:
+                cells.append(cell_class(cell_type, index, **kwargs))
+            else:
+                cells.append(ReducedMSN(cell_type, params=reduced_params))
+        self.populations[name] = cells
+        if positions is not None:
+            positions = np.asarray(positions, dtype=float)
+            if len(positions) != len(cells):
+                raise ValueError('There must be one position per cell')
+            self.positions[name] = positions
+
+        # Record spikes from every cell.
+        times = h.Vector()
+        ids = h.Vector()
+        detectors = []
+        for index, cell in enumerate(cells):
+            detector = h.NetCon(cell.soma(0.5)._ref_v, None, sec=cell.soma)
+            detector.threshold = self._threshold
+            detector.record(times, ids, index)
+            detectors.append(detector)
+        self._detectors[name] = detectors
+        self._spike_times[name] = times
+        self._spike_ids[name] = ids
+        return cells
+
+    def connect(self, source, target, probability, weight, delay=1,
+                stype='gaba', compartment='dend', seed=None, stp=None,
+                topology=None):
+        """
+        Connect two populations at random.
+
+        Each cell in `source` connects to each cell in `target` with a
+        given probability (cells do not connect to themselves), or as
+        given by `topology`. Each connection is made through a new
+        synapse placed at the middle of a randomly chosen section of
+        the target cell.
+
+        Parameters
+        ----------
+        source, target : str
+            Names of the source and target populations.
+        probability : None or float, range [0, 1]
+            Connection probability. Ignored (and can be None) if
+            `topology` is given.
+        weight : numeric
+            Connection weight (synaptic conductance) in uS.
+        delay : numeric, default=1
+            Connection delay in ms.
+        stype : {'gaba', 'gabab', 'glut'}, default='gaba'
+            Type of synapse; 'gabab' are slow GABA-B synapses (see
+            mechanisms/gabab.mod), whose maximal conductance is set to
+            `weight` (the NetCon weight, the relative amount of
+            transmitter released, is 1).
+        compartment : {'dend', 'soma', 'all'}, default='dend'
+            Where on the target cells synapses are placed. Synapses on
+            cells without dendrites (reduced cells) are placed on the
+            soma.
+        seed : None or int, default=None
+            Seed for the random number generator. If None, a
+            sub-stream of the master seed is used (see rng).
+        stp : None or dict, default=None
+            Short-term plasticity parameters for GABA and glutamate
+            synapses, e.g. {'U': 0.5, 'tau_rec': 800, 'tau_facil': 0}.
+            If given, the synapses are Tsodyks-Markram synapses (see
+            mechanisms/tmgaba.mod and tmglut.mod), and any parameter
+            not given takes the default value in that file; `weight` is
+            then the conductance of the first response. If None
+            (default), the synapses have no short-term plasticity.
+        topology : None or Topology, default=None
+            Connections to make, e.g. Topology.fixed_indegree(...). Its
+            sizes must match those of the populations.
+
+        Returns
+        -------
+        n : int
+            Number of connections made.
+
+        Example
+        -------
+        Depressing MSN-MSN collaterals:
+        >>> net.connect('dmsn', 'dmsn', probability=0.2, weight=5e-4,
+        ...             stp={'U': 0.5, 'tau_rec': 800})
+        """
+        if stp is not None and stype == 'gabab':
+            raise ValueError('Short-term plasticity is not available '
+                             'for GABA-B synapses')
+        rng = generator(seed)
+        n = 0
+        targets = self.populations[target]
+        sources = self.populations[source]
+        # Without a topology, connections are drawn pair by pair,
+        # interleaved with the choice of sections, so that a seed gives
+        # the same network as before topologies were introduced.
+        adjacency = None
+        if topology is not None:
+            if topology.shape != (len(sources), len(targets)):
+                raise ValueError(f'The topology {topology.shape} does not '
+                                 'match the sizes of the populations')
+            adjacency = topology.adjacency()
+        for target_index, target_cell in enumerate(targets):
+            if compartment == 'soma':
+                sections = [target_cell.soma]
+            elif compartment == 'dend':
+                sections = list(target_cell.dend)
+            elif compartment == 'all':
+                sections = list(target_cell.all)
+            else:
+                raise ValueError("`compartment` must be 'dend', 'soma' "
+                                 "or 'all'")
+            if not sections:
+                sections = [target_cell.soma]
+            for source_index, source_cell in enumerate(sources):
+                if source_cell is target_cell:
+                    continue
+                if adjacency is None:
+                    if rng.uniform() >= probability:
+                        continue
+                elif not adjacency[source_index, target_index]:
+                    continue
+                section = sections[rng.integers(len(sections))]
+                if stype == 'gaba' and stp is not None:
+                    synapse = h.tmgaba(0.5, sec=section)
+                    for key, value in stp.items():
+                        setattr(synapse, key, value)
+                elif stype == 'gaba':
+                    synapse = h.gaba(0.5, sec=section)
+                elif stype == 'gabab':
+                    synapse = h.gabab(0.5, sec=section)
+                elif stype == 'glut' and stp is not None:
+                    synapse = h.tmglut(0.5, sec=section)
+                    for key, value in stp.items():
+                        setattr(synapse, key, value)
+                elif stype == 'glut':
+                    synapse = h.glutamate(0.5, sec=section)
+                else:
+                    raise ValueError("`stype` must be 'gaba', 'gabab' or "
+                                     "'glut'")
+                netcon = h.NetCon(source_cell.soma(0.5)._ref_v, synapse,
+                                  sec=source_cell.soma)
+                netcon.threshold = self._threshold
+                netcon.delay = delay
+                if stype == 'gabab':
+                    synapse.gmax = weight
+                    netcon.weight[0] = 1
+                else:
+                    netcon.weight[0] = weight
+                self.connections.append((source, source_index, target,
+                                         target_index, synapse, netcon))
+                n += 1
+        return n
+
+    def run(self, tstop, v_init=-80, progress=None, cancel=None):
+        """
+        Run the simulation.
+
+        Parameters
+        ----------
+        tstop : numeric
+            Duration of the simulation in ms.
+        v_init : numeric, default=-80
+            Initialisation membrane voltage.
+        progress : None or callable, default=None
+            Progress callback; see simulation.run.
+        cancel : None or object, default=None
+            Cancellation signal; see simulation.run.
+
+        Returns
+        -------
+        completed : bool
+            False if the simulation was cancelled.
+        """
+        return run(tstop, v_init=v_init, progress=progress, cancel=cancel)
+
+    def spikes(self, population=None):
+        """
+        Recorded spike times.
+
+        Parameters
+        ----------
+        population : None or str, default=None
+            Population name. If None, spikes from all populations.
+
+        Returns
+        -------
+        spikes : pandas dataframe
+            One row per spike with columns [population, cell, time],
+            where `cell` is the index of the cell in its population and
+            `time` is in ms.
+        """
+        if population is None:
+            names = list(self.populations)
+        else:
+            names = [population]
+        spikes = [pd.DataFrame({
+            'population': name,
+            'cell': self._spike_ids[name].as_numpy().astype(int),
+            'time': self._spike_times[name].as_numpy()})
+            for name in names]
+        return pd.concat(spikes, ignore_index=True)
+
+
+def random_positions(n, size=(500, 500), seed=None):
+    """
+    Place cells uniformly at random in a box.
+
+    Parameters
+    ----------
+    n : int
+        Number of cells.
+    size : sequence, default=(500, 500)
+        Size of the box (um) along each dimension; 2 or 3 dimensions.
+    seed : None, int or numpy.random.Generator, default=None
+        See rng.generator.
+
+    Returns
+    -------
+    positions : array, shape (n, len(size))
+    """
+    return generator(seed).uniform(0, 1, (n, len(size))) * np.asarray(size)
+
+
+class Topology:
+    """
+    Connectivity between two populations.
+
+    A topology is the list of connections (pairs of source and target
+    cell indices) from a source population of `n_source` cells to a
+    target population of `n_target` cells. It is created by one of the
+    generators erdos_renyi(), fixed_indegree() or distance(), all of
+    which are reproducible given a seed, and is used to connect a
+    network with Network.connect(..., topology=topology).
+
+    Attributes
+    ----------
+    pairs : pandas dataframe
+        One row per connection, with columns [source, target].
+    shape : tuple
+        (n_source, n_target).
+
+    Methods
+    -------
+    adjacency()
+        Adjacency matrix
+    save(path)
+        Save to a file
+    load(path)
+        Load from a file
+
+    Example
+    -------
+    Each iMSN receives 20 connections from other iMSNs:
+    >>> n = len(net.populations['imsn'])
+    >>> topology = Topology.fixed_indegree(n, n, 20, exclude_self=True,
+    ...                                    seed=1)
+    >>> net.connect('imsn', 'imsn', None, 5e-4, topology=topology)
+    >>> topology.save('imsn_imsn.csv')
+    """
+
+    def __init__(self, pairs, n_source, n_target):
+        """
+        Parameters
+        ----------
+        pairs : array_like, shape (n_connections, 2)
+            Source and target index of each connection.
+        n_source, n_target : int
+            Sizes of the source and target populations.
+        """
+        pairs = np.asarray(pairs, dtype=int).reshape(-1, 2)
+        self.pairs = pd.DataFrame(pairs, columns=['source', 'target'])
+        self.shape = (n_source, n_target)
+
+    @staticmethod
+    def _exclude_self(matrix):
+        n = min(matrix.shape)
+        matrix[np.arange(n), np.arange(n)] = False
+        return matrix
+
+    @classmethod
+    def _from_matrix(cls, matrix):
+        return cls(np.argwhere(matrix), *matrix.shape)
+
+    @classmethod
+    def erdos_renyi(cls, n_source, n_target, probability,
+                    exclude_self=False, seed=None):
+        """
+        Connect every pair of cells independently with a probability.
+
+        Parameters
+        ----------
+        n_source, n_target : int
+            Sizes of the source and target populations.
+        probability : float, range [0, 1]
+            Connection probability.
+        exclude_self : bool, default=False
+            If True, no connections from cell i to cell i (for
+            connections within a population).
+        seed : None, int or numpy.random.Generator, default=None
+            See rng.generator.
+        """
+        rng = generator(seed)
+        matrix = rng.uniform(size=(n_source, n_target)) < probability
+        if exclude_self:
+            matrix = cls._exclude_self(matrix)
+        return cls._from_matrix(matrix)
+
+    @classmethod
+    def fixed_indegree(cls, n_source, n_target, indegree,
+                       exclude_self=False, seed=None):
+        """
+        Connect each target cell to a fixed number of random sources.
+
+        Parameters
+        ----------
+        n_source, n_target : int
+            Sizes of the source and target populations.
+        indegree : int
+            Number of (distinct) sources of each target cell.
+        exclude_self : bool, default=False
+            If True, no connections from cell i to cell i.
+        seed : None, int or numpy.random.Generator, default=None
+            See rng.generator.
+        """
+        rng = generator(seed)
+        pairs = []
+        for target in range(n_target):
+            candidates = np.arange(n_source)
+            if exclude_self:
+                candidates = candidates[candidates != target]
+            if indegree > len(candidates):
+                raise ValueError(f'indegree ({indegree}) is larger than '
+                                 f'the number of sources')
+            for source in rng.choice(candidates, indegree, replace=False):
+                pairs.append((source, target))
+        return cls(pairs, n_source, n_target)
+
+    @classmethod
+    def distance(cls, source_positions, target_positions, p_max, sigma,
+                 exclude_self=False, seed=None):
+        """
+        Connect cells with a probability that decays with distance.
+
+        The probability is p_max * exp(-d**2 / (2 sigma**2)), where d
+        is the distance between the cells (a Gaussian kernel).
+
+        Parameters
+        ----------
+        source_positions, target_positions : array_like
+            Positions (um) of the cells, shape (n_cells, 2) or
+            (n_cells, 3); see Network.positions and random_positions().
+        p_max : float, range [0, 1]
+            Connection probability at distance 0.
+        sigma : numeric
+            Width of the kernel (um).
+        exclude_self : bool, default=False
+            If True, no connections from cell i to cell i.
+        seed : None, int or numpy.random.Generator, default=None
+            See rng.generator.
+        """
+        rng = generator(seed)
+        source_positions = np.asarray(source_positions, dtype=float)
+        target_positions = np.asarray(target_positions, dtype=float)
+        distance = np.linalg.norm(source_positions[:, None, :] -
+                                  target_positions[None, :, :], axis=-1)
+        probability = p_max * np.exp(-distance**2 / (2 * sigma**2))
+        matrix = rng.uniform(size=probability.shape) < probability
+        if exclude_self:
+            matrix = cls._exclude_self(matrix)
+        return cls._from_matrix(matrix)
+
+    def adjacency(self):
+        """
+        Adjacency matrix.
+
+        Returns
+        -------
+        matrix : boolean array, shape (n_source, n_target)
+            True where there is a connection.
+        """
+        matrix = np.zeros(self.shape, dtype=bool)
+        matrix[self.pairs.source, self.pairs.target] = True
+        return matrix
+
+    def save(self, path):
+        """
+        Save to a file.
+
+        Parameters
+        ----------
+        path : str or Path
+            A CSV file (with a header line '# n_source n_target' and
+            columns [source, target]) or, with extension '.npz', a
+            numpy file with arrays 'pairs' and 'shape'.
+        """
+        path = Path(path)
+        if path.suffix == '.npz':
+            np.savez(path, pairs=self.pairs.values, shape=self.shape)
+            return
+        with open(path, 'w') as file:
+            file.write(f'# {self.shape[0]} {self.shape[1]}\n')
+            self.pairs.to_csv(file, index=False)
+
+    @classmethod
+    def load(cls, path):
+        """
+        Load a topology saved with save().
+        """
+        path = Path(path)
+        if path.suffix == '.npz':
+            data = np.load(path)
+            return cls(data['pairs'], *data['shape'])
+        with open(path) as file:
+            n_source, n_target = map(int, file.readline()[1:].split())
+            pairs = pd.read_csv(file)
+        return cls(pairs[['source', 'target']].values, n_source, n_target)
+
+    def __len__(self):
+        return len(self.pairs)
+
+    def __repr__(self):
+        return (f'Topology({len(self)} connections, {self.shape[0]} -> '
+                f'{self.shape[1]})')
+
+
+# Number of membrane potentials transferred to gap junctions, used as
+# the identifiers of ParallelContext.source_var.
+_n_transfers = 0
+
+
+class GapJunction:
+    """
+    A gap junction (electrical coupling) between two cells.
+
+    Attributes
+    ----------
+    g : numeric
+        Junction conductance in uS.
+
+    Example
+    -------
+    Couple the somata of two cells with a 1 nS junction:
+    >>> junction = GapJunction(cell1.soma, cell2.soma, g=1e-3)
+    """
+
+    def __init__(self, section1, section2, g=1e-3, x1=0.5, x2=0.5):
+        """
+        Parameters
+        ----------
+        section1, section2 : object
+            The coupled sections, one in each cell.
+        g : numeric, default=1e-3
+            Junction conductance in uS.
+        x1, x2 : float, range [0, 1], default=0.5
+            Location of the junction on each section.
+
+        Notes
+        -----
+        The junction is implemented with two point processes (see
+        mechanisms/gap.mod), each receiving the membrane potential of
+        the other cell with ParallelContext.source_var and target_var.
+        The cells can thus be in different threads (see
+        simulation.set_threads); the fixed time step or global variable
+        time step method must be used.
+        """
+        global _n_transfers
+        pc = h.ParallelContext()
+        self._gap1 = h.gap(x1, sec=section1)
+        self._gap2 = h.gap(x2, sec=section2)
+        for source, x, gap in ((section2, x2, self._gap1),
+                               (section1, x1, self._gap2)):
+            pc.source_var(source(x)._ref_v, _n_transfers, sec=source)
+            pc.target_var(gap, gap._ref_vgap, _n_transfers)
+            _n_transfers += 1
+        pc.setup_transfer()
+        self.g = g
+
+    @property
+    def g(self):
+        """
+        Junction conductance in uS.
+        """
+        return self._gap1.g
+
+    @g.setter
+    def g(self, value):
+        self._gap1.g = value
+        self._gap2.g = value
+
+    @property
+    def i(self):
+        """
+        Current (nA) flowing out of the first cell through the junction.
+        """
+        return self._gap1.i
@@ -0,0 +1,677 @@
+"""
+Import ion channels and synapses from NEURON (.mod) files.
+
+Many published models of MSN channels are only available as NMODL
+files. The functions here read the interface of a mod file (its name,
+ions, and parameters) and compile and load mod files at run time, so
+that they can be used with the cells in this library without copying
+them into the `mechanisms` directory.
+
+Example
+-------
+>>> mechanisms = load('kv7.mod')
+>>> mechanisms[0]['name']
+'kv7'
+>>> for section in cell.all:
+...     section.insert('kv7')
+
+author: Antonio Gonzalez
+"""
+import itertools
+import math
+import re
+import shutil
+import subprocess
+import tempfile
+from pathlib import Path
+
+import neuron as nrn
+from neuron import h
+
+
+def _block(text, name):
+    # Contents of a top-level block, e.g. 'NEURON' or 'PARAMETER'.
+    match = re.search(r'^\s*' + name + r'\s*\{', text, flags=re.MULTILINE)
+    if match is None:
+        return ''
+    depth = 1
+    for index in range(match.end(), len(text)):
+        if text[index] == '{':
+            depth += 1
+        elif text[index] == '}':
+            depth -= 1
+            if depth == 0:
+                return text[match.end():index]
+    return text[match.end():]
+
+
+def _strip_comments(text):
+    text = re.sub(r'^\s*COMMENT\b.*?^\s*ENDCOMMENT\b', '', text,
+                  flags=re.MULTILINE | re.DOTALL)
+    text = re.sub(r'^\s*TITLE.*$', '', text, flags=re.MULTILINE)
+    return re.sub(r':.*$', '', text, flags=re.MULTILINE)
+
+
+def parse(path):
+    """
+    Read the interface of a mechanism from a mod file.
+
+    Parameters
+    ----------
+    path : str or Path
+        A NEURON mod file.
+
+    Returns
+    -------
+    mechanism : dict
+        With keys:
+
+        name : str
+            The SUFFIX or POINT_PROCESS name.
+        kind : str
+            'density' or 'point_process'.
+        ions : dict
+            Ions used, as {ion: {'read': [...], 'write': [...]}}.
+        range : list
+            RANGE variables.
+        global : list
+            GLOBAL variables.
+        parameters : dict
+            Default values in the PARAMETER block, as {name: (value,
+            unit)}; unit is None if not given.
+        states : list
+            STATE variables.
+        path : Path
+            The mod file.
+
+    Raises
+    ------
+    ValueError
+        If the file does not define a mechanism.
+    """
+    path = Path(path)
+    text = _strip_comments(path.read_text())
+    neuron_block = _block(text, 'NEURON')
+    match = re.search(r'\b(SUFFIX|POINT_PROCESS|ARTIFICIAL_CELL)\s+(\w+)',
+                      neuron_block)
+    if match is None:
+        raise ValueError(f'{path}: no SUFFIX or POINT_PROCESS in the '
+                         'NEURON block')
+    name = match.group(2)
+    kind = 'density' if match.group(1) == 'SUFFIX' else 'point_process'
+
+    def names(keyword):
+        found = []
+        for line in re.findall(r'\b' + keyword + r'\b([^\n]*)',
+                               neuron_block):
+            found += [word for word in re.split(r'[\s,]+', line) if word]
+        return found
+
+    ions = {}
+    for line in re.findall(r'\bUSEION\b([^\n]*)', neuron_block):
+        ion = line.split()[0]
+        read = re.search(r'\bREAD\b(.*?)(?=\bWRITE\b|\bVALENCE\b|$)', line)
+        write = re.search(r'\bWRITE\b(.*?)(?=\bREAD\b|\bVALENCE\b|$)',
+                          line)
+        ions[ion] = {
+            'read': re.findall(r'\w+', read.group(1)) if read else [],
+            'write': re.findall(r'\w+', write.group(1)) if write else []}
+
+    parameters = {}
+    for line in _block(text, 'PARAMETER').splitlines():
+        match = re.match(r'\s*(\w+)\s*=\s*([-+.\deE]+)\s*(\([^)]*\))?',
+                         line)
+        if match is not None:
+            parameter, value, unit = match.groups()
+            parameters[parameter] = (float(value),
+                                unit.strip('()') if unit else None)
+
+    states = re.findall(r'\b([A-Za-z_]\w*)\b(?!\s*\))',
+                        re.sub(r'\([^)]*\)', '', _block(text, 'STATE')))
+    return {'name': name, 'kind': kind, 'ions': ions,
+            'range': names('RANGE'), 'global': names('GLOBAL'),
+            'parameters': parameters, 'states': states, 'path': path}
+
+
+def is_loaded(name):
+    """
+    Return True if a mechanism with this name is available in NEURON.
+    """
+    for kind in (0, 1):
+        mechanisms = h.MechanismType(kind)
+        mech_name = h.ref('')
+        for index in range(int(mechanisms.count())):
+            mechanisms.select(index)
+            mechanisms.selected(mech_name)
+            if mech_name[0] == name:
+                return True
+    return False
+
+
+def load(paths, build_dir=None):
+    """
+    Compile and load mechanisms from mod files.
+
+    Parameters
+    ----------
+    paths : str, Path or list
+        Mod files, or directories with mod files.
+    build_dir : None or str or Path, default=None
+        Directory where the mod files are compiled. If None, a temporary
+        directory is used.
+
+    Returns
+    -------
+    mechanisms : list of dict
+        The interface of each mechanism, see parse().
+
+    Raises
+    ------
+    ValueError
+        If a mechanism with the same name is already loaded (NEURON
+        does not allow to redefine a mechanism).
+    RuntimeError
+        If the files cannot be compiled.
+
+    Notes
+    -----
+    This requires NEURON's `nrnivmodl` (and a C compiler) to be
+    available. Mechanisms can be loaded only once per Python session.
+    """
+    if isinstance(paths, (str, Path)):
+        paths = [paths]
+    files = []
+    for path in map(Path, paths):
+        files += sorted(path.glob('*.mod')) if path.is_dir() else [path]
+    mechanisms = [parse(path) for path in files]
+    for mechanism in mechanisms:
+        if is_loaded(mechanism['name']):
+            raise ValueError(f"{mechanism['path']}: mechanism "
+                             f"'{mechanism['name']}' is already loaded")
+
+    if build_dir is None:
+        build_dir = tempfile.mkdtemp(prefix='msn_nmodl_')
+    build_dir = Path(build_dir)
+    build_dir.mkdir(parents=True, exist_ok=True)
+    for path in files:
+        shutil.copy(path, build_dir)
+    result = subprocess.run(['nrnivmodl'], cwd=build_dir,
+                            capture_output=True, text=True)
+    if result.returncode != 0:
+        raise RuntimeError(f'nrnivmodl failed:\n{result.stderr}')
+    nrn.load_mechanisms(str(build_dir))
+    return mechanisms
+
+
+_hh_template = """TITLE {name}: ion channel generated from formulas
+
+COMMENT
+Generated by msn.nmodl.hh_channel.
+{formulas}
+ENDCOMMENT
+
+NEURON {{
+    THREADSAFE
+    SUFFIX {name}
+    {current}
+    RANGE gbar, g, {i}
+}}
+
+UNITS {{
+    (S) = (siemens)
+    (mV) = (millivolt)
+    (mA) = (milliamp)
+}}
+
+PARAMETER {{
+    gbar = {gbar} (S/cm2)
+    {erev_parameter}
+    {parameters}
+}}
+
+ASSIGNED {{
+    v (mV)
+    celsius (degC)
+    {e}
+    {i} (mA/cm2)
+    g (S/cm2)
+    {assigned}
+}}
+
+STATE {{ {states} }}
+
+BREAKPOINT {{
+    SOLVE states METHOD cnexp
+    g = gbar * {open_probability}
+    {i} = g * (v - {e_name})
+}}
+
+DERIVATIVE states {{
+    rates(v)
+{derivatives}
+}}
+
+INITIAL {{
+    rates(v)
+{initial}
+}}
+
+PROCEDURE rates(v (mV)) {{
+{rates}
+}}
+"""
+
+
+_markov_template = """TITLE {name}: stochastic ion channel from formulas
+
+COMMENT
+Generated by msn.nmodl.hh_channel.
+{formulas}
+
+With stochastic = 1 (the default) the channels in each segment,
+nchannels = gbar * area / gamma, are a Markov chain: each channel is in
+one of the states given by the number of open subunits of each gate,
+{state_names}, and the number of channels that
+leave each state in a time step, and their transitions, are drawn from
+binomial distributions (with the random stream `ranvar`; see
+msn.rng.seed_channels). With stochastic = 0 the gates are deterministic
+(Hodgkin-Huxley).
+ENDCOMMENT
+
+NEURON {{
+    THREADSAFE
+    SUFFIX {name}
+    {current}
+    RANGE gbar, g, {i}, gamma, stochastic, nchannels
+    RANDOM ranvar
+}}
+
+UNITS {{
+    (S) = (siemens)
+    (pS) = (picosiemens)
+    (mV) = (millivolt)
+    (mA) = (milliamp)
+    (um) = (micron)
+}}
+
+PARAMETER {{
+    gbar = {gbar} (S/cm2)
+    gamma = {gamma} (pS) : single-channel conductance
+    stochastic = 1
+    {erev_parameter}
+    {parameters}
+}}
+
+ASSIGNED {{
+    v (mV)
+    dt (ms)
+    celsius (degC)
+    area (um2)
+    {e}
+    {i} (mA/cm2)
+    g (S/cm2)
+    nchannels
+    count[{n_states}]
+    dcount[{n_states}]
+    {assigned}
+}}
+
+STATE {{ {states} }}
+
+BREAKPOINT {{
+    SOLVE states METHOD cnexp
+    if (stochastic == 0) {{
+        g = gbar * {open_probability}
+    }} else if (nchannels > 0) {{
+        g = gbar * count[{open_state}] / nchannels
+    }} else {{
+        g = 0
+    }}
+    {i} = g * (v - {e_name})
+}}
+
+BEFORE STEP {{
+    if (stochastic) {{
+        markov()
+    }}
+}}
+
+DERIVATIVE states {{
+    rates(v)
+{derivatives}
+}}
+
+INITIAL {{
+    rates(v)
+{initial}
+    nchannels = floor(gbar * area * 1e4 / gamma + 0.5)
+    if (stochastic) {{
+        markov_init()
+    }}
+}}
+
+PROCEDURE rates(v (mV)) {{
+{rates}
+}}
+
+PROCEDURE markov_init() {{
+    : Channels distributed over the states at steady state.
+    LOCAL remaining, mass, p
+    remaining = nchannels
+    mass = 1
+{markov_init}
+}}
+
+PROCEDURE markov() {{
+    LOCAL leaving, total, moved, j
+    rates(v)
+    FROM j = 0 TO {last_state} {{
+        dcount[j] = 0
+    }}
+{markov}
+    FROM j = 0 TO {last_state} {{
+        count[j] = count[j] + dcount[j]
+    }}
+}}
+
+FUNCTION binomial(n, p) {{
+    LOCAL k, u, pmf, cdf, ratio, q
+    if (n < 1 || p <= 0) {{
+        binomial = 0
+    }} else if (p >= 1) {{
+        binomial = n
+    }} else if (n * p < 30 || n * (1 - p) < 30) {{
+        : Inversion of the cumulative distribution, of the number of
+        : channels with probability q = min(p, 1 - p), so that
+        : pow(1 - q, n) does not underflow.
+        q = p
+        if (p > 0.5) {{
+            q = 1 - p
+        }}
+        u = random_uniform(ranvar)
+        pmf = pow(1 - q, n)
+        cdf = pmf
+        ratio = q / (1 - q)
+        k = 0
+        while (u > cdf && k < n) {{
+            pmf = pmf * (n - k) / (k + 1) * ratio
+            k = k + 1
+            cdf = cdf + pmf
+        }}
+        if (p > 0.5) {{
+            k = n - k
+        }}
+        binomial = k
+    }} else {{
+        : Normal approximation.
+        u = sqrt(n * p * (1 - p)) * random_normal(ranvar)
+        k = floor(n * p + u + 0.5)
+        if (k < 0) {{
+            k = 0
+        }} else if (k > n) {{
+            k = n
+        }}
+        binomial = k
+    }}
+}}
+"""
+
+
+def _markov_blocks(powers):
+    # States of the Markov chain (number of open subunits of each gate),
+    # and the NMODL code that initialises and updates them.
+    gates = list(powers)
+    states = list(itertools.product(*(range(powers[gate] + 1)
+                                      for gate in gates)))
+    index = {state: number for number, state in enumerate(states)}
+    init = []
+    for number, state in enumerate(states[:-1]):
+        factors = []
+        for gate, k in zip(gates, state):
+            power = powers[gate]
+            factors.append(f'{math.comb(power, k)} * {gate}_inf^{k} * '
+                           f'(1 - {gate}_inf)^{power - k}')
+        init += [f"    p = {' * '.join(factors)}",
+                 '    if (mass > 0) {',
+                 f'        count[{number}] = binomial(remaining, p / mass)',
+                 '    } else {',
+                 f'        count[{number}] = 0',
+                 '    }',
+                 f'    remaining = remaining - count[{number}]',
+                 '    mass = mass - p']
+    init.append(f'    count[{len(states) - 1}] = remaining')
+    update = []
+    for number, state in enumerate(states):
+        transitions = []
+        for position, (gate, k) in enumerate(zip(gates, state)):
+            if k < powers[gate]:
+                target = state[:position] + (k + 1,) + state[position + 1:]
+                transitions.append(
+                    (index[target],
+                     f'{powers[gate] - k} * {gate}_inf / {gate}_tau'))
+            if k > 0:
+                target = state[:position] + (k - 1,) + state[position + 1:]
+                transitions.append(
+                    (index[target], f'{k} * (1 - {gate}_inf) / {gate}_tau'))
+        rates = ' + '.join(rate for __, rate in transitions)
+        update += [f'    : state {number}, {state}',
+                   f'    total = {rates}',
+                   f'    leaving = binomial(count[{number}], '
+                   '1 - exp(-total * dt))',
+                   f'    dcount[{number}] = dcount[{number}] - leaving']
+        for target, rate in transitions[:-1]:
+            update += ['    if (total > 0) {',
+                       f'        moved = binomial(leaving, ({rate}) / total)',
+                       '    } else {',
+                       '        moved = 0',
+                       '    }',
+                       f'    dcount[{target}] = dcount[{target}] + moved',
+                       '    leaving = leaving - moved',
+                       f'    total = total - ({rate})']
+        target = transitions[-1][0]
+        update.append(f'    dcount[{target}] = dcount[{target}] + leaving')
+    return states, '\n'.join(init), '\n'.join(update)
+
+
+# Channels created with hh_channel(), as {name: (signature, mechanism)},
+# where the signature (gates, ion and parameter names) tells whether a
+# channel can be updated without compiling.
+_hh_channels = {}
+
+
+def hh_channel(name, gates, ion=None, gbar=0, erev=0, parameters=None,
+               stochastic=False, gamma=10, build_dir=None):
+    """
+    Create and load a Hodgkin-Huxley type ion channel from formulas.
+
+    The rate functions of each gate are given as formulas of the
+    membrane potential `v` (mV), temperature `celsius`, and named
+    `parameters` (see expr.Expression); a mod file is written and
+    compiled, so that new channels can be defined e.g. in a
+    configuration file.
+
+    The formulas are compiled, but the values of `parameters` are
+    GLOBAL variables of the mechanism (h.<parameter>_<name>): calling
+    hh_channel again with the same name, gates and ion, and only new
+    parameter values, sets them without compiling again.
+
+    Parameters
+    ----------
+    name : str
+        Mechanism name (SUFFIX), e.g. 'kv7'.
+    gates : dict
+        As {gate: rates}, where gate is the name of the state variable
+        (e.g. 'm') and rates is a dict with 'power' (exponent of the
+        gate in the open probability, default 1) and either 'inf' and
+        'tau' (ms), or 'alpha' and 'beta' (1/ms).
+    ion : None or str, default=None
+        Ion carried by the current, e.g. 'k'. If None, a non-specific
+        current with reversal potential `erev`.
+    gbar : numeric, default=0
+        Default maximal conductance (S/cm2).
+    erev : numeric, default=0
+        Reversal potential (mV) of a non-specific current.
+    parameters : None or dict, default=None
+        Parameters used in the formulas, as {name: value}, e.g.
+        {'vhalf': -35}.
+    stochastic : bool, default=False
+        If True, the channels can run as a Markov chain with stochastic
+        transitions (see Notes); this is the default of each instance of
+        the mechanism, which can be switched back to deterministic
+        gating by setting its `stochastic` variable to 0.
+    gamma : numeric, default=10
+        Single-channel conductance (pS) of a stochastic channel, which
+        sets the number of channels in each segment. Must be greater
+        than 0.
+    build_dir : None or str or Path, default=None
+        Where to write and compile the mod file; see load().
+
+    Returns
+    -------
+    mechanism : dict
+        The interface of the mechanism, see parse().
+
+    Raises
+    ------
+    ValueError
+        If `gamma` is not greater than 0 in a stochastic channel, or if
+        a channel with this name is already loaded with different
+        formulas: NEURON cannot redefine a mechanism, so a change in
+        the formulas (rather than in parameter values) needs a new name
+        or a new Python session.
+
+    Notes
+    -----
+    Compiling requires NEURON's `nrnivmodl` and a C compiler; see
+    load().
+
+    In a stochastic channel, each channel is in one of the states given
+    by the number of open subunits of each gate (e.g. 8 states for
+    m^3 h), and opens only in the state with all subunits open. At each
+    time step, the number of channels that leave each state, and the
+    transition they make (one subunit opening or closing, with the
+    rates of the gate), are drawn from binomial distributions, which is
+    exact in the limit of small time steps. Channel noise matters in
+    small compartments (e.g. spines, thin dendrites), with few
+    channels. Stochastic channels draw random numbers from their own
+    Random123 streams, which must be seeded after the mechanism is
+    inserted (see rng.seed_channels). Stochastic gating requires
+    NEURON 9 or later and the fixed step method. Only channels defined
+    here can be stochastic; the mechanisms of the model (in
+    mechanisms/*.mod) are deterministic, but a stochastic version of
+    one can be defined with its rate functions as `gates`.
+
+    Example
+    -------
+    An M-type potassium current:
+    >>> hh_channel('kv7', ion='k', gbar=1e-4, gates={'m': {
+    ...     'inf': '1 / (1 + exp(-(v + 35) / 10))',
+    ...     'tau': '1000 / (3.3 * (exp((v + 35) / 20) + '
+    ...            'exp(-(v + 35) / 20)))'}})
+    >>> for section in cell.all:
+    ...     section.insert('kv7')
+
+    A stochastic version, deterministic in the dendrites:
+    >>> hh_channel('kv7s', gates, ion='k', gbar=1e-4, stochastic=True)
+    >>> for section in cell.all:
+    ...     section.insert('kv7s')
+    >>> for section in cell.dend:
+    ...     for segment in section:
+    ...         segment.kv7s.stochastic = 0
+    >>> rng.seed_channels(cell.all, 'kv7s')
+
+    The same channel with a parameter, shifted without compiling again:
+    >>> gates = {'m': {'inf': '1 / (1 + exp(-(v - vhalf) / 10))',
+    ...                'tau': '50'}}
+    >>> hh_channel('kv7', gates, ion='k', parameters={'vhalf': -35})
+    >>> hh_channel('kv7', gates, ion='k', parameters={'vhalf': -30})
+    """
+    from .expr import Expression
+
+    if stochastic and gamma <= 0:
+        raise ValueError('The single-channel conductance `gamma` must be '
+                         'greater than 0')
+    parameters = dict(parameters or {})
+    signature = (repr(gates), ion, sorted(parameters), stochastic)
+    if name in _hh_channels:
+        loaded, mechanism = _hh_channels[name]
+        if loaded != signature:
+            raise ValueError(f"Channel '{name}' is already loaded with "
+                             "different formulas; give it a new name")
+        for parameter, value in parameters.items():
+            setattr(h, f'{parameter}_{name}', value)
+        return mechanism
+    reserved = {'v', 'celsius', 'gbar', 'g', 'e', 'i', *gates}
+    if stochastic:
+        reserved |= {'dt', 'area', 'gamma', 'stochastic', 'nchannels',
+                     'count', 'dcount', 'ranvar', 'binomial'}
+    if ion is not None:
+        reserved |= {f'e{ion}', f'i{ion}'}
+    for parameter in parameters:
+        if parameter in reserved or not parameter.isidentifier():
+            raise ValueError(f"Invalid parameter name '{parameter}'")
+    variables = ['v', 'celsius', *parameters]
+
+    formulas, assigned, rates, derivatives, initial, factors = (
+        [], [], [], [], [], [])
+    for gate, spec in gates.items():
+        power = spec.get('power', 1)
+        factors.append(gate if power == 1 else f'{gate}^{power}')
+        if 'inf' in spec and 'tau' in spec:
+            inf = Expression(spec['inf'], variables).to_nmodl()
+            tau = Expression(spec['tau'], variables).to_nmodl()
+            formulas += [f"{gate}_inf = {spec['inf']}",
+                         f"{gate}_tau = {spec['tau']}"]
+        elif 'alpha' in spec and 'beta' in spec:
+            alpha = Expression(spec['alpha'], variables).to_nmodl()
+            beta = Expression(spec['beta'], variables).to_nmodl()
+            inf = f'({alpha}) / (({alpha}) + ({beta}))'
+            tau = f'1 / (({alpha}) + ({beta}))'
+            formulas += [f"{gate}_alpha = {spec['alpha']}",
+                         f"{gate}_beta = {spec['beta']}"]
+        else:
+            raise ValueError(f"gate '{gate}': give 'inf' and 'tau', or "
+                             "'alpha' and 'beta'")
+        assigned.append(f'{gate}_inf {gate}_tau (ms)')
+        rates += [f'    {gate}_inf = {inf}', f'    {gate}_tau = {tau}']
+        derivatives.append(f"    {gate}' = ({gate}_inf - {gate}) / "
+                           f"{gate}_tau")
+        initial.append(f'    {gate} = {gate}_inf')
+
+    if ion is None:
+        current = 'NONSPECIFIC_CURRENT i'
+        i, e, e_name = 'i', '', 'e'
+        erev_parameter = f'e = {erev} (mV)'
+    else:
+        current = f'USEION {ion} READ e{ion} WRITE i{ion}'
+        i, e, e_name = f'i{ion}', f'e{ion} (mV)', f'e{ion}'
+        erev_parameter = ''
+
+    fields = dict(
+        name=name, formulas='\n'.join(formulas), current=current, i=i,
+        gbar=gbar, erev_parameter=erev_parameter,
+        parameters='\n    '.join(f'{parameter} = {value}'
+                                  for parameter, value in parameters.items()),
+        e=e, e_name=e_name,
+        assigned='\n    '.join(assigned), states=' '.join(gates),
+        open_probability=' * '.join(factors), rates='\n'.join(rates),
+        derivatives='\n'.join(derivatives), initial='\n'.join(initial))
+    if stochastic:
+        states, markov_init, markov = _markov_blocks(
+            {gate: spec.get('power', 1) for gate, spec in gates.items()})
+        text = _markov_template.format(
+            **fields, gamma=gamma, n_states=len(states),
+            last_state=len(states) - 1, open_state=len(states) - 1,
+            state_names=', '.join(map(str, states)),
+            markov_init=markov_init, markov=markov)
+    else:
+        text = _hh_template.format(**fields)
+
+    if build_dir is None:
+        build_dir = tempfile.mkdtemp(prefix='msn_nmodl_')
+    path = Path(build_dir) / f'{name}.mod'
+    path.parent.mkdir(parents=True, exist_ok=True)
+    path.write_text(text)
+    mechanism = load(path, build_dir=path.parent)[0]
+    _hh_channels[name] = (signature, mechanism)
+    return mechanism
@@ -4,10 +4,15 @@ neurones (MSNs).
 
 author: Antonio Gonzalez
 """
+import copy
+import json
+from numbers import Number
+from pathlib import Path
+
 import numpy as np
 import pandas as pd
 
-from . import paths
+from . import paths, units
 
 
 class ModelParameters:
@@ -260,3 +265,299 @@ class ModelParameters:
             (self._conductances.cell == 'all')]
         gbar = gbar.drop('cell', axis=1)
         return gbar
+
+
+# Schema of simulation configuration files (see load_file()). Each
+# entry describes one setting: its type, whether it is required, and
+# the allowed values (`choices`) or range (`min`, `max`, or
+# `min_exclusive` for a lower bound that is not allowed). Settings of
+# type dict have their own `fields`. Numbers with a `unit` can also be
+# given as strings with units (e.g. '0.5 s'), which are converted to
+# `unit` (see units.parse).
+config_schema = {
+    'cell': {
+        'type': dict, 'required': True,
+        'fields': {
+            'type': {'type': str, 'required': True,
+                     'choices': ['dmsn', 'imsn']},
+            'index': {'type': int, 'required': True, 'min': 0},
+            'v_init': {'type': Number, 'unit': 'mV'}}},
+    'stimulus': {
+        'type': dict,
+        'fields': {
+            'delay': {'type': Number, 'min': 0, 'unit': 'ms'},
+            'duration': {'type': Number, 'min': 0, 'unit': 'ms'},
+            'amplitude': {'type': Number, 'unit': 'nA'},
+            'add_rheob': {'type': bool}}},
+    'noise': {
+        'type': dict,
+        'fields': {
+            'gaba_freq': {'type': Number, 'min': 0, 'unit': 'Hz'},
+            'glut_freq': {'type': Number, 'min': 0, 'unit': 'Hz'},
+            'dend_only': {'type': bool},
+            'ampa_scale_factor': {'type': Number, 'min': 0},
+            'nmda_scale_factor': {'type': Number, 'min': 0},
+            'gaba_scale_factor': {'type': Number, 'min': 0}}},
+    'modulation': {'type': str, 'choices': ['DA', 'ACh']},
+    'temperature': {'type': Number, 'min': 0, 'max': 50,
+                    'unit': 'degC'},
+    'tstop': {'type': Number, 'min': 0, 'unit': 'ms'},
+    'seed': {'type': int, 'min': 0},
+    'channels': {'type': dict},
+    'preset': {'type': str},
+    'output': {'type': str}}
+
+# Schema of each entry in the 'channels' setting, as {name: settings}:
+# additional ion channels inserted in the cell (see
+# cell.register_channel), defined in a mod file or by the formulas of
+# their rate functions (`gates`, `ion` and `parameters`, see
+# nmodl.hh_channel).
+channel_schema = {
+    'mod': {'type': str},
+    'gates': {'type': dict},
+    'ion': {'type': str},
+    'parameters': {'type': dict},
+    'stochastic': {'type': bool},
+    'gamma': {'type': Number, 'min_exclusive': 0},
+    'compartments': {'type': list},
+    'gbar': {'type': Number, 'min': 0},
+    'variable': {'type': str}}
+
+
+class ParameterError(ValueError):
+    """
+    Invalid setting in a configuration file.
+    """
+
+
+# Named configurations, as {name: {'description': str, 'reference': str,
+# 'config': dict}}. A configuration file with "preset": name starts from
+# the preset's settings, and its own settings take precedence. Only
+# models implemented in this library are included: the parameter sets
+# of other published MSN models (e.g. Wolf et al 2005, Moyer et al
+# 2007) use different channel models and cannot be expressed as
+# settings of this one. More presets can be added with
+# register_preset().
+presets = {
+    'lindroos2020-dmsn': {
+        'description': 'dMSN, first of the 71 fitted parameter sets',
+        'reference': 'Lindroos R & Hellgren Kotaleski J (2020). Eur J '
+                     'Neurosci, DOI: 10.1111/ejn.14891',
+        'config': {'cell': {'type': 'dmsn', 'index': 0}}},
+    'lindroos2020-imsn': {
+        'description': 'iMSN, first of the 34 fitted parameter sets',
+        'reference': 'Lindroos R & Hellgren Kotaleski J (2020). Eur J '
+                     'Neurosci, DOI: 10.1111/ejn.14891',
+        'config': {'cell': {'type': 'imsn', 'index': 0}}},
+    'lindroos2020-dmsn-da': {
+        'description': 'dMSN with dopamine modulation',
+        'reference': 'Lindroos R & Hellgren Kotaleski J (2020). Eur J '
+                     'Neurosci, DOI: 10.1111/ejn.14891',
+        'config': {'cell': {'type': 'dmsn', 'index': 0},
+                   'modulation': 'DA'}},
+    'lindroos2020-imsn-da': {
+        'description': 'iMSN with dopamine modulation',
+        'reference': 'Lindroos R & Hellgren Kotaleski J (2020). Eur J '
+                     'Neurosci, DOI: 10.1111/ejn.14891',
+        'config': {'cell': {'type': 'imsn', 'index': 0},
+                   'modulation': 'DA'}},
+}
+
+
+def register_preset(name, config, description='', reference=''):
+    """
+    Add a named configuration to `presets`.
+
+    Parameters
+    ----------
+    name : str
+        Name of the preset, as used in "preset" in configuration files.
+    config : dict
+        Settings of the preset; see `config_schema`. It may be partial,
+        e.g. only a "noise" setting.
+    description : str, default=''
+    reference : str, default=''
+        Publication that the settings come from.
+
+    Raises
+    ------
+    ParameterError
+        If `config` is not valid.
+    """
+    if 'preset' in config:
+        raise ParameterError(f'{name}: presets cannot use other presets')
+    # Validation converts quantities in place; keep the caller's copy.
+    config = copy.deepcopy(config)
+    schema = {key: {**rules, 'required': False}
+              for key, rules in config_schema.items()}
+    validate(config, schema, prefix=f'preset {name}: ')
+    presets[name] = {'description': description, 'reference': reference,
+                     'config': config}
+
+
+def _merge(base, override):
+    merged = dict(base)
+    for key, value in override.items():
+        if isinstance(value, dict) and isinstance(merged.get(key), dict):
+            merged[key] = _merge(merged[key], value)
+        else:
+            merged[key] = value
+    return merged
+
+
+def apply_preset(config):
+    """
+    Return a configuration with the settings of its preset.
+
+    Parameters
+    ----------
+    config : dict
+        Configuration, with or without a "preset" setting.
+
+    Returns
+    -------
+    config : dict
+        The settings of the preset, updated (recursively) with those of
+        `config`. The name of the preset is kept in "preset". It is a
+        new dictionary that shares no values with the preset or with
+        the given `config`, so that it can be validated (which converts
+        quantities in place) without changing either.
+    """
+    if 'preset' not in config:
+        return config
+    name = config['preset']
+    if name not in presets:
+        raise ParameterError(f"preset: unknown preset '{name}'; expected "
+                             f'one of {list(presets)}')
+    return _merge(copy.deepcopy(presets[name]['config']),
+                  copy.deepcopy(config))
+
+
+def validate(config, schema=config_schema, prefix=''):
+    """
+    Check a configuration against a schema.
+
+    Parameters
+    ----------
+    config : dict
+        Configuration, e.g. as loaded from a file.
+    schema : dict, default=config_schema
+        Schema; see `config_schema`.
+    prefix : str, default=''
+        Name of the parent setting, used in error messages.
+
+    Raises
+    ------
+    ParameterError
+        If any setting is unknown, missing, of the wrong type, or out of
+        range. The error message names the offending setting, e.g.
+        'cell.index'.
+
+    Notes
+    -----
+    Quantities given with units (settings with a `unit` in the schema)
+    are converted in place, so that after validation all numbers in
+    `config` are in the units used internally.
+    """
+    for key in config:
+        if key not in schema:
+            raise ParameterError(f'{prefix}{key}: unknown setting; '
+                                 f'expected one of {list(schema)}')
+    for key, rules in schema.items():
+        name = f'{prefix}{key}'
+        if key not in config:
+            if rules.get('required', False):
+                raise ParameterError(f'{name}: required setting missing')
+            continue
+        value = config[key]
+        if 'unit' in rules and isinstance(value, str):
+            try:
+                value = units.parse(value, rules['unit'])
+            except units.UnitError as error:
+                raise ParameterError(f'{name}: {error}') from None
+            config[key] = value
+        expected = rules['type']
+        # bool is a subclass of int in Python, but True is not a valid
+        # number here.
+        if not isinstance(value, expected) or (
+                isinstance(value, bool) and expected is not bool):
+            raise ParameterError(
+                f'{name}: expected {expected.__name__}, got '
+                f'{type(value).__name__} ({value!r})')
+        if 'choices' in rules and value not in rules['choices']:
+            raise ParameterError(f'{name}: {value!r} is not one of '
+                                 f'{rules["choices"]}')
+        if 'min' in rules and value < rules['min']:
+            raise ParameterError(f'{name}: {value} is less than the '
+                                 f'minimum ({rules["min"]})')
+        if 'min_exclusive' in rules and value <= rules['min_exclusive']:
+            raise ParameterError(f'{name}: {value} must be greater than '
+                                 f'{rules["min_exclusive"]}')
+        if 'max' in rules and value > rules['max']:
+            raise ParameterError(f'{name}: {value} is greater than the '
+                                 f'maximum ({rules["max"]})')
+        if 'fields' in rules:
+            validate(value, rules['fields'], prefix=f'{name}.')
+    if schema is not config_schema:
+        return
+    for key, settings in config.get('channels', {}).items():
+        if not isinstance(settings, dict):
+            raise ParameterError(f'channels.{key}: expected a mapping '
+                                 'of settings')
+        validate(settings, channel_schema, prefix=f'channels.{key}.')
+        # Only channels defined by formulas can be stochastic (see
+        # nmodl.hh_channel); those in mod files are deterministic.
+        for setting in ('stochastic', 'gamma'):
+            if setting in settings and 'gates' not in settings:
+                raise ParameterError(f'channels.{key}.{setting}: only '
+                                     'channels defined by formulas '
+                                     '("gates") can be stochastic')
+
+
+def load_file(path, schema=config_schema):
+    """
+    Load and validate a simulation configuration file.
+
+    Parameters
+    ----------
+    path : str or Path
+        A JSON file, or a YAML file (extension '.yaml' or '.yml'; this
+        requires the package PyYAML).
+    schema : dict, default=config_schema
+        Schema used to validate the configuration.
+
+    Returns
+    -------
+    config : dict
+        The configuration.
+
+    Raises
+    ------
+    ParameterError
+        If the configuration is not valid; see validate().
+
+    Notes
+    -----
+    If the configuration names a "preset", it is completed with the
+    settings of the preset (see apply_preset).
+
+    Example
+    -------
+    >>> config = load_file('config.json')
+    """
+    path = Path(path)
+    with open(path) as file:
+        if path.suffix in ('.yaml', '.yml'):
+            import yaml
+            config = yaml.safe_load(file)
+        else:
+            config = json.load(file)
+    if not isinstance(config, dict):
+        raise ParameterError(f'{path}: expected a mapping of settings')
+    try:
+        if schema is config_schema:
+            config = apply_preset(config)
+        validate(config, schema)
+    except ParameterError as error:
+        raise ParameterError(f'{path}: {error}') from None
+    return config
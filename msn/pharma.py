@@ -0,0 +1,301 @@
+"""
+Pharmacology: channel blockers, receptor agonists and antagonists.
+
+Drugs are described by the channels or receptors they act on, and by
+the concentration-response relation of each action (Hill equation).
+Applying a drug at a given concentration scales the conductance of its
+targets in a model cell; for dopamine receptor drugs, it changes the
+level of dopamine or adenosine modulation (see modulation.Dopamine
+and modulation.Adenosine). Drugs can be
+applied and washed out during a simulation with simulation.Schedule.
+
+The potencies (IC50/EC50) given in `drugs` are approximate values
+intended for qualitative simulations; check them against the literature
+for the preparation of interest before using them quantitatively.
+
+Example
+-------
+Apply 10 uM nimodipine at t=2 s, wash out at t=5 s:
+>>> cell = MSN('dmsn', 12)
+>>> schedule = Schedule()
+>>> pharmacology = Pharmacology(cell)
+>>> pharmacology.schedule(schedule, 2000, 'nimodipine', 10)
+>>> pharmacology.schedule(schedule, 5000, 'nimodipine', 0)
+
+author: Antonio Gonzalez
+"""
+from dataclasses import dataclass, field
+
+
+@dataclass
+class Drug:
+    """
+    A drug and its targets.
+
+    Attributes
+    ----------
+    name : str
+    targets : dict
+        As {(mechanism, variable): (efficacy, potency)}. `mechanism` is
+        the name of a density mechanism or point process (e.g. 'naf',
+        'glutamate'), a dopamine receptor ('D1' or 'D2') or the
+        adenosine A2A receptor ('A2A'); `variable` is the parameter
+        that is scaled (e.g. 'gbar'; 'level' for receptors).
+        `efficacy` is the maximum effect: -1 for full block (or full
+        antagonism), positive for enhancement (or agonism). `potency`
+        is the IC50 or EC50 (uM).
+    hill : numeric, default=1
+        Hill coefficient.
+    """
+    name: str
+    targets: dict = field(default_factory=dict)
+    hill: float = 1
+
+    def effect(self, target, concentration):
+        """
+        Fractional effect on a target at a given concentration.
+
+        Parameters
+        ----------
+        target : tuple
+            (mechanism, variable), a key of `targets`.
+        concentration : numeric
+            Drug concentration (uM).
+
+        Returns
+        -------
+        effect : float
+            Fractional change of the target, from -1 (full block) up;
+            0 if the drug does not act on the target.
+        """
+        if target not in self.targets or concentration <= 0:
+            return 0.
+        efficacy, potency = self.targets[target]
+        occupancy = 1 / (1 + (potency / concentration)**self.hill)
+        return efficacy * occupancy
+
+
+drugs = {
+    'TTX': Drug('TTX', {('naf', 'gbar'): (-1, 0.005),
+                        ('nap', 'gbar'): (-1, 0.005)}),
+    '4-AP': Drug('4-AP', {('kas', 'gbar'): (-1, 50),
+                          ('kaf', 'gbar'): (-1, 2000)}),
+    'TEA': Drug('TEA', {('kdr', 'gbar'): (-1, 5000),
+                        ('bk', 'gbar'): (-1, 200),
+                        ('kv31', 'gbar'): (-1, 200)}),
+    'barium': Drug('barium', {('kir', 'gbar'): (-1, 5)}),
+    'XE991': Drug('XE991', {('Im', 'gbar'): (-1, 1)}),
+    'apamin': Drug('apamin', {('sk', 'gbar'): (-1, 0.0001)}),
+    'iberiotoxin': Drug('iberiotoxin', {('bk', 'gbar'): (-1, 0.002)}),
+    'nimodipine': Drug('nimodipine', {('cal12', 'pbar'): (-1, 0.1),
+                                      ('cal13', 'pbar'): (-1, 1)}),
+    'conotoxin GVIA': Drug('conotoxin GVIA',
+                           {('can', 'pbar'): (-1, 0.001)}),
+    'SNX-482': Drug('SNX-482', {('car', 'pbar'): (-1, 0.03)}),
+    'mibefradil': Drug('mibefradil', {('cav32', 'pbar'): (-1, 1),
+                                      ('cav33', 'pbar'): (-1, 1)}),
+    'NBQX': Drug('NBQX', {('glutamate', 'ampa_scale_factor'): (-1, 0.15),
+                          ('tmglut', 'ampa_scale_factor'): (-1, 0.15)}),
+    'AP5': Drug('AP5', {('glutamate', 'nmda_scale_factor'): (-1, 5),
+                        ('tmglut', 'nmda_scale_factor'): (-1, 5)}),
+    'gabazine': Drug('gabazine', {('gaba', 'scale_factor'): (-1, 0.2),
+                                  ('tmgaba', 'scale_factor'): (-1, 0.2)}),
+    'SKF-81297': Drug('SKF-81297', {('D1', 'level'): (1, 0.005)}),
+    'SCH-23390': Drug('SCH-23390', {('D1', 'level'): (-1, 0.001)}),
+    'quinpirole': Drug('quinpirole', {('D2', 'level'): (1, 0.01)}),
+    'sulpiride': Drug('sulpiride', {('D2', 'level'): (-1, 0.01)}),
+    'caffeine': Drug('caffeine', {('A2A', 'level'): (-1, 5)}),
+    'CGS-21680': Drug('CGS-21680', {('A2A', 'level'): (1, 0.03)}),
+    'SCH-58261': Drug('SCH-58261', {('A2A', 'level'): (-1, 0.002)}),
+}
+
+
+def get_drug(drug):
+    """
+    Return a Drug, given a Drug or a name in `drugs`.
+    """
+    if isinstance(drug, Drug):
+        return drug
+    if drug not in drugs:
+        raise ValueError(f"Unknown drug '{drug}'; it must be one of "
+                         f"{list(drugs)} or a Drug")
+    return drugs[drug]
+
+
+class Pharmacology:
+    """
+    Drugs applied to a model cell.
+
+    The effects of drugs acting on the same target multiply, and are
+    always relative to the value of the target before any drug was
+    applied, so drugs can be applied, their concentration changed, and
+    washed out in any order.
+
+    Attributes
+    ----------
+    cell : object
+        The model cell.
+    dopamine : None or modulation.Dopamine
+        Dopamine modulation of the cell, required for drugs acting on
+        dopamine receptors.
+    adenosine : None or modulation.Adenosine
+        Adenosine modulation of the cell, required for drugs acting on
+        A2A receptors.
+    concentrations : dict
+        Current concentration (uM) of each drug, as {name: uM}.
+
+    Methods
+    -------
+    apply(drug, concentration)
+        Apply a drug, or change its concentration
+    wash_out(drug=None)
+        Remove a drug, or all drugs
+    schedule(schedule, time, drug, concentration)
+        Apply a drug at a given time during a simulation
+
+    Notes
+    -----
+    Only the synapses that exist when a drug is applied are affected.
+    """
+
+    def __init__(self, cell, dopamine=None, adenosine=None):
+        """
+        Parameters
+        ----------
+        cell : object
+            Model cell, e.g. cell.MSN.
+        dopamine : None or modulation.Dopamine, default=None
+            Dopamine modulation of the cell. The baseline dopamine level
+            is the level of the modulation when the first drug acting
+            on dopamine receptors is applied.
+        adenosine : None or modulation.Adenosine, default=None
+            Adenosine modulation of the cell. Its Dopamine modulation
+            is used if `dopamine` is None; drugs acting on D2 receptors
+            then change its dopamine level.
+        """
+        if dopamine is None and adenosine is not None:
+            dopamine = adenosine.dopamine
+        self.cell = cell
+        self.dopamine = dopamine
+        self.adenosine = adenosine
+        self.concentrations = {}
+        self._drugs = {}
+        self._baseline = {}
+        self._scheduled = set()
+
+    def _receptor(self):
+        if self.dopamine is None:
+            return None
+        if self.dopamine.receptor is not None:
+            return self.dopamine.receptor
+        return {'dmsn': 'D1', 'imsn': 'D2'}[self.cell.type]
+
+    def _objects(self, mechanism):
+        # Mechanisms (in every segment) or point processes with this
+        # name.
+        for section in self.cell.all:
+            for segment in section:
+                if hasattr(segment, mechanism):
+                    yield getattr(segment, mechanism)
+                for point in segment.point_processes():
+                    if point.hname().split('[')[0] == mechanism:
+                        yield point
+
+    def _update(self, target):
+        mechanism, variable = target
+        factor = 1
+        for name, drug in self._drugs.items():
+            factor *= 1 + drug.effect(target, self.concentrations[name])
+        if mechanism in ('D1', 'D2', 'A2A'):
+            if mechanism == 'A2A':
+                modulation = self.adenosine
+                if modulation is None:
+                    return
+                current = modulation.level
+            elif mechanism != self._receptor():
+                return
+            elif self.adenosine is not None:
+                modulation = self.adenosine
+                current = modulation.dopamine_level
+            else:
+                modulation = self.dopamine
+                current = modulation.level
+            baseline = self._baseline.setdefault(target, current)
+            level = baseline * factor
+            # Agonists increase the level towards full modulation.
+            if factor > 1:
+                level = baseline + (1 - baseline) * min(factor - 1, 1)
+            if modulation is self.adenosine and mechanism != 'A2A':
+                modulation.set_dopamine(level)
+            else:
+                modulation.set_level(level)
+            return
+        if target not in self._baseline:
+            self._baseline[target] = [
+                (obj, getattr(obj, variable))
+                for obj in self._objects(mechanism)]
+        for obj, baseline in self._baseline[target]:
+            setattr(obj, variable, baseline * max(factor, 0))
+
+    def apply(self, drug, concentration):
+        """
+        Apply a drug, or change its concentration.
+
+        Parameters
+        ----------
+        drug : str or Drug
+            The drug, e.g. 'TTX' (see `drugs`).
+        concentration : numeric
+            Concentration in uM; 0 to wash out.
+        """
+        drug = get_drug(drug)
+        self._drugs[drug.name] = drug
+        self.concentrations[drug.name] = concentration
+        for target in drug.targets:
+            self._update(target)
+
+    def wash_out(self, drug=None):
+        """
+        Remove a drug.
+
+        Parameters
+        ----------
+        drug : None, str or Drug, default=None
+            The drug to remove. If None, all drugs are removed.
+        """
+        names = list(self._drugs) if drug is None else [
+            get_drug(drug).name]
+        for name in names:
+            if name in self._drugs:
+                self.apply(self._drugs[name], 0)
+
+    def schedule(self, schedule, time, drug, concentration):
+        """
+        Apply a drug at a given time during a simulation.
+
+        Parameters
+        ----------
+        schedule : simulation.Schedule
+        time : numeric
+            Simulation time (ms).
+        drug : str or Drug
+            The drug, e.g. 'TTX' (see `drugs`).
+        concentration : numeric
+            Concentration in uM; 0 to wash out.
+
+        Notes
+        -----
+        The effect is instantaneous; for a gradual wash-in, schedule a
+        series of increasing concentrations.
+
+        The concentration of the drug when it is first scheduled (0 if
+        it has not been applied) is restored every time the simulation
+        is initialised, so that every run starts from the pre-drug
+        state.
+        """
+        drug = get_drug(drug)
+        if (schedule, drug.name) not in self._scheduled:
+            self._scheduled.add((schedule, drug.name))
+            schedule.reset(self.apply, drug,
+                           self.concentrations.get(drug.name, 0))
+        schedule.at(time, self.apply, drug, concentration)
@@ -0,0 +1,345 @@
+"""
+Synaptic plasticity.
+
+author: Antonio Gonzalez
+"""
+import numpy as np
+from neuron import h
+
+
+def _spike_detector(netcon):
+    # A NetCon with the same source as `netcon` and no target, to detect
+    # its presynaptic spikes without replacing what `netcon` records.
+    source = netcon.pre()
+    if source is not None:
+        detector = h.NetCon(source, None)
+    else:
+        segment = netcon.preseg()
+        detector = h.NetCon(segment._ref_v, None, sec=segment.sec)
+    detector.threshold = netcon.threshold
+    return detector
+
+
+class DopamineSTDP:
+    """
+    Spike-timing-dependent plasticity gated by dopamine.
+
+    A three-factor learning rule for corticostriatal synapses. Pairs of
+    pre- and postsynaptic spikes do not change the synaptic weights
+    directly but build up an eligibility trace in each synapse: pre-
+    before-post pairs increase the trace and post-before-pre pairs
+    decrease it, by an amount that decreases exponentially with the
+    time between spikes (pair-based STDP). The eligibility trace itself
+    decays with time. The weights change only when dopamine is
+    delivered, by an amount proportional to the eligibility trace and
+    to the dopamine signal.
+
+    Attributes
+    ----------
+    netcons : list
+        The connections (NEURON NetCon objects) whose weights are
+        modified.
+    eligibility : array
+        Current value of the eligibility trace in each connection.
+
+    Methods
+    -------
+    dopamine(amount=1)
+        Deliver dopamine now
+    schedule_dopamine(times, amounts=1)
+        Deliver dopamine at given times during the simulation
+    weights()
+        Current connection weights
+
+    Notes
+    -----
+    The weight change caused by dopamine at time t is
+    `learning_rate * amount * e(t)`, where e(t) is the eligibility
+    trace, and weights are kept within [w_min, w_max]. Eligibility
+    traces are reset when the simulation is initialised
+    (h.finitialize), but the weights are kept, so that learning
+    accumulates over successive runs.
+
+    References
+    ----------
+    Izhikevich EM (2007). Solving the distal reward problem through
+    linkage of STDP and dopamine signaling. Cereb Cortex 17, 2443-2452.
+
+    Example
+    -------
+    Corticostriatal inputs (see stimulus.spike_train_input) to a dMSN,
+    with a dopamine reward at t=500 ms:
+    >>> stdp = DopamineSTDP(netcons, cell)
+    >>> stdp.schedule_dopamine([500])
+    >>> stim.run()
+    >>> stdp.weights()
+    """
+
+    def __init__(self, netcons, cell, a_plus=0.01, a_minus=0.012,
+                 tau_plus=20, tau_minus=20, tau_eligibility=1000,
+                 learning_rate=1e-4, w_min=0, w_max=None, threshold=0):
+        """
+        Parameters
+        ----------
+        netcons : list
+            Connections (NetCon objects) onto synapses in `cell` whose
+            weights will be modified.
+        cell : object
+            The postsynaptic cell.
+        a_plus : numeric, default=0.01
+            Increase of the eligibility trace for a pre-before-post pair
+            with zero time difference.
+        a_minus : numeric, default=0.012
+            Decrease of the eligibility trace for a post-before-pre pair
+            with zero time difference.
+        tau_plus, tau_minus : numeric, default=20
+            Time constants (ms) of the STDP window for pre-before-post
+            and post-before-pre pairs.
+        tau_eligibility : numeric, default=1000
+            Decay time constant (ms) of the eligibility trace.
+        learning_rate : numeric, default=1e-4
+            Weight change (uS) per unit of eligibility and dopamine.
+        w_min : numeric, default=0
+            Minimum weight in uS.
+        w_max : None or numeric, default=None
+            Maximum weight in uS. If None, weights are unbounded.
+        threshold : numeric, default=0
+            Voltage threshold (mV) at the soma of `cell` for detecting
+            postsynaptic action potentials.
+        """
+        self.netcons = list(netcons)
+        self.a_plus = a_plus
+        self.a_minus = a_minus
+        self.tau_plus = tau_plus
+        self.tau_minus = tau_minus
+        self.tau_eligibility = tau_eligibility
+        self.learning_rate = learning_rate
+        self.w_min = w_min
+        self.w_max = w_max
+        self._reset()
+
+        # Callbacks for pre- and postsynaptic spikes. Presynaptic spikes
+        # count when they reach the synapse, after the connection delay.
+        self._pre_detectors = []
+        for index, netcon in enumerate(self.netcons):
+            detector = _spike_detector(netcon)
+            detector.record(
+                lambda index=index, netcon=netcon: h.CVode().event(
+                    h.t + netcon.delay,
+                    lambda: self._pre_spike(index)))
+            self._pre_detectors.append(detector)
+        self._detector = h.NetCon(cell.soma(0.5)._ref_v, None,
+                                  sec=cell.soma)
+        self._detector.threshold = threshold
+        self._detector.record(self._post_spike)
+
+        self._dopamine_events = []
+        self._init_handler = h.FInitializeHandler(self._initialize)
+
+    def _reset(self):
+        n = len(self.netcons)
+        self._pre_trace = np.zeros(n)
+        self._post_trace = 0
+        self.eligibility = np.zeros(n)
+        self._t_last = 0
+
+    def _update_traces(self):
+        # Decay all traces from the time of the last update to now.
+        dt = h.t - self._t_last
+        if dt > 0:
+            self._pre_trace *= np.exp(-dt / self.tau_plus)
+            self._post_trace *= np.exp(-dt / self.tau_minus)
+            self.eligibility *= np.exp(-dt / self.tau_eligibility)
+            self._t_last = h.t
+
+    def _pre_spike(self, index):
+        self._update_traces()
+        self.eligibility[index] -= self.a_minus * self._post_trace
+        self._pre_trace[index] += 1
+
+    def _post_spike(self):
+        self._update_traces()
+        self.eligibility += self.a_plus * self._pre_trace
+        self._post_trace += 1
+
+    def dopamine(self, amount=1):
+        """
+        Deliver dopamine now, changing the weights.
+
+        Parameters
+        ----------
+        amount : numeric, default=1
+            Dopamine signal. Negative values (e.g. a dip in dopamine)
+            reverse the sign of the weight change.
+        """
+        self._update_traces()
+        delta = self.learning_rate * amount * self.eligibility
+        for netcon, dw in zip(self.netcons, delta):
+            weight = max(netcon.weight[0] + dw, self.w_min)
+            if self.w_max is not None:
+                weight = min(weight, self.w_max)
+            netcon.weight[0] = weight
+
+    def schedule_dopamine(self, times, amounts=1):
+        """
+        Deliver dopamine at given times during the simulation.
+
+        Parameters
+        ----------
+        times : array_like
+            Times (ms) of dopamine delivery.
+        amounts : numeric or array_like, default=1
+            Dopamine signal at each time.
+        """
+        amounts = np.broadcast_to(amounts, np.shape(times))
+        self._dopamine_events += list(zip(times, amounts))
+
+    def _initialize(self):
+        self._reset()
+        for time, amount in self._dopamine_events:
+            h.CVode().event(time, lambda amount=amount:
+                            self.dopamine(amount))
+
+    def weights(self):
+        """
+        Current connection weights in uS.
+        """
+        return np.array([netcon.weight[0] for netcon in self.netcons])
+
+
+class HomeostaticScaling:
+    """
+    Homeostatic scaling of excitatory synaptic weights.
+
+    A slow rule that keeps the firing rate of a cell near a target rate
+    by scaling all of its excitatory weights by the same factor
+    (synaptic scaling; Turrigiano et al 1998). The firing rate is
+    estimated from the postsynaptic spikes with an exponential filter
+    of time constant `tau_rate`; at regular intervals, the weights are
+    multiplied by
+
+        1 + interval / tau_scaling * (target_rate - rate) / target_rate,
+
+    so that weights increase when the cell fires too little, and
+    decrease when it fires too much. Because the scaling is
+    multiplicative, it preserves the relative weights set by other
+    rules (e.g. DopamineSTDP on the same connections), while preventing
+    runaway excitation or silencing in long simulations.
+
+    Attributes
+    ----------
+    netcons : list
+        The connections (NEURON NetCon objects) whose weights are
+        scaled.
+    rate : float
+        Current estimate of the firing rate (Hz).
+    target_rate : float
+        Target firing rate (Hz).
+
+    Methods
+    -------
+    weights()
+        Current connection weights
+
+    Notes
+    -----
+    The rate estimate is reset to the target rate when the simulation
+    is initialised, but the weights are kept, so that scaling
+    accumulates over successive runs. Scaling is slow by design (time
+    constants of minutes or longer), so simulations must be long for it
+    to have an effect.
+
+    References
+    ----------
+    Turrigiano GG, Leslie KR, Desai NS, Rutherford LC & Nelson SB
+    (1998). Activity-dependent scaling of quantal amplitude in
+    neocortical neurons. Nature 391, 892-896.
+
+    Example
+    -------
+    Keep an MSN firing at 2 Hz during 10 min of cortical input:
+    >>> scaling = HomeostaticScaling(netcons, cell, target_rate=2)
+    >>> stim.run(600e3)
+    >>> scaling.weights()
+    """
+
+    def __init__(self, netcons, cell, target_rate=1, tau_rate=10e3,
+                 tau_scaling=60e3, interval=1000, w_min=0, w_max=None,
+                 threshold=0):
+        """
+        Parameters
+        ----------
+        netcons : list
+            Excitatory connections (NetCon objects) onto synapses in
+            `cell` whose weights will be scaled.
+        cell : object
+            The postsynaptic cell.
+        target_rate : numeric, default=1
+            Target firing rate in Hz.
+        tau_rate : numeric, default=10e3
+            Time constant (ms) of the firing rate estimate.
+        tau_scaling : numeric, default=60e3
+            Time constant (ms) of the scaling.
+        interval : numeric, default=1000
+            Time (ms) between weight updates.
+        w_min : numeric, default=0
+            Minimum weight in uS.
+        w_max : None or numeric, default=None
+            Maximum weight in uS. If None, weights are unbounded.
+        threshold : numeric, default=0
+            Voltage threshold (mV) at the soma of `cell` for detecting
+            postsynaptic action potentials.
+        """
+        if target_rate <= 0:
+            raise ValueError('`target_rate` must be positive')
+        self.netcons = list(netcons)
+        self.target_rate = target_rate
+        self.tau_rate = tau_rate
+        self.tau_scaling = tau_scaling
+        self.interval = interval
+        self.w_min = w_min
+        self.w_max = w_max
+        self._reset()
+
+        self._detector = h.NetCon(cell.soma(0.5)._ref_v, None,
+                                  sec=cell.soma)
+        self._detector.threshold = threshold
+        self._detector.record(self._post_spike)
+        self._init_handler = h.FInitializeHandler(self._initialize)
+
+    def _reset(self):
+        self.rate = self.target_rate
+        self._t_last = 0
+
+    def _update_rate(self):
+        # Decay the rate estimate from the time of the last update.
+        dt = h.t - self._t_last
+        if dt > 0:
+            self.rate *= np.exp(-dt / self.tau_rate)
+            self._t_last = h.t
+
+    def _post_spike(self):
+        self._update_rate()
+        # Each spike adds 1/tau_rate (in Hz) to the estimate.
+        self.rate += 1000 / self.tau_rate
+
+    def _scale(self):
+        self._update_rate()
+        factor = 1 + (self.interval / self.tau_scaling
+                      * (self.target_rate - self.rate) / self.target_rate)
+        for netcon in self.netcons:
+            weight = max(netcon.weight[0] * max(factor, 0), self.w_min)
+            if self.w_max is not None:
+                weight = min(weight, self.w_max)
+            netcon.weight[0] = weight
+        h.CVode().event(h.t + self.interval, self._scale)
+
+    def _initialize(self):
+        self._reset()
+        h.CVode().event(self.interval, self._scale)
+
+    def weights(self):
+        """
+        Current connection weights in uS.
+        """
+        return np.array([netcon.weight[0] for netcon in self.netcons])
@@ -0,0 +1,249 @@
+"""
+Quick-look figures.
+
+One-call helpers to plot the most common simulation results and save
+them to a file (the format, e.g. SVG or PNG, is set by the file name
+extension).
+
+author: Antonio Gonzalez
+"""
+import matplotlib.pyplot as plt
+
+from .instrumentation import as_array
+
+
+def _axes(ax):
+    if ax is None:
+        ax = plt.figure().add_subplot(111)
+    return ax
+
+
+def _label(ax, xlabel, ylabel):
+    # Label the axes if these are not set.
+    if ax.get_xlabel() == '':
+        ax.set_xlabel(xlabel)
+    if ax.get_ylabel() == '':
+        ax.set_ylabel(ylabel)
+
+
+def save(ax, path, dpi=300):
+    """
+    Save the figure of a matplotlib axes to a file.
+
+    Parameters
+    ----------
+    ax : matplotlib axes object
+    path : str or Path
+        Output file name. The extension sets the format, e.g. '.svg',
+        '.png' or '.pdf'.
+    dpi : numeric, default=300
+        Resolution, for raster formats.
+
+    Notes
+    -----
+    The figure is closed after it is saved, so that figures saved in a
+    loop do not accumulate in memory.
+    """
+    figure = ax.get_figure()
+    figure.tight_layout()
+    figure.savefig(path, dpi=dpi)
+    plt.close(figure)
+
+
+def trace(t, v, ax=None, path=None, **kwargs):
+    """
+    Plot a voltage trace.
+
+    Parameters
+    ----------
+    t, v : array_like
+        Time (ms) and membrane potential (mV); NEURON vectors or arrays.
+    ax : None or matplotlib axes object
+        Matplotlib axes to use for plotting. If None (default), one
+        will be created.
+    path : None or str or Path, default=None
+        If given, the figure is saved to this file.
+    **kwargs :
+        Additional keyword arguments passed on to the plot function.
+
+    Returns
+    -------
+    ax : matplotlib axes object
+    """
+    ax = _axes(ax)
+    ax.plot(as_array(t), as_array(v), **kwargs)
+    _label(ax, 'Time (ms)', 'Membrane potential (mV)')
+    if path is not None:
+        save(ax, path)
+    return ax
+
+
+def family(traces, ax=None, path=None, offset=0, cmap='viridis',
+           **kwargs):
+    """
+    Plot a family of voltage traces, e.g. from a series of current steps.
+
+    Parameters
+    ----------
+    traces : dict
+        Traces as {label: (t, v)}, e.g. {amplitude: (t, v)}. Labels are
+        shown in the legend.
+    ax : None or matplotlib axes object
+        Matplotlib axes to use for plotting. If None (default), one
+        will be created.
+    path : None or str or Path, default=None
+        If given, the figure is saved to this file.
+    offset : numeric, default=0
+        Vertical offset (mV) between consecutive traces.
+    cmap : str, default='viridis'
+        Matplotlib colour map used to colour the traces in order.
+    **kwargs :
+        Additional keyword arguments passed on to the plot function.
+
+    Returns
+    -------
+    ax : matplotlib axes object
+
+    Example
+    -------
+    >>> traces = {}
+    >>> for amplitude in [-0.1, 0, 0.1, 0.2]:
+    ...     stim.set_stim(amplitude=amplitude)
+    ...     stim.run()
+    ...     traces[amplitude] = (stim.t.as_numpy(), stim.v.as_numpy())
+    >>> family(traces, path='family.svg')
+    """
+    ax = _axes(ax)
+    colours = plt.get_cmap(cmap)
+    n = max(len(traces) - 1, 1)
+    for index, (label, (t, v)) in enumerate(traces.items()):
+        ax.plot(as_array(t), as_array(v) + index * offset,
+                color=colours(index / n), label=str(label), **kwargs)
+    ax.legend(frameon=False)
+    _label(ax, 'Time (ms)', 'Membrane potential (mV)')
+    if path is not None:
+        save(ax, path)
+    return ax
+
+
+def fi_curve(results, ax=None, path=None, **kwargs):
+    """
+    Plot a frequency-current (F-I) curve.
+
+    Parameters
+    ----------
+    results : pandas dataframe
+        With columns 'amplitude' (nA) and 'rate' (Hz), as returned by
+        protocols.FICurve.run.
+    ax : None or matplotlib axes object
+        Matplotlib axes to use for plotting. If None (default), one
+        will be created.
+    path : None or str or Path, default=None
+        If given, the figure is saved to this file.
+    **kwargs :
+        Additional keyword arguments passed on to the plot function.
+
+    Returns
+    -------
+    ax : matplotlib axes object
+    """
+    ax = _axes(ax)
+    kwargs.setdefault('marker', 'o')
+    ax.plot(results.amplitude, results.rate, **kwargs)
+    _label(ax, 'Current (nA)', 'Firing rate (Hz)')
+    if path is not None:
+        save(ax, path)
+    return ax
+
+
+def raster(spikes, ax=None, path=None, sizes=None, **kwargs):
+    """
+    Raster plot of network activity.
+
+    Parameters
+    ----------
+    spikes : pandas dataframe
+        With columns [population, cell, time], as returned by
+        network.Network.spikes. Populations are stacked vertically and
+        shown in different colours.
+    ax : None or matplotlib axes object
+        Matplotlib axes to use for plotting. If None (default), one
+        will be created.
+    path : None or str or Path, default=None
+        If given, the figure is saved to this file.
+    sizes : None or dict, default=None
+        Number of cells in each population, as {population: n_cells},
+        in the order in which they are stacked, e.g. {name: len(cells)
+        for name, cells in net.populations.items()}. If None, taken
+        from the highest cell number with spikes in each population,
+        so that silent cells at the end of a population (or silent
+        populations) are not shown.
+    **kwargs :
+        Additional keyword arguments passed on to the scatter function.
+
+    Returns
+    -------
+    ax : matplotlib axes object
+
+    Example
+    -------
+    >>> raster(net.spikes(), sizes={name: len(cells) for name, cells
+    ...                             in net.populations.items()})
+    """
+    ax = _axes(ax)
+    kwargs.setdefault('s', 2)
+    kwargs.setdefault('marker', '|')
+    if sizes is None:
+        sizes = (spikes.groupby('population', sort=False).cell.max()
+                 + 1).to_dict()
+    offset = 0
+    for population, size in sizes.items():
+        group = spikes[spikes.population == population]
+        ax.scatter(group.time, group.cell + offset, label=population,
+                   **kwargs)
+        offset += size
+    if spikes.population.nunique() > 1:
+        ax.legend(frameon=False, markerscale=5)
+    _label(ax, 'Time (ms)', 'Cell')
+    if path is not None:
+        save(ax, path)
+    return ax
+
+
+def heatmap(matrix, ax=None, path=None, label=None, cmap='viridis',
+            **kwargs):
+    """
+    Plot a matrix of results over a grid of two parameters.
+
+    Parameters
+    ----------
+    matrix : pandas dataframe
+        Results with the values of one parameter as index (y axis) and
+        of the other as columns (x axis), e.g. from
+        scan.PhaseDiagram.matrix().
+    ax : None or matplotlib axes object
+        Matplotlib axes to use for plotting. If None (default), one
+        will be created.
+    path : None or str or Path, default=None
+        If given, the figure is saved to this file.
+    label : None or str, default=None
+        Label of the colour bar.
+    cmap : str, default='viridis'
+        Colour map.
+    **kwargs :
+        Additional keyword arguments passed on to pcolormesh.
+
+    Returns
+    -------
+    ax : matplotlib axes object
+    """
+    ax = _axes(ax)
+    mesh = ax.pcolormesh(matrix.columns, matrix.index, matrix.to_numpy(),
+                         cmap=cmap, shading='nearest', **kwargs)
+    colorbar = ax.get_figure().colorbar(mesh, ax=ax)
+    if label is not None:
+        colorbar.set_label(label)
+    _label(ax, str(matrix.columns.name), str(matrix.index.name))
+    if path is not None:
+        save(ax, path)
+    return ax
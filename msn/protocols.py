@@ -0,0 +1,1736 @@
+"""
+Stimulation protocols.
+
+Classes that run standard experimental protocols (e.g. a series of
+current steps) on a model cell and collect the results. Other protocols
+can be described in text files and run with Engine.
+
+author: Antonio Gonzalez
+"""
+import itertools
+import json
+from dataclasses import dataclass
+from pathlib import Path
+
+import numpy as np
+import pandas as pd
+import matplotlib.pyplot as plt
+from neuron import h
+
+from . import units
+from .analysis import Impedance, spike_reliability, spike_precision
+from .batch import run_batch
+from .cell import MSN, ReducedMSN
+from .expr import Expression
+from .instrumentation import Stim, ActionPotentials, get_section
+from .meta import capture, write_sidecar
+from .stimulus import Chirp, OUNoise, Ramp, Step
+
+
+class FICurve:
+    """
+    Frequency-current (F-I) curve.
+
+    A series of current steps of increasing amplitude is applied to the
+    cell, and the firing rate during each step is measured.
+
+    Attributes
+    ----------
+    cell : object
+        The model cell
+    amplitudes : array
+        Current step amplitudes in nA
+    delay : numeric
+        Step delay in ms
+    duration : numeric
+        Step duration in ms
+    results : pandas dataframe
+        The results, with columns [amplitude, n_spikes, rate]; rate is
+        in Hz. Empty until run() is called.
+
+    Methods
+    -------
+    run(parallel=False, processes=None)
+        Run the protocol
+    to_csv(path)
+        Save the results to a CSV file
+    to_json(path)
+        Save the results to a JSON file
+    plot(ax=None, **kwargs)
+        Plot firing rate vs current
+
+    Example
+    -------
+    >>> cell = MSN('dmsn', 3)
+    >>> fi = FICurve(cell, amplitudes=np.arange(0.3, 0.8, 0.1))
+    >>> results = fi.run()
+    >>> fi.plot()
+    """
+
+    def __init__(self, cell, amplitudes, delay=50, duration=250,
+                 add_rheob=False, section='soma', threshold=0):
+        """
+        Parameters
+        ----------
+        cell : object
+            A NEURON model cell, e.g. cell.MSN.
+        amplitudes : array_like
+            Amplitudes of the current steps in nA.
+        delay : numeric, default=50
+            Delay of each step in ms.
+        duration : numeric, default=250
+            Duration of each step in ms.
+        add_rheob : bool, default=False
+            If True, `amplitudes` are added on top of the cell's
+            rheobase.
+        section : str, default='soma'
+            Cell section where the current is injected; see
+            instrumentation.Stim.
+        threshold : numeric, default=0
+            Voltage threshold for detecting action potentials.
+        """
+        self.cell = cell
+        self.amplitudes = np.asarray(amplitudes, dtype=float)
+        self.delay = delay
+        self.duration = duration
+        self._add_rheob = add_rheob
+        self._section = section
+        self._threshold = threshold
+        self._stim = Stim(cell, section=section)
+        self.results = pd.DataFrame(columns=['amplitude', 'n_spikes',
+                                             'rate'])
+
+    def run(self, parallel=False, processes=None):
+        """
+        Run the protocol.
+
+        Parameters
+        ----------
+        parallel : bool, default=False
+            If True, run each current step in a separate process (see
+            batch.run_batch), in a copy of the cell built from its type
+            and parameters: MSN(cell.type, cell.index) or
+            ReducedMSN(cell.type, cell.params) (or a subclass, e.g.
+            FSI). Changes made to the cell after it was built (e.g.
+            modulation, drugs) are not included. Must be called from a
+            script protected by `if __name__ == '__main__'`.
+        processes : None or int, default=None
+            Number of worker processes if `parallel`; if None, the
+            number of CPUs.
+
+        Returns
+        -------
+        results : pandas dataframe
+            Firing rate (Hz) and number of action potentials for each
+            current amplitude.
+        """
+        if parallel:
+            return self._run_parallel(processes)
+        n_spikes = np.zeros(self.amplitudes.size, dtype=int)
+        rate = np.zeros(self.amplitudes.size)
+        for index, amplitude in enumerate(self.amplitudes):
+            n_spikes[index], rate[index] = _fi_step(
+                self._stim, amplitude, self.delay, self.duration,
+                self._add_rheob, self._threshold)
+        self.results = pd.DataFrame({'amplitude': self.amplitudes,
+                                     'n_spikes': n_spikes,
+                                     'rate': rate})
+        return self.results
+
+    def _run_parallel(self, processes):
+        if type(self.cell) is MSN:
+            cell = {'cell_class': MSN,
+                    'cell_args': (self.cell.type, self.cell.index,
+                                  self.cell.v_init)}
+        elif isinstance(self.cell, ReducedMSN):
+            cell = {'cell_class': type(self.cell),
+                    'cell_args': (self.cell.type, self.cell.params,
+                                  self.cell.v_init)}
+        else:
+            raise TypeError('Parallel runs need a MSN or reduced cell, '
+                            f'not {type(self.cell).__name__}')
+        params = [{**cell, 'amplitude': amplitude, 'delay': self.delay,
+                   'duration': self.duration,
+                   'add_rheob': self._add_rheob,
+                   'section': self._section,
+                   'threshold': self._threshold}
+                  for amplitude in self.amplitudes]
+        batch = run_batch(_fi_worker, params, processes=processes,
+                          progress=False, maxtasksperchild=1)
+        failed = batch.error.notna()
+        if failed.any():
+            raise RuntimeError('F-I step failed:\n'
+                               + batch.error[failed].iloc[0])
+        n_spikes, rate = zip(*batch.result)
+        self.results = pd.DataFrame({'amplitude': self.amplitudes,
+                                     'n_spikes': np.array(n_spikes),
+                                     'rate': np.array(rate)})
+        return self.results
+
+    def _metadata(self):
+        return capture(cell=self.cell,
+                       params={'protocol': 'FICurve',
+                               'amplitudes': self.amplitudes,
+                               'delay': self.delay,
+                               'duration': self.duration,
+                               'add_rheob': self._add_rheob,
+                               'threshold': self._threshold})
+
+    def to_csv(self, path):
+        """
+        Save the results to a CSV file.
+
+        The provenance of the results (see meta.capture) is saved in a
+        JSON file with the same name plus '.json'.
+        """
+        self.results.to_csv(path, index=False)
+        write_sidecar(path, self._metadata())
+
+    def to_json(self, path):
+        """
+        Save the results to a JSON file (one record per amplitude).
+
+        The provenance of the results (see meta.capture) is saved in a
+        JSON file with the same name plus '.json'.
+        """
+        self.results.to_json(path, orient='records', indent=2)
+        write_sidecar(path, self._metadata())
+
+    def plot(self, ax=None, **kwargs):
+        """
+        Plot firing rate vs current amplitude.
+
+        Parameters
+        ----------
+        ax : None or matplotlib axes object
+            Matplotlib axes to use for plotting. If None (default), one
+            will be created.
+        **kwargs :
+            Additional keyword arguments passed on to the plot function.
+
+        Returns
+        -------
+        ax : matplotlib axes object
+        """
+        if ax is None:
+            ax = plt.figure().add_subplot(111)
+        kwargs.setdefault('marker', 'o')
+        ax.plot(self.results.amplitude, self.results.rate, **kwargs)
+        if ax.get_xlabel() == '':
+            ax.set_xlabel('Current (nA)')
+        if ax.get_ylabel() == '':
+            ax.set_ylabel('Firing rate (Hz)')
+        return ax
+
+
+def _fi_step(stim, amplitude, delay, duration, add_rheob, threshold):
+    # Run one step of an F-I curve; returns the number of action
+    # potentials and the firing rate (Hz) during the step.
+    stop = delay + duration
+    stim.set_stim(delay=delay, duration=duration, amplitude=amplitude,
+                  tmax=stop, add_rheob=add_rheob)
+    stim.run()
+    ap = ActionPotentials(stim.t, stim.v, threshold=threshold)
+    return ap.n, ap.firing_rate(start=delay, stop=stop)
+
+
+def _fi_worker(cell_class, cell_args, amplitude, delay, duration,
+               add_rheob, section, threshold):
+    # One step of FICurve.run(parallel=True), in a worker process.
+    cell = cell_class(*cell_args)
+    stim = Stim(cell, section=section)
+    return _fi_step(stim, amplitude, delay, duration, add_rheob,
+                    threshold)
+
+
+@dataclass
+class RheobaseResult:
+    """
+    Result of the Rheobase protocol.
+
+    Attributes
+    ----------
+    rheobase : float
+        Smallest current (nA) that elicits an action potential.
+    precision : float
+        Width (nA) of the final bisection interval; the true rheobase
+        lies between `rheobase - precision` and `rheobase`.
+    n_iterations : int
+        Number of simulations run.
+    """
+    rheobase: float
+    precision: float
+    n_iterations: int
+
+
+class Rheobase:
+    """
+    Find a cell's rheobase by bisection.
+
+    Current steps are applied, and the amplitude is bisected between a
+    value that does not elicit action potentials and one that does
+    until the interval between them is smaller than `precision`.
+
+    Methods
+    -------
+    run()
+        Run the protocol
+
+    Example
+    -------
+    >>> cell = MSN('dmsn', 12)
+    >>> result = Rheobase(cell, low=0, high=1).run()
+    >>> result.rheobase
+    """
+
+    def __init__(self, cell, low=0, high=1, precision=1e-3, delay=50,
+                 duration=500, section='soma', threshold=0):
+        """
+        Parameters
+        ----------
+        cell : object
+            A NEURON model cell, e.g. cell.MSN.
+        low, high : numeric, default=0, 1
+            Initial search interval in nA. `high` must elicit at least
+            one action potential and `low` none.
+        precision : numeric, default=1e-3
+            Precision (nA) of the result.
+        delay : numeric, default=50
+            Delay of each step in ms.
+        duration : numeric, default=500
+            Duration of each step in ms.
+        section : str, default='soma'
+            Cell section where the current is injected; see
+            instrumentation.Stim.
+        threshold : numeric, default=0
+            Voltage threshold for detecting action potentials.
+        """
+        self.cell = cell
+        self.low = low
+        self.high = high
+        self.precision = precision
+        self.delay = delay
+        self.duration = duration
+        self._threshold = threshold
+        self._stim = Stim(cell, section=section)
+
+    def _fires(self, amplitude):
+        self._stim.set_stim(delay=self.delay, duration=self.duration,
+                            amplitude=amplitude,
+                            tmax=self.delay + self.duration,
+                            add_rheob=False)
+        self._stim.run()
+        ap = ActionPotentials(self._stim.t, self._stim.v,
+                              threshold=self._threshold)
+        return ap.n > 0
+
+    def run(self):
+        """
+        Run the protocol.
+
+        Returns
+        -------
+        result : RheobaseResult
+
+        Raises
+        ------
+        ValueError
+            If the initial interval does not contain the rheobase.
+        """
+        low, high = self.low, self.high
+        n_iterations = 2
+        if self._fires(low):
+            raise ValueError(f'The cell fires at {low} nA; decrease `low`')
+        if not self._fires(high):
+            raise ValueError(f'The cell does not fire at {high} nA; '
+                             'increase `high`')
+        while high - low > self.precision:
+            middle = (low + high) / 2
+            if self._fires(middle):
+                high = middle
+            else:
+                low = middle
+            n_iterations += 1
+        return RheobaseResult(rheobase=high, precision=high - low,
+                              n_iterations=n_iterations)
+
+
+@dataclass
+class InputResistanceResult:
+    """
+    Result of the InputResistance protocol.
+
+    Attributes
+    ----------
+    input_resistance : float
+        Input resistance in MOhm, the slope of the steady-state voltage
+        change vs current.
+    tau : float
+        Membrane time constant in ms (mean over steps).
+    v_rest : float
+        Membrane potential before the steps in mV.
+    steps : pandas dataframe
+        One row per step with columns [amplitude, delta_v, tau]
+        (nA, mV, ms).
+    """
+    input_resistance: float
+    tau: float
+    v_rest: float
+    steps: pd.DataFrame
+
+
+class InputResistance:
+    """
+    Measure input resistance and membrane time constant.
+
+    Small hyperpolarising current steps are applied. The input
+    resistance is the slope of the steady-state change in membrane
+    potential vs current, and the time constant is obtained by fitting
+    an exponential to the onset of the response to each step.
+
+    Methods
+    -------
+    run()
+        Run the protocol
+
+    Example
+    -------
+    >>> cell = MSN('dmsn', 12)
+    >>> result = InputResistance(cell).run()
+    >>> result.input_resistance, result.tau
+    """
+
+    def __init__(self, cell, amplitudes=(-0.01, -0.02, -0.03), delay=200,
+                 duration=300, section='soma'):
+        """
+        Parameters
+        ----------
+        cell : object
+            A NEURON model cell, e.g. cell.MSN.
+        amplitudes : array_like, default=(-0.01, -0.02, -0.03)
+            Amplitudes of the steps in nA. These should be small, so
+            that the response is close to passive.
+        delay : numeric, default=200
+            Delay of each step in ms; long enough for the membrane
+            potential to settle.
+        duration : numeric, default=300
+            Duration of each step in ms; long enough to reach a steady
+            state.
+        section : str, default='soma'
+            Cell section where the current is injected; see
+            instrumentation.Stim.
+        """
+        self.cell = cell
+        self.amplitudes = np.asarray(amplitudes, dtype=float)
+        self.delay = delay
+        self.duration = duration
+        self._stim = Stim(cell, section=section)
+
+    def _fit_tau(self, t, v, v_start, v_end):
+        # Fit v = v_end + (v_start - v_end) exp(-t/tau) by linear
+        # regression of log|v - v_end| on t, between 10% and 90% of the
+        # response (where the fit is not dominated by noise or by the
+        # initial, non-exponential charging of remote compartments).
+        delta = np.abs(v - v_end) / abs(v_start - v_end)
+        fit = (delta < 0.9) & (delta > 0.1)
+        if fit.sum() < 3:
+            return np.nan
+        slope = np.polyfit(t[fit], np.log(delta[fit]), 1)[0]
+        return -1 / slope
+
+    def run(self):
+        """
+        Run the protocol.
+
+        Returns
+        -------
+        result : InputResistanceResult
+        """
+        stop = self.delay + self.duration
+        delta_v = np.zeros(self.amplitudes.size)
+        tau = np.zeros(self.amplitudes.size)
+        v_rest = np.zeros(self.amplitudes.size)
+        for index, amplitude in enumerate(self.amplitudes):
+            self._stim.set_stim(delay=self.delay, duration=self.duration,
+                                amplitude=amplitude, tmax=stop,
+                                add_rheob=False)
+            self._stim.run()
+            t = self._stim.t.as_numpy()
+            v = self._stim.v.as_numpy()
+            # Baseline: the 10% of the delay before the step; steady
+            # state: the last 10% of the step.
+            before = (t >= self.delay * 0.9) & (t < self.delay)
+            end = (t >= stop - self.duration * 0.1) & (t < stop)
+            v_rest[index] = v[before].mean()
+            v_end = v[end].mean()
+            delta_v[index] = v_end - v_rest[index]
+            step = (t >= self.delay) & (t < stop)
+            tau[index] = self._fit_tau(t[step] - self.delay, v[step],
+                                       v_rest[index], v_end)
+        # mV/nA = MOhm
+        if self.amplitudes.size > 1:
+            resistance = np.polyfit(self.amplitudes, delta_v, 1)[0]
+        else:
+            resistance = delta_v[0] / self.amplitudes[0]
+        steps = pd.DataFrame({'amplitude': self.amplitudes,
+                              'delta_v': delta_v, 'tau': tau})
+        return InputResistanceResult(input_resistance=resistance,
+                                     tau=np.nanmean(tau),
+                                     v_rest=v_rest.mean(), steps=steps)
+
+
+class StepFamily:
+    """
+    Family of hyperpolarising and depolarising current steps.
+
+    Current steps of increasing amplitude are applied, and the standard
+    measures of excitability are taken from each response: for
+    hyperpolarising steps, the sag (the relaxation of the membrane
+    potential from its peak to its steady state during the step) and
+    the rebound depolarisation (and rebound action potentials) after
+    the step; for depolarising steps, the latency to the first action
+    potential and the firing rate.
+
+    Attributes
+    ----------
+    cell : object
+        The model cell
+    amplitudes : array
+        Current step amplitudes in nA
+    results : pandas dataframe
+        One row per step with columns [amplitude, v_rest, v_peak,
+        v_steady, sag_ratio, rebound, n_rebound_spikes, n_spikes,
+        latency, rate] (nA, mV, ms, Hz); see run(). Empty until run()
+        is called.
+    traces : dict
+        Recorded time and voltage of each step, as {amplitude: (t, v)}.
+
+    Methods
+    -------
+    run()
+        Run the protocol
+    to_csv(path)
+        Save the results to a CSV file
+    plot(ax=None, **kwargs)
+        Plot the voltage traces
+
+    Example
+    -------
+    >>> cell = MSN('imsn', 12)
+    >>> family = StepFamily(cell, amplitudes=np.arange(-0.3, 0.35, 0.1))
+    >>> results = family.run()
+    >>> results[['amplitude', 'sag_ratio', 'rebound', 'latency']]
+    """
+
+    def __init__(self, cell, amplitudes=np.arange(-0.3, 0.31, 0.05),
+                 delay=200, duration=1000, after=500, section='soma',
+                 threshold=0):
+        """
+        Parameters
+        ----------
+        cell : object
+            A NEURON model cell, e.g. cell.MSN.
+        amplitudes : array_like, default=np.arange(-0.3, 0.31, 0.05)
+            Amplitudes of the current steps in nA.
+        delay : numeric, default=200
+            Delay of each step in ms; long enough for the membrane
+            potential to settle.
+        duration : numeric, default=1000
+            Duration of each step in ms; long enough for the sag to
+            develop.
+        after : numeric, default=500
+            Recording time after each step in ms, where the rebound is
+            measured.
+        section : str, default='soma'
+            Cell section where the current is injected; see
+            instrumentation.Stim.
+        threshold : numeric, default=0
+            Voltage threshold for detecting action potentials.
+        """
+        self.cell = cell
+        # Rounded, so that e.g. the 0 of np.arange(-0.3, 0.31, 0.05) is
+        # not a tiny negative step.
+        self.amplitudes = np.round(np.asarray(amplitudes, dtype=float), 10)
+        self.delay = delay
+        self.duration = duration
+        self.after = after
+        self._threshold = threshold
+        self._stim = Stim(cell, section=section)
+        self.results = pd.DataFrame(columns=[
+            'amplitude', 'v_rest', 'v_peak', 'v_steady', 'sag_ratio',
+            'rebound', 'n_rebound_spikes', 'n_spikes', 'latency', 'rate'])
+        self.traces = {}
+
+    def _measure(self, amplitude, t, v):
+        stop = self.delay + self.duration
+        before = (t >= self.delay * 0.9) & (t < self.delay)
+        step = (t >= self.delay) & (t < stop)
+        end = (t >= stop - self.duration * 0.1) & (t < stop)
+        post = t >= stop
+        v_rest = v[before].mean()
+        v_steady = v[end].mean()
+        ap = ActionPotentials(t, v, threshold=self._threshold)
+        times = np.asarray(ap.timestamps)
+        in_step = times[(times >= self.delay) & (times < stop)]
+        result = {'amplitude': amplitude, 'v_rest': v_rest,
+                  'v_steady': v_steady, 'n_spikes': in_step.size,
+                  'rate': ap.firing_rate(start=self.delay, stop=stop),
+                  'latency': (in_step[0] - self.delay if in_step.size
+                              else np.nan)}
+        if amplitude < 0:
+            # Sag: fraction of the peak deflection that relaxes by the
+            # end of the step; rebound: peak depolarisation above rest
+            # after the step.
+            v_peak = v[step].min()
+            deflection = v_peak - v_rest
+            result['v_peak'] = v_peak
+            result['sag_ratio'] = ((v_peak - v_steady) / deflection
+                                   if deflection != 0 else np.nan)
+            result['rebound'] = v[post].max() - v_rest
+            result['n_rebound_spikes'] = int(np.sum(times >= stop))
+        else:
+            result['v_peak'] = v[step].max()
+            result['sag_ratio'] = np.nan
+            result['rebound'] = np.nan
+            result['n_rebound_spikes'] = 0
+        return result
+
+    def run(self):
+        """
+        Run the protocol.
+
+        Returns
+        -------
+        results : pandas dataframe
+            One row per step, with:
+
+            amplitude : float
+                Step amplitude (nA).
+            v_rest : float
+                Membrane potential before the step (mV).
+            v_peak : float
+                Most negative (hyperpolarising steps) or most positive
+                (depolarising steps) membrane potential during the step
+                (mV).
+            v_steady : float
+                Membrane potential at the end of the step (mV).
+            sag_ratio : float
+                (v_peak - v_steady) / (v_peak - v_rest); 0 for no sag.
+                NaN for depolarising steps.
+            rebound : float
+                Peak depolarisation above v_rest after a hyperpolarising
+                step (mV); NaN for depolarising steps.
+            n_rebound_spikes : int
+                Action potentials after a hyperpolarising step.
+            n_spikes : int
+                Action potentials during the step.
+            latency : float
+                Time from the start of the step to the first action
+                potential (ms); NaN if there is none.
+            rate : float
+                Firing rate during the step (Hz).
+        """
+        stop = self.delay + self.duration
+        rows = []
+        self.traces = {}
+        for amplitude in self.amplitudes:
+            self._stim.set_stim(delay=self.delay, duration=self.duration,
+                                amplitude=amplitude, tmax=stop + self.after,
+                                add_rheob=False)
+            self._stim.run()
+            t = self._stim.t.as_numpy().copy()
+            v = self._stim.v.as_numpy().copy()
+            self.traces[amplitude] = (t, v)
+            rows.append(self._measure(amplitude, t, v))
+        self.results = pd.DataFrame(rows, columns=self.results.columns)
+        return self.results
+
+    def _metadata(self):
+        return capture(cell=self.cell,
+                       params={'protocol': 'StepFamily',
+                               'amplitudes': self.amplitudes,
+                               'delay': self.delay,
+                               'duration': self.duration,
+                               'after': self.after,
+                               'threshold': self._threshold})
+
+    def to_csv(self, path):
+        """
+        Save the results to a CSV file.
+
+        The provenance of the results (see meta.capture) is saved in a
+        JSON file with the same name plus '.json'.
+        """
+        self.results.to_csv(path, index=False)
+        write_sidecar(path, self._metadata())
+
+    def plot(self, ax=None, **kwargs):
+        """
+        Plot the voltage traces, one per step.
+
+        Parameters
+        ----------
+        ax : None or matplotlib axes object
+            Matplotlib axes to use for plotting. If None (default), one
+            will be created.
+        **kwargs :
+            Additional keyword arguments passed on to the plot function.
+
+        Returns
+        -------
+        ax : matplotlib axes object
+        """
+        if ax is None:
+            ax = plt.figure().add_subplot(111)
+        for amplitude, (t, v) in self.traces.items():
+            ax.plot(t, v, label=f'{amplitude:.3g} nA', **kwargs)
+        if ax.get_xlabel() == '':
+            ax.set_xlabel('Time (ms)')
+        if ax.get_ylabel() == '':
+            ax.set_ylabel('Membrane potential (mV)')
+        return ax
+
+
+class RampProtocol:
+    """
+    Current ramps, and the dynamic rheobase.
+
+    Current ramps of one or more slopes are applied, and the first
+    action potential of each is characterised: the current at which it
+    occurs (the dynamic rheobase), its voltage threshold, and its delay
+    from the start of the ramp and from the time the ramp reached the
+    step rheobase. In MSNs, slowly inactivating A-type potassium
+    currents delay firing, so that ramps, unlike steps, reveal how the
+    threshold depends on the rate of depolarisation.
+
+    Attributes
+    ----------
+    cell : object
+        The model cell
+    slopes : array
+        Slopes of the ramps in nA/s
+    results : pandas dataframe
+        One row per slope; see run(). Empty until run() is called.
+    traces : dict
+        Recorded time, voltage and current of each ramp, as {slope:
+        (t, v, i)}.
+
+    Methods
+    -------
+    run()
+        Run the protocol
+    to_csv(path)
+        Save the results to a CSV file
+    plot(ax=None, **kwargs)
+        Plot the voltage traces
+
+    Example
+    -------
+    >>> cell = MSN('dmsn', 12)
+    >>> rheobase = Rheobase(cell).run().rheobase
+    >>> ramp = RampProtocol(cell, slopes=[0.1, 0.3, 1],
+    ...                     rheobase=rheobase)
+    >>> ramp.run()[['slope', 'current', 'v_threshold', 'delay']]
+    """
+
+    def __init__(self, cell, slopes=(0.1,), start_amplitude=0,
+                 end_amplitude=0.6, delay=200, rheobase=None,
+                 section='soma', threshold=0, dvdt_threshold=10):
+        """
+        Parameters
+        ----------
+        cell : object
+            A NEURON model cell, e.g. cell.MSN.
+        slopes : array_like, default=(0.1,)
+            Slopes of the ramps in nA/s.
+        start_amplitude, end_amplitude : numeric, default=0, 0.6
+            Current (nA) at the start and at the end of each ramp; the
+            duration of a ramp is given by these and its slope.
+        delay : numeric, default=200
+            Start of the ramps in ms.
+        rheobase : None or numeric, default=None
+            Step rheobase (nA), e.g. from Rheobase. If given, the delay
+            from the time each ramp reaches it to the first action
+            potential is also measured.
+        section : str, default='soma'
+            Cell section where the current is injected; see
+            instrumentation.Stim.
+        threshold : numeric, default=0
+            Voltage threshold for detecting action potentials.
+        dvdt_threshold : numeric, default=10
+            Rate of rise (mV/ms) that defines the voltage threshold of
+            an action potential.
+        """
+        self.cell = cell
+        self.slopes = np.asarray(slopes, dtype=float)
+        if np.any(self.slopes <= 0):
+            raise ValueError('slopes must be positive')
+        self.start_amplitude = start_amplitude
+        self.end_amplitude = end_amplitude
+        self.delay = delay
+        self.rheobase = rheobase
+        self._threshold = threshold
+        self._dvdt_threshold = dvdt_threshold
+        self._section = get_section(cell, section)
+        self.results = pd.DataFrame(columns=[
+            'slope', 'n_spikes', 'latency', 'current', 'v_threshold',
+            'delay'])
+        self.traces = {}
+
+    def _first_spike(self, t, v, current):
+        # Latency, current and voltage threshold of the first action
+        # potential, and its delay from the step rheobase.
+        ap = ActionPotentials(t, v, threshold=self._threshold)
+        times = np.asarray(ap.timestamps)
+        times = times[times >= self.delay]
+        row = {'n_spikes': times.size, 'latency': np.nan,
+               'current': np.nan, 'v_threshold': np.nan, 'delay': np.nan}
+        if times.size == 0:
+            return row
+        first = times[0]
+        row['latency'] = first - self.delay
+        row['current'] = np.interp(first, t, current)
+        # Voltage threshold: the first point, in the 5 ms before the
+        # threshold crossing, at which dV/dt exceeds dvdt_threshold.
+        window = np.flatnonzero((t >= first - 5) & (t <= first))
+        dvdt = np.gradient(v, t)
+        rising = window[dvdt[window] >= self._dvdt_threshold]
+        if rising.size:
+            row['v_threshold'] = v[rising[0]]
+        if self.rheobase is not None:
+            above = np.flatnonzero(current >= self.rheobase)
+            if above.size:
+                row['delay'] = first - t[above[0]]
+        return row
+
+    def run(self):
+        """
+        Run the protocol.
+
+        Returns
+        -------
+        results : pandas dataframe
+            One row per slope, with:
+
+            slope : float
+                Slope of the ramp (nA/s).
+            n_spikes : int
+                Action potentials during the ramp.
+            latency : float
+                Time from the start of the ramp to the first action
+                potential (ms).
+            current : float
+                Current at the first action potential (nA), the
+                dynamic rheobase.
+            v_threshold : float
+                Voltage threshold of the first action potential (mV).
+            delay : float
+                Time from when the ramp reached the step rheobase to
+                the first action potential (ms); NaN if `rheobase` was
+                not given.
+
+            Measures of the first action potential are NaN if there is
+            none.
+        """
+        rows = []
+        self.traces = {}
+        for slope in self.slopes:
+            duration = (self.end_amplitude - self.start_amplitude) / (
+                slope * 1e-3)
+            ramp = Ramp(self.start_amplitude, self.end_amplitude,
+                        start=self.delay, duration=duration)
+            clamp = ramp.play(self._section)
+            t = h.Vector()
+            t.record(h._ref_t)
+            v = h.Vector()
+            v.record(self.cell.soma(0.5)._ref_v)
+            h.finitialize(self.cell.v_init)
+            while h.t < ramp.stop:
+                h.fadvance()
+            # Stop injecting the current.
+            ramp.clear()
+            del clamp
+            t = t.as_numpy().copy()
+            v = v.as_numpy().copy()
+            current = ramp(t)
+            self.traces[slope] = (t, v, current)
+            rows.append({'slope': slope,
+                         **self._first_spike(t, v, current)})
+        self.results = pd.DataFrame(rows, columns=self.results.columns)
+        return self.results
+
+    def _metadata(self):
+        return capture(cell=self.cell,
+                       params={'protocol': 'RampProtocol',
+                               'slopes': self.slopes,
+                               'start_amplitude': self.start_amplitude,
+                               'end_amplitude': self.end_amplitude,
+                               'delay': self.delay,
+                               'rheobase': self.rheobase,
+                               'threshold': self._threshold,
+                               'dvdt_threshold': self._dvdt_threshold})
+
+    def to_csv(self, path):
+        """
+        Save the results to a CSV file.
+
+        The provenance of the results (see meta.capture) is saved in a
+        JSON file with the same name plus '.json'.
+        """
+        self.results.to_csv(path, index=False)
+        write_sidecar(path, self._metadata())
+
+    def plot(self, ax=None, **kwargs):
+        """
+        Plot the voltage traces, one per slope.
+
+        Parameters
+        ----------
+        ax : None or matplotlib axes object
+            Matplotlib axes to use for plotting. If None (default), one
+            will be created.
+        **kwargs :
+            Additional keyword arguments passed on to the plot function.
+
+        Returns
+        -------
+        ax : matplotlib axes object
+        """
+        if ax is None:
+            ax = plt.figure().add_subplot(111)
+        for slope, (t, v, __) in self.traces.items():
+            ax.plot(t, v, label=f'{slope:.3g} nA/s', **kwargs)
+        if ax.get_xlabel() == '':
+            ax.set_xlabel('Time (ms)')
+        if ax.get_ylabel() == '':
+            ax.set_ylabel('Membrane potential (mV)')
+        return ax
+
+
+class Train:
+    """
+    Trains of synaptic stimulation, and short-term plasticity.
+
+    A population of synapses is activated synchronously by trains of
+    pulses of one or more frequencies, as by extracellular stimulation
+    of their afferents, and the amplitude of the postsynaptic potential
+    (current clamp) or current (voltage clamp) evoked by each pulse is
+    measured. Normalised by the first response, the amplitudes show
+    the depression or facilitation of the synapses along the train.
+
+    Attributes
+    ----------
+    cell : object
+        The model cell
+    synapses : list
+        The stimulated synapses
+    results : pandas dataframe
+        One row per pulse and frequency, with columns [frequency,
+        pulse, time, amplitude, normalised] (Hz, ms, mV or nA). Empty
+        until run() is called.
+    traces : dict
+        Recorded time and response of each train, as {frequency: (t,
+        response)}.
+
+    Methods
+    -------
+    run()
+        Run the protocol
+    to_csv(path)
+        Save the results to a CSV file
+    plot(ax=None, **kwargs)
+        Plot the normalised amplitudes
+
+    Notes
+    -----
+    Each amplitude is measured from the baseline just before its
+    pulse; at high frequencies, where responses summate, this
+    baseline includes the decay of the previous responses.
+
+    With Tsodyks-Markram synapses (tmgaba.mod, tmglut.mod), the
+    conductance of the first response is `weight`, as with the
+    synapses without plasticity: the release is normalised by the
+    utilisation `U`.
+
+    Example
+    -------
+    Depression of GABA synapses with short-term plasticity:
+    >>> synapses = [h.tmgaba(0.5, sec=dend) for dend in cell.dend[:20]]
+    >>> train = Train(cell, synapses, weight=5e-4, n_pulses=10,
+    ...               frequencies=[10, 20, 50], mode='voltage',
+    ...               holding=-50)
+    >>> results = train.run()
+    >>> train.plot()
+    """
+
+    def __init__(self, cell, synapses, weight, n_pulses=10,
+                 frequencies=(20,), delay=100, after=200, mode='current',
+                 holding=-80, window=None):
+        """
+        Parameters
+        ----------
+        cell : object
+            A NEURON model cell, e.g. cell.MSN.
+        synapses : list
+            Synapses (point processes) on the cell, e.g. h.glutamate or
+            h.tmgaba; they are activated together.
+        weight : numeric
+            Connection weight (uS) of each synapse.
+        n_pulses : int, default=10
+            Number of pulses in each train.
+        frequencies : array_like, default=(20,)
+            Frequencies of the trains in Hz.
+        delay : numeric, default=100
+            Time of the first pulse in ms.
+        after : numeric, default=200
+            Recording time after the last pulse in ms.
+        mode : {'current', 'voltage'}, default='current'
+            Record postsynaptic potentials in current clamp, or
+            postsynaptic currents in voltage clamp at the soma.
+        holding : numeric, default=-80
+            Holding potential (mV) in voltage clamp.
+        window : None or numeric, default=None
+            Time (ms) after each pulse in which its peak response is
+            searched. If None, the interval between pulses (and at most
+            50 ms).
+        """
+        if mode not in ('current', 'voltage'):
+            raise ValueError("mode must be 'current' or 'voltage'")
+        self.cell = cell
+        self.synapses = list(synapses)
+        self.weight = weight
+        self.n_pulses = n_pulses
+        self.frequencies = np.asarray(frequencies, dtype=float)
+        self.delay = delay
+        self.after = after
+        self.mode = mode
+        self.holding = holding
+        self.window = window
+        self.results = pd.DataFrame(columns=[
+            'frequency', 'pulse', 'time', 'amplitude', 'normalised'])
+        self.traces = {}
+
+    def _run_train(self, times):
+        # Record the response to pulses at `times`.
+        vector = h.Vector(times)
+        stim = h.VecStim()
+        stim.play(vector)
+        netcons = []
+        for synapse in self.synapses:
+            netcon = h.NetCon(stim, synapse)
+            netcon.delay = 0
+            netcon.weight[0] = self.weight
+            netcons.append(netcon)
+        t = h.Vector()
+        t.record(h._ref_t)
+        response = h.Vector()
+        clamp = None
+        if self.mode == 'voltage':
+            clamp = h.SEClamp(0.5, sec=self.cell.soma)
+            clamp.dur1 = 1e9
+            clamp.amp1 = self.holding
+            clamp.rs = 0.001
+            response.record(clamp._ref_i)
+        else:
+            response.record(self.cell.soma(0.5)._ref_v)
+        h.finitialize(self.holding if clamp is not None
+                      else self.cell.v_init)
+        stop = times[-1] + self.after
+        while h.t < stop:
+            h.fadvance()
+        return t.as_numpy().copy(), response.as_numpy().copy()
+
+    def _amplitudes(self, t, response, times):
+        # Peak response to each pulse, from the baseline just before it.
+        interval = np.diff(times).min() if len(times) > 1 else 50
+        window = self.window or min(interval, 50)
+        amplitudes = []
+        for time in times:
+            before = (t >= time - 1) & (t < time)
+            after = (t >= time) & (t < time + window)
+            # Without samples before the pulse (at the start of the
+            # simulation), the value at the pulse.
+            baseline = response[before].mean() if before.any() else (
+                np.interp(time, t, response))
+            deviation = response[after] - baseline
+            amplitudes.append(deviation[np.argmax(np.abs(deviation))])
+        return np.array(amplitudes)
+
+    def run(self):
+        """
+        Run the protocol.
+
+        Returns
+        -------
+        results : pandas dataframe
+            One row per pulse and frequency, with the time of the
+            pulse, the amplitude of the response (mV in current clamp,
+            nA in voltage clamp; negative for hyperpolarising or inward
+            responses) and the amplitude normalised by that of the
+            first pulse.
+        """
+        rows = []
+        self.traces = {}
+        for frequency in self.frequencies:
+            times = self.delay + np.arange(self.n_pulses) * 1e3 / frequency
+            t, response = self._run_train(times)
+            self.traces[frequency] = (t, response)
+            amplitudes = self._amplitudes(t, response, times)
+            for pulse, (time, amplitude) in enumerate(zip(times,
+                                                          amplitudes)):
+                rows.append({'frequency': frequency, 'pulse': pulse + 1,
+                             'time': time, 'amplitude': amplitude,
+                             'normalised': amplitude / amplitudes[0]})
+        self.results = pd.DataFrame(rows, columns=self.results.columns)
+        return self.results
+
+    def _params(self):
+        return {'protocol': type(self).__name__,
+                'n_synapses': len(self.synapses),
+                'weight': self.weight,
+                'n_pulses': self.n_pulses,
+                'frequencies': self.frequencies,
+                'delay': self.delay,
+                'after': self.after,
+                'mode': self.mode,
+                'holding': self.holding,
+                'window': self.window}
+
+    def _metadata(self):
+        return capture(cell=self.cell, params=self._params())
+
+    def to_csv(self, path):
+        """
+        Save the results to a CSV file.
+
+        The provenance of the results (see meta.capture) is saved in a
+        JSON file with the same name plus '.json'.
+        """
+        self.results.to_csv(path, index=False)
+        write_sidecar(path, self._metadata())
+
+    def plot(self, ax=None, **kwargs):
+        """
+        Plot the normalised amplitude vs pulse number, one line per
+        frequency.
+
+        Parameters
+        ----------
+        ax : None or matplotlib axes object
+            Matplotlib axes to use for plotting. If None (default), one
+            will be created.
+        **kwargs :
+            Additional keyword arguments passed on to the plot function.
+
+        Returns
+        -------
+        ax : matplotlib axes object
+        """
+        if ax is None:
+            ax = plt.figure().add_subplot(111)
+        kwargs.setdefault('marker', 'o')
+        for frequency, rows in self.results.groupby('frequency'):
+            ax.plot(rows.pulse, rows.normalised,
+                    label=f'{frequency:.3g} Hz', **kwargs)
+        if ax.get_xlabel() == '':
+            ax.set_xlabel('Pulse')
+        if ax.get_ylabel() == '':
+            ax.set_ylabel('Normalised amplitude')
+        return ax
+
+
+class PairedPulse(Train):
+    """
+    Paired-pulse ratio of synaptic responses.
+
+    Pairs of pulses with different intervals are applied to a
+    population of synapses (see Train), and the paired-pulse ratio
+    (PPR), the amplitude of the second response divided by that of the
+    first, is measured for each interval: PPR > 1 indicates
+    facilitation, PPR < 1 depression.
+
+    Attributes
+    ----------
+    intervals : array
+        Intervals between the pulses in ms.
+    ppr : pandas dataframe
+        One row per interval, with columns [interval, amplitude_1,
+        amplitude_2, ppr]. Empty until run() is called.
+
+    Example
+    -------
+    >>> synapses = [h.glutamate(0.5, sec=dend) for dend in cell.dend[:10]]
+    >>> pp = PairedPulse(cell, synapses, weight=3e-4,
+    ...                  intervals=[20, 50, 100, 200])
+    >>> pp.run()
+    """
+
+    def __init__(self, cell, synapses, weight, intervals=(20, 50, 100, 200),
+                 **kwargs):
+        """
+        Parameters
+        ----------
+        cell, synapses, weight :
+            See Train.
+        intervals : array_like, default=(20, 50, 100, 200)
+            Intervals between the pulses in ms.
+        **kwargs :
+            Additional keyword arguments passed on to Train, e.g.
+            `mode`.
+        """
+        self.intervals = np.asarray(intervals, dtype=float)
+        super().__init__(cell, synapses, weight, n_pulses=2,
+                         frequencies=1e3 / self.intervals, **kwargs)
+        self.ppr = pd.DataFrame(columns=['interval', 'amplitude_1',
+                                         'amplitude_2', 'ppr'])
+
+    def run(self):
+        """
+        Run the protocol.
+
+        Returns
+        -------
+        ppr : pandas dataframe
+            One row per interval (ms), with the amplitudes of the two
+            responses and the paired-pulse ratio.
+        """
+        results = super().run()
+        first = results[results.pulse == 1].amplitude.values
+        second = results[results.pulse == 2].amplitude.values
+        self.ppr = pd.DataFrame({'interval': self.intervals,
+                                 'amplitude_1': first,
+                                 'amplitude_2': second,
+                                 'ppr': second / first})
+        return self.ppr
+
+    def _params(self):
+        return {**super()._params(), 'intervals': self.intervals}
+
+    def to_csv(self, path):
+        """
+        Save the paired-pulse ratios to a CSV file.
+
+        The provenance of the results (see meta.capture) is saved in a
+        JSON file with the same name plus '.json'.
+        """
+        self.ppr.to_csv(path, index=False)
+        write_sidecar(path, self._metadata())
+
+    def plot(self, ax=None, **kwargs):
+        """
+        Plot the paired-pulse ratio vs interval.
+
+        Parameters
+        ----------
+        ax : None or matplotlib axes object
+            Matplotlib axes to use for plotting. If None (default), one
+            will be created.
+        **kwargs :
+            Additional keyword arguments passed on to the plot function.
+
+        Returns
+        -------
+        ax : matplotlib axes object
+        """
+        if ax is None:
+            ax = plt.figure().add_subplot(111)
+        kwargs.setdefault('marker', 'o')
+        ax.plot(self.ppr.interval, self.ppr.ppr, **kwargs)
+        ax.axhline(1, color='0.5', linestyle=':')
+        if ax.get_xlabel() == '':
+            ax.set_xlabel('Interval (ms)')
+        if ax.get_ylabel() == '':
+            ax.set_ylabel('Paired-pulse ratio')
+        return ax
+
+
+class ImpedanceProfile:
+    """
+    Impedance profile measured with a ZAP (chirp) current.
+
+    A sine current of increasing frequency is injected and the
+    impedance is calculated from the response (see analysis.Impedance).
+    Cells with resonance show a peak in impedance at a non-zero
+    frequency. The response is recorded where the current is injected
+    (input impedance) or, with `record`, elsewhere in the cell
+    (transfer impedance).
+
+    Methods
+    -------
+    run()
+        Run the protocol
+
+    Example
+    -------
+    >>> cell = MSN('dmsn', 12)
+    >>> impedance = ImpedanceProfile(cell, amplitude=0.02).run()
+    >>> impedance.resonance_frequency
+    >>> impedance.plot()
+    """
+
+    def __init__(self, cell, amplitude=0.02, f_start=0.5, f_end=20,
+                 duration=20000, delay=500, offset=0, method='linear',
+                 section='soma', record=None):
+        """
+        Parameters
+        ----------
+        cell : object
+            A NEURON model cell, e.g. cell.MSN.
+        amplitude : numeric, default=0.02
+            Amplitude of the ZAP current in nA. It should be small,
+            so that the response is close to linear.
+        f_start, f_end : numeric, default=0.5, 20
+            Frequency range of the ZAP current in Hz.
+        duration : numeric, default=20000
+            Duration of the ZAP current in ms.
+        delay : numeric, default=500
+            Delay of the ZAP current in ms.
+        offset : numeric, default=0
+            Constant current (nA) added to the ZAP current, e.g. to
+            measure the impedance at a different membrane potential.
+        method : {'linear', 'exponential'}, default='linear'
+            How the frequency increases; see stimulus.Chirp.
+        section : str, default='soma'
+            Cell section where the current is injected; see
+            instrumentation.Stim.
+        record : None or str, default=None
+            Cell section where the membrane potential is recorded, at
+            its middle. If None, `section`.
+        """
+        self.cell = cell
+        self.zap = Chirp(amplitude, f_start, f_end, start=delay,
+                         duration=duration, offset=offset, method=method)
+        self._section = get_section(cell, section)
+        self._record = get_section(cell, record or section)
+
+    def run(self):
+        """
+        Run the protocol.
+
+        Returns
+        -------
+        impedance : analysis.Impedance
+        """
+        clamp = self.zap.play(self._section)
+        t = h.Vector()
+        t.record(h._ref_t)
+        v = h.Vector()
+        v.record(self._record(0.5)._ref_v)
+        h.finitialize(self.cell.v_init)
+        while h.t < self.zap.stop:
+            h.fadvance()
+        # Stop injecting the current.
+        self.zap.clear()
+        del clamp
+        t = t.as_numpy()
+        return Impedance(t, v.as_numpy(), self.zap(t),
+                         f_min=self.zap.f_start, f_max=self.zap.f_end,
+                         start=self.zap.start, stop=self.zap.stop)
+
+
+@dataclass
+class FrozenNoiseResult:
+    """
+    Result of the FrozenNoise protocol.
+
+    Attributes
+    ----------
+    trains : list of arrays
+        Spike times (ms) in each trial.
+    reliability : float
+        Spike-time reliability (see analysis.spike_reliability).
+    jitter : float
+        Mean time difference (ms) between matching spikes in different
+        trials (see analysis.spike_precision).
+    fraction_matched : float
+        Fraction of spikes matched in the other trials.
+    """
+    trains: list
+    reliability: float
+    jitter: float
+    fraction_matched: float
+
+
+class FrozenNoise:
+    """
+    Repeated presentation of a frozen noise current.
+
+    The same realisation of a noise current (an Ornstein-Uhlenbeck
+    process; see stimulus.OUNoise) is injected in every trial, together
+    with an independent noise current that is different in each trial.
+    The reliability and precision of the spike times across trials
+    show how much the independent noise limits the encoding of the
+    frozen input.
+
+    Methods
+    -------
+    run()
+        Run the protocol
+
+    Notes
+    -----
+    The ion channels of the Lindroos et al model have deterministic
+    gating; with them, the independent noise current (`private_sigma`)
+    stands in for channel noise and other sources of intrinsic noise.
+    Stochastic channels (see nmodl.hh_channel, seeded with
+    rng.seed_channels) add channel noise, which is different in each
+    trial since their random streams are not restarted when the
+    simulation is initialised; `private_sigma` can then be 0.
+
+    Example
+    -------
+    >>> cell = MSN('dmsn', 12)
+    >>> result = FrozenNoise(cell, mean=0.3, sigma=0.1,
+    ...                      private_sigma=0.02, n_trials=10).run()
+    >>> result.reliability
+    """
+
+    def __init__(self, cell, mean, sigma, tau=5, private_sigma=0.01,
+                 private_tau=1, n_trials=10, duration=2000, delay=100,
+                 kernel_sigma=3, window=5, seed=None, section='soma',
+                 threshold=0):
+        """
+        Parameters
+        ----------
+        cell : object
+            A NEURON model cell, e.g. cell.MSN.
+        mean, sigma : numeric
+            Mean and standard deviation (nA) of the frozen noise.
+        tau : numeric, default=5
+            Correlation time (ms) of the frozen noise.
+        private_sigma : numeric, default=0.01
+            Standard deviation (nA) of the independent noise; 0 for
+            none.
+        private_tau : numeric, default=1
+            Correlation time (ms) of the independent noise.
+        n_trials : int, default=10
+            Number of trials.
+        duration : numeric, default=2000
+            Duration of the noise in ms.
+        delay : numeric, default=100
+            Delay of the noise in ms.
+        kernel_sigma : numeric, default=3
+            Time scale (ms) of the reliability measure.
+        window : numeric, default=5
+            Maximum time difference (ms) for spikes in different trials
+            to be matched.
+        seed : None or int, default=None
+            Seed of the frozen noise. If None, a sub-stream of the
+            master seed is used (see rng). The independent noise in
+            each trial always uses new sub-streams.
+        section : str, default='soma'
+            Cell section where the current is injected; see
+            instrumentation.Stim.
+        threshold : numeric, default=0
+            Voltage threshold for detecting action potentials.
+        """
+        self.cell = cell
+        self.frozen = OUNoise(mean, sigma, tau, start=delay,
+                              duration=duration, seed=seed)
+        self.private_sigma = private_sigma
+        self.private_tau = private_tau
+        self.n_trials = n_trials
+        self.kernel_sigma = kernel_sigma
+        self.window = window
+        self._section = get_section(cell, section)
+        self._threshold = threshold
+
+    def _trial(self):
+        stimulus = self.frozen
+        if self.private_sigma > 0:
+            stimulus = stimulus + OUNoise(
+                0, self.private_sigma, self.private_tau,
+                start=self.frozen.start,
+                duration=self.frozen.stop - self.frozen.start)
+        stimulus.play(self._section)
+        t = h.Vector()
+        t.record(h._ref_t)
+        v = h.Vector()
+        v.record(self.cell.soma(0.5)._ref_v)
+        h.finitialize(self.cell.v_init)
+        while h.t < stimulus.stop:
+            h.fadvance()
+        # Stop injecting the current.
+        stimulus.clear()
+        ap = ActionPotentials(t, v, threshold=self._threshold)
+        return np.atleast_1d(ap.timestamps)
+
+    def run(self):
+        """
+        Run the protocol.
+
+        Returns
+        -------
+        result : FrozenNoiseResult
+        """
+        trains = [self._trial() for __ in range(self.n_trials)]
+        reliability = spike_reliability(trains, self.frozen.start,
+                                        self.frozen.stop,
+                                        sigma=self.kernel_sigma)
+        precision = spike_precision(trains, window=self.window)
+        return FrozenNoiseResult(trains=trains, reliability=reliability,
+                                 **precision)
+
+
+class Engine:
+    """
+    Run a protocol described in a text (YAML or JSON) file.
+
+    A protocol is a sequence of epochs of current injection, optionally
+    repeated over the values of one or more loop variables, and a list
+    of measurements taken in each repetition. For example:
+
+        name: steps
+        section: soma
+        loops:
+          - {variable: amplitude, values: [-0.1, 0.1, 0.2, 0.3]}
+        epochs:
+          - {name: baseline, type: hold, duration: 200}
+          - {name: step, type: step, duration: 500, amplitude: $amplitude}
+          - {type: wait, duration: 200}
+        measure:
+          - {name: v_rest, type: mean_v, epoch: baseline}
+          - {name: rate, type: rate, epoch: step}
+          - {name: latency, type: latency, epoch: step}
+        derived:
+          conductance: 1 / (v_rest + 80)
+
+    Current is injected, and the membrane potential recorded, at the
+    middle of `section` (default 'soma'; see instrumentation.get_section);
+    the potential can be recorded elsewhere with `record`, e.g.
+    `record: dend[3]`.
+
+    Epochs
+        Each epoch has a `type`, a `duration` (ms) and, optionally, a
+        `name`. Types are 'hold' and 'step' (constant current
+        `amplitude`, nA; 'hold' defaults to the `holding` current of
+        the protocol), 'ramp' (from `start_amplitude` to
+        `end_amplitude`) and 'wait' (no current but the holding
+        current).
+
+    Loops
+        Values of loop variables are used in the epochs as `$name`.
+        Values are a list or {start, stop, step} (stop included). With
+        several loops, all combinations are run.
+
+    Measurements
+        In an epoch (name or index): 'mean_v', 'min_v', 'max_v',
+        'final_v' (mean over the last 10%), 'n_spikes', 'rate' (Hz),
+        'latency' (ms from the start of the epoch to the first action
+        potential; NaN if none).
+
+    Derived measurements
+        Formulas of the measurements and loop variables; see
+        expr.Expression.
+
+    Numbers can be given with units, e.g. '0.5 s' or '100 pA' (see
+    units.parse).
+
+    Attributes
+    ----------
+    cell : object
+        The model cell.
+    protocol : dict
+        The protocol description.
+    results : None or pandas dataframe
+        One row per repetition, with columns for the loop variables,
+        the measurements and the derived measurements.
+    traces : list
+        Recorded (t, v) of each repetition, as numpy arrays.
+
+    Methods
+    -------
+    from_file(cell, path)
+        Create an engine with a protocol file
+    run()
+        Run the protocol
+
+    Example
+    -------
+    >>> engine = Engine.from_file(cell, 'steps.yaml')
+    >>> engine.run()
+    """
+    epoch_types = ('hold', 'step', 'ramp', 'wait')
+    measurement_types = ('mean_v', 'min_v', 'max_v', 'final_v', 'n_spikes',
+                         'rate', 'latency')
+
+    def __init__(self, cell, protocol):
+        """
+        Parameters
+        ----------
+        cell : object
+            A NEURON model cell, e.g. cell.MSN.
+        protocol : dict
+            The protocol; see above.
+
+        Raises
+        ------
+        ValueError
+            If the protocol is not valid.
+        """
+        self.cell = cell
+        self.protocol = protocol
+        self.results = None
+        self.traces = []
+        self._section = get_section(cell, protocol.get('section', 'soma'))
+        self._record = get_section(
+            cell, protocol.get('record', protocol.get('section', 'soma')))
+        self._check()
+
+    @classmethod
+    def from_file(cls, cell, path):
+        """
+        Create an engine with a protocol file.
+
+        Parameters
+        ----------
+        cell : object
+            A NEURON model cell.
+        path : str or Path
+            A YAML (extension '.yaml' or '.yml'; this requires PyYAML)
+            or JSON file.
+        """
+        path = Path(path)
+        with open(path) as file:
+            if path.suffix in ('.yaml', '.yml'):
+                import yaml
+                protocol = yaml.safe_load(file)
+            else:
+                protocol = json.load(file)
+        return cls(cell, protocol)
+
+    def _check(self):
+        epochs = self.protocol.get('epochs', [])
+        if len(epochs) == 0:
+            raise ValueError('The protocol has no epochs')
+        for index, epoch in enumerate(epochs):
+            if epoch.get('type') not in self.epoch_types:
+                raise ValueError(f'epochs[{index}]: type must be one of '
+                                 f'{self.epoch_types}')
+            if 'duration' not in epoch:
+                raise ValueError(f'epochs[{index}]: duration missing')
+        for measure in self.protocol.get('measure', []):
+            if measure.get('type') not in self.measurement_types:
+                raise ValueError(f"measure '{measure.get('name')}': type "
+                                 f'must be one of {self.measurement_types}')
+            self._epoch_index(measure.get('epoch', 0))
+        variables = ([loop['variable'] for loop in self._loops()] +
+                     [measure['name'] for measure in
+                      self.protocol.get('measure', [])])
+        self._derived = {
+            name: Expression(str(formula), variables)
+            for name, formula in self.protocol.get('derived', {}).items()}
+
+    def _epoch_index(self, epoch):
+        if isinstance(epoch, int):
+            return epoch
+        names = [e.get('name') for e in self.protocol['epochs']]
+        if epoch not in names:
+            raise ValueError(f"Unknown epoch '{epoch}'")
+        return names.index(epoch)
+
+    def _loops(self):
+        loops = []
+        for loop in self.protocol.get('loops', []):
+            values = loop['values']
+            if isinstance(values, dict):
+                values = np.arange(values['start'],
+                                   values['stop'] + values['step'] / 2,
+                                   values['step'])
+            loops.append({'variable': loop['variable'],
+                          'values': list(values)})
+        return loops
+
+    def _value(self, value, unit, variables):
+        # Substitute loop variables ('$name') and convert units.
+        if isinstance(value, str) and value.startswith('$'):
+            value = variables[value[1:]]
+        return units.parse(value, unit)
+
+    def _waveform(self, variables):
+        # The current of all epochs, and the start and stop time of each.
+        holding = self._value(self.protocol.get('holding', 0), 'nA',
+                              variables)
+        waveforms, times, start = [], [], 0
+        for epoch in self.protocol['epochs']:
+            duration = self._value(epoch['duration'], 'ms', variables)
+            kind = epoch['type']
+            if kind == 'ramp':
+                waveforms.append(Ramp(
+                    self._value(epoch['start_amplitude'], 'nA', variables),
+                    self._value(epoch['end_amplitude'], 'nA', variables),
+                    start=start, duration=duration))
+            else:
+                amplitude = holding
+                if kind in ('hold', 'step') and 'amplitude' in epoch:
+                    amplitude = self._value(epoch['amplitude'], 'nA',
+                                            variables)
+                waveforms.append(Step(amplitude, start=start,
+                                      duration=duration))
+            times.append((start, start + duration))
+            start += duration
+        waveform = waveforms[0]
+        for other in waveforms[1:]:
+            waveform = waveform + other
+        return waveform, times
+
+    def _measure(self, measure, t, v, times):
+        start, stop = times[self._epoch_index(measure.get('epoch', 0))]
+        inside = (t >= start) & (t < stop)
+        kind = measure['type']
+        if kind == 'mean_v':
+            return v[inside].mean()
+        if kind == 'min_v':
+            return v[inside].min()
+        if kind == 'max_v':
+            return v[inside].max()
+        if kind == 'final_v':
+            return v[inside & (t >= stop - 0.1 * (stop - start))].mean()
+        ap = ActionPotentials(t[inside], v[inside],
+                              threshold=measure.get('threshold', 0))
+        spikes = np.atleast_1d(ap.timestamps)
+        if kind == 'n_spikes':
+            return len(spikes)
+        if kind == 'rate':
+            return len(spikes) / (stop - start) * 1e3
+        # latency
+        return spikes[0] - start if len(spikes) else np.nan
+
+    def run(self):
+        """
+        Run the protocol.
+
+        Returns
+        -------
+        results : pandas dataframe
+            See `results`.
+        """
+        loops = self._loops()
+        names = [loop['variable'] for loop in loops]
+        rows = []
+        self.traces = []
+        for values in itertools.product(
+                *[loop['values'] for loop in loops]):
+            variables = dict(zip(names, values))
+            waveform, times = self._waveform(variables)
+            waveform.play(self._section)
+            t = h.Vector()
+            t.record(h._ref_t)
+            v = h.Vector()
+            v.record(self._record(0.5)._ref_v)
+            h.finitialize(self.protocol.get('v_init', self.cell.v_init))
+            while h.t < waveform.stop:
+                h.fadvance()
+            # Stop injecting the current.
+            waveform.clear()
+            t, v = t.as_numpy().copy(), v.as_numpy().copy()
+            self.traces.append((t, v))
+            row = dict(variables)
+            for measure in self.protocol.get('measure', []):
+                row[measure['name']] = self._measure(measure, t, v, times)
+            for name, formula in self._derived.items():
+                row[name] = formula(**{key: row[key]
+                                       for key in formula.variables})
+            rows.append(row)
+        self.results = pd.DataFrame(rows)
+        return self.results
@@ -0,0 +1,332 @@
+"""
+Reinforcement learning with networks of MSNs.
+
+A closed-loop harness in which a network of dMSNs and iMSNs selects
+actions in a task, and the outcome of each action, signalled by
+dopamine, changes the corticostriatal weights (actor-critic model of
+the basal ganglia; Frank 2005, Collins & Frank 2014).
+
+Each action is represented by a channel, a population of dMSNs ("Go")
+and a population of iMSNs ("NoGo"). On each trial, cortical inputs
+specific to the current state of the task drive all the cells; the
+action with the largest difference between the activity of its dMSNs
+and iMSNs is selected (softmax). The environment returns a reward, and
+the critic computes the reward prediction error (RPE), which is the
+dopamine signal: bursts (positive RPE) strengthen the active inputs to
+dMSNs and weaken those to iMSNs, and dips (negative RPE) do the
+opposite.
+
+Tasks are objects with the interface of Environment.
+
+References
+----------
+Frank MJ (2005). Dynamic dopamine modulation in the basal ganglia: a
+neurocomputational account of cognitive deficits in medicated and
+nonmedicated Parkinsonism. J Cogn Neurosci 17, 51-72.
+
+Collins AGE & Frank MJ (2014). Opponent actor learning (OpAL):
+modeling interactive effects of striatal dopamine on reinforcement
+learning and choice incentive. Psychol Rev 121, 337-366.
+
+Example
+-------
+A two-armed bandit, with one channel of 5 dMSNs and 5 iMSNs per arm:
+>>> net = Network()
+>>> for action in (0, 1):
+...     net.add_population(f'dmsn_{action}', 'dmsn', range(5))
+...     net.add_population(f'imsn_{action}', 'imsn', range(5))
+>>> agent = ActorCritic(net, Bandit([0.8, 0.2]))
+>>> results = agent.run(100)
+>>> results.groupby('action').size()
+
+author: Antonio Gonzalez
+"""
+import numpy as np
+import pandas as pd
+from neuron import h
+
+from .rng import generator
+from .simulation import run
+
+
+class Environment:
+    """
+    Interface of a task.
+
+    Subclasses define `states` and `actions`, and the methods reset()
+    and step().
+
+    Attributes
+    ----------
+    states : list
+        All the states of the task (hashable, e.g. int or str).
+    actions : list
+        All the actions available.
+    """
+    states = []
+    actions = []
+
+    def reset(self):
+        """
+        Start a new episode, and return its first state.
+        """
+        raise NotImplementedError
+
+    def step(self, action):
+        """
+        Take an action.
+
+        Returns
+        -------
+        state :
+            The new state.
+        reward : float
+        done : bool
+            True if the episode has ended.
+        """
+        raise NotImplementedError
+
+
+class Bandit(Environment):
+    """
+    Multi-armed bandit: one state, and one action per arm, rewarded
+    with a given probability.
+    """
+
+    def __init__(self, probabilities, seed=None):
+        """
+        Parameters
+        ----------
+        probabilities : sequence
+            Reward probability of each arm.
+        seed : None or int, default=None
+            Seed for the random number generator (see rng).
+        """
+        self.probabilities = list(probabilities)
+        self.states = [0]
+        self.actions = list(range(len(self.probabilities)))
+        self._rng = generator(seed)
+
+    def reset(self):
+        return 0
+
+    def step(self, action):
+        reward = float(self._rng.uniform() < self.probabilities[action])
+        return 0, reward, True
+
+
+class ActorCritic:
+    """
+    Closed-loop actor-critic learning with a network of MSNs.
+
+    Attributes
+    ----------
+    network : network.Network
+    environment : Environment
+    channels : dict
+        Populations of each action, as {action: (dMSN population, iMSN
+        population)}.
+    values : dict
+        The critic: value of each state.
+    inputs : list
+        One tuple (state, population, cell index, synapse, netcon) for
+        each cortical input.
+
+    Methods
+    -------
+    run(n_trials)
+        Run trials of the task
+    weights()
+        Current weights of the cortical inputs
+    """
+
+    def __init__(self, network, environment, channels=None, n_inputs=20,
+                 input_rate=20, weight=3e-4, trial_duration=500,
+                 interval=500, learning_rate=1e-5, critic_rate=0.1,
+                 discount=0.9, temperature=1, w_max=None, dopamine=None,
+                 seed=None):
+        """
+        Parameters
+        ----------
+        network : network.Network
+            The network, with the populations of `channels`.
+        environment : Environment
+            The task.
+        channels : None or dict, default=None
+            Populations of each action, as {action: (dMSN population,
+            iMSN population)}. If None, the populations of action `a`
+            are named 'dmsn_a' and 'imsn_a'.
+        n_inputs : int, default=20
+            Number of cortical inputs (glutamate synapses) per state on
+            each cell.
+        input_rate : numeric, default=20
+            Firing rate (Hz) of the inputs of the current state.
+        weight : numeric, default=3e-4
+            Initial weight (uS) of the inputs.
+        trial_duration : numeric, default=500
+            Duration (ms) of the decision period of each trial.
+        interval : numeric, default=500
+            Time (ms) without input between trials.
+        learning_rate : numeric, default=1e-5
+            Weight change (uS) per unit of RPE, presynaptic spike and
+            postsynaptic spike.
+        critic_rate : numeric, default=0.1
+            Learning rate of the critic.
+        discount : numeric, default=0.9
+            Discount factor of future rewards.
+        temperature : numeric, default=1
+            Temperature of the softmax action selection, in spikes.
+        w_max : None or numeric, default=None
+            Maximum weight in uS. If None, weights are unbounded.
+        dopamine : None or modulation.DopamineField, default=None
+            If given, the RPE also drives dopamine release: a burst for
+            positive RPE and a pause for negative RPE, which modulate
+            the excitability of the cells.
+        seed : None or int, default=None
+            Seed for the random number generator (see rng).
+        """
+        self.network = network
+        self.environment = environment
+        if channels is None:
+            channels = {action: (f'dmsn_{action}', f'imsn_{action}')
+                        for action in environment.actions}
+        self.channels = channels
+        self.input_rate = input_rate
+        self.trial_duration = trial_duration
+        self.interval = interval
+        self.learning_rate = learning_rate
+        self.critic_rate = critic_rate
+        self.discount = discount
+        self.temperature = temperature
+        self.w_max = w_max
+        self.dopamine = dopamine
+        self.values = {state: 0. for state in environment.states}
+        self._rng = generator(seed)
+        self._initialised = False
+
+        self.inputs = []
+        for d1, d2 in channels.values():
+            for population in (d1, d2):
+                for index, cell in enumerate(network.populations[population]):
+                    dendrites = list(cell.dend)
+                    for state in environment.states:
+                        for _ in range(n_inputs):
+                            section = dendrites[
+                                self._rng.integers(len(dendrites))]
+                            synapse = h.glutamate(0.5, sec=section)
+                            netcon = h.NetCon(None, synapse)
+                            netcon.weight[0] = weight
+                            self.inputs.append((state, population, index,
+                                                synapse, netcon))
+
+    def _trial(self, state):
+        # Present the state and return the number of spikes of each
+        # cell, and of each input, during the trial.
+        t_start = h.t
+        n_pre = np.zeros(len(self.inputs))
+        for index, (input_state, __, __, __, netcon) in enumerate(
+                self.inputs):
+            if input_state != state:
+                continue
+            n_spikes = self._rng.poisson(
+                self.input_rate * self.trial_duration / 1000)
+            for time in self._rng.uniform(
+                    t_start, t_start + self.trial_duration, n_spikes):
+                netcon.event(time)
+            n_pre[index] = n_spikes
+        run(t_start + self.trial_duration, initialise=False)
+        spikes = self.network.spikes()
+        spikes = spikes[spikes['time'] >= t_start]
+        counts = spikes.groupby(['population', 'cell']).size()
+        return counts, n_pre
+
+    def _select(self, counts):
+        activity = []
+        for d1, d2 in self.channels.values():
+            go = counts.get(d1, pd.Series(dtype=int)).sum()
+            nogo = counts.get(d2, pd.Series(dtype=int)).sum()
+            activity.append(go - nogo)
+        activity = np.array(activity, dtype=float) / self.temperature
+        p = np.exp(activity - activity.max())
+        p /= p.sum()
+        actions = list(self.channels)
+        return actions[self._rng.choice(len(actions), p=p)]
+
+    def _learn(self, rpe, counts, n_pre):
+        d1_populations = {d1 for d1, __ in self.channels.values()}
+        for (state, population, index, __, netcon), pre in zip(
+                self.inputs, n_pre):
+            if pre == 0:
+                continue
+            post = counts.get((population, index), 0)
+            sign = 1 if population in d1_populations else -1
+            weight = (netcon.weight[0]
+                      + sign * self.learning_rate * rpe * pre * post)
+            weight = max(weight, 0)
+            if self.w_max is not None:
+                weight = min(weight, self.w_max)
+            netcon.weight[0] = weight
+
+    def run(self, n_trials, v_init=-80):
+        """
+        Run trials of the task.
+
+        The simulation is initialised on the first call only, so that
+        learning continues over successive calls.
+
+        Parameters
+        ----------
+        n_trials : int
+            Number of trials (actions).
+        v_init : numeric, default=-80
+            Initialisation membrane voltage.
+
+        Returns
+        -------
+        results : pandas dataframe
+            One row per trial, with columns [time, state, action,
+            reward, rpe, value], where `time` is the start of the trial
+            (ms) and `value` is the value of the state after learning.
+        """
+        if not self._initialised:
+            h.finitialize(v_init)
+            self._initialised = True
+            self._state = self.environment.reset()
+        results = []
+        for _ in range(n_trials):
+            state = self._state
+            t_start = h.t
+            counts, n_pre = self._trial(state)
+            action = self._select(counts)
+            next_state, reward, done = self.environment.step(action)
+            future = 0 if done else self.values[next_state]
+            rpe = reward + self.discount * future - self.values[state]
+            self.values[state] += self.critic_rate * rpe
+            self._learn(rpe, counts, n_pre)
+            if self.dopamine is not None:
+                if rpe > 0:
+                    self.dopamine.burst(h.t, n_spikes=max(
+                        int(round(6 * rpe)), 1))
+                elif rpe < 0:
+                    self.dopamine.pause(h.t, 500 * min(-rpe, 1))
+            results.append((t_start, state, action, reward, rpe,
+                            self.values[state]))
+            self._state = self.environment.reset() if done else next_state
+            run(h.t + self.interval, initialise=False)
+        return pd.DataFrame(results, columns=['time', 'state', 'action',
+                                              'reward', 'rpe', 'value'])
+
+    def weights(self):
+        """
+        Current weights of the cortical inputs.
+
+        Returns
+        -------
+        weights : pandas dataframe
+            One row per input, with columns [state, population, cell,
+            weight] (uS).
+        """
+        return pd.DataFrame(
+            [(state, population, index, netcon.weight[0])
+             for state, population, index, __, netcon in self.inputs],
+            columns=['state', 'population', 'cell', 'weight'])
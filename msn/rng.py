@@ -0,0 +1,322 @@
+"""
+Random number generation.
+
+All the stochastic elements in this library (modulation parameters,
+background noise, spike trains, connectivity, etc) draw their random
+numbers from here. A master seed set with `set_seed()` makes a whole
+simulation reproducible: each element gets its own, independent
+sub-stream derived deterministically from the master seed.
+
+Example
+-------
+>>> from msn import rng
+>>> rng.set_seed(1234)
+>>> cell = MSN('dmsn', 12)
+>>> Dopamine(cell)  # Same random modulation parameters in every run.
+
+author: Antonio Gonzalez
+"""
+import contextlib
+import weakref
+import zlib
+
+import numpy as np
+from neuron import h
+
+_master_seed = None
+_seed_sequence = np.random.SeedSequence()
+_streams = {}
+_n_netstims = 0
+_n_channels = 0
+
+
+class _Session:
+    # Owner of the registered objects that have no other owner.
+    pass
+
+
+_session = _Session()
+# Seeded NetStims, as (NetStim, Random), to save and restore their
+# positions in the Random123 streams; Random is None with NEURON 9, where
+# the NetStim's own generator (ranvar) is used. And random streams of
+# stochastic channels (see seed_channels). Both are registered by owner
+# (e.g. the cell they belong to), in the order in which they are
+# seeded; owners are held weakly, so that the objects of a model that
+# no longer exists are dropped.
+_netstims = weakref.WeakKeyDictionary()
+_channels = weakref.WeakKeyDictionary()
+
+
+def _register(registry, owner, entry):
+    registry.setdefault(_session if owner is None else owner,
+                        []).append(entry)
+
+
+def _entries(registry):
+    # Registered objects of all the owners that still exist.
+    return [entry for entries in list(registry.values())
+            for entry in entries]
+
+
+def set_seed(seed=None):
+    """
+    Set the master seed.
+
+    Parameters
+    ----------
+    seed : None or int, default=None
+        The master seed. If None, a seed is drawn from the operating
+        system's entropy source; it can be read with get_seed() (e.g.
+        to save it with the results so that the run can be repeated).
+
+    Returns
+    -------
+    seed : int
+        The master seed.
+
+    Notes
+    -----
+    Setting the seed resets all the sub-streams, and NEURON's Random123
+    generators (used by NetStim for spike time randomness) are given a
+    global index derived from the seed. The seed should thus be set
+    before building the model.
+    """
+    global _master_seed, _seed_sequence, _n_netstims, _n_channels
+    if seed is None:
+        seed = np.random.SeedSequence().entropy
+    _master_seed = int(seed)
+    _seed_sequence = np.random.SeedSequence(_master_seed)
+    _streams.clear()
+    _n_netstims = 0
+    _n_channels = 0
+    _netstims.clear()
+    _channels.clear()
+    h.Random123_globalindex(_master_seed % 2**32)
+    return _master_seed
+
+
+def get_seed():
+    """
+    Return the master seed, or None if it has not been set.
+    """
+    return _master_seed
+
+
+def stream(name):
+    """
+    Random number generator for a named stochastic element.
+
+    Parameters
+    ----------
+    name : str
+        Name of the stream, e.g. 'modulation'.
+
+    Returns
+    -------
+    generator : numpy.random.Generator
+        The generator for this stream. The same object is returned for
+        the same name until the seed is set again, and its sequence of
+        numbers depends only on the master seed and the name.
+    """
+    if name not in _streams:
+        key = zlib.crc32(name.encode())
+        _streams[name] = np.random.default_rng(np.random.SeedSequence(
+            _seed_sequence.entropy, spawn_key=(key,)))
+    return _streams[name]
+
+
+def generator(seed=None):
+    """
+    Random number generator for a stochastic element.
+
+    Parameters
+    ----------
+    seed : None, int or numpy.random.Generator, default=None
+        If None, a new, independent sub-stream of the master seed is
+        returned (or a randomly seeded generator if no master seed has
+        been set). Otherwise the generator is created as by
+        numpy.random.default_rng(seed), i.e. an explicit seed takes
+        precedence over the master seed.
+
+    Returns
+    -------
+    generator : numpy.random.Generator
+    """
+    if seed is None and _master_seed is not None:
+        return np.random.default_rng(_seed_sequence.spawn(1)[0])
+    return np.random.default_rng(seed)
+
+
+def seed_netstim(netstim, owner=None):
+    """
+    Give a NetStim its own Random123 stream.
+
+    Parameters
+    ----------
+    netstim : NEURON NetStim
+    owner : None or object, default=None
+        Object whose lifetime bounds that of the NetStim, e.g. the cell
+        it stimulates. The NetStim is kept in the registry saved by
+        get_state() while the owner exists; if None, for the whole
+        session.
+
+    Notes
+    -----
+    Each NetStim gets a different stream identifier, in the order in
+    which they are seeded; with the same master seed, the same NetStims
+    created in the same order produce the same spike times.
+    """
+    global _n_netstims
+    _n_netstims += 1
+    if hasattr(netstim, 'ranvar'):
+        netstim.ranvar.set_ids(_n_netstims, 0, 0)
+        _register(_netstims, owner, (netstim, None))
+    else:
+        # A Random object (rather than noiseFromRandom123) so that the
+        # position in the stream can be read and set; see get_state.
+        random = h.Random()
+        random.Random123(_n_netstims, 0, 0)
+        random.negexp(1)
+        netstim.noiseFromRandom(random)
+        _register(_netstims, owner, (netstim, random))
+
+
+def seed_channels(sections, mechanism, owner=None):
+    """
+    Give the stochastic channels in some sections their own Random123
+    streams.
+
+    Parameters
+    ----------
+    sections : list
+        Sections with the channels, e.g. `cell.all`.
+    mechanism : str
+        Name of a stochastic channel (see nmodl.hh_channel). Segments
+        without it are ignored.
+    owner : None or object, default=None
+        Object whose lifetime bounds that of the channels (see
+        seed_netstim). If None, the cell of the sections (their
+        `cell()`), or the session if they belong to no cell.
+
+    Notes
+    -----
+    Each segment gets a different stream identifier, in the order in
+    which they are seeded and distinct from those of NetStims; with the
+    same master seed, the same channels seeded in the same order
+    produce the same channel noise.
+    """
+    global _n_channels
+    for section in sections:
+        for segment in section:
+            if hasattr(segment, mechanism):
+                ranvar = getattr(segment, mechanism).ranvar
+                _n_channels += 1
+                ranvar.set_ids(_n_channels, 1, 0)
+                _register(_channels,
+                          section.cell() if owner is None else owner,
+                          ranvar)
+
+
+def get_state():
+    """
+    State of all the random number generators.
+
+    Returns
+    -------
+    state : dict
+        The master seed, the position of each named stream and of the
+        sub-streams given by generator(), and the position of each
+        seeded NetStim and stochastic channel in its Random123 stream.
+        It can be saved as JSON and restored with set_state().
+
+    Notes
+    -----
+    Generators returned by generator() are not tracked; their state is
+    kept by their owners. Nor are NetStims and channels whose owners
+    (see seed_netstim) no longer exist.
+    """
+    netstims = []
+    for netstim, random in _entries(_netstims):
+        if random is None:
+            netstims.append(netstim.ranvar.get_seq())
+        else:
+            netstims.append(random.seq())
+    return {'master_seed': _master_seed,
+            'spawned': _seed_sequence.n_children_spawned,
+            'streams': {name: generator.bit_generator.state
+                        for name, generator in _streams.items()},
+            'netstims': netstims,
+            'channels': [ranvar.get_seq()
+                         for ranvar in _entries(_channels)]}
+
+
+def set_state(state):
+    """
+    Restore the state of the random number generators.
+
+    Parameters
+    ----------
+    state : dict
+        State returned by get_state(), in a model built in the same way
+        (same seed, and same NetStims and channels seeded in the same
+        order).
+    """
+    global _master_seed, _seed_sequence
+    netstims = _entries(_netstims)
+    ranvars = _entries(_channels)
+    if len(state['netstims']) != len(netstims):
+        raise ValueError(f"{len(state['netstims'])} NetStims in the "
+                         f"state, {len(netstims)} in the model")
+    channels = state.get('channels', [])
+    if len(channels) != len(ranvars):
+        raise ValueError(f'{len(channels)} channel streams in the state, '
+                         f'{len(ranvars)} in the model')
+    if state['master_seed'] is not None:
+        _master_seed = int(state['master_seed'])
+        _seed_sequence = np.random.SeedSequence(
+            _master_seed, n_children_spawned=state['spawned'])
+    for name, bit_state in state['streams'].items():
+        stream(name).bit_generator.state = bit_state
+    for (netstim, random), seq in zip(netstims, state['netstims']):
+        if random is None:
+            netstim.ranvar.set_seq(seq)
+        else:
+            random.seq(seq)
+    for ranvar, seq in zip(ranvars, channels):
+        ranvar.set_seq(seq)
+
+
+@contextlib.contextmanager
+def preserve():
+    """
+    Context manager that restores the master seed on exit.
+
+    The master seed, its sub-streams and the registry of seeded
+    NetStims and channels are restored, e.g. after a reproducible run
+    with its own seed that should not change the random numbers of the
+    rest of the session.
+
+    Example
+    -------
+    >>> with rng.preserve():
+    ...     rng.set_seed(0)
+    ...     cell = MSN('dmsn', 12)
+    """
+    global _master_seed, _seed_sequence, _n_netstims, _n_channels
+    saved = (_master_seed, _seed_sequence, dict(_streams), _n_netstims,
+             _n_channels, {owner: list(entries)
+                           for owner, entries in _netstims.items()},
+             {owner: list(entries) for owner, entries in _channels.items()},
+             h.Random123_globalindex())
+    try:
+        yield
+    finally:
+        (_master_seed, _seed_sequence, streams, _n_netstims, _n_channels,
+         netstims, channels, index) = saved
+        _streams.clear()
+        _streams.update(streams)
+        for registry, entries in ((_netstims, netstims),
+                                  (_channels, channels)):
+            registry.clear()
+            registry.update(entries)
+        h.Random123_globalindex(index)
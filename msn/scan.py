@@ -0,0 +1,443 @@
+"""
+Parameter scans: bifurcation and phase diagrams.
+
+The dynamics of a model cell change qualitatively with some
+parameters, e.g. the cell may rest, fire repetitively, or do either
+depending on its history (bistability, as in the up and down states of
+MSNs). Bifurcation sweeps a parameter, lets the cell settle at each
+value, and classifies the attractor it reaches; PhaseDiagram maps an
+output of the model (e.g. firing rate) over a grid of two parameters.
+
+author: Antonio Gonzalez
+"""
+import multiprocessing
+import sys
+from pathlib import Path
+
+import numpy as np
+import pandas as pd
+from neuron import h
+
+from .batch import _run_one
+from .meta import capture, write_sidecar
+from .simulation import run
+
+
+def _setter(cell, parameter):
+    # Functions that set a parameter, given as a callable or as
+    # (mechanism, variable) to be scaled in every segment, and that
+    # restore its original value (a no-op for callables).
+    if callable(parameter):
+        return parameter, lambda: None
+    mechanism, variable = parameter
+    baseline = [(getattr(segment, mechanism),
+                 getattr(getattr(segment, mechanism), variable))
+                for section in cell.all for segment in section
+                if hasattr(segment, mechanism)]
+    if not baseline:
+        raise ValueError(f"No segment has mechanism '{mechanism}'")
+
+    def set_parameter(value):
+        for mech, value0 in baseline:
+            setattr(mech, variable, value0 * value)
+    return set_parameter, lambda: set_parameter(1)
+
+
+def classify(t, v, threshold=-20, tolerance=1):
+    """
+    Classify the attractor reached by a cell from its membrane
+    potential.
+
+    Parameters
+    ----------
+    t, v : array_like
+        Time (ms) and membrane potential (mV), after the transient.
+    threshold : numeric, default=-20
+        Voltage threshold (mV) for action potentials.
+    tolerance : numeric, default=1
+        Peak-to-peak amplitude (mV) below which the potential is taken
+        to be constant.
+
+    Returns
+    -------
+    attractor : dict
+        With keys 'state' ('rest', 'spiking' or 'oscillation'),
+        'frequency' (Hz; 0 at rest), and 'v_mean', 'v_min' and 'v_max'
+        (mV).
+    """
+    t, v = np.asarray(t), np.asarray(v)
+    result = {'v_mean': v.mean(), 'v_min': v.min(), 'v_max': v.max(),
+              'frequency': 0., 'state': 'rest'}
+    crossings = t[1:][(v[:-1] < threshold) & (v[1:] >= threshold)]
+    if crossings.size >= 2:
+        result['state'] = 'spiking'
+        result['frequency'] = ((crossings.size - 1)
+                               / (crossings[-1] - crossings[0]) * 1000)
+    elif v.max() - v.min() > tolerance:
+        above = v >= v.mean()
+        ups = t[1:][~above[:-1] & above[1:]]
+        if ups.size >= 2:
+            result['state'] = 'oscillation'
+            result['frequency'] = (ups.size - 1) / (ups[-1] - ups[0]) * 1000
+    return result
+
+
+class Bifurcation:
+    """
+    One-parameter bifurcation scan.
+
+    The parameter is increased step by step, and then decreased. At
+    each step, the simulation continues from the state reached at the
+    previous step (numerical continuation) for a settling period,
+    after which the attractor is classified (see classify()). Where the
+    upward and downward sweeps reach different attractors, the cell is
+    bistable.
+
+    Attributes
+    ----------
+    cell : object
+        The model cell.
+    values : array
+        Values of the parameter.
+    results : None or pandas dataframe
+        The results of the last scan (see run()).
+
+    Methods
+    -------
+    run()
+        Run the scan
+    bistable()
+        Parameter values at which the cell is bistable
+
+    Example
+    -------
+    Scan the Kir conductance, from 20% to 150% of its value:
+    >>> cell = MSN('dmsn', 12)
+    >>> scan = Bifurcation(cell, ('kir', 'gbar'), np.linspace(0.2, 1.5, 14))
+    >>> results = scan.run()
+    >>> scan.bistable()
+    """
+
+    def __init__(self, cell, parameter, values, settle=1000, window=1000,
+                 both_directions=True, threshold=-20, tolerance=1,
+                 v_init=-80):
+        """
+        Parameters
+        ----------
+        cell : object
+            Model cell, e.g. cell.MSN.
+        parameter : callable or tuple
+            The parameter to vary: a function called with each value
+            (e.g. to set the level of a Dopamine modulation, or of a
+            DC current), or (mechanism, variable), e.g. ('kir', 'gbar'),
+            in which case the values are factors that scale the
+            variable in every segment (and the variable is restored
+            after the scan).
+        values : array_like
+            Values of the parameter, in increasing order.
+        settle : numeric, default=1000
+            Time (ms) to settle at each value before the analysis
+            window.
+        window : numeric, default=1000
+            Duration (ms) of the analysis window.
+        both_directions : bool, default=True
+            If True, sweep up and then down, to detect bistability.
+        threshold : numeric, default=-20
+            Voltage threshold (mV) for action potentials.
+        tolerance : numeric, default=1
+            Voltage tolerance (mV) for constant potentials and for
+            comparing the two sweeps.
+        v_init : numeric, default=-80
+            Initialisation membrane voltage.
+        """
+        self.cell = cell
+        self.values = np.asarray(values, dtype=float)
+        self.settle = settle
+        self.window = window
+        self.both_directions = both_directions
+        self.threshold = threshold
+        self.tolerance = tolerance
+        self.v_init = v_init
+        self.results = None
+        self._set_parameter, self._restore = _setter(cell, parameter)
+
+    def run(self):
+        """
+        Run the scan.
+
+        Returns
+        -------
+        results : pandas dataframe
+            One row per value and direction, with columns [value,
+            direction ('up' or 'down'), state, frequency, v_mean, v_min,
+            v_max]; see classify().
+        """
+        sweeps = [('up', self.values)]
+        if self.both_directions:
+            sweeps.append(('down', self.values[::-1]))
+        t = h.Vector().record(h._ref_t)
+        v = h.Vector().record(self.cell.soma(0.5)._ref_v)
+        cvode = h.CVode()
+        rows = []
+        try:
+            self._set_parameter(self.values[0])
+            h.finitialize(self.v_init)
+            for direction, values in sweeps:
+                for value in values:
+                    self._set_parameter(value)
+                    # The variable step integrator must be told of the
+                    # discontinuous change.
+                    if cvode.active():
+                        cvode.re_init()
+                    start = h.t + self.settle
+                    run(start + self.window, initialise=False)
+                    tt, vv = t.as_numpy(), v.as_numpy()
+                    window = tt >= start
+                    attractor = classify(tt[window], vv[window],
+                                         self.threshold, self.tolerance)
+                    rows.append({'value': value, 'direction': direction,
+                                 **attractor})
+        finally:
+            self._restore()
+        self.results = pd.DataFrame(rows, columns=[
+            'value', 'direction', 'state', 'frequency', 'v_mean', 'v_min',
+            'v_max'])
+        return self.results
+
+    def bistable(self):
+        """
+        Parameter values at which the upward and downward sweeps reach
+        different attractors.
+
+        Returns
+        -------
+        values : array
+        """
+        if self.results is None or not self.both_directions:
+            raise RuntimeError('Run a scan in both directions first')
+        up = self.results[self.results['direction'] == 'up'].set_index(
+            'value')
+        down = self.results[self.results['direction'] == 'down'].set_index(
+            'value').loc[up.index]
+        different = ((up['state'] != down['state'])
+                     | ((up['v_mean'] - down['v_mean']).abs()
+                        > self.tolerance))
+        return up.index[different.to_numpy()].to_numpy()
+
+
+def firing_rate(t, v, threshold=-20):
+    """
+    Firing rate (Hz): number of action potentials per unit time.
+
+    Parameters
+    ----------
+    t, v : array_like
+        Time (ms) and membrane potential (mV).
+    threshold : numeric, default=-20
+        Voltage threshold (mV) for action potentials.
+    """
+    t, v = np.asarray(t), np.asarray(v)
+    n_spikes = np.sum((v[:-1] < threshold) & (v[1:] >= threshold))
+    return n_spikes / (t[-1] - t[0]) * 1000
+
+
+def up_state_probability(t, v, threshold=-65):
+    """
+    Fraction of time in the up state.
+
+    Parameters
+    ----------
+    t, v : array_like
+        Time (ms) and membrane potential (mV).
+    threshold : numeric, default=-65
+        Membrane potential (mV) that separates the down and up states.
+
+    Notes
+    -----
+    Time is weighted by the sampling intervals, so traces recorded with
+    a variable time step are handled correctly.
+    """
+    t, v = np.asarray(t), np.asarray(v)
+    dt = np.diff(t)
+    return np.sum(dt[v[:-1] >= threshold]) / (t[-1] - t[0])
+
+
+class PhaseDiagram:
+    """
+    Two-parameter scan of a model output.
+
+    A function that runs one simulation and returns a number (e.g. the
+    firing rate, or the up-state probability) is evaluated on a grid of
+    values of two parameters, in parallel processes. Results are
+    appended to a CSV file as they complete, so that an interrupted
+    scan can be resumed: points already in the file are not run again.
+
+    Attributes
+    ----------
+    function : callable
+        The function that runs one simulation.
+    x, y : str
+        Names of the parameters.
+    x_values, y_values : array
+        Values of each parameter.
+    path : None or Path
+        The CSV file with the results.
+    results : pandas dataframe
+        Results so far, with columns [x, y, 'result', 'error',
+        'completed']; 'completed' is True for the points that ran
+        without error (whose result may be NaN).
+
+    Methods
+    -------
+    run(processes=None, progress=True)
+        Run the points of the grid not yet done
+    matrix()
+        Results as a matrix
+    to_csv(path)
+        Save the results
+    plot(ax=None, path=None, **kwargs)
+        Heatmap of the results
+
+    Example
+    -------
+    In a script:
+    >>> def rate(nmda, kir):
+    ...     cell = MSN('dmsn', 12)
+    ...     ...  # Scale NMDA and Kir, add synaptic input, run.
+    ...     return firing_rate(t, v)
+    >>> if __name__ == '__main__':
+    ...     diagram = PhaseDiagram(rate, nmda=np.linspace(0, 2, 11),
+    ...                            kir=np.linspace(0, 2, 11),
+    ...                            path='nmda_kir.csv')
+    ...     diagram.run()
+    ...     diagram.plot(path='nmda_kir.png')
+    """
+
+    def __init__(self, function, path=None, **parameters):
+        """
+        Parameters
+        ----------
+        function : callable
+            Called as `function(**{x: x_value, y: y_value})`; it must
+            return a number, and be defined at the top level of a
+            module (see batch.run_batch).
+        path : None or str or Path, default=None
+            CSV file where results are saved as they complete, with
+            the provenance of the scan in a JSON file with the same
+            name plus '.json'. If it exists, its results are loaded and
+            the completed points are not run again.
+        **parameters :
+            Exactly two parameter names, each with a sequence of
+            values; the first is shown on the x axis.
+        """
+        if len(parameters) != 2:
+            raise ValueError('Give exactly two parameters')
+        self.function = function
+        (self.x, x_values), (self.y, y_values) = parameters.items()
+        self.x_values = np.asarray(x_values, dtype=float)
+        self.y_values = np.asarray(y_values, dtype=float)
+        self.path = None if path is None else Path(path)
+        columns = [self.x, self.y, 'result', 'error', 'completed']
+        if self.path is not None and self.path.exists():
+            results = pd.read_csv(self.path)
+            if 'completed' not in results:
+                # Saved by an earlier version; new rows are appended
+                # with the column.
+                results['completed'] = results['error'].isna()
+                results[columns].to_csv(self.path, index=False)
+            self.results = results[columns]
+        else:
+            self.results = pd.DataFrame(columns=columns)
+
+    def _pending(self):
+        done = self.results[self.results['completed'].astype(bool)]
+        done = set(zip(done[self.x], done[self.y]))
+        return [{self.x: x, self.y: y}
+                for x in self.x_values for y in self.y_values
+                if (x, y) not in done]
+
+    def run(self, processes=None, progress=True):
+        """
+        Run the points of the grid that are not done yet.
+
+        Points that failed in a previous run are run again.
+
+        Parameters
+        ----------
+        processes : None or int, default=None
+            Number of worker processes. If None, the number of CPUs.
+        progress : bool, default=True
+            If True, print the number of completed points.
+
+        Returns
+        -------
+        results : pandas dataframe
+            All the results, see `results`.
+        """
+        pending = self._pending()
+        tasks = [(index, self.function, params)
+                 for index, params in enumerate(pending)]
+        done = self.results[self.results['completed'].astype(bool)]
+        if self.path is not None:
+            write_sidecar(self.path, self._metadata())
+        rows = []
+        with multiprocessing.Pool(processes) as pool:
+            for n, (index, result, error) in enumerate(
+                    pool.imap_unordered(_run_one, tasks), start=1):
+                row = {**pending[index], 'result': result, 'error': error,
+                       'completed': error is None}
+                rows.append(row)
+                if self.path is not None:
+                    pd.DataFrame([row]).to_csv(
+                        self.path, mode='a', index=False,
+                        header=not self.path.exists())
+                if progress:
+                    print(f'\r{n}/{len(tasks)} points completed', end='',
+                          file=sys.stderr)
+        if progress and tasks:
+            print(file=sys.stderr)
+        self.results = pd.concat([done, pd.DataFrame(rows)],
+                                 ignore_index=True)
+        return self.results
+
+    def matrix(self):
+        """
+        Results as a matrix.
+
+        Returns
+        -------
+        matrix : pandas dataframe
+            Results with one row per value of y and one column per
+            value of x; NaN for points not done or failed.
+        """
+        results = self.results.astype({'result': float})
+        matrix = results.pivot_table(index=self.y, columns=self.x,
+                                     values='result').reindex(
+            index=self.y_values, columns=self.x_values)
+        matrix.index.name = self.y
+        matrix.columns.name = self.x
+        return matrix
+
+    def _metadata(self):
+        return capture(params={
+            'protocol': 'PhaseDiagram',
+            'function': (f'{self.function.__module__}.'
+                         f'{self.function.__qualname__}'),
+            self.x: self.x_values, self.y: self.y_values})
+
+    def to_csv(self, path):
+        """
+        Save the results to a CSV file.
+
+        The provenance of the results (see meta.capture) is saved in a
+        JSON file with the same name plus '.json'.
+        """
+        self.results.to_csv(path, index=False)
+        write_sidecar(path, self._metadata())
+
+    def plot(self, ax=None, path=None, **kwargs):
+        """
+        Heatmap of the results; see plot.heatmap.
+        """
+        from .plot import heatmap
+        return heatmap(self.matrix(), ax=ax, path=path, **kwargs)
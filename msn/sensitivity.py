@@ -0,0 +1,166 @@
+"""
+Sensitivity analysis.
+
+Sample model parameters (e.g. conductance scaling factors) and quantify
+how much each parameter contributes to the variability of an output
+feature (e.g. rheobase).
+
+author: Antonio Gonzalez
+"""
+import numpy as np
+import pandas as pd
+
+from .rng import generator
+
+
+def latin_hypercube(bounds, n, seed=None):
+    """
+    Latin hypercube sample of parameter values.
+
+    The range of each parameter is divided into `n` intervals of equal
+    width, and one value is drawn at random from each interval. The
+    intervals of the different parameters are paired at random.
+
+    Parameters
+    ----------
+    bounds : dict
+        Lower and upper bound of each parameter, as
+        {name: (low, high)}.
+    n : int
+        Number of samples.
+    seed : None or int, default=None
+        Seed for the random number generator.
+
+    Returns
+    -------
+    samples : pandas dataframe
+        One row per sample, one column per parameter.
+
+    Example
+    -------
+    >>> samples = latin_hypercube({'kaf': (0.5, 1.5), 'kir': (0.5, 1.5)},
+    ...                           n=100)
+    """
+    rng = generator(seed)
+    samples = {}
+    for name, (low, high) in bounds.items():
+        # One point in each interval, then shuffle the intervals.
+        points = (np.arange(n) + rng.uniform(size=n)) / n
+        rng.shuffle(points)
+        samples[name] = low + points * (high - low)
+    return pd.DataFrame(samples)
+
+
+def sobol_sample(bounds, n, seed=None):
+    """
+    Parameter sample for the estimation of Sobol indices.
+
+    Parameters
+    ----------
+    bounds : dict
+        Lower and upper bound of each parameter, as
+        {name: (low, high)}.
+    n : int
+        Base number of samples. The total number of samples (i.e. of
+        model evaluations) is `n * (k + 2)`, where k is the number of
+        parameters.
+    seed : None or int, default=None
+        Seed for the random number generator.
+
+    Returns
+    -------
+    samples : pandas dataframe
+        One row per sample, one column per parameter. The model output
+        for each of these samples, in the same order, is the input to
+        sobol_indices().
+
+    Notes
+    -----
+    Two independent Latin hypercube samples A and B (n rows each) are
+    drawn, and k more matrices AB_i are built from A by replacing
+    column i by that of B [Saltelli2010]. The rows of the returned
+    sample are A, B, AB_1, ..., AB_k, in this order.
+
+    References
+    ----------
+    [Saltelli2010]: Saltelli A, Annoni P, Azzini I, Campolongo F,
+    Ratto M & Tarantola S (2010). Variance based sensitivity analysis of
+    model output. Design and estimator for the total sensitivity index.
+    Comput Phys Commun 181, 259-270.
+    """
+    rng = generator(seed)
+    a = latin_hypercube(bounds, n, seed=rng)
+    b = latin_hypercube(bounds, n, seed=rng)
+    blocks = [a, b]
+    for name in bounds:
+        ab = a.copy()
+        ab[name] = b[name].values
+        blocks.append(ab)
+    return pd.concat(blocks, ignore_index=True)
+
+
+def sobol_indices(samples, outputs):
+    """
+    First-order and total Sobol sensitivity indices.
+
+    Parameters
+    ----------
+    samples : pandas dataframe
+        The parameter sample created with sobol_sample().
+    outputs : array_like or pandas dataframe
+        Model output for each row in `samples`. A dataframe with one
+        column per output feature gives the indices for each feature.
+
+    Returns
+    -------
+    indices : pandas dataframe
+        One row per parameter (and per output feature, if there are
+        several), with columns 'S1' (first-order index: fraction of the
+        output variance due to the parameter alone) and 'ST' (total
+        index: fraction of variance due to the parameter including its
+        interactions with other parameters).
+
+    Notes
+    -----
+    The indices are calculated with the estimators in Table 2 in
+    [Saltelli2010] (the first-order index with the estimator by
+    Saltelli et al and the total index with that by Jansen). Model
+    evaluations that returned NaN are not allowed.
+
+    Example
+    -------
+    Using batch.run_batch() to evaluate a model function `rheobase`
+    that takes parameters `kaf` and `kir`:
+    >>> samples = sobol_sample({'kaf': (0.5, 1.5), 'kir': (0.5, 1.5)},
+    ...                        n=256)
+    >>> results = run_batch(rheobase, samples.to_dict('records'))
+    >>> sobol_indices(samples, results.result)
+    """
+    names = list(samples.columns)
+    k = len(names)
+    n = len(samples) // (k + 2)
+    if n * (k + 2) != len(samples):
+        raise ValueError('`samples` does not have the size of a sample '
+                         'created by sobol_sample()')
+
+    if isinstance(outputs, pd.DataFrame):
+        features = {name: outputs[name].values for name in outputs}
+    else:
+        features = {None: np.asarray(outputs, dtype=float)}
+
+    rows = []
+    for feature, y in features.items():
+        if np.isnan(y).any():
+            raise ValueError('Model outputs cannot be NaN')
+        y_a = y[:n]
+        y_b = y[n:2*n]
+        variance = np.var(np.concatenate([y_a, y_b]))
+        for index, name in enumerate(names):
+            y_ab = y[(2 + index) * n:(3 + index) * n]
+            s1 = np.mean(y_b * (y_ab - y_a)) / variance
+            st = 0.5 * np.mean((y_a - y_ab)**2) / variance
+            row = {'parameter': name, 'S1': s1, 'ST': st}
+            if feature is not None:
+                row = {'feature': feature, **row}
+            rows.append(row)
+    return pd.DataFrame(rows)
@@ -0,0 +1,826 @@
+"""
+Simulation control.
+
+Functions to configure how NEURON runs a simulation, e.g. the method of
+numerical integration.
+
+author: Antonio Gonzalez
+"""
+import json
+import time
+from pathlib import Path
+
+from neuron import h
+
+from . import rng
+
+h.load_file('stdrun.hoc')
+
+
+def set_integrator(method='fixed', dt=0.025, atol=1e-3, rtol=0):
+    """
+    Set the method of numerical integration.
+
+    Parameters
+    ----------
+    method : {'fixed', 'cn', 'cvode'}, default='fixed'
+        Integration method. 'fixed' is NEURON's default fixed time step
+        method (backward Euler), which is stable with any time step.
+        'cn' is the fixed time step Crank-Nicolson method, also stable
+        and more accurate (second order) than 'fixed' for the same
+        time step, which allows longer steps. 'cvode' is NEURON's
+        variable time step method (CVODE), which takes long steps when
+        the cell is at rest and short steps during action potentials.
+    dt : numeric, default=0.025
+        Time step in ms for the fixed step methods. Ignored if `method`
+        is 'cvode'.
+    atol : numeric, default=1e-3
+        Absolute error tolerance for 'cvode'.
+    rtol : numeric, default=0
+        Relative error tolerance for 'cvode'.
+
+    Notes
+    -----
+    The fixed step methods are implicit and use NEURON's staggered time
+    steps for voltage and gating variables [NEURONBook, Chapter 4].
+    With 'cn', the membrane potential is second-order correct at each
+    time step but gating variables and ion currents are correct at the
+    midpoint of the steps; see the documentation of `secondorder` in
+    NEURON.
+
+    With 'cvode' the time points at which the simulation is solved are
+    not evenly spaced. To record traces on a uniform time grid pass a
+    sampling interval to the recording vectors, e.g. the `record_dt`
+    parameter of instrumentation.Stim, or
+    `vector.record(ref, record_dt)` when using NEURON vectors directly.
+
+    See the documentation of NEURON's
+    [CVode](https://neuron.yale.edu/neuron/static/py_doc/simctrl/cvode.html)
+    class for details.
+
+    References
+    ----------
+    [NEURONBook]: Carnevale NT & Hines ML (2006). The NEURON Book.
+    Cambridge University Press.
+
+    Example
+    -------
+    >>> set_integrator('cvode', atol=1e-4)
+    """
+    cvode = h.CVode()
+    if method in ('fixed', 'cn'):
+        cvode.active(0)
+        h.dt = dt
+        h.secondorder = 2 if method == 'cn' else 0
+    elif method == 'cvode':
+        cvode.active(1)
+        cvode.atol(atol)
+        cvode.rtol(rtol)
+    else:
+        raise ValueError("Integration `method` must be 'fixed', 'cn' or "
+                         "'cvode'")
+
+
+def set_cache_efficient(enabled=True):
+    """
+    Store the simulation state in contiguous arrays.
+
+    With this option NEURON reorganises its internal data so that the
+    state variables of all the instances of each mechanism (e.g. the
+    gating variables of `naf` in every segment of every cell) are
+    stored contiguously and updated in tight loops, with the nodes
+    ordered for efficient memory access. This can speed up large
+    simulations (e.g. networks of many cells) substantially.
+
+    Parameters
+    ----------
+    enabled : bool, default=True
+
+    Notes
+    -----
+    The reorganisation happens at initialisation, after all the cells
+    have been built. Results are the same as without this option.
+
+    Example
+    -------
+    >>> network = Network()
+    >>> ...  # build the network
+    >>> set_cache_efficient()
+    >>> network.run(1000)
+    """
+    h.CVode().cache_efficient(int(enabled))
+
+
+def set_threads(n_threads=None):
+    """
+    Run simulations in several threads.
+
+    The cells in the model are distributed among threads, which
+    integrate them in parallel on different processor cores.
+
+    Parameters
+    ----------
+    n_threads : None or int, default=None
+        Number of threads. If None, one per processor core. 1 runs
+        simulations in a single thread (NEURON's default).
+
+    Returns
+    -------
+    n_threads : int
+        The number of threads used.
+
+    Notes
+    -----
+    The cells are partitioned among threads as a whole (a cell is never
+    split between threads), and spike events are exchanged between
+    threads at fixed intervals (the minimum connection delay); the
+    results are thus identical for any number of threads. A network
+    should have at least as many cells as threads to make use of them.
+
+    Mechanisms that are not thread safe are run in a single thread.
+
+    Example
+    -------
+    >>> set_threads(4)
+    >>> network.run(1000)
+    """
+    if n_threads is None:
+        import os
+        n_threads = os.cpu_count()
+    pc = h.ParallelContext()
+    # Second argument: 1 for parallel execution (0 would only
+    # partition the model, running the threads serially).
+    pc.nthread(n_threads, 1)
+    # Transfers of membrane potentials between threads (gap junctions,
+    # see network.GapJunction) for the new partition.
+    pc.setup_transfer()
+    return int(pc.nthread())
+
+
+def initialise(v_init=-80, settle=0, dt=10):
+    """
+    Initialise the simulation, optionally at steady state.
+
+    h.finitialize sets every gating variable to its steady-state value
+    at `v_init`, but the cell is not at rest unless `v_init` is its
+    resting potential (and ion concentrations are at equilibrium), so
+    simulations start with a transient. With `settle`, the simulation
+    is run for that long before t=0, with long time steps, so that the
+    cell reaches its resting state; the clock is then set to 0 and the
+    recordings are started, so the settling period is not recorded.
+
+    Parameters
+    ----------
+    v_init : numeric, default=-80
+        Initialisation membrane voltage.
+    settle : numeric, default=0
+        Duration (ms) of the settling period. If 0, no settling.
+    dt : numeric, default=10
+        Time step (ms) during the settling period. The fixed step
+        backward Euler method is stable with long steps.
+
+    Notes
+    -----
+    Stimuli and events at t >= 0 do not act during the settling period,
+    but those active at negative times (e.g. an IClamp with a negative
+    delay) do. Based on the custom initialisation in The NEURON Book
+    (Section 8.4.2).
+    """
+    h.finitialize(v_init)
+    if settle <= 0:
+        return
+    cvode = h.CVode()
+    cvode_active = cvode.active()
+    second_order = h.secondorder
+    dt_saved = h.dt
+    cvode.active(0)
+    h.secondorder = 0
+    h.dt = dt
+    h.t = -settle
+    while h.t < -dt / 2:
+        h.fadvance()
+    h.dt = dt_saved
+    h.secondorder = second_order
+    h.t = 0
+    cvode.active(cvode_active)
+    if cvode_active:
+        cvode.re_init()
+    else:
+        h.fcurrent()
+    h.frecord_init()
+
+
+# The argument `initialise` of run() hides the function.
+_initialise = initialise
+
+
+def run(tstop, v_init=-80, progress=None, cancel=None, interval=100,
+        initialise=True, settle=0):
+    """
+    Run a simulation with progress reports and cancellation.
+
+    Parameters
+    ----------
+    tstop : numeric
+        Time (ms) until which to run.
+    v_init : numeric, default=-80
+        Initialisation membrane voltage.
+    progress : None or callable, default=None
+        Called every `interval` ms of simulated time (and at the end)
+        as `progress(report)`, where report is a dict with keys 't'
+        (simulated time, ms), 'tstop', 'fraction' (of the run done),
+        'wall' (elapsed wall-clock time, s) and 'eta' (estimated
+        wall-clock time remaining, s).
+    cancel : None or object, default=None
+        Cancellation signal: an object with a method `is_set()` (e.g.
+        a threading.Event set from another thread), checked every
+        `interval` ms of simulated time. The run stops when it returns
+        True.
+    interval : numeric, default=100
+        Simulated time (ms) between progress reports and checks for
+        cancellation.
+    initialise : bool, default=True
+        If True, initialise the simulation (h.finitialize) before
+        running; if False, continue from the current time.
+    settle : numeric, default=0
+        Duration (ms) of a settling period before t=0, excluded from
+        the recordings; see initialise().
+
+    Returns
+    -------
+    completed : bool
+        True if the simulation ran until `tstop`, False if it was
+        cancelled. In that case h.t is the time reached, and the
+        simulation can be continued with `initialise=False`.
+
+    Example
+    -------
+    Run in a separate thread, printing progress, so that the run can
+    be cancelled:
+    >>> def report(r):
+    ...     print(f"{r['t']:.0f} ms, ETA {r['eta']:.0f} s")
+    >>> cancel = threading.Event()
+    >>> thread = threading.Thread(
+    ...     target=run, args=(10000,),
+    ...     kwargs={'progress': report, 'cancel': cancel})
+    >>> thread.start()
+    >>> cancel.set()  # Stop the run.
+    """
+    if initialise:
+        _initialise(v_init, settle)
+    t_start = h.t
+    wall_start = time.perf_counter()
+    while h.t < tstop:
+        if cancel is not None and cancel.is_set():
+            return False
+        stop = min(h.t + interval, tstop)
+        while h.t < stop:
+            h.fadvance()
+        if progress is not None:
+            wall = time.perf_counter() - wall_start
+            fraction = (h.t - t_start) / (tstop - t_start)
+            progress({'t': h.t, 'tstop': tstop,
+                      'fraction': min(fraction, 1), 'wall': wall,
+                      'eta': wall * (1 - fraction) / fraction})
+    return True
+
+
+def save_state(path):
+    """
+    Save the state of a simulation to a file.
+
+    All state variables (membrane potentials, gating variables, ion
+    concentrations, etc), the simulation time, and the queue of pending
+    synaptic events are saved, so that the simulation can be resumed
+    later with restore_state(). The state of the random number
+    generators (see rng.get_state) is saved alongside, in
+    '<path>.rng.json', so that e.g. background noise continues with the
+    same spike times as an uninterrupted run.
+
+    Parameters
+    ----------
+    path : str or Path
+        Output file name.
+
+    Notes
+    -----
+    This uses NEURON's
+    [SaveState](https://neuron.yale.edu/neuron/static/py_doc/simctrl/savstate.html)
+    class. The state can only be restored into a model with exactly the
+    same structure (same cells, sections, mechanisms and connections)
+    as the one that was saved, e.g. the same script run up to the point
+    of restoring. The contents of recording vectors are not saved.
+
+    Example
+    -------
+    Run for 1000 ms and save:
+    >>> h.finitialize(cell.v_init)
+    >>> while h.t < 1000:
+    ...     h.fadvance()
+    >>> save_state('checkpoint.dat')
+    """
+    state = h.SaveState()
+    state.save()
+    file = h.File()
+    file.wopen(str(path))
+    state.fwrite(file)
+    file.close()
+    with open(_rng_path(path), 'w') as file:
+        json.dump(rng.get_state(), file)
+
+
+def _rng_path(path):
+    # File with the state of the random number generators.
+    return Path(f'{path}.rng.json')
+
+
+def restore_state(path):
+    """
+    Restore the state of a simulation from a file.
+
+    Parameters
+    ----------
+    path : str or Path
+        File created with save_state(). The state of the random number
+        generators is also restored, if saved.
+
+    Notes
+    -----
+    The model must have been initialised (h.finitialize()) before
+    restoring. After restoring, the simulation continues from the time
+    at which the state was saved (h.t).
+
+    Example
+    -------
+    Build the same model as when the state was saved, then:
+    >>> h.finitialize(cell.v_init)
+    >>> restore_state('checkpoint.dat')
+    >>> while h.t < 2000:
+    ...     h.fadvance()
+    """
+    state = h.SaveState()
+    file = h.File()
+    file.ropen(str(path))
+    state.fread(file)
+    file.close()
+    state.restore()
+    if _rng_path(path).exists():
+        with open(_rng_path(path)) as file:
+            rng.set_state(json.load(file))
+    cvode = h.CVode()
+    if cvode.active():
+        cvode.re_init()
+    else:
+        h.fcurrent()
+
+
+# Temperature at which the kinetics of the ion channel mechanisms are
+# defined (see the `q` factors in mechanisms/*.mod), and default Q10
+# used to scale these to other temperatures.
+reference_temperature = 35
+default_q10 = {
+    'naf': 3,
+    'nap': 3,
+    'kaf': 3,
+    'kas': 3,
+    'kdr': 3,
+    'kir': 3,
+    'kv31': 3,
+    'sk': 3,
+    'bk': 3,
+    'Im': 3,
+    'cal12': 3,
+    'cal13': 3,
+    'can': 3,
+    'car': 3,
+    'cav32': 3,
+    'cav33': 3}
+
+# Default Q10 of the maximal conductances (the `qg` factors in the mod
+# files), smaller than that of the kinetics (Hille 2001).
+default_q10_conductance = {mech: 1.2 for mech in default_q10}
+
+# Original values of the `q` and `qg` factors, read the first time
+# set_temperature() is called.
+_reference_q = {}
+
+
+def _temperature_names():
+    # NEURON global variables changed by set_temperature: the
+    # temperature and the temperature factors of the loaded mechanisms.
+    names = ['celsius']
+    for factor in ('q', 'qg'):
+        names += [f'{factor}_{mech}' for mech in default_q10
+                  if hasattr(h, f'{factor}_{mech}')]
+    return names
+
+
+def set_temperature(celsius, q10=None, q10_conductance=None):
+    """
+    Set the simulation temperature.
+
+    Sets NEURON's temperature (used e.g. in the GHK current equation
+    of calcium channels) and scales the rate of the ion channel
+    kinetics and their maximal conductances according to their Q10
+    coefficients.
+
+    Parameters
+    ----------
+    celsius : numeric
+        Temperature in degrees Celsius.
+    q10 : None or dict, default=None
+        Q10 coefficients of the kinetics, as {mechanism: q10}, for the
+        channels whose Q10 should differ from `default_q10`.
+    q10_conductance : None or dict, default=None
+        Q10 coefficients of the maximal conductances (or
+        permeabilities), as {mechanism: q10}, for the channels whose
+        Q10 should differ from `default_q10_conductance`.
+
+    Raises
+    ------
+    ValueError
+        If a mechanism in `q10` or `q10_conductance` has no
+        temperature factor.
+
+    Notes
+    -----
+    The rates of the channel mechanisms in the model are multiplied by
+    a factor `q` that adjusts them to 35 degC (the temperature set by
+    cell.MSN). Here, that factor is scaled by
+    `Q10**((celsius - 35) / 10)`; likewise, the conductances are
+    multiplied by a factor `qg`, 1 at 35 degC. All the ion channels of
+    the model are covered; the synaptic mechanisms are not.
+
+    cell.MSN sets the temperature to 35 degC when a cell is created,
+    so this function should be called after creating all cells.
+
+    Example
+    -------
+    Simulate a recording at room temperature, with a Q10 of 2.5 for
+    the fast sodium current:
+    >>> cell = MSN('dmsn', 12)
+    >>> set_temperature(23, q10={'naf': 2.5})
+    """
+    for factor, defaults, values in (('q', default_q10, q10),
+                                     ('qg', default_q10_conductance,
+                                      q10_conductance)):
+        values = {**defaults, **(values or {})}
+        for mech, value in values.items():
+            name = f'{factor}_{mech}'
+            if not hasattr(h, name):
+                raise ValueError(f"Mechanism '{mech}' has no temperature "
+                                 f"factor ({name})")
+            if name not in _reference_q:
+                _reference_q[name] = getattr(h, name)
+            scale = value ** ((celsius - reference_temperature) / 10)
+            setattr(h, name, _reference_q[name] * scale)
+    h.celsius = celsius
+
+
+# Mechanisms whose rate functions can be computed from lookup tables
+# (see the TABLE statement in their mod files), and the variables
+# tabulated. The tables have 1000 intervals between the GLOBALs
+# table_vmin and table_vmax of each mechanism (by default -150 to 100
+# mV, i.e. 0.25 mV steps) and are linearly interpolated. Rates that
+# depend on RANGE parameters (e.g. naf minf, kir block) are not
+# tabulated.
+table_mechanisms = {
+    'naf': ['mtau', 'htau'],
+    'nap': ['minf', 'mtau', 'hinf', 'htau'],
+    'kaf': ['minf', 'mtau', 'hinf', 'htau'],
+    'kas': ['minf', 'mtau', 'hinf', 'htau'],
+    'kir': ['minf', 'mtau'],
+    'kdr': ['minf', 'mtau'],
+    'kv31': ['ninf', 'ntau'],
+    'can': ['minf', 'mtau', 'hinf', 'htau'],
+    'car': ['minf', 'mtau', 'hinf', 'htau'],
+    'cal12': ['minf', 'mtau', 'hinf', 'htau'],
+    'cal13': ['minf', 'mtau', 'hinf', 'htau']}
+
+
+def set_tables(enabled=True, mechanisms=None, vmin=None, vmax=None,
+               resolution=None):
+    """
+    Use lookup tables for the rate functions of ion channels.
+
+    Computing the voltage-dependent rate functions (exponentials) of
+    the ion channels at every time step takes a large part of the
+    simulation time. With tables, these functions are precomputed for
+    a range of membrane potentials and interpolated.
+
+    Parameters
+    ----------
+    enabled : bool, default=True
+        If True, use tables; if False, compute the rate functions
+        exactly (the default when the library is loaded).
+    mechanisms : None or list of str, default=None
+        Mechanisms to set. If None, all in `table_mechanisms`.
+    vmin, vmax : None or numeric, default=None
+        Range of membrane potentials (mV) of the tables; outside it,
+        the values at the ends are used. If None, unchanged (-150 and
+        100 mV initially).
+    resolution : None or numeric, default=None
+        Maximum step (mV) between table points. Tables have a fixed
+        number of intervals (1000), so a range wider than 1000 steps is
+        narrowed around its centre.
+
+    See also
+    --------
+    table_error : Error of the tables relative to the exact functions.
+    """
+    if mechanisms is None:
+        mechanisms = table_mechanisms
+    for mech in mechanisms:
+        setattr(h, f'usetable_{mech}', int(enabled))
+        low = getattr(h, f'table_vmin_{mech}') if vmin is None else vmin
+        high = getattr(h, f'table_vmax_{mech}') if vmax is None else vmax
+        if resolution is not None and high - low > resolution * 1000:
+            centre = (low + high) / 2
+            low = centre - resolution * 500
+            high = centre + resolution * 500
+        if high <= low:
+            raise ValueError(f'Empty table range: {low} to {high} mV')
+        setattr(h, f'table_vmin_{mech}', low)
+        setattr(h, f'table_vmax_{mech}', high)
+
+
+def table_error(mechanism, v=None):
+    """
+    Error of a lookup table relative to the exact rate functions.
+
+    Parameters
+    ----------
+    mechanism : str
+        A mechanism in `table_mechanisms`, e.g. 'kdr'.
+    v : None or array_like, default=None
+        Membrane potentials (mV) at which to compare. If None, from
+        -120 to 60 mV in steps of 0.01 mV (i.e. mostly between table
+        points, where the interpolation error is largest).
+
+    Returns
+    -------
+    error : pandas dataframe
+        One row per variable (e.g. minf, mtau), with the maximum
+        absolute error ('max_error'), the maximum error relative to the
+        exact value ('max_relative_error'), and the membrane potential
+        where the absolute error is largest ('v_max_error').
+    """
+    import numpy as np
+    import pandas as pd
+
+    if v is None:
+        v = np.arange(-120, 60, 0.01)
+    variables = table_mechanisms[mechanism]
+    section = h.Section(name='table_test')
+    section.insert(mechanism)
+    getattr(h, f'setdata_{mechanism}')(section(0.5))
+    rates = getattr(h, f'rates_{mechanism}')
+    usetable = getattr(h, f'usetable_{mechanism}')
+
+    values = {}
+    for enabled in (0, 1):
+        setattr(h, f'usetable_{mechanism}', enabled)
+        values[enabled] = {name: np.zeros(len(v)) for name in variables}
+        for index, voltage in enumerate(v):
+            rates(voltage)
+            for name in variables:
+                # GLOBAL, or RANGE (e.g. naf mtau) in the test segment.
+                attribute = f'{name}_{mechanism}'
+                source = h if hasattr(h, attribute) else section(0.5)
+                values[enabled][name][index] = getattr(source, attribute)
+    setattr(h, f'usetable_{mechanism}', usetable)
+
+    rows = []
+    for name in variables:
+        exact = values[0][name]
+        error = np.abs(values[1][name] - exact)
+        index = np.argmax(error)
+        rows.append({'variable': name,
+                     'max_error': error[index],
+                     'max_relative_error': np.max(
+                         error / np.maximum(np.abs(exact), 1e-12)),
+                     'v_max_error': v[index]})
+    return pd.DataFrame(rows)
+
+
+# The original model computes the rate functions exactly.
+set_tables(False)
+
+
+class Schedule:
+    """
+    Change parameters at given times during a simulation.
+
+    Events are scheduled with NEURON's CVode.event and are set up again
+    every time the simulation is initialised, so the same schedule
+    applies to every run. This allows e.g. wash-in and wash-out of a
+    drug or neuromodulator within a single run.
+
+    Changes made with `set`, `set_range` and `at(time, set_temperature,
+    ...)` are undone when the simulation is initialised, before the
+    mechanisms are (so that their initial state is that of the original
+    parameters); the effect of other functions passed to `at` or
+    `every` can be undone with `reset`.
+
+    Methods
+    -------
+    at(time, function, *args, **kwargs)
+        Call a function at a given time
+    every(interval, function, start=0, stop=None)
+        Call a function periodically
+    set(time, target, attribute, value)
+        Set an attribute of an object at a given time
+    set_range(time, sections, mechanism, variable, value, scale=False)
+        Set a mechanism variable in all segments at a given time
+    reset(function, *args, **kwargs)
+        Call a function when the simulation is initialised
+    clear()
+        Remove all scheduled events
+
+    Example
+    -------
+    Dopamine wash-in at 2 s, and cooling to 30 degC at 5 s:
+    >>> da = Dopamine(cell)
+    >>> schedule = Schedule()
+    >>> schedule.reset(da.set_level, 0)
+    >>> schedule.at(2000, da.set_level, 1)
+    >>> schedule.at(5000, set_temperature, 30)
+
+    Block half of the Kir conductance at 1 s:
+    >>> schedule.set_range(1000, cell.all, 'kir', 'gbar', 0.5, scale=True)
+    """
+
+    def __init__(self):
+        self._events = []
+        self._resets = []
+        # Parameters are restored before the mechanisms are initialised
+        # (type 0 handler), and events are queued after (type 1).
+        self._reset_handler = h.FInitializeHandler(0, self._reset)
+        self._init_handler = h.FInitializeHandler(self._initialize)
+
+    def at(self, time, function, *args, **kwargs):
+        """
+        Call a function at a given time.
+
+        Parameters
+        ----------
+        time : numeric
+            Simulation time in ms.
+        function : callable
+            Called as `function(*args, **kwargs)`.
+
+        Notes
+        -----
+        If `function` is set_temperature, the temperature and the
+        temperature factors of the ion channels when `at` is called are
+        restored every time the simulation is initialised. The effect of
+        other functions is not undone; see `reset`.
+        """
+        if function is set_temperature:
+            self._resets.append(self._restore_globals(_temperature_names()))
+        self._events.append((time, lambda: function(*args, **kwargs)))
+
+    def every(self, interval, function, start=0, stop=None):
+        """
+        Call a function periodically.
+
+        Parameters
+        ----------
+        interval : numeric
+            Time (ms) between calls.
+        function : callable
+            Called as `function(t)`, with the current time in ms; it
+            can e.g. set a parameter as a function of time.
+        start : numeric, default=0
+            Time (ms) of the first call.
+        stop : None or numeric, default=None
+            No calls after this time (ms). If None, until the end of
+            the simulation.
+        """
+        def call():
+            function(h.t)
+            next_time = h.t + interval
+            if stop is None or next_time <= stop:
+                h.CVode().event(next_time, self._wrap(call))
+        self._events.append((start, call))
+
+    def set(self, time, target, attribute, value):
+        """
+        Set an attribute of an object at a given time.
+
+        Parameters
+        ----------
+        time : numeric
+            Simulation time in ms.
+        target : object
+            Any object, e.g. a synapse, a NetCon, or `h` for NEURON's
+            global variables (e.g. 'celsius').
+        attribute : str
+            Name of the attribute.
+        value :
+            New value.
+
+        Notes
+        -----
+        The value when `set` is called is restored every time the
+        simulation is initialised.
+        """
+        original = getattr(target, attribute)
+        self._resets.append(lambda: setattr(target, attribute, original))
+        self.at(time, setattr, target, attribute, value)
+
+    def set_range(self, time, sections, mechanism, variable, value,
+                  scale=False):
+        """
+        Set a mechanism variable in all segments at a given time.
+
+        Parameters
+        ----------
+        time : numeric
+            Simulation time in ms.
+        sections : list
+            Sections to change, e.g. `cell.all` or `cell.dend`.
+        mechanism : str
+            Mechanism name, e.g. 'kir'. Segments without the mechanism
+            are ignored.
+        variable : str
+            Variable of the mechanism, e.g. 'gbar'.
+        value : numeric
+            New value, or factor if `scale` is True.
+        scale : bool, default=False
+            If True, multiply the value by `value`.
+
+        Notes
+        -----
+        The values in each segment when set_range is called are kept
+        as the baseline: they are restored every time the simulation is
+        initialised, and `scale` is relative to them, so that repeated
+        runs do not compound the change.
+        """
+        baseline = []
+        for section in sections:
+            for segment in section:
+                if hasattr(segment, mechanism):
+                    mech = getattr(segment, mechanism)
+                    baseline.append((mech, getattr(mech, variable)))
+
+        def restore():
+            for mech, original in baseline:
+                setattr(mech, variable, original)
+
+        def change():
+            for mech, original in baseline:
+                setattr(mech, variable,
+                        original * value if scale else value)
+        self._resets.append(restore)
+        self.at(time, change)
+
+    def reset(self, function, *args, **kwargs):
+        """
+        Call a function every time the simulation is initialised.
+
+        The function is called before the mechanisms are initialised,
+        e.g. to undo the change made by a function passed to `at`.
+
+        Parameters
+        ----------
+        function : callable
+            Called as `function(*args, **kwargs)`.
+        """
+        self._resets.append(lambda: function(*args, **kwargs))
+
+    def clear(self):
+        """
+        Remove all scheduled events (from the next initialisation).
+        """
+        self._events = []
+        self._resets = []
+
+    @staticmethod
+    def _wrap(function):
+        # Re-initialise the variable step integrator after the change,
+        # as parameters may change discontinuously.
+        def callback():
+            function()
+            cvode = h.CVode()
+            if cvode.active():
+                cvode.re_init()
+        return callback
+
+    @staticmethod
+    def _restore_globals(names):
+        # Restore NEURON global variables to their current values.
+        values = {name: getattr(h, name) for name in names}
+
+        def restore():
+            for name, value in values.items():
+                setattr(h, name, value)
+        return restore
+
+    def _reset(self):
+        for reset in self._resets:
+            reset()
+
+    def _initialize(self):
+        for time, function in self._events:
+            h.CVode().event(time, self._wrap(function))
@@ -0,0 +1,898 @@
+"""
+Stimuli: spike trains for driving synaptic inputs, and current
+waveforms for injection into any compartment.
+
+author: Antonio Gonzalez
+"""
+import numpy as np
+from neuron import h
+
+from .expr import Expression
+from .rng import generator
+
+
+def poisson_trains(rate, duration, n_trains=1, correlation=0, start=0,
+                   seed=None):
+    """
+    Generate (correlated) Poisson spike trains.
+
+    Parameters
+    ----------
+    rate : numeric
+        Mean firing rate of each train in Hz (spikes per s).
+    duration : numeric
+        Duration of the trains in ms.
+    n_trains : int, default=1
+        Number of spike trains.
+    correlation : float, range [0, 1], default=0
+        Pairwise correlation between trains. 0 (default) gives
+        independent trains; 1 gives identical trains.
+    start : numeric, default=0
+        Time of the start of the trains in ms.
+    seed : None or int, default=None
+        Seed for the random number generator. Trains generated with the
+        same seed (and parameters) are identical. If None, a sub-stream
+        of the master seed is used (see rng).
+
+    Returns
+    -------
+    trains : list of arrays
+        Spike times in ms, one array for each train.
+
+    Notes
+    -----
+    Correlated trains are generated by the "single interaction process"
+    method of Kuhn et al (2003): a "mother" Poisson train is generated
+    at rate `rate/correlation`, and each train copies each of the
+    spikes in the mother train with probability `correlation`. Each
+    resulting train is thus a Poisson train with rate `rate`, and the
+    correlation coefficient between the spike counts of any two trains
+    equals `correlation`.
+
+    References
+    ----------
+    Kuhn A, Aertsen A & Rotter S (2003). Higher-order statistics of
+    input ensembles and the response of simple model neurons. Neural
+    Comput 15, 67-101.
+
+    Example
+    -------
+    Ten trains at 5 Hz, 1 s long, with correlation 0.2:
+    >>> trains = poisson_trains(5, 1000, n_trains=10, correlation=0.2)
+    """
+    if not (0 <= correlation <= 1):
+        raise ValueError('`correlation` must be between 0 and 1')
+    rng = generator(seed)
+
+    def homogeneous_poisson(rate):
+        # Rate in Hz, times in ms.
+        n_spikes = rng.poisson(rate * duration / 1000)
+        return np.sort(rng.uniform(start, start + duration, n_spikes))
+
+    if correlation == 0:
+        return [homogeneous_poisson(rate) for _ in range(n_trains)]
+
+    mother = homogeneous_poisson(rate / correlation)
+    trains = []
+    for _ in range(n_trains):
+        keep = rng.uniform(size=mother.size) < correlation
+        trains.append(mother[keep])
+    return trains
+
+
+def up_down_trains(duration, n_trains=1, up_rate=20, down_rate=0.5,
+                   up_duration=500, down_duration=500, shared=1, start=0,
+                   seed=None):
+    """
+    Generate spike trains of cortical inputs with up and down states.
+
+    In vivo (anaesthesia, slow-wave sleep), cortical neurons alternate
+    between a quiescent down state and an active up state, and the
+    transitions are shared by large ensembles of neurons. Corticostriatal
+    input with this structure drives the membrane potential of MSNs
+    between a hyperpolarised down state and a depolarised up state
+    (Wilson & Kawaguchi 1996).
+
+    Up and down states alternate with durations drawn from exponential
+    distributions. A fraction `shared` of the trains follows a common
+    sequence of states (the ensemble); each of the remaining trains
+    follows its own, independent sequence. Within each state, spikes
+    are Poisson at the rate of the state.
+
+    Parameters
+    ----------
+    duration : numeric
+        Duration of the trains in ms.
+    n_trains : int, default=1
+        Number of spike trains.
+    up_rate, down_rate : numeric, default=20, 0.5
+        Firing rate (Hz) in the up and down states.
+    up_duration, down_duration : numeric, default=500, 500
+        Mean duration (ms) of up and down states.
+    shared : float, range [0, 1], default=1
+        Fraction of trains that share the ensemble transitions.
+    start : numeric, default=0
+        Time of the start of the trains in ms.
+    seed : None or int, default=None
+        Seed for the random number generator (see poisson_trains).
+
+    Returns
+    -------
+    trains : list of arrays
+        Spike times in ms, one array for each train; the first
+        round(shared * n_trains) trains are those of the ensemble.
+    up_states : array
+        Start and end times (ms) of the up states of the ensemble,
+        shape (n_states, 2).
+
+    References
+    ----------
+    Wilson CJ & Kawaguchi Y (1996). The origins of two-state spontaneous
+    membrane potential fluctuations of neostriatal spiny neurons. J
+    Neurosci 16, 2397-2410.
+
+    Example
+    -------
+    100 inputs, 80% of them in a common ensemble, to drive up states of
+    about 1 s every 2 s:
+    >>> trains, up_states = up_down_trains(
+    ...     10000, n_trains=100, up_duration=1000, down_duration=1000,
+    ...     shared=0.8)
+    """
+    if not (0 <= shared <= 1):
+        raise ValueError('`shared` must be between 0 and 1')
+    rng = generator(seed)
+    stop = start + duration
+
+    def states():
+        # Alternating states, starting in a random state.
+        up = rng.uniform() < up_duration / (up_duration + down_duration)
+        t = start
+        intervals = []
+        while t < stop:
+            length = rng.exponential(up_duration if up else down_duration)
+            if up:
+                intervals.append((t, min(t + length, stop)))
+            t += length
+            up = not up
+        return np.array(intervals).reshape(-1, 2)
+
+    def train(up_states):
+        spikes = [rng.uniform(start, stop, rng.poisson(
+            down_rate * duration / 1000))]
+        # Down-state spikes within up states are replaced by up-state
+        # spikes.
+        inside = np.zeros(spikes[0].size, dtype=bool)
+        for up_start, up_stop in up_states:
+            inside |= (spikes[0] >= up_start) & (spikes[0] < up_stop)
+            n_spikes = rng.poisson(up_rate * (up_stop - up_start) / 1000)
+            spikes.append(rng.uniform(up_start, up_stop, n_spikes))
+        spikes[0] = spikes[0][~inside]
+        return np.sort(np.concatenate(spikes))
+
+    up_states = states()
+    n_shared = round(shared * n_trains)
+    trains = [train(up_states) for _ in range(n_shared)]
+    trains += [train(states()) for _ in range(n_trains - n_shared)]
+    return trains, up_states
+
+
+def spike_train_input(synapse, spike_times, weight, delay=0,
+                      threshold=10):
+    """
+    Deliver a given spike train to a synapse.
+
+    Parameters
+    ----------
+    synapse : object
+        The synapse (a NEURON point process, e.g. as created by
+        cell.synaptic_input()) that will receive the spikes.
+    spike_times : array_like
+        Spike times in ms.
+    weight : numeric
+        Connection weight in uS.
+    delay : numeric, default=0
+        Connection delay in ms.
+    threshold : numeric, default=10
+        Connection threshold.
+
+    Returns
+    -------
+    stim : object
+        The VecStim object (a spike generator that plays a vector of
+        spike times; see mechanisms/vecevent.mod).
+    vector : object
+        The NEURON vector of spike times.
+    conn : object
+        The NetCon object connecting `stim` and `synapse`.
+
+    Notes
+    -----
+    The vector of spike times must be kept (a reference to it must
+    exist) for as long as the stimulus is used.
+
+    Example
+    -------
+    Drive 20 dendritic glutamate synapses with correlated Poisson trains:
+    >>> trains = poisson_trains(10, 1000, n_trains=20, correlation=0.3)
+    >>> inputs = []
+    >>> for dend, train in zip(cell.dend, trains):
+    ...     synapse = h.glutamate(0.5, sec=dend)
+    ...     inputs.append(
+    ...         (synapse, *spike_train_input(synapse, train, 3e-4)))
+    """
+    vector = h.Vector(spike_times)
+    stim = h.VecStim()
+    stim.play(vector)
+    conn = h.NetCon(stim, synapse)
+    conn.threshold = threshold
+    conn.delay = delay
+    conn.weight[0] = weight
+    return stim, vector, conn
+
+
+def quantal_release(spike_times, n_sites=1, p_release=0.5, cv=0.3,
+                    seed=None):
+    """
+    Draw the quantal content of the release evoked by each spike.
+
+    Each spike releases a vesicle at each of `n_sites` independent
+    release sites with probability `p_release` (binomial model of
+    release). The amplitude of each quantum varies, with a gamma
+    distribution of mean 1 and coefficient of variation `cv`.
+
+    Parameters
+    ----------
+    spike_times : array_like
+        Presynaptic spike times in ms.
+    n_sites : int, default=1
+        Number of release sites.
+    p_release : float, range [0, 1], default=0.5
+        Release probability of each site.
+    cv : float, default=0.3
+        Coefficient of variation of the quantal size; 0 for identical
+        quanta.
+    seed : None or int, default=None
+        Seed for the random number generator (see poisson_trains).
+
+    Returns
+    -------
+    times : array
+        Times (ms) of the spikes that released at least one vesicle.
+    amplitudes : array
+        Amplitude of each release, in units of the mean quantal size.
+    """
+    if not (0 <= p_release <= 1):
+        raise ValueError('`p_release` must be between 0 and 1')
+    rng = generator(seed)
+    spike_times = np.asarray(spike_times, dtype=float)
+    n_quanta = rng.binomial(n_sites, p_release, spike_times.size)
+    amplitudes = np.zeros(spike_times.size)
+    for index, n in enumerate(n_quanta):
+        if n == 0:
+            continue
+        if cv > 0:
+            # Gamma distribution with mean 1 and CV `cv`.
+            quanta = rng.gamma(1 / cv**2, cv**2, n)
+        else:
+            quanta = np.ones(n)
+        amplitudes[index] = quanta.sum()
+    released = n_quanta > 0
+    return spike_times[released], amplitudes[released]
+
+
+class QuantalInput:
+    """
+    Deliver a spike train to a synapse with probabilistic release.
+
+    Instead of activating the synapse with every spike (as
+    spike_train_input), each spike releases a random number of quanta
+    of variable size (see quantal_release), and fails to activate the
+    synapse if none is released. This reproduces the failures and
+    amplitude fluctuations of responses to minimal stimulation in
+    vitro.
+
+    The release events are drawn when the object is created, so every
+    run of the simulation gives the same responses; call `redraw()`
+    for a new realisation.
+
+    Attributes
+    ----------
+    synapse : object
+        The synapse.
+    times : array
+        Times (ms) of the release events, before `delay`.
+    amplitudes : array
+        Amplitude of each release, in units of the mean quantal size.
+    netcon : object
+        The NetCon that delivers the events.
+
+    Example
+    -------
+    Minimal stimulation at 0.2 Hz of a synapse with 2 release sites:
+    >>> synapse = h.glutamate(0.5, sec=cell.dend[10])
+    >>> stimulus = QuantalInput(synapse, np.arange(100, 50000, 5000),
+    ...                         weight=3e-4, n_sites=2, p_release=0.3)
+    >>> failures = 1 - stimulus.times.size / 10
+    """
+
+    def __init__(self, synapse, spike_times, weight, n_sites=1,
+                 p_release=0.5, cv=0.3, delay=0, seed=None):
+        """
+        Parameters
+        ----------
+        synapse : object
+            A synapse (NEURON point process, e.g. h.glutamate).
+        spike_times : array_like
+            Presynaptic spike times in ms.
+        weight : numeric
+            Synaptic weight (uS) of one quantum of mean size.
+        n_sites, p_release, cv :
+            See quantal_release.
+        delay : numeric, default=0
+            Synaptic delay in ms.
+        seed : None or int, default=None
+            Seed for the random number generator (see poisson_trains).
+        """
+        self.synapse = synapse
+        self.weight = weight
+        self.delay = delay
+        self._spike_times = np.asarray(spike_times, dtype=float)
+        self._release = dict(n_sites=n_sites, p_release=p_release, cv=cv)
+        self._rng = generator(seed)
+        self.redraw()
+        self.netcon = h.NetCon(None, synapse)
+        self._init_handler = h.FInitializeHandler(self._initialize)
+
+    def redraw(self):
+        """
+        Draw new release events.
+        """
+        self.times, self.amplitudes = quantal_release(
+            self._spike_times, seed=self._rng, **self._release)
+
+    def _initialize(self):
+        for time, amplitude in zip(self.times, self.amplitudes):
+            h.CVode().event(time + self.delay,
+                            lambda amplitude=amplitude: self._deliver(
+                                amplitude))
+
+    def _deliver(self, amplitude):
+        # The weight is read when the event is delivered, i.e. now.
+        self.netcon.weight[0] = self.weight * amplitude
+        self.netcon.event(h.t)
+
+
+class Waveform:
+    """
+    Base class for current waveforms.
+
+    A waveform is a function of time that gives the current (nA) to
+    inject. It is played into an IClamp with play(); several waveforms
+    played into the same compartment add up, and waveforms can also be
+    added with `+` to make a single one (see Sum).
+
+    Subclasses define `start`, `stop` (ms) and `_values(t)`, the current
+    at times `t` within [start, stop); the current is 0 outside this
+    interval.
+
+    Methods
+    -------
+    __call__(t)
+        Current at given times
+    play(section, x=0.5, dt=None)
+        Inject the waveform into a section
+    clear()
+        Stop injecting the waveform
+    """
+    start = 0
+    stop = 0
+    dt = 0.025
+
+    def __call__(self, t):
+        """
+        Current (nA) at times `t` (ms).
+        """
+        t = np.asarray(t, dtype=float)
+        inside = (t >= self.start) & (t < self.stop)
+        values = np.zeros(t.shape)
+        values[inside] = self._values(t[inside])
+        return values
+
+    def _values(self, t):
+        raise NotImplementedError
+
+    def __add__(self, other):
+        return Sum(self, other)
+
+    def _target(self, section, x):
+        # Point process driven by the waveform, and the reference to the
+        # variable that is played into.
+        clamp = h.IClamp(x, sec=section)
+        clamp.delay = 0
+        clamp.dur = 1e9
+        return clamp, clamp._ref_amp
+
+    def play(self, section, x=0.5, dt=None):
+        """
+        Inject the waveform into a section.
+
+        Parameters
+        ----------
+        section : object
+            The cell section, e.g. `cell.soma`.
+        x : float, range [0, 1], default=0.5
+            Location on `section`.
+        dt : None or numeric, default=None
+            Sampling interval (ms) of the waveform. Values between
+            samples are linearly interpolated at each solver time step.
+            If None, the waveform's own `dt`.
+
+        Returns
+        -------
+        clamp : object
+            The point process that injects the waveform (an IClamp, or
+            a gclamp for conductances). The waveform keeps references
+            to it and to the played vectors while it exists.
+        """
+        if dt is None:
+            dt = self.dt
+        t = np.arange(0, self.stop + dt, dt)
+        clamp, ref = self._target(section, x)
+        t_vector = h.Vector(t)
+        values = h.Vector(self(t))
+        values.play(ref, t_vector, 1)
+        self._played = getattr(self, '_played', [])
+        self._played.append((clamp, t_vector, values))
+        return clamp
+
+    def clear(self):
+        """
+        Stop injecting the waveform.
+
+        The played vectors are detached from every point process made
+        by play(), and the waveform drops its references to them; each
+        point process is deleted by NEURON once there are no other
+        references to it (e.g. the one returned by play()).
+        """
+        for clamp, t_vector, values in getattr(self, '_played', []):
+            values.play_remove()
+        self._played = []
+
+
+class Sum(Waveform):
+    """
+    Sum of waveforms.
+
+    Example
+    -------
+    A step plus noise:
+    >>> stimulus = Step(0.2, start=50, duration=500) + OUNoise(
+    ...     0, 0.05, tau=5, start=0, duration=600)
+    >>> stimulus.play(cell.soma)
+    """
+
+    def __init__(self, *waveforms):
+        """
+        Parameters
+        ----------
+        *waveforms : Waveform
+            The waveforms to add up.
+        """
+        self.waveforms = waveforms
+        self.start = min(waveform.start for waveform in waveforms)
+        self.stop = max(waveform.stop for waveform in waveforms)
+        self.dt = min(waveform.dt for waveform in waveforms)
+
+    def _values(self, t):
+        return sum(waveform(t) for waveform in self.waveforms)
+
+
+class Step(Waveform):
+    """
+    Current step.
+    """
+
+    def __init__(self, amplitude, start=0, duration=100):
+        """
+        Parameters
+        ----------
+        amplitude : numeric
+            Amplitude in nA.
+        start : numeric, default=0
+            Start of the step in ms.
+        duration : numeric, default=100
+            Duration of the step in ms.
+        """
+        self.amplitude = amplitude
+        self.start = start
+        self.stop = start + duration
+
+    def _values(self, t):
+        return np.full(t.shape, float(self.amplitude))
+
+
+class OUNoise(Waveform):
+    """
+    Ornstein-Uhlenbeck noise current.
+
+    Gaussian noise with exponential autocorrelation, often used to mimic
+    the synaptic bombardment of neurons in vivo:
+
+        tau dI/dt = mean - I + sigma sqrt(2 tau) xi(t)
+
+    where xi is white noise. The current has mean `mean`, standard
+    deviation `sigma` and correlation time `tau`.
+
+    Example
+    -------
+    >>> noise = OUNoise(mean=0.1, sigma=0.05, tau=5, duration=1000,
+    ...                 seed=1)
+    >>> noise.play(cell.soma)
+    """
+
+    def __init__(self, mean, sigma, tau, start=0, duration=1000, dt=0.1,
+                 seed=None):
+        """
+        Parameters
+        ----------
+        mean : numeric
+            Mean current in nA.
+        sigma : numeric
+            Standard deviation of the current in nA.
+        tau : numeric
+            Correlation time in ms.
+        start : numeric, default=0
+            Start of the noise in ms.
+        duration : numeric, default=1000
+            Duration of the noise in ms.
+        dt : numeric, default=0.1
+            Time step (ms) at which the noise is generated.
+        seed : None or int, default=None
+            Seed for the random number generator. If None, a sub-stream
+            of the master seed is used (see rng).
+        """
+        self.mean = mean
+        self.sigma = sigma
+        self.tau = tau
+        self.start = start
+        self.stop = start + duration
+        self.dt = dt
+
+        # Exact update of the process over each time step (Gillespie
+        # 1996), starting from its stationary distribution.
+        rng = generator(seed)
+        n = int(np.ceil(duration / dt)) + 1
+        decay = np.exp(-dt / tau)
+        kicks = rng.normal(size=n) * sigma * np.sqrt(1 - decay**2)
+        values = np.empty(n)
+        values[0] = mean + sigma * rng.normal()
+        for index in range(1, n):
+            values[index] = (mean + (values[index - 1] - mean) * decay +
+                             kicks[index])
+        self.t = start + np.arange(n) * dt
+        self.values = values
+
+    def _values(self, t):
+        return np.interp(t, self.t, self.values)
+
+
+class FromSamples(Waveform):
+    """
+    Waveform from samples, e.g. an experimentally recorded injection.
+
+    The samples, taken at a constant sampling rate, are linearly
+    interpolated onto the solver time step. The waveform can be a
+    current (injected with an IClamp) or a conductance (injected with a
+    dynamic clamp, see mechanisms/gclamp.mod).
+
+    Methods
+    -------
+    from_csv(path, rate, column=0, scale=1, **kwargs)
+        Load samples from a CSV file
+    from_binary(path, rate, dtype='<f4', scale=1, **kwargs)
+        Load samples from a raw binary file
+    from_wav(path, scale=1, **kwargs)
+        Load samples from a WAV file
+
+    Example
+    -------
+    Replay a current recorded at 20 kHz, in pA, from a CSV file:
+    >>> stimulus = FromSamples.from_csv('injection.csv', rate=20000,
+    ...                                 column='current', scale=1e-3)
+    >>> stimulus.play(cell.soma)
+
+    Replay an excitatory conductance (in nS):
+    >>> stimulus = FromSamples(g, rate=10000, scale=1e-3,
+    ...                        kind='conductance', erev=0)
+    >>> stimulus.play(cell.dend[3])
+    """
+
+    def __init__(self, samples, rate, start=0, scale=1, kind='current',
+                 erev=0):
+        """
+        Parameters
+        ----------
+        samples : array_like
+            The waveform's samples.
+        rate : numeric
+            Sampling rate in Hz.
+        start : numeric, default=0
+            Time (ms) at which the waveform starts.
+        scale : numeric, default=1
+            Factor that converts the samples to nA (current) or uS
+            (conductance), e.g. 1e-3 for samples in pA or nS.
+        kind : {'current', 'conductance'}, default='current'
+            What the samples are.
+        erev : numeric, default=0
+            Reversal potential (mV) of a conductance.
+        """
+        if kind not in ('current', 'conductance'):
+            raise ValueError("`kind` must be 'current' or 'conductance'")
+        self.samples = np.asarray(samples, dtype=float) * scale
+        self.rate = rate
+        self.kind = kind
+        self.erev = erev
+        self.dt = 1000 / rate
+        self.start = start
+        self.stop = start + self.samples.size * self.dt
+
+    @classmethod
+    def from_csv(cls, path, rate, column=0, scale=1, **kwargs):
+        """
+        Load samples from a CSV file.
+
+        Parameters
+        ----------
+        path : str or Path
+            The file name.
+        rate : numeric
+            Sampling rate in Hz.
+        column : int or str, default=0
+            Column (index or name, if the file has a header) with the
+            samples.
+        scale : numeric, default=1
+            Factor that converts the samples to nA or uS.
+        **kwargs :
+            Other parameters of FromSamples (start, kind, erev).
+        """
+        import pandas as pd
+
+        header = None if isinstance(column, int) else 'infer'
+        data = pd.read_csv(path, header=header)
+        if isinstance(column, int):
+            samples = data.iloc[:, column].values
+        else:
+            samples = data[column].values
+        return cls(samples, rate, scale=scale, **kwargs)
+
+    @classmethod
+    def from_binary(cls, path, rate, dtype='<f4', scale=1, **kwargs):
+        """
+        Load samples from a raw binary file (one channel, no header).
+
+        Parameters
+        ----------
+        path : str or Path
+            The file name.
+        rate : numeric
+            Sampling rate in Hz.
+        dtype : str or numpy dtype, default='<f4'
+            Data type of the samples, e.g. '<f4' (little-endian 32-bit
+            float) or '<i2' (16-bit integer).
+        scale : numeric, default=1
+            Factor that converts the samples to nA or uS.
+        **kwargs :
+            Other parameters of FromSamples (start, kind, erev).
+        """
+        return cls(np.fromfile(path, dtype=dtype), rate, scale=scale,
+                   **kwargs)
+
+    @classmethod
+    def from_wav(cls, path, scale=1, **kwargs):
+        """
+        Load samples from a WAV file (PCM; first channel only).
+
+        The sampling rate is read from the file.
+
+        Parameters
+        ----------
+        path : str or Path
+            The file name.
+        scale : numeric, default=1
+            Factor that converts the samples (integers) to nA or uS.
+        **kwargs :
+            Other parameters of FromSamples (start, kind, erev).
+        """
+        import wave
+
+        with wave.open(str(path), 'rb') as file:
+            rate = file.getframerate()
+            width = file.getsampwidth()
+            n_channels = file.getnchannels()
+            frames = file.readframes(file.getnframes())
+        if width == 1:
+            # 8-bit WAV samples are unsigned.
+            samples = np.frombuffer(
+                frames, dtype=np.uint8).astype(np.int16) - 128
+        elif width in (2, 4):
+            samples = np.frombuffer(frames, dtype=f'<i{width}')
+        else:
+            raise ValueError(f'Unsupported sample width: {width} bytes')
+        return cls(samples[::n_channels], rate, scale=scale, **kwargs)
+
+    def _values(self, t):
+        times = self.start + np.arange(self.samples.size) * self.dt
+        return np.interp(t, times, self.samples)
+
+    def _target(self, section, x):
+        if self.kind == 'current':
+            return super()._target(section, x)
+        clamp = h.gclamp(x, sec=section)
+        clamp.e = self.erev
+        return clamp, clamp._ref_g
+
+
+class Ramp(Waveform):
+    """
+    Current ramp.
+    """
+
+    def __init__(self, start_amplitude, end_amplitude, start=0,
+                 duration=1000):
+        """
+        Parameters
+        ----------
+        start_amplitude, end_amplitude : numeric
+            Current (nA) at the start and at the end of the ramp.
+        start : numeric, default=0
+            Start of the ramp in ms.
+        duration : numeric, default=1000
+            Duration of the ramp in ms.
+        """
+        self.start_amplitude = start_amplitude
+        self.end_amplitude = end_amplitude
+        self.start = start
+        self.stop = start + duration
+
+    def _values(self, t):
+        fraction = (t - self.start) / (self.stop - self.start)
+        return (self.start_amplitude +
+                fraction * (self.end_amplitude - self.start_amplitude))
+
+
+class Sine(Waveform):
+    """
+    Sinusoidal current.
+    """
+
+    def __init__(self, amplitude, frequency, start=0, duration=1000,
+                 offset=0, phase=0, dt=0.1):
+        """
+        Parameters
+        ----------
+        amplitude : numeric
+            Amplitude (nA).
+        frequency : numeric
+            Frequency in Hz.
+        start : numeric, default=0
+            Start of the current in ms.
+        duration : numeric, default=1000
+            Duration in ms.
+        offset : numeric, default=0
+            Constant current (nA) added to the sine wave.
+        phase : numeric, default=0
+            Phase (radians) at `start`.
+        dt : numeric, default=0.1
+            Sampling interval (ms) used by play().
+        """
+        self.amplitude = amplitude
+        self.frequency = frequency
+        self.start = start
+        self.stop = start + duration
+        self.offset = offset
+        self.phase = phase
+        self.dt = dt
+
+    def _values(self, t):
+        seconds = (t - self.start) * 1e-3
+        return self.offset + self.amplitude * np.sin(
+            2 * np.pi * self.frequency * seconds + self.phase)
+
+
+class Formula(Waveform):
+    """
+    Current given by a formula of time.
+
+    Example
+    -------
+    A sine wave whose amplitude grows linearly over 1 s:
+    >>> stimulus = Formula('0.1 * t / 1000 * sin(2 * pi * 5 * t / 1000)',
+    ...                    start=0, duration=1000)
+    """
+
+    def __init__(self, formula, start=0, duration=1000, dt=0.1):
+        """
+        Parameters
+        ----------
+        formula : str
+            The current (nA) as a function of `t`, the time (ms) from
+            `start`; see expr.Expression for the syntax.
+        start : numeric, default=0
+            Start of the current in ms.
+        duration : numeric, default=1000
+            Duration in ms.
+        dt : numeric, default=0.1
+            Sampling interval (ms) used by play().
+        """
+        self.formula = Expression(formula, variables=['t'])
+        self.start = start
+        self.stop = start + duration
+        self.dt = dt
+
+    def _values(self, t):
+        values = self.formula(t=t - self.start)
+        return np.broadcast_to(np.asarray(values, dtype=float), t.shape)
+
+
+class Chirp(Waveform):
+    """
+    Chirp, or ZAP (impedance amplitude profile), current.
+
+    A sine wave whose frequency increases from `f_start` to `f_end`
+    during the stimulus, used to measure the impedance of a cell as a
+    function of frequency (see analysis.Impedance).
+
+    Example
+    -------
+    >>> zap = Chirp(0.02, 0.5, 20, start=500, duration=20000)
+    >>> zap.play(cell.soma)
+    """
+
+    def __init__(self, amplitude, f_start, f_end, start=0,
+                 duration=10000, offset=0, method='linear', dt=0.1):
+        """
+        Parameters
+        ----------
+        amplitude : numeric
+            Amplitude (nA).
+        f_start, f_end : numeric
+            Frequency (Hz) at the start and at the end.
+        start : numeric, default=0
+            Start of the current in ms.
+        duration : numeric, default=10000
+            Duration in ms.
+        offset : numeric, default=0
+            Constant current (nA) added to the chirp.
+        method : {'linear', 'exponential'}, default='linear'
+            How the frequency changes with time. With 'exponential' the
+            same time is spent in each octave.
+        dt : numeric, default=0.1
+            Sampling interval (ms) used by play().
+        """
+        if method not in ('linear', 'exponential'):
+            raise ValueError("`method` must be 'linear' or 'exponential'")
+        self.amplitude = amplitude
+        self.f_start = f_start
+        self.f_end = f_end
+        self.start = start
+        self.stop = start + duration
+        self.offset = offset
+        self.method = method
+        self.dt = dt
+
+    def _values(self, t):
+        # Phase (in cycles) is the integral of the frequency.
+        seconds = (t - self.start) * 1e-3
+        total = (self.stop - self.start) * 1e-3
+        if self.method == 'linear':
+            cycles = (self.f_start * seconds + (self.f_end - self.f_start) *
+                      seconds**2 / (2 * total))
+        else:
+            k = (self.f_end / self.f_start)**(1 / total)
+            cycles = self.f_start * (k**seconds - 1) / np.log(k)
+        return self.offset + self.amplitude * np.sin(2 * np.pi * cycles)
+
+
+# ZAP is another common name for a chirp stimulus.
+ZAP = Chirp
@@ -0,0 +1,92 @@
+"""
+Tests of the analysis of recorded traces, on synthetic traces with known
+answers.
+
+author: Antonio Gonzalez
+"""
+import numpy as np
+import pytest
+
+pytest.importorskip('neuron')
+
+from msn.analysis import PSP, StateDetector
+
+
+def _psp(t, onset, amplitude, tau_rise=1, tau_decay=20):
+    # Difference of exponentials with peak `amplitude`, starting at
+    # `onset`.
+    t_peak = (tau_rise * tau_decay / (tau_decay - tau_rise)
+              * np.log(tau_decay / tau_rise))
+    norm = np.exp(-t_peak / tau_decay) - np.exp(-t_peak / tau_rise)
+    s = np.clip(t - onset, 0, None)
+    return amplitude * (np.exp(-s / tau_decay) - np.exp(-s / tau_rise)) / (
+        norm)
+
+
+def test_psp_known_events():
+    t = np.arange(0, 500, 0.025)
+    v = -80 + _psp(t, 100, 2) + _psp(t, 300, 1)
+    psp = PSP(t, v)
+    events = psp.events
+    assert len(events) == 2
+    assert events.onset.values == pytest.approx([100, 300], abs=0.5)
+    assert events.baseline.values == pytest.approx([-80, -80], abs=0.01)
+    assert events.amplitude.values == pytest.approx([2, 1], rel=0.02)
+    assert events.tau_decay.values == pytest.approx([20, 20], rel=0.1)
+    assert np.all((events.rise_time > 0) & (events.rise_time < 3.2))
+    assert psp.frequency == pytest.approx(2 / (t[-1] - t[0]) * 1e3,
+                                          rel=1e-3)
+
+
+def test_psp_sign():
+    t = np.arange(0, 300, 0.025)
+    v = -60 - _psp(t, 100, 1.5)
+    assert len(PSP(t, v).events) == 0
+    events = PSP(t, v, sign=-1).events
+    assert len(events) == 1
+    assert events.amplitude.iloc[0] == pytest.approx(1.5, rel=0.02)
+
+
+def test_psp_variable_step():
+    # A trace sampled irregularly (as with CVODE) is resampled at its
+    # shortest step, so the rise is not missed.
+    t = np.concatenate([np.arange(0, 100, 1), np.arange(100, 120, 0.025),
+                        np.arange(120, 300, 2)])
+    v = -80 + _psp(t, 100, 2)
+    events = PSP(t, v).events
+    assert len(events) == 1
+    assert events.amplitude.iloc[0] == pytest.approx(2, rel=0.05)
+
+
+def test_state_detector_known_states():
+    t = np.arange(0, 2000, 0.1)
+    v = np.full(t.shape, -80.0)
+    v[(t >= 500) & (t < 1000)] = -50
+    v[(t >= 1500) & (t < 1800)] = -50
+    detector = StateDetector(t, v, up_threshold=-60, down_threshold=-70)
+    states = detector.states
+    assert list(states.state) == ['down', 'up', 'down', 'up', 'down']
+    assert states.start.values == pytest.approx([0, 500, 1000, 1500, 1800],
+                                                abs=10)
+    assert states.end.values[-1] == pytest.approx(2000)
+    assert detector.dwell_times('up') == pytest.approx([500, 300], abs=10)
+
+
+def test_state_detector_short_states_merged():
+    # A 20 ms dip in an up state is shorter than min_duration.
+    t = np.arange(0, 1000, 0.1)
+    v = np.full(t.shape, -80.0)
+    v[(t >= 200) & (t < 800)] = -50
+    v[(t >= 500) & (t < 520)] = -80
+    states = StateDetector(t, v, min_duration=50).states
+    assert list(states.state) == ['down', 'up', 'down']
+
+
+def test_state_detector_edges():
+    # The trace starts and ends in an up state: the smoothing must not
+    # pull the ends towards 0 mV or below the down threshold.
+    t = np.arange(0, 1000, 0.1)
+    v = np.full(t.shape, -50.0)
+    v[(t >= 300) & (t < 700)] = -80
+    states = StateDetector(t, v).states
+    assert list(states.state) == ['up', 'down', 'up']
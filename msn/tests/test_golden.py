@@ -0,0 +1,58 @@
+"""
+Tests of the regression checks against reference traces.
+
+author: Antonio Gonzalez
+"""
+import numpy as np
+import pytest
+
+pytest.importorskip('neuron')
+
+from neuron import h
+
+from msn import golden
+
+case = 'dmsn_subthreshold'
+
+
+def test_record_and_compare(tmp_path):
+    paths = golden.record(tmp_path, [case])
+    assert paths == [tmp_path / f'{case}.npz']
+    report = golden.compare(tmp_path)
+    assert list(report.case) == [case]
+    assert report.passed.all()
+    # The simulations are deterministic.
+    assert report.max_error.max() == 0
+
+
+def test_compare_detects_changes(tmp_path):
+    golden.record(tmp_path, [case])
+    path = tmp_path / f'{case}.npz'
+    with np.load(path) as data:
+        reference = dict(data)
+    reference['v'] = reference['v'] + 1
+    np.savez_compressed(path, **reference)
+    report = golden.compare(tmp_path)
+    assert not report.passed.any()
+    assert report.max_error.iloc[0] == pytest.approx(1, abs=1e-6)
+
+
+def test_settings_restored():
+    cvode = h.CVode()
+    cvode.active(1)
+    try:
+        golden.run_case(case)
+        assert cvode.active()
+    finally:
+        cvode.active(0)
+
+
+def test_main_without_reference(tmp_path):
+    assert golden.main(['compare', str(tmp_path)]) == 1
+
+
+def test_distributed_reference():
+    if not any(golden.reference_directory.glob('*.npz')):
+        pytest.skip('no reference traces distributed')
+    report = golden.compare()
+    assert report.passed.all(), report[~report.passed]
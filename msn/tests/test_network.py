@@ -0,0 +1,60 @@
+"""
+Tests of network construction.
+
+author: Antonio Gonzalez
+"""
+import pytest
+
+pytest.importorskip('neuron')
+
+from neuron import h
+
+from msn.cell import FSI, MSN, ConductanceFSI, ReducedMSN, TAN
+from msn.network import Network
+
+
+def test_mixed_msn_fsi():
+    net = Network()
+    msns = net.add_population('dmsn', 'dmsn', [0, 1, 2], full=[0])
+    fsis = net.add_population('fsi', 'fsi', range(4), cell_class=FSI)
+    assert isinstance(msns[0], MSN)
+    assert all(type(cell) is ReducedMSN for cell in msns[1:])
+    assert all(type(cell) is FSI for cell in fsis)
+    n = net.connect('fsi', 'dmsn', probability=1, weight=1e-3, seed=0)
+    assert n == len(fsis) * len(msns)
+    stims = []
+    for cell in fsis:
+        stims.append(h.IClamp(cell.soma(0.5)))
+        stims[-1].dur = 50
+        stims[-1].amp = 2 * cell.rheobase * 1e-3
+    assert net.run(50)
+    spikes = net.spikes()
+    assert set(spikes['cell'][spikes['population'] == 'fsi']) == {
+        0, 1, 2, 3}
+
+
+def test_reduced_class_kwargs():
+    net = Network()
+    cells = net.add_population('tan', 'tan', range(2), cell_class=TAN,
+                               reduced_params={'Ib': 0}, v_init=-70)
+    assert all(type(cell) is TAN for cell in cells)
+    assert all(cell.params['Ib'] == 0 for cell in cells)
+    assert all(cell.v_init == -70 for cell in cells)
+
+
+def test_mixed_msn_conductance_fsi():
+    net = Network()
+    net.add_population('dmsn', 'dmsn', [0])
+    fsis = net.add_population('fsi', 'fsi', [None] * 2,
+                              cell_class=ConductanceFSI)
+    assert all(type(cell) is ConductanceFSI for cell in fsis)
+    assert net.connect('fsi', 'dmsn', probability=1, weight=1e-3,
+                       seed=0) == 2
+    stim = h.IClamp(fsis[0].soma(0.5))
+    stim.dur = 100
+    stim.amp = 0.5
+    assert net.run(100)
+    spikes = net.spikes('fsi')
+    # ~120 Hz, well above the firing rate of a MSN.
+    assert (spikes['cell'] == 0).sum() >= 8
+    assert (spikes['cell'] == 1).sum() == 0
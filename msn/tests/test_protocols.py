@@ -0,0 +1,117 @@
+"""
+Tests of the stimulation protocols.
+
+author: Antonio Gonzalez
+"""
+import numpy as np
+import pytest
+
+pytest.importorskip('neuron')
+
+from neuron import h
+
+from msn.cell import MSN
+from msn.protocols import PairedPulse, RampProtocol, StepFamily, Train
+
+
+def _depression(n_pulses, interval, U=0.5, tau_rec=800):
+    # Normalised responses of Tsodyks-Markram synapses without
+    # facilitation (u = U), from the recovery of the resources R
+    # between pulses.
+    R = [1.0]
+    for __ in range(n_pulses - 1):
+        R.append(1 - (1 - R[-1] * (1 - U)) * np.exp(-interval / tau_rec))
+    return np.array(R)
+
+
+@pytest.fixture
+def cell():
+    return MSN('dmsn', 12)
+
+
+@pytest.fixture
+def somatic_gaba(cell):
+    # GABA synapses at the soma, so that in voltage clamp the current is
+    # proportional to their conductance.
+    return [h.tmgaba(0.5, sec=cell.soma) for __ in range(10)]
+
+
+def test_step_family(cell):
+    rheobase = cell.rheobase * 1e-3
+    family = StepFamily(cell, amplitudes=[-0.2, 0, rheobase + 0.1],
+                        delay=200, duration=300, after=100)
+    results = family.run()
+    assert len(results) == 3
+    assert set(family.traces) == set(results.amplitude)
+
+    hyperpolarising = results.iloc[0]
+    assert hyperpolarising.v_peak < hyperpolarising.v_rest
+    assert 0 <= hyperpolarising.sag_ratio < 1
+    assert np.isfinite(hyperpolarising.rebound)
+    assert hyperpolarising.n_spikes == 0
+
+    # No current, no change.
+    resting = results.iloc[1]
+    assert resting.v_steady == pytest.approx(resting.v_rest, abs=1)
+    assert resting.n_spikes == 0
+    assert np.isnan(resting.sag_ratio)
+    assert np.isnan(resting.latency)
+
+    firing = results.iloc[2]
+    assert firing.n_spikes > 0
+    assert 0 < firing.latency < 300
+    assert firing.rate > 0
+
+
+def test_ramp(cell):
+    rheobase = cell.rheobase * 1e-3
+    ramp = RampProtocol(cell, slopes=[1], end_amplitude=0.6, delay=50,
+                        rheobase=rheobase)
+    results = ramp.run()
+    row = results.iloc[0]
+    assert row.n_spikes > 0
+    # The dynamic rheobase is reached during the ramp, 0.6 nA in 600 ms.
+    assert 0 < row.current <= 0.6
+    assert row.current == pytest.approx(row.latency * 1e-3, rel=0.01)
+    assert -70 < row.v_threshold < 0
+    assert np.isfinite(row.delay)
+    t, v, current = ramp.traces[1.0]
+    assert current.max() == pytest.approx(0.6, abs=0.01)
+
+    # The current of the first run is no longer injected.
+    again = ramp.run()
+    assert again.iloc[0].latency == pytest.approx(row.latency)
+
+
+def test_train_depression(cell, somatic_gaba):
+    train = Train(cell, somatic_gaba, weight=5e-4, n_pulses=5,
+                  frequencies=[10], mode='voltage', holding=-50)
+    results = train.run()
+    assert list(results.pulse) == [1, 2, 3, 4, 5]
+    assert results.time.tolist() == pytest.approx([100, 200, 300, 400,
+                                                   500])
+    assert results.normalised.values == pytest.approx(
+        _depression(5, 100), rel=0.02)
+
+
+def test_train_first_pulse_at_zero(cell, somatic_gaba):
+    train = Train(cell, somatic_gaba, weight=5e-4, n_pulses=2,
+                  frequencies=[20], delay=0, after=50, mode='voltage',
+                  holding=-50)
+    results = train.run()
+    assert len(results) == 2
+    assert results.time.tolist() == pytest.approx([0, 50])
+    assert np.all(np.isfinite(results.amplitude))
+
+
+def test_paired_pulse(cell, somatic_gaba):
+    intervals = [50, 200]
+    pp = PairedPulse(cell, somatic_gaba, weight=5e-4, intervals=intervals,
+                     mode='voltage', holding=-50)
+    ppr = pp.run()
+    assert ppr.interval.tolist() == intervals
+    expected = [_depression(2, interval)[1] for interval in intervals]
+    assert ppr.ppr.values == pytest.approx(expected, rel=0.02)
+    params = pp._metadata()['params']
+    assert params['intervals'] == intervals
+    assert params['n_pulses'] == 2
@@ -0,0 +1,90 @@
+"""
+Tests of the simulation settings and of parameter schedules.
+
+author: Antonio Gonzalez
+"""
+import numpy as np
+import pytest
+
+pytest.importorskip('neuron')
+
+from neuron import h
+
+from msn.simulation import Schedule, set_integrator
+
+
+@pytest.fixture
+def passive():
+    # A passive single compartment, with a current clamp that is off
+    # until the schedule switches it on.
+    set_integrator('fixed')
+    soma = h.Section(name='soma')
+    soma.L = soma.diam = 20
+    soma.insert('pas')
+    soma.g_pas = 1e-4
+    soma.e_pas = -70
+    stim = h.IClamp(soma(0.5))
+    stim.dur = 1e9
+    stim.amp = 0
+    return soma, stim
+
+
+def _run(soma, tstop):
+    t = h.Vector()
+    t.record(h._ref_t)
+    v = h.Vector()
+    v.record(soma(0.5)._ref_v)
+    h.finitialize(-70)
+    while h.t < tstop:
+        h.fadvance()
+    return t.as_numpy().copy(), v.as_numpy().copy()
+
+
+def test_schedule_set(passive):
+    soma, stim = passive
+    schedule = Schedule()
+    schedule.set(50, stim, 'amp', 0.01)
+    t, v = _run(soma, 100)
+    assert stim.amp == 0.01
+    assert v[t < 50] == pytest.approx(-70)
+    # Charging of the membrane: tau = cm / g_pas = 10 ms, and input
+    # resistance 1 / (g_pas * area).
+    area = soma(0.5).area() * 1e-8
+    resistance = 1 / (soma.g_pas * area) * 1e-6
+    expected = -70 + 0.01 * resistance * (1 - np.exp(-50 / 10))
+    assert v[-1] == pytest.approx(expected, abs=0.05)
+
+    # The original value is restored when the simulation is
+    # initialised, so that every run is the same.
+    h.finitialize(-70)
+    assert stim.amp == 0
+    __, again = _run(soma, 100)
+    assert again == pytest.approx(v)
+
+
+def test_schedule_set_range_does_not_compound(passive):
+    soma, stim = passive
+    stim.amp = 0.01
+    schedule = Schedule()
+    schedule.set_range(50, [soma], 'pas', 'g', 2, scale=True)
+    __, first = _run(soma, 100)
+    assert soma(0.5).pas.g == pytest.approx(2e-4)
+    __, second = _run(soma, 100)
+    assert soma(0.5).pas.g == pytest.approx(2e-4)
+    assert second == pytest.approx(first)
+
+
+def test_schedule_at_and_reset(passive):
+    soma, stim = passive
+    calls = []
+    schedule = Schedule()
+    schedule.at(10, calls.append, 'at')
+    schedule.every(20, lambda t: calls.append(round(t)), start=20,
+                   stop=60)
+    schedule.reset(calls.append, 'reset')
+    _run(soma, 100)
+    assert calls == ['reset', 'at', 20, 40, 60]
+    schedule.clear()
+    calls.clear()
+    _run(soma, 100)
+    assert calls == []
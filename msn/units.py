@@ -0,0 +1,142 @@
+"""
+Physical units.
+
+NEURON uses a fixed set of units (ms, mV, nA, S/cm2, etc) and numbers
+are assumed to be in those units. The functions here convert quantities
+given with explicit units, e.g. the string '0.5 s' in a configuration
+file, to the units used internally, so that a value in the wrong units
+is converted (or rejected) instead of being silently misread.
+
+Example
+-------
+>>> parse('0.5 s', 'ms')
+500.0
+>>> parse('2 mS/cm2', 'S/cm2')
+0.002
+>>> parse(100, 'pA')  # Plain numbers are taken to be in `unit`.
+100.0
+
+author: Antonio Gonzalez
+"""
+import re
+
+# Units by dimension, as {unit: factor}, where factor converts a value
+# to the first (reference) unit of the dimension.
+dimensions = {
+    'time': {'ms': 1, 's': 1e3, 'us': 1e-3, 'min': 60e3},
+    'voltage': {'mV': 1, 'V': 1e3, 'uV': 1e-3},
+    'current': {'nA': 1, 'pA': 1e-3, 'uA': 1e3, 'mA': 1e6},
+    'conductance': {'uS': 1, 'nS': 1e-3, 'pS': 1e-6, 'mS': 1e3,
+                    'S': 1e6},
+    'conductance density': {'S/cm2': 1, 'mS/cm2': 1e-3,
+                            'uS/cm2': 1e-6, 'pS/um2': 1e-4},
+    'permeability': {'cm/s': 1},
+    'capacitance': {'pF': 1, 'nF': 1e3, 'uF': 1e6},
+    'specific capacitance': {'uF/cm2': 1},
+    'resistance': {'MOhm': 1, 'kOhm': 1e-3, 'GOhm': 1e3, 'Ohm': 1e-6},
+    'axial resistivity': {'Ohm cm': 1, 'Ohm*cm': 1, 'kOhm cm': 1e3},
+    'frequency': {'Hz': 1, 'kHz': 1e3},
+    'length': {'um': 1, 'mm': 1e3, 'cm': 1e4, 'nm': 1e-3},
+    'concentration': {'mM': 1, 'uM': 1e-3, 'nM': 1e-6, 'M': 1e3},
+    'temperature': {'degC': 1, 'C': 1}}
+
+# Alternative spellings.
+_aliases = {'µ': 'u', 'μ': 'u', 'Ω': 'Ohm', 'ohm': 'Ohm', '²': '2',
+            'cm^2': 'cm2', 'um^2': 'um2', '°C': 'degC', 'sec': 's',
+            'msec': 'ms'}
+
+_quantity = re.compile(r'^\s*([-+]?(?:\d+\.?\d*|\.\d+)(?:[eE][-+]?\d+)?)'
+                       r'\s*(.*?)\s*$')
+
+
+class UnitError(ValueError):
+    """
+    Unknown units, or units of the wrong dimension.
+    """
+
+
+def _normalise(unit):
+    for alias, name in _aliases.items():
+        unit = unit.replace(alias, name)
+    return unit
+
+
+def dimension(unit):
+    """
+    Return the dimension of a unit, e.g. 'time' for 'ms'.
+
+    Raises
+    ------
+    UnitError
+        If the unit is not known.
+    """
+    unit = _normalise(unit)
+    for name, units in dimensions.items():
+        if unit in units:
+            return name
+    raise UnitError(f"unknown unit '{unit}'")
+
+
+def convert(value, unit, to):
+    """
+    Convert a value between units of the same dimension.
+
+    Parameters
+    ----------
+    value : numeric
+    unit : str
+        Units of `value`, e.g. 's'.
+    to : str
+        Units to convert to, e.g. 'ms'.
+
+    Returns
+    -------
+    value : float
+        The value in units of `to`.
+
+    Raises
+    ------
+    UnitError
+        If the units are unknown or of different dimensions.
+    """
+    unit, to = _normalise(unit), _normalise(to)
+    if dimension(unit) != dimension(to):
+        raise UnitError(f"cannot convert '{unit}' ({dimension(unit)}) "
+                        f"to '{to}' ({dimension(to)})")
+    units = dimensions[dimension(to)]
+    return float(value) * units[unit] / units[to]
+
+
+def parse(quantity, unit):
+    """
+    Convert a quantity to the given units.
+
+    Parameters
+    ----------
+    quantity : numeric or str
+        A number, or a string with a number and its units, e.g. '0.5 s'
+        or '200pA'. Numbers, and strings without units, are taken to be
+        in `unit`.
+    unit : str
+        Units of the result, e.g. 'ms'.
+
+    Returns
+    -------
+    value : float
+
+    Raises
+    ------
+    UnitError
+        If the string cannot be read, or its units are unknown or of a
+        different dimension than `unit`.
+    """
+    if not isinstance(quantity, str):
+        return float(quantity)
+    match = _quantity.match(quantity)
+    if match is None:
+        raise UnitError(f"cannot read quantity '{quantity}'; expected "
+                        f"a number followed by its units, e.g. '1 {unit}'")
+    value, given = match.groups()
+    if given == '':
+        return float(value)
+    return convert(value, given, unit)